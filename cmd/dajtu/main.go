@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -34,24 +38,23 @@ func isValidSlug(s string) bool {
 
 var resizeGroup singleflight.Group
 
-var dynamicSizes = map[string]int{
-	"800":  800,
-	"1200": 1200,
-	"1600": 1600,
-	"2400": 2400,
+// transformFormats maps /t/ URL extensions to output formats.
+var transformFormats = map[string]image.Format{
+	"webp": image.FormatWebP,
+	"avif": image.FormatAVIF,
+	"jpg":  image.FormatJPEG,
 }
 
+// resizeResult is a rendered file in the cache (path), a stored variant
+// that already fits (key) or, when caching failed, the encoded bytes.
 type resizeResult struct {
 	path string
+	key  string
 	data []byte
 }
 
-func webpPath(dataDir, slug, name string) string {
-	return filepath.Join(dataDir, "images", slug[:2], slug, name+".webp")
-}
-
-func cachePath(cacheDir, slug, size string) string {
-	filename := slug + "_" + size + ".webp"
+func cachePath(cacheDir, slug, key string, format image.Format) string {
+	filename := slug + "_" + key + "." + image.Extension(format)
 	return filepath.Join(cacheDir, slug[:2], filename)
 }
 
@@ -63,33 +66,187 @@ func cacheValid(path string, originMod time.Time) bool {
 	return !info.ModTime().Before(originMod)
 }
 
+func blobExists(fs *storage.Filesystem, key string) bool {
+	_, err := fs.Stat(key)
+	return err == nil
+}
+
 func touch(path string) {
 	now := time.Now()
 	_ = os.Chtimes(path, now, now)
 }
 
+// writeCacheFile never leaves a truncated render behind: cached files are
+// served with immutable caching.
 func writeCacheFile(path string, data []byte) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+	return storage.WriteFileAtomic(path, data, 0644)
+}
+
+// isAnimatedBlob sniffs the header of a stored WebP variant.
+func isAnimatedBlob(fs *storage.Filesystem, key string) bool {
+	b, err := fs.Open(key)
+	if err != nil {
+		return false
 	}
-	return os.WriteFile(path, data, 0644)
+	defer b.Close()
+	header := make([]byte, 32)
+	n, _ := io.ReadFull(b, header)
+	return image.IsAnimated(header[:n])
+}
+
+func serveImageFile(w http.ResponseWriter, r *http.Request, img *storage.Image, path string, format image.Format) {
+	w.Header().Add("Vary", "Accept")
+	handler.ServeImageFile(w, r, img, path, string(format))
 }
 
-func serveWebpFile(w http.ResponseWriter, r *http.Request, path string) {
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	w.Header().Set("Content-Type", "image/webp")
-	http.ServeFile(w, r, path)
+func serveImageBlob(w http.ResponseWriter, r *http.Request, fs *storage.Filesystem, img *storage.Image, key string, format image.Format) {
+	w.Header().Add("Vary", "Accept")
+	handler.ServeImageBlob(w, r, fs, img, key, string(format))
 }
 
-func serveWebpBytes(w http.ResponseWriter, data []byte) {
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	w.Header().Set("Content-Type", "image/webp")
-	w.Write(data)
+func serveImageBytes(w http.ResponseWriter, r *http.Request, img *storage.Image, data []byte, format image.Format) {
+	w.Header().Add("Vary", "Accept")
+	handler.ServeImageBytes(w, r, img, data, string(format))
+}
+
+// renderVariant encodes the stored srcKey with preset p (resize=false only
+// re-encodes a stored variant of p) on the processing pool and caches the
+// result in CacheDir. Concurrent requests share one encode, so it is not
+// tied to the context of any of them.
+func renderVariant(processor *image.Processor, fs *storage.Filesystem, cacheDir, slug string, p image.Preset, srcKey string, resize bool, format image.Format) (resizeResult, error) {
+	key := p.Key()
+	cacheFile := cachePath(cacheDir, slug, key, format)
+	ext := image.Extension(format)
+
+	srcInfo, err := fs.Stat(srcKey)
+	if err != nil {
+		return resizeResult{}, err
+	}
+	if cacheValid(cacheFile, srcInfo.ModTime) {
+		logging.Get("cache").Printf("cache hit slug=%s preset=%s format=%s path=%s", slug, p.Name, ext, cacheFile)
+		touch(cacheFile)
+		return resizeResult{path: cacheFile}, nil
+	}
+
+	resultAny, err, _ := resizeGroup.Do(slug+":"+key+":"+ext, func() (any, error) {
+		start := time.Now()
+
+		srcInfo, err := fs.Stat(srcKey)
+		if err != nil {
+			return resizeResult{}, err
+		}
+		if cacheValid(cacheFile, srcInfo.ModTime) {
+			logging.Get("cache").Printf("cache hit slug=%s preset=%s format=%s path=%s", slug, p.Name, ext, cacheFile)
+			return resizeResult{path: cacheFile}, nil
+		}
+
+		data, err := fs.Read(srcKey)
+		if err != nil {
+			return resizeResult{}, err
+		}
+		if resize {
+			origWidth, origHeight, err := image.GetSize(data)
+			if err != nil {
+				return resizeResult{}, err
+			}
+			if p.KeepsSize(origWidth, origHeight) {
+				if format == image.FormatWebP {
+					return resizeResult{key: srcKey}, nil
+				}
+				resize = false
+			}
+		}
+
+		var rendered []byte
+		if resize {
+			rendered, err = processor.Render(context.Background(), data, p, format)
+		} else {
+			rendered, err = processor.Convert(context.Background(), data, p.Quality, format)
+		}
+		if err != nil {
+			return resizeResult{}, err
+		}
+		if err := writeCacheFile(cacheFile, rendered); err != nil {
+			logging.Get("image").Printf("resize generated slug=%s preset=%s format=%s dur_ms=%d cache=miss write=fail", slug, key, ext, time.Since(start).Milliseconds())
+			return resizeResult{data: rendered}, nil
+		}
+		logging.Get("image").Printf("resize generated slug=%s preset=%s format=%s dur_ms=%d cache=miss write=true", slug, key, ext, time.Since(start).Milliseconds())
+		return resizeResult{path: cacheFile}, nil
+	})
+	if err != nil {
+		return resizeResult{}, err
+	}
+
+	result, ok := resultAny.(resizeResult)
+	if !ok {
+		return resizeResult{}, fmt.Errorf("unexpected resize result %T", resultAny)
+	}
+	if result.path == cacheFile {
+		touch(cacheFile)
+	}
+	return result, nil
+}
+
+// serveRendered serves preset p of srcKey, rendering it through the cache.
+func serveRendered(w http.ResponseWriter, r *http.Request, processor *image.Processor, fs *storage.Filesystem, img *storage.Image, cacheDir string, p image.Preset, srcKey string, resize bool, format image.Format) {
+	slug := img.Slug
+	result, err := renderVariant(processor, fs, cacheDir, slug, p, srcKey, resize, format)
+	if err != nil {
+		logging.Get("image").Printf("resize error slug=%s preset=%s format=%s: %v", slug, p.Key(), image.Extension(format), err)
+		if handler.ProcessingBusy(w, processor, err) {
+			return
+		}
+		http.Error(w, "image processing failed", http.StatusInternalServerError)
+		return
+	}
+
+	if result.key != "" {
+		serveImageBlob(w, r, fs, img, result.key, image.FormatWebP)
+		return
+	}
+	if result.path != "" {
+		serveImageFile(w, r, img, result.path, format)
+		return
+	}
+	if len(result.data) > 0 {
+		serveImageBytes(w, r, img, result.data, format)
+		return
+	}
+
+	http.Error(w, "image processing failed", http.StatusInternalServerError)
+}
+
+// openFilesystem opens the image store chosen with STORAGE_BACKEND.
+func openFilesystem(cfg *config.Config, db *storage.DB) (*storage.Filesystem, error) {
+	switch cfg.StorageBackend {
+	case "", "local":
+		return storage.NewFilesystem(cfg.DataDir, db)
+	case "s3":
+		store, err := storage.NewS3Store(storage.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Prefix:    cfg.S3Prefix,
+			PathStyle: cfg.S3PathStyle,
+			Timeout:   time.Duration(cfg.S3TimeoutSec) * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewBlobFilesystem(store, db, time.Duration(cfg.S3PresignTTLSec)*time.Second), nil
+	}
+	return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", cfg.StorageBackend)
 }
 
 func main() {
 	cfg := config.Load()
 
+	if err := image.LoadPresets(cfg.ImagePresets); err != nil {
+		log.Fatalf("Invalid IMAGE_PRESETS: %v", err)
+	}
+
 	if err := logging.Init(cfg.LogDir); err != nil {
 		log.Printf("Failed to init loggers: %v", err)
 	}
@@ -100,33 +257,58 @@ func main() {
 	}
 	defer db.Close()
 
-	fs, err := storage.NewFilesystem(cfg.DataDir)
+	fs, err := openFilesystem(cfg, db)
 	if err != nil {
 		log.Fatalf("Failed to init filesystem: %v", err)
 	}
+	if report, err := fs.RecoverInterruptedWrites(); err != nil {
+		log.Printf("Failed to recover interrupted writes: %v", err)
+	} else if !report.Empty() {
+		log.Printf("Recovered interrupted writes: %d temp files, %d unfinished images, %d orphaned slugs, %d unused blobs",
+			report.TempFiles, report.Unfinished, report.Orphans, report.Blobs)
+	}
+	if n, err := storage.RemoveTempFiles(cfg.CacheDir); err != nil {
+		log.Printf("Failed to clean cache dir: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d interrupted cache writes", n)
+	}
 
-	cleanupDaemon := cleanup.NewDaemon(cfg, db, fs)
-	cleanupDaemon.Start()
+	workers := cfg.ProcessWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	processingPool := image.NewPool(workers, cfg.ProcessQueueSize, time.Duration(cfg.ProcessTimeoutSec)*time.Second)
+	defer processingPool.Close()
+	processor := image.NewPooledProcessor(processingPool)
+	if queued, err := handler.ResumePendingImages(db, fs, processor); err != nil {
+		log.Printf("Failed to resume pending images: %v", err)
+	} else if queued > 0 {
+		log.Printf("Resumed processing of %d pending images", queued)
+	}
 
-	processor := image.NewProcessor()
+	cleanupDaemon := cleanup.NewDaemon(cfg, db, fs, processor)
+	cleanupDaemon.Start()
 
 	uploadHandler := handler.NewUploadHandler(cfg, db, fs, processor)
-	galleryHandler := handler.NewGalleryHandler(cfg, db, fs)
+	galleryHandler := handler.NewGalleryHandler(cfg, db, fs, processor)
 	authHandler, err := handler.NewAuthHandler(cfg, db)
 	if err != nil {
 		log.Fatalf("Failed to init SSO: %v", err)
 	}
 	userHandler := handler.NewUserHandler(cfg, db)
 	uploadLimiter := middleware.NewRateLimiter(30, time.Minute)
+	// gallery ZIPs read every file of the gallery, so they get their own limit
+	downloadLimiter := middleware.NewRateLimiter(5, 10*time.Minute)
 	sessionMiddleware := middleware.NewSessionMiddleware(db)
 	trafficStats := middleware.NewTrafficStats()
-	adminHandler := handler.NewAdminHandler(cfg, db, fs, trafficStats)
+	adminHandler := handler.NewAdminHandler(cfg, db, fs, trafficStats, processor, cleanupDaemon.Scrubber())
 	adminMiddleware := middleware.NewAdminMiddleware(cfg.AdminNicks)
 	requestLogger := middleware.NewRequestLogger(trafficStats)
 
 	bratUploadHandler := handler.NewBratUploadHandler(cfg, db, fs, authHandler.GetDecoder(), processor)
 
 	imageViewHandler := handler.NewImageViewHandler(db, cfg)
+	oembedHandler := handler.NewOEmbedHandler(cfg, db)
 
 	imageEditHandler := handler.NewImageEditHandler(db, fs, processor, cfg)
 
@@ -159,6 +341,8 @@ func main() {
 			galleryHandler.AddImages(w, r)
 		} else if strings.HasSuffix(path, "/title") {
 			galleryHandler.UpdateTitle(w, r)
+		} else if strings.HasSuffix(path, "/watermark") {
+			galleryHandler.UpdateWatermark(w, r)
 		} else if r.Method == http.MethodDelete {
 			galleryHandler.DeleteImage(w, r)
 		} else {
@@ -166,8 +350,20 @@ func main() {
 		}
 	})
 
-	mux.HandleFunc("/g/", galleryHandler.View)
+	galleryDownload := downloadLimiter.Middleware(http.HandlerFunc(galleryHandler.Download))
+	mux.HandleFunc("/g/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/download.zip") {
+			galleryDownload.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/embed") {
+			galleryHandler.Embed(w, r)
+			return
+		}
+		galleryHandler.View(w, r)
+	})
 	mux.HandleFunc("/u/", userHandler.View)
+	mux.Handle("/oembed", oembedHandler)
 	mux.HandleFunc("/brrrt/", authHandler.HandleBratSSO)
 	mux.HandleFunc("/logout", authHandler.Logout)
 	mux.Handle("/brtup/", bratUploadHandler)
@@ -180,8 +376,18 @@ func main() {
 	adminMux.HandleFunc("GET /admin/galleries/{slug}", adminHandler.GalleryDetail)
 	adminMux.HandleFunc("POST /admin/galleries/{id}/delete", adminHandler.DeleteGallery)
 	adminMux.HandleFunc("GET /admin/images", adminHandler.Images)
+	adminMux.HandleFunc("GET /admin/duplicates", adminHandler.Duplicates)
+	adminMux.HandleFunc("POST /admin/duplicates/resolve", adminHandler.ResolveDuplicates)
+	adminMux.HandleFunc("GET /admin/integrity", adminHandler.Integrity)
+	adminMux.HandleFunc("POST /admin/integrity/scrub", adminHandler.StartScrub)
+	adminMux.HandleFunc("GET /admin/trash", adminHandler.Trash)
+	adminMux.HandleFunc("POST /admin/trash/images/{id}/restore", adminHandler.RestoreImage)
+	adminMux.HandleFunc("POST /admin/trash/images/{id}/purge", adminHandler.PurgeImage)
+	adminMux.HandleFunc("POST /admin/trash/galleries/{id}/restore", adminHandler.RestoreGallery)
+	adminMux.HandleFunc("POST /admin/trash/galleries/{id}/purge", adminHandler.PurgeGallery)
 	adminMux.HandleFunc("GET /admin/logs", adminHandler.Logs)
 	adminMux.HandleFunc("POST /admin/images/{id}/delete", adminHandler.DeleteImage)
+	adminMux.HandleFunc("POST /admin/images/{id}/retry", adminHandler.RetryImage)
 
 	mux.Handle("/admin", adminMiddleware.Middleware(adminMux))
 	mux.Handle("/admin/", adminMiddleware.Middleware(adminMux))
@@ -194,7 +400,7 @@ func main() {
 			http.NotFound(w, r)
 			return
 		}
-		if len(parts) > 2 {
+		if len(parts) > 2 && parts[1] != "revisions" {
 			http.NotFound(w, r)
 			return
 		}
@@ -205,6 +411,12 @@ func main() {
 			return
 		}
 
+		// /i/{slug}/revisions[/{id}[/revert]] - edit history (GET/POST)
+		if len(parts) >= 2 && parts[1] == "revisions" {
+			imageEditHandler.Revisions(w, r, slug, parts[2:])
+			return
+		}
+
 		if r.Method == http.MethodDelete && len(parts) == 1 {
 			uploadHandler.DeleteImage(w, r, slug)
 			return
@@ -216,6 +428,18 @@ func main() {
 			return
 		}
 
+		// /i/{slug}/focal - focal point of cover crops (POST sets, DELETE clears)
+		if len(parts) == 2 && parts[1] == "focal" {
+			imageEditHandler.FocalPoint(w, r, slug)
+			return
+		}
+
+		// /i/{slug}/status - background processing state (JSON)
+		if len(parts) == 2 && parts[1] == "status" {
+			uploadHandler.Status(w, r, slug)
+			return
+		}
+
 		// /i/{slug}/restore - restore original (POST)
 		if len(parts) == 2 && parts[1] == "restore" {
 			if r.Method != http.MethodPost {
@@ -232,6 +456,12 @@ func main() {
 			return
 		}
 
+		img, err := db.GetImageBySlug(slug)
+		if err != nil || img == nil || img.Status == storage.ImageStatusWriting {
+			handler.ImageNotFound(w, r, db, slug)
+			return
+		}
+
 		// Track access for image files
 		go func() {
 			_ = db.TouchImageBySlug(slug)
@@ -247,114 +477,98 @@ func main() {
 		sizePart := "original"
 		if len(parts) == 2 {
 			sizePart = parts[1]
-		} else if strings.HasSuffix(parts[0], ".webp") {
+		}
+		for _, ext := range []string{".webp", ".avif", ".jpg"} {
+			sizePart = strings.TrimSuffix(sizePart, ext)
+		}
+		if sizePart == "max" {
 			sizePart = "original"
 		}
-		sizePart = strings.TrimSuffix(sizePart, ".webp")
-
-		originalPath := webpPath(cfg.DataDir, slug, "original")
-		thumbPath := webpPath(cfg.DataDir, slug, "thumb")
 
-		switch sizePart {
-		case "original", "max":
-			if _, err := os.Stat(originalPath); err != nil {
-				http.NotFound(w, r)
-				return
-			}
-			serveWebpFile(w, r, originalPath)
-			return
-		case "thumb":
-			if _, err := os.Stat(thumbPath); err != nil {
-				http.NotFound(w, r)
-				return
-			}
-			serveWebpFile(w, r, thumbPath)
+		preset, ok := image.LookupPreset(sizePart)
+		if !ok {
+			http.NotFound(w, r)
 			return
-		default:
-			targetWidth, ok := dynamicSizes[sizePart]
-			if !ok {
-				http.NotFound(w, r)
-				return
-			}
+		}
+		preset = preset.WithFocal(handler.ImageFocalPoint(img))
 
-			origInfo, err := os.Stat(originalPath)
-			if err != nil {
+		format := image.NegotiateFormat(r.Header.Get("Accept"))
+		if preset.Format != "" {
+			format = preset.Format
+		}
+
+		// Eager presets are stored at upload; anything else renders from the original
+		srcKey, resize := fs.Key(slug, preset.Name), false
+		if !preset.Eager || !blobExists(fs, srcKey) {
+			srcKey, resize = fs.Key(slug, "original"), preset.Name != "original"
+			if !blobExists(fs, srcKey) {
 				http.NotFound(w, r)
 				return
 			}
+		}
 
-			cacheFile := cachePath(cfg.CacheDir, slug, sizePart)
-			if cacheValid(cacheFile, origInfo.ModTime()) {
-				logging.Get("cache").Printf("cache hit slug=%s size=%s path=%s", slug, sizePart, cacheFile)
-				touch(cacheFile)
-				serveWebpFile(w, r, cacheFile)
-				return
-			}
+		// libvips cannot write animated AVIF; keep animations in WebP
+		if format == image.FormatAVIF && isAnimatedBlob(fs, srcKey) {
+			format = image.FormatWebP
+		}
 
-			resultAny, err, _ := resizeGroup.Do(slug+":"+sizePart, func() (any, error) {
-				start := time.Now()
-				var wroteCache bool
+		// Stored variants are WebP already
+		if !resize && format == image.FormatWebP {
+			serveImageBlob(w, r, fs, img, srcKey, format)
+			return
+		}
 
-				origInfo, err := os.Stat(originalPath)
-				if err != nil {
-					return resizeResult{}, err
-				}
-				if cacheValid(cacheFile, origInfo.ModTime()) {
-					logging.Get("cache").Printf("cache hit slug=%s size=%s path=%s", slug, sizePart, cacheFile)
-					return resizeResult{path: cacheFile}, nil
-				}
+		serveRendered(w, r, processor, fs, img, cfg.CacheDir, preset, srcKey, resize, format)
+	})
 
-				data, err := os.ReadFile(originalPath)
-				if err != nil {
-					return resizeResult{}, err
-				}
-				origWidth, _, err := image.GetSize(data)
-				if err != nil {
-					return resizeResult{}, err
-				}
-				if targetWidth >= origWidth {
-					return resizeResult{path: originalPath}, nil
-				}
+	// /t/{signature}/{spec}/{slug}.{ext} - signed ad-hoc transform of the original
+	mux.HandleFunc("/t/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/t/"), "/")
+		if cfg.TransformSecret == "" || len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		signature, spec, file := parts[0], parts[1], parts[2]
 
-				resized, err := image.ResizeToWidth(data, targetWidth)
-				if err != nil {
-					return resizeResult{}, err
-				}
-				if err := writeCacheFile(cacheFile, resized); err != nil {
-					logging.Get("image").Printf("resize generated slug=%s size=%s target=%d dur_ms=%d cache=miss write=fail", slug, sizePart, targetWidth, time.Since(start).Milliseconds())
-					return resizeResult{data: resized}, nil
-				}
-				wroteCache = true
-				logging.Get("image").Printf("resize generated slug=%s size=%s target=%d dur_ms=%d cache=miss write=%t", slug, sizePart, targetWidth, time.Since(start).Milliseconds(), wroteCache)
-				return resizeResult{path: cacheFile}, nil
-			})
-			if err != nil {
-				logging.Get("image").Printf("resize error slug=%s size=%s: %v", slug, sizePart, err)
-				http.Error(w, "image processing failed", http.StatusInternalServerError)
-				return
-			}
+		slug, ext, _ := strings.Cut(file, ".")
+		format, ok := transformFormats[ext]
+		if !ok || !isValidSlug(slug) {
+			http.NotFound(w, r)
+			return
+		}
+		if !image.VerifyTransform(cfg.TransformSecret, signature, spec, file) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+		preset, err := image.ParseTransformSpec(spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			result, ok := resultAny.(resizeResult)
-			if !ok {
-				http.Error(w, "image processing failed", http.StatusInternalServerError)
-				return
-			}
+		// like /i/, and a pending or failed image has no final original to
+		// render from either; the cached render would outlive it
+		img, err := db.GetImageBySlug(slug)
+		if err != nil || img == nil || img.Status != storage.ImageStatusReady {
+			handler.ImageNotFound(w, r, db, slug)
+			return
+		}
+		preset = preset.WithFocal(handler.ImageFocalPoint(img))
+		srcKey := fs.Key(slug, "original")
+		if !blobExists(fs, srcKey) {
+			http.NotFound(w, r)
+			return
+		}
 
-			if result.path != "" {
-				if result.path == cacheFile {
-					touch(cacheFile)
-				}
-				serveWebpFile(w, r, result.path)
-				return
-			}
-			if len(result.data) > 0 {
-				serveWebpBytes(w, result.data)
-				return
-			}
+		go func() {
+			_ = db.TouchImageBySlug(slug)
+			_ = db.IncrementDownloads(slug)
+		}()
 
-			http.Error(w, "image processing failed", http.StatusInternalServerError)
-			return
+		if format == image.FormatAVIF && isAnimatedBlob(fs, srcKey) {
+			format = image.FormatWebP
 		}
+		serveRendered(w, r, processor, fs, img, cfg.CacheDir, preset, srcKey, true, format)
 	})
 
 	log.Printf("Starting server on :%s", cfg.Port)
@@ -3,7 +3,7 @@ module dajtu
 go 1.22.2
 
 require (
-	github.com/h2non/bimg v1.1.9 // indirect
-	github.com/mattn/go-sqlite3 v1.14.33 // indirect
+	github.com/h2non/bimg v1.1.9
+	github.com/mattn/go-sqlite3 v1.14.33
 	golang.org/x/sync v0.10.0
 )
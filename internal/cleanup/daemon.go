@@ -1,23 +1,46 @@
 package cleanup
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"dajtu/internal/config"
+	"dajtu/internal/image"
 	"dajtu/internal/logging"
 	"dajtu/internal/storage"
 )
 
 type Daemon struct {
-	cfg *config.Config
-	db  *storage.DB
-	fs  *storage.Filesystem
+	cfg       *config.Config
+	db        *storage.DB
+	fs        *storage.Filesystem
+	processor *image.Processor // backfills share the request pool
+	scrubber  *Scrubber
 }
 
-func NewDaemon(cfg *config.Config, db *storage.DB, fs *storage.Filesystem) *Daemon {
-	return &Daemon{cfg: cfg, db: db, fs: fs}
+func NewDaemon(cfg *config.Config, db *storage.DB, fs *storage.Filesystem, processor *image.Processor) *Daemon {
+	return &Daemon{cfg: cfg, db: db, fs: fs, processor: processor, scrubber: NewScrubber(db, fs, processor)}
+}
+
+// poolBusy reports whether a backfill job was turned away by a full
+// processing queue. The image is left for the next run instead of being
+// recorded as failed; live requests keep the pool.
+func poolBusy(err error) bool {
+	if errors.Is(err, image.ErrQueueFull) {
+		logging.Get("cleanup").Printf("cleanup: processing queue full, backfill deferred")
+		return true
+	}
+	return false
+}
+
+// Scrubber is the storage scrubber the daemon runs every
+// ScrubIntervalHours, for on-demand runs.
+func (d *Daemon) Scrubber() *Scrubber {
+	return d.scrubber
 }
 
 func (d *Daemon) Start() {
@@ -32,10 +55,36 @@ func (d *Daemon) Start() {
 			d.cleanup()
 		}
 	}()
+
+	// a scrub reads every stored file, so the first one waits a period
+	// instead of slowing down every restart
+	if d.cfg.ScrubIntervalHours > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(d.cfg.ScrubIntervalHours) * time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				d.scrub()
+			}
+		}()
+	}
+}
+
+// scrub runs a scheduled scrub with the repairs of ScrubRepair; the
+// scrubber logs the outcome.
+func (d *Daemon) scrub() {
+	if _, err := d.scrubber.Run(ParseRepairOptions(d.cfg.ScrubRepair)); errors.Is(err, ErrScrubRunning) {
+		logging.Get("cleanup").Printf("scrub: skipped, one started from the admin panel is still running")
+	}
 }
 
+// backfillBatch caps how many images each backfill handles per cleanup run.
+const backfillBatch = 50
+
 func (d *Daemon) cleanup() {
 	d.cleanupCache()
+	d.backfillPlaceholders()
+	d.backfillFingerprints()
+	d.applyWatermarks()
 
 	if deleted, err := d.db.CleanExpiredSessions(); err != nil {
 		logging.Get("cleanup").Printf("cleanup: failed to clean sessions: %v", err)
@@ -43,6 +92,9 @@ func (d *Daemon) cleanup() {
 		logging.Get("cleanup").Printf("cleanup: deleted %d expired sessions", deleted)
 	}
 
+	d.purgeTrash()
+	d.collectBlobs()
+
 	totalSize, err := d.db.GetTotalSize()
 	if err != nil {
 		logging.Get("cleanup").Printf("cleanup: failed to get total size: %v", err)
@@ -88,14 +140,212 @@ func (d *Daemon) cleanup() {
 				continue
 			}
 
-			totalSize -= img.FileSize
-			logging.Get("cleanup").Printf("cleanup: deleted %s (%.2f MB)", img.Slug, float64(img.FileSize)/(1024*1024))
+			// blobs shared with other images stay, so ask what is really left
+			before := totalSize
+			if totalSize, err = d.db.GetTotalSize(); err != nil {
+				logging.Get("cleanup").Printf("cleanup: failed to get total size: %v", err)
+				return
+			}
+			logging.Get("cleanup").Printf("cleanup: deleted %s (%.2f MB)", img.Slug, float64(before-totalSize)/(1024*1024))
 		}
 	}
 
 	logging.Get("cleanup").Printf("cleanup: done, current usage %.2f GB", float64(totalSize)/(1024*1024*1024))
 }
 
+// trashBatch caps how many images and galleries each cleanup run purges.
+const trashBatch = 100
+
+// purgeTrash deletes for good what has been in the trash longer than
+// TrashRetentionDays.
+func (d *Daemon) purgeTrash() {
+	before := time.Now().AddDate(0, 0, -d.cfg.TrashRetentionDays).Unix()
+	slugs, galleryIDs, err := d.db.GetExpiredTrash(before, trashBatch)
+	if err != nil {
+		logging.Get("cleanup").Printf("cleanup: failed to get expired trash: %v", err)
+		return
+	}
+
+	purged := 0
+	for _, slug := range slugs {
+		if err := d.fs.PurgeImage(slug); err != nil {
+			logging.Get("cleanup").Printf("cleanup: failed to purge %s: %v", slug, err)
+			continue
+		}
+		purged++
+	}
+	for _, id := range galleryIDs {
+		if err := d.fs.PurgeGallery(id); err != nil {
+			logging.Get("cleanup").Printf("cleanup: failed to purge gallery %d: %v", id, err)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		logging.Get("cleanup").Printf("cleanup: purged %d expired trash entries", purged)
+	}
+}
+
+// blobBatch caps how many unreferenced blobs each cleanup run removes.
+const blobBatch = 500
+
+// collectBlobs removes blobs no image references any more, e.g. after an
+// image row was deleted before its files.
+func (d *Daemon) collectBlobs() {
+	n, err := d.fs.CollectBlobs(blobBatch)
+	if err != nil {
+		logging.Get("cleanup").Printf("cleanup: failed to collect blobs: %v", err)
+	}
+	if n > 0 {
+		logging.Get("cleanup").Printf("cleanup: removed %d unreferenced blobs", n)
+	}
+}
+
+// backfillPlaceholders computes LQIP and dominant colour for images uploaded
+// before placeholders existed. Failures are stored as empty values so the
+// same image is not retried every run.
+func (d *Daemon) backfillPlaceholders() {
+	images, err := d.db.GetImagesWithoutPlaceholder(backfillBatch)
+	if err != nil {
+		logging.Get("cleanup").Printf("cleanup: failed to get images without placeholder: %v", err)
+		return
+	}
+
+	var done int
+	for _, img := range images {
+		var ph image.Placeholder
+		data, err := d.fs.Read(d.fs.Key(img.Slug, "original"))
+		if err == nil {
+			ph, err = d.processor.MakePlaceholder(context.Background(), data)
+		}
+		if poolBusy(err) {
+			break
+		}
+		if err != nil {
+			logging.Get("cleanup").Printf("cleanup: placeholder for %s: %v", img.Slug, err)
+		}
+		if err := d.db.UpdateImagePlaceholder(img.Slug, ph.LQIP, ph.Color); err != nil {
+			logging.Get("cleanup").Printf("cleanup: failed to store placeholder for %s: %v", img.Slug, err)
+			return
+		}
+		if ph.LQIP != "" {
+			done++
+		}
+	}
+	if done > 0 {
+		logging.Get("cleanup").Printf("cleanup: generated %d placeholders", done)
+	}
+}
+
+// applyWatermarks re-renders the variants of images whose burned-in
+// watermark no longer matches their gallery's or owner's settings, from the
+// clean copy when there is one. The key is recorded on failures too, so the
+// same image is not retried every run.
+func (d *Daemon) applyWatermarks() {
+	images, err := d.db.GetImagesWithStaleWatermark(backfillBatch)
+	if err != nil {
+		logging.Get("cleanup").Printf("cleanup: failed to get images with stale watermark: %v", err)
+		return
+	}
+
+	var done int
+	for _, img := range images {
+		key, wm, err := effectiveWatermark(d.db, img)
+		if err != nil {
+			logging.Get("cleanup").Printf("cleanup: watermark for %s: %v", img.Slug, err)
+			return
+		}
+
+		if err := d.rewatermark(img.Slug, wm, imageFocal(img)); poolBusy(err) {
+			break
+		} else if err != nil {
+			logging.Get("cleanup").Printf("cleanup: watermark %s: %v", img.Slug, err)
+		} else {
+			done++
+		}
+		if err := d.db.SetImageWatermarkKey(img.Slug, key); err != nil {
+			logging.Get("cleanup").Printf("cleanup: failed to store watermark key for %s: %v", img.Slug, err)
+			return
+		}
+	}
+	if done > 0 {
+		logging.Get("cleanup").Printf("cleanup: re-rendered %d images for watermark changes", done)
+	}
+}
+
+// effectiveWatermark returns the watermark the variants of img should
+// carry and its key; nil and "" when none.
+func effectiveWatermark(db *storage.DB, img *storage.Image) (string, *image.Watermark, error) {
+	stored, err := db.GetEffectiveWatermark(img.GalleryID, img.UserID)
+	if err != nil || stored == nil {
+		return "", nil, err
+	}
+	wm := &image.Watermark{Text: stored.Text, Image: stored.Image, Position: stored.Position, Opacity: stored.Opacity, Scale: stored.Scale}
+	return stored.Key, wm, nil
+}
+
+func imageFocal(img *storage.Image) *image.FocalPoint {
+	if img.Focal == nil {
+		return nil
+	}
+	return &image.FocalPoint{X: img.Focal.X, Y: img.Focal.Y}
+}
+
+func (d *Daemon) rewatermark(slug string, wm *image.Watermark, focal *image.FocalPoint) error {
+	data, err := d.fs.Read(d.fs.SourceKey(slug))
+	if err != nil {
+		return err
+	}
+	results, err := d.processor.ProcessWithTransform(context.Background(), data, image.TransformParams{Watermark: wm, Focal: focal})
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if err := d.fs.Save(slug, res.Name, res.Data); err != nil {
+			return err
+		}
+	}
+	if wm == nil {
+		return d.fs.DeleteVariant(slug, image.CleanVariant)
+	}
+	return nil
+}
+
+// backfillFingerprints hashes images uploaded before duplicate detection,
+// so they show up in the admin duplicate clusters.
+func (d *Daemon) backfillFingerprints() {
+	images, err := d.db.GetImagesWithoutFingerprint(backfillBatch)
+	if err != nil {
+		logging.Get("cleanup").Printf("cleanup: failed to get images without fingerprint: %v", err)
+		return
+	}
+
+	var done int
+	for _, img := range images {
+		var fp image.Fingerprint
+		data, err := d.fs.Read(d.fs.SourceKey(img.Slug))
+		if err == nil {
+			fp, err = d.processor.ComputeFingerprint(context.Background(), data)
+		}
+		if poolBusy(err) {
+			break
+		}
+		if err != nil {
+			logging.Get("cleanup").Printf("cleanup: fingerprint for %s: %v", img.Slug, err)
+		}
+		if err := d.db.UpdateImageFingerprint(img.Slug, fp.DHash, fp.PixelHash); err != nil {
+			logging.Get("cleanup").Printf("cleanup: failed to store fingerprint for %s: %v", img.Slug, err)
+			return
+		}
+		if fp.PixelHash != "" {
+			done++
+		}
+	}
+	if done > 0 {
+		logging.Get("cleanup").Printf("cleanup: hashed %d images", done)
+	}
+}
+
 func (d *Daemon) cleanupCache() {
 	if d.cfg.CacheDir == "" {
 		return
@@ -112,6 +362,12 @@ func (d *Daemon) cleanupCache() {
 	var removed int
 	var bytes int64
 
+	// renders of removed or reconfigured presets are never served again
+	presetKeys := make(map[string]bool)
+	for _, p := range image.Presets() {
+		presetKeys[p.BaseKey()] = true
+	}
+
 	err := filepath.WalkDir(d.cfg.CacheDir, func(path string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -123,7 +379,8 @@ func (d *Daemon) cleanupCache() {
 		if err != nil {
 			return err
 		}
-		if info.ModTime().After(cutoff) {
+		// a fresh temp file is a render being written right now
+		if info.ModTime().After(cutoff) && (storage.IsTempFile(path) || !stalePresetRender(entry.Name(), presetKeys)) {
 			return nil
 		}
 		if err := os.Remove(path); err != nil {
@@ -141,3 +398,15 @@ func (d *Daemon) cleanupCache() {
 		logging.Get("cleanup").Printf("cleanup: cache removed %d files (%.2f MB)", removed, float64(bytes)/(1024*1024))
 	}
 }
+
+// stalePresetRender reports whether a cache file named {slug}_{key}.{ext}
+// belongs to a preset key that is no longer configured. Focal-point renders
+// are matched by their base key; renders of signed transform URLs only
+// expire by age.
+func stalePresetRender(name string, presetKeys map[string]bool) bool {
+	_, key, ok := strings.Cut(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+	if !ok || strings.HasPrefix(key, image.TransformPresetName+"-") {
+		return false
+	}
+	return !presetKeys[image.BaseKeyOf(key)]
+}
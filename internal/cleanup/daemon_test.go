@@ -1,11 +1,17 @@
 package cleanup
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"dajtu/internal/config"
+	"dajtu/internal/image"
 	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
 )
 
 func testSetup(t *testing.T) (*config.Config, *storage.DB, *storage.Filesystem, func()) {
@@ -22,7 +28,7 @@ func testSetup(t *testing.T) (*config.Config, *storage.DB, *storage.Filesystem,
 		t.Fatalf("create db: %v", err)
 	}
 
-	fs, err := storage.NewFilesystem(dir)
+	fs, err := storage.NewFilesystem(dir, db)
 	if err != nil {
 		t.Fatalf("create fs: %v", err)
 	}
@@ -38,7 +44,7 @@ func TestNewDaemon(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 	if d == nil {
 		t.Fatal("NewDaemon() = nil")
 	}
@@ -51,6 +57,9 @@ func TestNewDaemon(t *testing.T) {
 	if d.fs != fs {
 		t.Error("daemon.fs not set")
 	}
+	if d.Scrubber() == nil {
+		t.Error("daemon.scrubber not set")
+	}
 }
 
 func TestDaemon_Cleanup_UnderLimit(t *testing.T) {
@@ -69,7 +78,7 @@ func TestDaemon_Cleanup_UnderLimit(t *testing.T) {
 	db.InsertImage(img)
 	fs.Save("small", "original", make([]byte, 100))
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 	d.cleanup()
 
 	// Image should still exist
@@ -90,7 +99,7 @@ func TestDaemon_Cleanup_OverLimit(t *testing.T) {
 	db, _ := storage.NewDB(dir)
 	defer db.Close()
 
-	fs, _ := storage.NewFilesystem(dir)
+	fs, _ := storage.NewFilesystem(dir, db)
 
 	// Add data over limit
 	now := time.Now().Unix()
@@ -104,10 +113,10 @@ func TestDaemon_Cleanup_OverLimit(t *testing.T) {
 			AccessedAt: now,
 		}
 		db.InsertImage(img)
-		fs.Save(slug, "original", make([]byte, 200))
+		fs.Save(slug, "original", bytes.Repeat([]byte{byte(i)}, 200))
 	}
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 	d.cleanup()
 
 	// Some images should be deleted
@@ -130,7 +139,7 @@ func TestDaemon_Cleanup_DeletesOldestFirst(t *testing.T) {
 	db, _ := storage.NewDB(dir)
 	defer db.Close()
 
-	fs, _ := storage.NewFilesystem(dir)
+	fs, _ := storage.NewFilesystem(dir, db)
 
 	now := time.Now().Unix()
 
@@ -143,7 +152,7 @@ func TestDaemon_Cleanup_DeletesOldestFirst(t *testing.T) {
 		AccessedAt: now,
 	}
 	db.InsertImage(oldImg)
-	fs.Save("oldest", "original", make([]byte, 500))
+	fs.Save("oldest", "original", bytes.Repeat([]byte{1}, 500))
 
 	// newer image
 	newImg := &storage.Image{
@@ -154,9 +163,9 @@ func TestDaemon_Cleanup_DeletesOldestFirst(t *testing.T) {
 		AccessedAt: now,
 	}
 	db.InsertImage(newImg)
-	fs.Save("newest", "original", make([]byte, 500))
+	fs.Save("newest", "original", bytes.Repeat([]byte{2}, 500))
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 	d.cleanup()
 
 	// Oldest should be deleted first
@@ -168,6 +177,81 @@ func TestDaemon_Cleanup_DeletesOldestFirst(t *testing.T) {
 	}
 }
 
+func TestDaemon_Cleanup_SharedBlobs(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxDiskGB = 0.000001 // ~1KB
+
+	// three reposts of one 600-byte file take 600 bytes, not 1800
+	now := time.Now().Unix()
+	data := bytes.Repeat([]byte{7}, 600)
+	for i, slug := range []string{"rep01", "rep02", "rep03"} {
+		db.InsertImage(&storage.Image{Slug: slug, MimeType: "image/jpeg", FileSize: 600, CreatedAt: now - int64(i), AccessedAt: now})
+		fs.Save(slug, "original", data)
+	}
+	if total, _ := db.GetTotalSize(); total != 600 {
+		t.Fatalf("GetTotalSize() = %d, want 600", total)
+	}
+
+	NewDaemon(cfg, db, fs, image.NewProcessor()).cleanup()
+	for _, slug := range []string{"rep01", "rep02", "rep03"} {
+		if img, _ := db.GetImageBySlug(slug); img == nil {
+			t.Errorf("%s deleted while under the limit", slug)
+		}
+	}
+}
+
+func TestDaemon_CollectBlobs(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "gone1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("gone1", "original", []byte("orphaned"))
+	db.DeleteImageBySlug("gone1")
+
+	NewDaemon(cfg, db, fs, image.NewProcessor()).cleanup()
+	if usage, _ := fs.GetDiskUsage(); usage != 0 {
+		t.Errorf("disk usage after collecting = %d, want 0", usage)
+	}
+}
+
+func TestDaemon_PurgeTrash(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.TrashRetentionDays = 30
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "gal1", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+	db.InsertImage(&storage.Image{Slug: "del01", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("del01", "original", []byte("deleted"))
+	db.InsertImage(&storage.Image{Slug: "gal01", MimeType: "image/jpeg", GalleryID: &galleryID, CreatedAt: now, AccessedAt: now})
+	fs.Save("gal01", "original", []byte("in gallery"))
+	db.TrashImage("del01", storage.DeletedByOwner)
+	db.TrashGallery(galleryID, storage.DeletedByOwner)
+
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
+	d.cleanup()
+	if exists, _ := db.SlugExists("images", "del01"); !exists {
+		t.Fatal("image purged within the retention period")
+	}
+
+	// a retention of -1 days expires everything trashed until tomorrow
+	cfg.TrashRetentionDays = -1
+	d.cleanup()
+	for _, slug := range []string{"del01", "gal01"} {
+		if exists, _ := db.SlugExists("images", slug); exists {
+			t.Errorf("%s not purged", slug)
+		}
+	}
+	if exists, _ := db.SlugExists("galleries", "gal1"); exists {
+		t.Error("gallery not purged")
+	}
+	if usage, _ := fs.GetDiskUsage(); usage != 0 {
+		t.Errorf("disk usage after purging = %d, want 0", usage)
+	}
+}
+
 func TestDaemon_Cleanup_NoImages(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
@@ -175,7 +259,7 @@ func TestDaemon_Cleanup_NoImages(t *testing.T) {
 	// High usage configured but no images
 	cfg.MaxDiskGB = 0.000000001
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 
 	// Should not panic
 	d.cleanup()
@@ -185,7 +269,7 @@ func TestDaemon_Start(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	d := NewDaemon(cfg, db, fs)
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
 
 	// Just verify Start doesn't panic
 	d.Start()
@@ -193,3 +277,206 @@ func TestDaemon_Start(t *testing.T) {
 	// Give goroutine time to start
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestDaemon_BackfillPlaceholders(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "broken", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("broken", "original", []byte("not an image"))
+	db.InsertImage(&storage.Image{Slug: "nofile", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
+	d.backfillPlaceholders()
+
+	// failures are marked as processed, not retried forever
+	pending, err := db.GetImagesWithoutPlaceholder(10)
+	if err != nil {
+		t.Fatalf("GetImagesWithoutPlaceholder() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending after backfill = %d, want 0", len(pending))
+	}
+	got, _ := db.GetImageBySlug("broken")
+	if got.LQIP != "" || got.DominantColor != "" {
+		t.Errorf("broken placeholder = %q, %q; want empty", got.LQIP, got.DominantColor)
+	}
+}
+
+// busyProcessor returns a processor whose single worker and queue slot are
+// taken until the test ends, so every job gets ErrQueueFull.
+func busyProcessor(t *testing.T) *image.Processor {
+	t.Helper()
+	pool := image.NewPool(1, 1, 0)
+	unblock := make(chan struct{})
+	t.Cleanup(func() {
+		close(unblock)
+		pool.Close()
+	})
+	block := func() error {
+		<-unblock
+		return nil
+	}
+	for s := pool.Stats(); s.Active == 0; s = pool.Stats() {
+		if s.Queued == 0 {
+			pool.Go(block)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pool.Go(block)
+	return image.NewPooledProcessor(pool)
+}
+
+func TestDaemon_Backfills_PoolBusy(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "photo", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("photo", "original", []byte("not an image"))
+
+	d := NewDaemon(cfg, db, fs, busyProcessor(t))
+	d.backfillPlaceholders()
+	d.backfillFingerprints()
+
+	// turned away by a full queue is not a failure, the next run retries
+	if pending, _ := db.GetImagesWithoutPlaceholder(10); len(pending) != 1 {
+		t.Errorf("placeholders pending = %d, want 1", len(pending))
+	}
+	if pending, _ := db.GetImagesWithoutFingerprint(10); len(pending) != 1 {
+		t.Errorf("fingerprints pending = %d, want 1", len(pending))
+	}
+}
+
+func TestDaemon_BackfillPlaceholders_Generates(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "photo", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("photo", "original", testutil.SampleJPEG())
+
+	NewDaemon(cfg, db, fs, image.NewProcessor()).backfillPlaceholders()
+
+	got, _ := db.GetImageBySlug("photo")
+	if got.LQIP == "" {
+		t.Skip("image processing unavailable")
+	}
+	if !strings.HasPrefix(got.LQIP, "data:image/webp;base64,") || len(got.DominantColor) != 7 {
+		t.Errorf("placeholder = %q, %q", got.LQIP, got.DominantColor)
+	}
+}
+
+func TestDaemon_BackfillFingerprints(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "broken", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("broken", "original", []byte("not an image"))
+	db.InsertImage(&storage.Image{Slug: "hashed", MimeType: "image/jpeg", PHash: 7, PixelSHA: "abc", CreatedAt: now, AccessedAt: now})
+
+	NewDaemon(cfg, db, fs, image.NewProcessor()).backfillFingerprints()
+
+	pending, err := db.GetImagesWithoutFingerprint(10)
+	if err != nil {
+		t.Fatalf("GetImagesWithoutFingerprint() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending after backfill = %d, want 0", len(pending))
+	}
+	got, _ := db.GetImageBySlug("hashed")
+	if got.PHash != 7 || got.PixelSHA != "abc" {
+		t.Errorf("existing fingerprint overwritten: %d, %q", got.PHash, got.PixelSHA)
+	}
+}
+
+func TestDaemon_CleanupCache_StalePresets(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.CacheDir = t.TempDir()
+
+	thumb, _ := image.LookupPreset("thumb")
+	dir := filepath.Join(cfg.CacheDir, "ab")
+	os.MkdirAll(dir, 0755)
+	current := filepath.Join(dir, "abcd_"+thumb.Key()+".avif")
+	stale := filepath.Join(dir, "abcd_thumb-00000000.avif")
+	old := filepath.Join(dir, "abcd_"+thumb.Key()+".jpg")
+	transform := filepath.Join(dir, "abcd_"+image.TransformPresetName+"-0badf00d.webp")
+	focal := filepath.Join(dir, "abcd_"+thumb.WithFocal(&image.FocalPoint{X: 0.3, Y: 0.2}).Key()+".avif")
+	staleFocal := filepath.Join(dir, "abcd_thumb-00000000-f0badf00d.avif")
+	for _, p := range []string{current, stale, old, transform, focal, staleFocal} {
+		os.WriteFile(p, []byte("x"), 0644)
+	}
+	past := time.Now().Add(-72 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	NewDaemon(cfg, db, fs, image.NewProcessor()).cleanupCache()
+
+	if _, err := os.Stat(current); err != nil {
+		t.Error("fresh render of a current preset should be kept")
+	}
+	if _, err := os.Stat(transform); err != nil {
+		t.Error("fresh transform render should be kept")
+	}
+	if _, err := os.Stat(focal); err != nil {
+		t.Error("fresh focal-point render of a current preset should be kept")
+	}
+	if _, err := os.Stat(staleFocal); !os.IsNotExist(err) {
+		t.Error("focal-point render of a reconfigured preset should be removed")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("render of a reconfigured preset should be removed")
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("render older than 48h should be removed")
+	}
+}
+
+func TestDaemon_ApplyWatermarks(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	user, _ := db.GetOrCreateBratUser("artist")
+	mark := &storage.Watermark{Text: "artist", Position: image.PositionBottomRight, Opacity: 0.5, Scale: 0.2}
+	db.SetUserWatermark(user.ID, mark)
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "photo", MimeType: "image/jpeg", UserID: &user.ID, CreatedAt: now, AccessedAt: now})
+	fs.Save("photo", "original", testutil.SampleJPEG())
+	db.InsertImage(&storage.Image{Slug: "anim", MimeType: "image/gif", UserID: &user.ID, Frames: 3, CreatedAt: now, AccessedAt: now})
+	fs.Save("anim", "original", testutil.AnimatedGIF(300, 300, 3))
+
+	d := NewDaemon(cfg, db, fs, image.NewProcessor())
+	d.applyWatermarks()
+
+	// recorded even when re-rendering is impossible, nothing is retried forever
+	for _, slug := range []string{"photo", "anim"} {
+		img, _ := db.GetImageBySlug(slug)
+		if img.WatermarkKey != mark.Key {
+			t.Errorf("%s watermark_key = %q, want %q", slug, img.WatermarkKey, mark.Key)
+		}
+	}
+	processed := true
+	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
+		processed = false
+	}
+	for _, slug := range []string{"photo", "anim"} {
+		if _, err := fs.Stat(fs.Key(slug, image.CleanVariant)); (err == nil) != processed {
+			t.Errorf("%s clean copy exists = %v, want %v", slug, err == nil, processed)
+		}
+	}
+	if data, _ := fs.Read(fs.Key("anim", "original")); processed && !image.IsAnimated(data) {
+		t.Error("watermarked animation lost its frames")
+	}
+
+	db.DeleteUserWatermark(user.ID)
+	d.applyWatermarks()
+	if img, _ := db.GetImageBySlug("photo"); img.WatermarkKey != "" {
+		t.Errorf("watermark_key after removal = %q", img.WatermarkKey)
+	}
+	if _, err := fs.Stat(fs.Key("photo", image.CleanVariant)); processed && err == nil {
+		t.Error("clean copy kept after the watermark was removed")
+	}
+}
@@ -0,0 +1,432 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
+	"dajtu/internal/storage"
+)
+
+// ErrScrubRunning is returned by Run while another scrub is in progress.
+var ErrScrubRunning = errors.New("scrub already running")
+
+// Problem kinds of a scrub.
+const (
+	ProblemMissing     = "missing"      // a file the image needs is not stored
+	ProblemUnreadable  = "unreadable"   // the store failed to return the file
+	ProblemChecksum    = "checksum"     // blob bytes differ from the hash they are named after
+	ProblemCorrupt     = "corrupt"      // stored, but not a complete or decodable image
+	ProblemOrphan      = "orphan"       // files of a slug without an image row
+	ProblemOrphanBlob  = "orphan_blob"  // blob file without a blob row
+	ProblemMissingBlob = "missing_blob" // blob row whose file is gone
+)
+
+const (
+	// scrubBatch is how many image rows are loaded at a time.
+	scrubBatch = 100
+	// orphanGrace keeps files of uploads in progress out of the orphans.
+	orphanGrace = time.Hour
+	// maxReportedProblems caps the problems kept in a report; the rest
+	// are only counted.
+	maxReportedProblems = 1000
+	// scrubQueueWait is the pause before a pixel check turned away by a
+	// full processing queue is offered again.
+	scrubQueueWait = time.Second
+)
+
+// RepairOptions selects what a scrub fixes besides reporting it.
+type RepairOptions struct {
+	Regenerate    bool // re-render damaged or missing variants from the source
+	DeleteOrphans bool // delete files and blobs nothing references
+	Flag          bool // record what could not be repaired on the image rows
+}
+
+// ParseRepairOptions reads a comma-separated list of "regenerate",
+// "orphans" and "flag"; unknown names are ignored.
+func ParseRepairOptions(spec string) RepairOptions {
+	var opts RepairOptions
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "regenerate":
+			opts.Regenerate = true
+		case "orphans":
+			opts.DeleteOrphans = true
+		case "flag":
+			opts.Flag = true
+		}
+	}
+	return opts
+}
+
+// Problem is one thing a scrub found wrong. Repair says what was done
+// about it, empty when nothing was.
+type Problem struct {
+	Kind   string
+	Slug   string
+	Key    string
+	Detail string
+	Repair string
+}
+
+// ScrubReport is the outcome of one scrub.
+type ScrubReport struct {
+	Options    RepairOptions
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Images     int // image rows checked
+	Files      int // files read
+	Problems   []Problem
+	Omitted    int // problems beyond maxReportedProblems
+	Repaired   int
+	Flagged    int    // images flagged with an integrity error
+	Err        string // why the scrub stopped early
+}
+
+// Found is the number of problems, reported or omitted.
+func (r *ScrubReport) Found() int {
+	return len(r.Problems) + r.Omitted
+}
+
+func (r *ScrubReport) add(p Problem) {
+	if p.Repair != "" {
+		r.Repaired++
+	}
+	if len(r.Problems) < maxReportedProblems {
+		r.Problems = append(r.Problems, p)
+	} else {
+		r.Omitted++
+	}
+}
+
+// Scrubber verifies that the database and the image store agree: every
+// ready image has its variants, every stored file is a complete image
+// whose pixels decode, matching its checksum, and nothing is stored for images that are gone.
+type Scrubber struct {
+	db        *storage.DB
+	fs        *storage.Filesystem
+	processor *image.Processor // re-renders share the request pool
+	grace     time.Duration    // see orphanGrace
+
+	running sync.Mutex
+	mu      sync.Mutex // guards last
+	last    *ScrubReport
+}
+
+func NewScrubber(db *storage.DB, fs *storage.Filesystem, processor *image.Processor) *Scrubber {
+	return &Scrubber{db: db, fs: fs, processor: processor, grace: orphanGrace}
+}
+
+// Run scrubs the whole store and returns the report, also kept for Last.
+func (s *Scrubber) Run(opts RepairOptions) (*ScrubReport, error) {
+	if !s.running.TryLock() {
+		return nil, ErrScrubRunning
+	}
+	defer s.running.Unlock()
+	return s.run(opts)
+}
+
+// Start runs a scrub in the background; it reports false when one is
+// already running.
+func (s *Scrubber) Start(opts RepairOptions) bool {
+	if !s.running.TryLock() {
+		return false
+	}
+	go func() {
+		defer s.running.Unlock()
+		s.run(opts)
+	}()
+	return true
+}
+
+// Running reports whether a scrub is in progress.
+func (s *Scrubber) Running() bool {
+	if s.running.TryLock() {
+		s.running.Unlock()
+		return false
+	}
+	return true
+}
+
+// Last returns the report of the latest finished scrub, nil before the
+// first one.
+func (s *Scrubber) Last() *ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *Scrubber) run(opts RepairOptions) (*ScrubReport, error) {
+	report := &ScrubReport{Options: opts, StartedAt: time.Now()}
+	err := s.scrubImages(report)
+	if err == nil {
+		err = s.scrubOrphans(report)
+	}
+	report.FinishedAt = time.Now()
+	if err != nil {
+		report.Err = err.Error()
+		logging.Get("cleanup").Printf("scrub: stopped: %v", err)
+	}
+	logging.Get("cleanup").Printf("scrub: checked %d images, %d files in %s: %d problems, %d repaired, %d flagged",
+		report.Images, report.Files, report.FinishedAt.Sub(report.StartedAt).Round(time.Second),
+		report.Found(), report.Repaired, report.Flagged)
+
+	s.mu.Lock()
+	s.last = report
+	s.mu.Unlock()
+	return report, err
+}
+
+func (s *Scrubber) scrubImages(report *ScrubReport) error {
+	var after int64
+	for {
+		images, err := s.db.GetReadyImagesAfter(after, scrubBatch)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			if err := s.scrubImage(img, report); err != nil {
+				return fmt.Errorf("%s: %w", img.Slug, err)
+			}
+			after = img.ID
+		}
+		if len(images) < scrubBatch {
+			return nil
+		}
+	}
+}
+
+// variantNames lists the stored variants every image has: the eager
+// presets, "original" first.
+func variantNames() []string {
+	names := []string{"original"}
+	for _, p := range image.Presets() {
+		if p.Eager && p.Name != "original" {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// checkFile reads a file and returns what is wrong with it, "" when it is
+// a complete image.
+func (s *Scrubber) checkFile(key string, report *ScrubReport) (kind, detail string) {
+	report.Files++
+	data, err := s.fs.ReadVerified(key)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ProblemMissing, ""
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		return ProblemChecksum, ""
+	case err != nil:
+		return ProblemUnreadable, err.Error()
+	}
+	if err := image.CheckIntegrity(data); err != nil {
+		return ProblemCorrupt, err.Error()
+	}
+	if err := s.decodes(data); errors.Is(err, image.ErrUndecodable) {
+		return ProblemCorrupt, err.Error()
+	} else if err != nil {
+		return ProblemUnreadable, err.Error()
+	}
+	return "", ""
+}
+
+// decodes verifies the pixels of data on the processing pool. A full
+// queue is waited out, the scrub is in no hurry.
+func (s *Scrubber) decodes(data []byte) error {
+	for {
+		err := s.processor.CheckDecode(context.Background(), data)
+		if !errors.Is(err, image.ErrQueueFull) {
+			return err
+		}
+		time.Sleep(scrubQueueWait)
+	}
+}
+
+func (s *Scrubber) scrubImage(img *storage.Image, report *ScrubReport) error {
+	report.Images++
+	refs, err := s.db.GetBlobRefs(img.Slug)
+	if err != nil {
+		return err
+	}
+
+	// variants can be re-rendered; the other files (kept upload, backup,
+	// revisions) are only checked
+	var problems []Problem
+	checked := make(map[string]bool)
+	check := func(name string) {
+		checked[name] = true
+		key := s.fs.FileKey(img.Slug, name)
+		if kind, detail := s.checkFile(key, report); kind != "" {
+			problems = append(problems, Problem{Kind: kind, Slug: img.Slug, Key: key, Detail: detail})
+		}
+	}
+	for _, name := range variantNames() {
+		check(name + ".webp")
+	}
+	for _, ref := range refs {
+		if !checked[ref.Name] {
+			check(ref.Name)
+		}
+	}
+
+	if report.Options.Regenerate && len(problems) > 0 {
+		if err := s.regenerate(img, problems); err != nil {
+			logging.Get("cleanup").Printf("scrub: regenerate %s: %v", img.Slug, err)
+		}
+	}
+
+	var unrepaired []string
+	for _, p := range problems {
+		report.add(p)
+		// a store failing to answer says nothing about the file
+		if p.Repair == "" && p.Kind != ProblemUnreadable {
+			unrepaired = append(unrepaired, path.Base(p.Key)+": "+p.Kind)
+		}
+	}
+	// a flag is cleared once the files are fine, set only with Flag
+	reason := strings.Join(unrepaired, ", ")
+	if reason != "" && !report.Options.Flag {
+		return nil
+	}
+	if reason != "" {
+		report.Flagged++
+	}
+	if reason == img.IntegrityError {
+		return nil
+	}
+	return s.db.SetImageIntegrityError(img.Slug, reason)
+}
+
+// regenerate re-renders the variants among problems from the first intact
+// source and marks those it stored again as repaired. Rendering goes
+// through the processing pool; a full queue leaves the variants for the
+// next scrub.
+func (s *Scrubber) regenerate(img *storage.Image, problems []Problem) error {
+	broken := make(map[string]bool)
+	for _, p := range problems {
+		if name, ok := strings.CutSuffix(path.Base(p.Key), ".webp"); ok && p.Kind != ProblemUnreadable {
+			broken[name] = true
+		}
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+
+	source, err := s.source(img, broken)
+	if err != nil {
+		return err
+	}
+	_, wm, err := effectiveWatermark(s.db, img)
+	if err != nil {
+		return err
+	}
+	results, err := s.processor.ProcessWithTransform(context.Background(), source, image.TransformParams{Watermark: wm, Focal: imageFocal(img)})
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		if !broken[res.Name] {
+			continue
+		}
+		if err := s.fs.SaveRepaired(img.Slug, res.Name, res.Data); err != nil {
+			return err
+		}
+		for i := range problems {
+			if problems[i].Key == s.fs.Key(img.Slug, res.Name) {
+				problems[i].Repair = "regenerated"
+			}
+		}
+	}
+	return nil
+}
+
+// source returns the data to re-render the variants of img from: its
+// unmarked original when intact, else what edits are rendered from, the
+// latest revision of an edited image.
+func (s *Scrubber) source(img *storage.Image, broken map[string]bool) ([]byte, error) {
+	var keys []string
+	if !broken[image.CleanVariant] {
+		keys = append(keys, s.fs.Key(img.Slug, image.CleanVariant))
+	}
+	// a marked original would get marked twice
+	if !broken["original"] && img.WatermarkKey == "" {
+		keys = append(keys, s.fs.Key(img.Slug, "original"))
+	}
+	if img.Edited {
+		revisions, err := s.db.GetImageRevisions(img.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(revisions) > 0 {
+			keys = append(keys, s.fs.RevisionKey(img.Slug, revisions[0].ID))
+		}
+	} else if key := s.fs.EditSourceKey(img.Slug); !slices.Contains(keys, key) && key != s.fs.Key(img.Slug, "original") {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		data, err := s.fs.ReadVerified(key)
+		if err == nil && image.CheckIntegrity(data) == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("no intact source")
+}
+
+// scrubOrphans reports stored files no image row references, deleting
+// them with DeleteOrphans. The mtime grace alone cannot tell a crashed
+// upload from a slow one, so deletion goes through fs.DeleteOrphan, which
+// skips slugs an upload has claimed.
+func (s *Scrubber) scrubOrphans(report *ScrubReport) error {
+	orphans, err := s.fs.FindOrphans(s.grace)
+	if err != nil {
+		return err
+	}
+	deleteOrphans := report.Options.DeleteOrphans
+
+	for _, slug := range orphans.Slugs {
+		p := Problem{Kind: ProblemOrphan, Slug: slug, Key: s.fs.FileKey(slug, "")}
+		if deleteOrphans {
+			// the row may have been inserted since
+			deleted, err := s.fs.DeleteOrphan(slug)
+			if err != nil {
+				return fmt.Errorf("delete files of %s: %w", slug, err)
+			}
+			if deleted {
+				p.Repair = "deleted"
+			}
+		}
+		report.add(p)
+	}
+
+	for _, key := range orphans.Blobs {
+		p := Problem{Kind: ProblemOrphanBlob, Key: key}
+		if deleteOrphans {
+			deleted, err := s.fs.DeleteOrphanBlob(key)
+			if err != nil {
+				return fmt.Errorf("delete %s: %w", key, err)
+			}
+			if deleted {
+				p.Repair = "deleted"
+			}
+		}
+		report.add(p)
+	}
+
+	// the files referencing these were reported with their images
+	for _, hash := range orphans.MissingBlobs {
+		report.add(Problem{Kind: ProblemMissingBlob, Key: hash})
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package cleanup
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+// sampleWebP returns a valid WebP with distinct bytes per n, so that files
+// do not share a blob.
+func sampleWebP(n int) []byte {
+	return append(testutil.SampleWebP(), byte(n))
+}
+
+// storeTestImage inserts a ready image with its original and thumb.
+func storeTestImage(t *testing.T, db *storage.DB, fs *storage.Filesystem, slug string, n int) {
+	t.Helper()
+	now := time.Now().Unix()
+	if _, err := db.InsertImage(&storage.Image{Slug: slug, MimeType: "image/webp", CreatedAt: now, AccessedAt: now}); err != nil {
+		t.Fatalf("InsertImage(%s) error = %v", slug, err)
+	}
+	fs.Save(slug, "original", sampleWebP(n))
+	fs.Save(slug, "thumb", sampleWebP(n+1))
+}
+
+// blobKeyOf returns the store key holding the bytes of a file.
+func blobKeyOf(t *testing.T, fs *storage.Filesystem, key string) string {
+	t.Helper()
+	info, err := fs.Stat(key)
+	if err != nil {
+		t.Fatalf("Stat(%s) error = %v", key, err)
+	}
+	return info.Key
+}
+
+func problemKinds(report *ScrubReport) string {
+	var kinds []string
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind+" "+p.Key)
+	}
+	return strings.Join(kinds, "\n")
+}
+
+func testScrubber(t *testing.T) (*Scrubber, *storage.DB, *storage.Filesystem) {
+	t.Helper()
+	_, db, fs, cleanup := testSetup(t)
+	t.Cleanup(cleanup)
+	s := NewScrubber(db, fs, image.NewProcessor())
+	s.grace = 0
+	return s, db, fs
+}
+
+func TestScrubber_Report(t *testing.T) {
+	s, db, fs := testScrubber(t)
+
+	storeTestImage(t, db, fs, "good1", 10)
+	storeTestImage(t, db, fs, "lost1", 20)
+	fs.Store().Delete(blobKeyOf(t, fs, fs.Key("lost1", "original")))
+	storeTestImage(t, db, fs, "rott1", 30)
+	fs.Store().Put(blobKeyOf(t, fs, fs.Key("rott1", "thumb")), []byte("bit rot"))
+	storeTestImage(t, db, fs, "trun1", 40)
+	fs.Save("trun1", "thumb", sampleWebP(41)[:30])
+	// files of a gallery upload whose row was rolled back
+	fs.Save("orph1", "original", sampleWebP(50))
+	stray := "blobs/00/" + strings.Repeat("0", 64) + ".webp"
+	fs.Store().Put(stray, []byte("stray"))
+	// pending images have no variants yet
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "pend1", MimeType: "image/jpeg", Status: storage.ImageStatusPending, CreatedAt: now, AccessedAt: now})
+
+	report, err := s.Run(RepairOptions{})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Images != 4 {
+		t.Errorf("Images = %d, want 4", report.Images)
+	}
+	want := strings.Join([]string{
+		"missing lo/lost1/original.webp",
+		"checksum ro/rott1/thumb.webp",
+		"corrupt tr/trun1/thumb.webp",
+		"orphan or/orph1/",
+		"orphan_blob " + stray,
+		"missing_blob " + fmt.Sprintf("%x", sha256.Sum256(sampleWebP(20))),
+	}, "\n")
+	if got := problemKinds(report); got != want {
+		t.Errorf("problems:\n%s\nwant:\n%s", got, want)
+	}
+	if report.Repaired != 0 || report.Flagged != 0 {
+		t.Errorf("Repaired/Flagged = %d/%d, want nothing changed", report.Repaired, report.Flagged)
+	}
+	if !fs.Exists("orph1") {
+		t.Error("orphan deleted without DeleteOrphans")
+	}
+	if s.Last() != report {
+		t.Error("Last() is not the report of the run")
+	}
+}
+
+func TestScrubber_Flag(t *testing.T) {
+	s, db, fs := testScrubber(t)
+	storeTestImage(t, db, fs, "good1", 10)
+	storeTestImage(t, db, fs, "lost1", 20)
+	fs.Store().Delete(blobKeyOf(t, fs, fs.Key("lost1", "thumb")))
+
+	report, err := s.Run(RepairOptions{Flag: true})
+	if err != nil || report.Flagged != 1 {
+		t.Fatalf("Run() = %+v, %v, want one flagged image", report, err)
+	}
+	if img, _ := db.GetImageBySlug("lost1"); img.IntegrityError != "thumb.webp: missing" {
+		t.Errorf("IntegrityError = %q", img.IntegrityError)
+	}
+	if img, _ := db.GetImageBySlug("good1"); img.IntegrityError != "" {
+		t.Errorf("intact image flagged: %q", img.IntegrityError)
+	}
+
+	// flagged again on the next run, counted once per run
+	if report, _ := s.Run(RepairOptions{Flag: true}); report.Flagged != 1 {
+		t.Errorf("second run Flagged = %d", report.Flagged)
+	}
+
+	// fixed by hand: the flag goes away even without Flag
+	fs.SaveRepaired("lost1", "thumb", sampleWebP(21))
+	if report, _ := s.Run(RepairOptions{}); report.Found() != 0 {
+		t.Errorf("after the fix: %s", problemKinds(report))
+	}
+	if img, _ := db.GetImageBySlug("lost1"); img.IntegrityError != "" {
+		t.Errorf("IntegrityError after the fix = %q", img.IntegrityError)
+	}
+}
+
+func TestScrubber_DeleteOrphans(t *testing.T) {
+	s, db, fs := testScrubber(t)
+	storeTestImage(t, db, fs, "good1", 10)
+	fs.Save("orph1", "original", sampleWebP(10)) // shares its blob with good1
+	fs.Store().Put(fs.Key("orph2", "thumb"), sampleWebP(30))
+	stray := "blobs/00/" + strings.Repeat("0", 64) + ".webp"
+	fs.Store().Put(stray, []byte("stray"))
+
+	report, err := s.Run(RepairOptions{DeleteOrphans: true})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Found() != 3 || report.Repaired != 3 {
+		t.Errorf("Found/Repaired = %d/%d, want 3/3:\n%s", report.Found(), report.Repaired, problemKinds(report))
+	}
+	for _, slug := range []string{"orph1", "orph2"} {
+		if fs.Exists(slug) {
+			t.Errorf("orphan %s left", slug)
+		}
+	}
+	if _, err := fs.Store().Stat(stray); err == nil {
+		t.Error("stray blob left")
+	}
+	if data, err := fs.ReadVerified(fs.Key("good1", "original")); err != nil || image.CheckIntegrity(data) != nil {
+		t.Errorf("shared blob damaged: %v", err)
+	}
+
+	if report, _ := s.Run(RepairOptions{DeleteOrphans: true}); report.Found() != 0 {
+		t.Errorf("second run:\n%s", problemKinds(report))
+	}
+}
+
+func TestScrubber_OrphanGrace(t *testing.T) {
+	s, _, fs := testScrubber(t)
+	s.grace = time.Hour
+	fs.Save("orph1", "original", sampleWebP(10))
+
+	report, err := s.Run(RepairOptions{DeleteOrphans: true})
+	if err != nil || report.Found() != 0 {
+		t.Errorf("Run() = %s, %v, want a fresh upload left alone", problemKinds(report), err)
+	}
+	if !fs.Exists("orph1") {
+		t.Error("upload in progress deleted")
+	}
+}
+
+func TestScrubber_OrphanClaimed(t *testing.T) {
+	s, _, fs := testScrubber(t)
+	// an upload processing for longer than the grace period
+	defer fs.Claim("slow1")()
+	fs.Save("slow1", "original", sampleWebP(10))
+
+	report, err := s.Run(RepairOptions{DeleteOrphans: true})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Found() != 1 || report.Repaired != 0 {
+		t.Errorf("Found/Repaired = %d/%d, want 1/0:\n%s", report.Found(), report.Repaired, problemKinds(report))
+	}
+	if !fs.Exists("slow1") {
+		t.Error("files of a claimed upload deleted")
+	}
+}
+
+func TestScrubber_Regenerate(t *testing.T) {
+	s, db, fs := testScrubber(t)
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "lost1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.SaveOriginal("lost1", "original", testutil.SampleJPEG(), "image/jpeg")
+	fs.Save("lost1", "thumb", sampleWebP(10))
+	// no source at all
+	db.InsertImage(&storage.Image{Slug: "gone1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("gone1", "thumb", sampleWebP(20))
+
+	report, err := s.Run(RepairOptions{Regenerate: true, Flag: true})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	processed := true
+	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
+		processed = false
+	}
+	repaired := map[string]bool{}
+	for _, p := range report.Problems {
+		repaired[p.Slug] = repaired[p.Slug] || p.Repair == "regenerated"
+	}
+	if repaired["lost1"] != processed {
+		t.Errorf("lost1 regenerated = %v, want %v", repaired["lost1"], processed)
+	}
+	if repaired["gone1"] {
+		t.Error("gone1 regenerated without a source")
+	}
+	if _, err := fs.Stat(fs.Key("lost1", "original")); (err == nil) != processed {
+		t.Errorf("lost1 original stored = %v, want %v", err == nil, processed)
+	}
+	if data, _ := fs.Read(fs.Key("lost1", "thumb")); string(data) != string(sampleWebP(10)) {
+		t.Error("intact thumb re-rendered")
+	}
+
+	img, _ := db.GetImageBySlug("lost1")
+	if (img.IntegrityError == "") != processed {
+		t.Errorf("lost1 IntegrityError = %q", img.IntegrityError)
+	}
+	if img, _ := db.GetImageBySlug("gone1"); img.IntegrityError != "original.webp: missing" {
+		t.Errorf("gone1 IntegrityError = %q", img.IntegrityError)
+	}
+}
+
+func TestScrubber_Regenerate_PoolBusy(t *testing.T) {
+	s, db, fs := testScrubber(t)
+	s.processor = busyProcessor(t)
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "lost1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.SaveOriginal("lost1", "original", testutil.SampleJPEG(), "image/jpeg")
+	fs.Save("lost1", "thumb", sampleWebP(10))
+
+	report, err := s.Run(RepairOptions{Regenerate: true, Flag: true})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Repaired != 0 {
+		t.Errorf("Repaired = %d with a full queue, want 0", report.Repaired)
+	}
+	if _, err := fs.Stat(fs.Key("lost1", "original")); err == nil {
+		t.Error("original rendered outside the pool")
+	}
+	if img, _ := db.GetImageBySlug("lost1"); img.IntegrityError != "original.webp: missing" {
+		t.Errorf("IntegrityError = %q, want it flagged for the next scrub", img.IntegrityError)
+	}
+}
+
+func TestScrubber_Running(t *testing.T) {
+	s, _, _ := testScrubber(t)
+	s.running.Lock()
+	if !s.Running() {
+		t.Error("Running() = false during a scrub")
+	}
+	if _, err := s.Run(RepairOptions{}); !errors.Is(err, ErrScrubRunning) {
+		t.Errorf("Run() error = %v, want ErrScrubRunning", err)
+	}
+	if s.Start(RepairOptions{}) {
+		t.Error("Start() started a second scrub")
+	}
+	s.running.Unlock()
+
+	if !s.Start(RepairOptions{}) {
+		t.Fatal("Start() = false")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Last() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Last() == nil {
+		t.Error("background scrub did not finish")
+	}
+}
+
+func TestParseRepairOptions(t *testing.T) {
+	tests := map[string]RepairOptions{
+		"":                         {},
+		"flag":                     {Flag: true},
+		"regenerate, orphans,flag": {Regenerate: true, DeleteOrphans: true, Flag: true},
+		"orphans,unknown":          {DeleteOrphans: true},
+	}
+	for spec, want := range tests {
+		if got := ParseRepairOptions(spec); got != want {
+			t.Errorf("ParseRepairOptions(%q) = %+v, want %+v", spec, got, want)
+		}
+	}
+}
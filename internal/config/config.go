@@ -48,14 +48,41 @@ type Config struct {
 	LogDir             string
 	CacheDir           string
 	MaxFileSizeMB      int
+	MaxImageWidth      int     // px, 0 = no limit
+	MaxImageHeight     int     // px, 0 = no limit
+	MaxImageMegapixels float64 // width*height*frames / 1e6, 0 = no limit
 	MaxDiskGB          float64
 	CleanupTarget      float64
+	ScrubIntervalHours int    // storage integrity scrub period, 0 = only on demand
+	ScrubRepair        string // what scheduled scrubs repair: "regenerate,orphans,flag"
+	TrashRetentionDays int    // deleted images and galleries stay restorable this long
 	BaseURL            string
 	KeepOriginalFormat bool
+	DedupScope         string   // "off", "user" (same uploader) or "global"
+	DedupMaxDistance   int      // max dHash bit difference for near-duplicates, -1 = exact pixels only (default)
+	ImagePresets       string   // variant presets, see image.DefaultPresets; empty = defaults
+	TransformSecret    string   // HMAC key of /t/ transform URLs, empty = disabled
+	ProcessWorkers     int      // concurrent libvips jobs, 0 = number of CPUs
+	ProcessQueueSize   int      // jobs waiting for a worker before 503
+	ProcessTimeoutSec  int      // per job, queueing included, 0 = no limit
+	AsyncProcessingMB  int      // uploads this large are processed in the background, 0 = never
 	AllowedOrigins     []string // CORS allowed origins
 	PublicUpload       bool     // allow upload without login
 	AdminNicks         []string // nicks with admin panel access
 
+	// Image storage: "local" keeps images in DataDir/images, "s3" in a
+	// bucket of an S3-compatible server
+	StorageBackend  string
+	S3Endpoint      string
+	S3Region        string
+	S3Bucket        string
+	S3AccessKey     string
+	S3SecretKey     string
+	S3Prefix        string
+	S3PathStyle     bool // bucket in the path, as MinIO expects
+	S3PresignTTLSec int  // > 0: redirect image requests to presigned URLs valid this long instead of streaming
+	S3TimeoutSec    int  // per request; a stalled endpoint fails instead of hanging
+
 	// SSO Braterstwo
 	BratHashSecret        string
 	BratEncryptionKey     string
@@ -82,14 +109,39 @@ func Load() *Config {
 		LogDir:             getEnv("LOG_DIR", "./data/logs"),
 		CacheDir:           getEnv("CACHE_DIR", "/tmp/dajtu-cache"),
 		MaxFileSizeMB:      getEnvInt("MAX_FILE_SIZE_MB", 20),
+		MaxImageWidth:      getEnvInt("MAX_IMAGE_WIDTH", 16384),
+		MaxImageHeight:     getEnvInt("MAX_IMAGE_HEIGHT", 16384),
+		MaxImageMegapixels: getEnvFloat("MAX_IMAGE_MEGAPIXELS", 100),
 		MaxDiskGB:          getEnvFloat("MAX_DISK_GB", 50.0),
 		CleanupTarget:      getEnvFloat("CLEANUP_TARGET_GB", 45.0),
+		ScrubIntervalHours: getEnvInt("SCRUB_INTERVAL_HOURS", 168),
+		ScrubRepair:        getEnv("SCRUB_REPAIR", "flag"),
+		TrashRetentionDays: getEnvInt("TRASH_RETENTION_DAYS", 30),
 		BaseURL:            getEnv("BASE_URL", ""),
 		KeepOriginalFormat: getEnvBool("KEEP_ORIGINAL_FORMAT", true),
+		DedupScope:         getEnv("DEDUP_SCOPE", "user"),
+		DedupMaxDistance:   getEnvInt("DEDUP_MAX_DISTANCE", -1),
+		ImagePresets:       getEnv("IMAGE_PRESETS", ""),
+		TransformSecret:    getEnv("TRANSFORM_SECRET", ""),
+		ProcessWorkers:     getEnvInt("PROCESS_WORKERS", 0),
+		ProcessQueueSize:   getEnvInt("PROCESS_QUEUE_SIZE", 32),
+		ProcessTimeoutSec:  getEnvInt("PROCESS_TIMEOUT_SEC", 120),
+		AsyncProcessingMB:  getEnvInt("ASYNC_PROCESSING_MB", 5),
 		AllowedOrigins:     parseOrigins(getEnv("ALLOWED_ORIGINS", "")),
 		PublicUpload:       getEnvBool("PUBLIC_UPLOAD", true),
 		AdminNicks:         adminNicks,
 
+		StorageBackend:  getEnv("STORAGE_BACKEND", "local"),
+		S3Endpoint:      getEnv("S3_ENDPOINT", ""),
+		S3Region:        getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:        getEnv("S3_BUCKET", ""),
+		S3AccessKey:     getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:     getEnv("S3_SECRET_KEY", ""),
+		S3Prefix:        getEnv("S3_PREFIX", ""),
+		S3PathStyle:     getEnvBool("S3_PATH_STYLE", true),
+		S3PresignTTLSec: getEnvInt("S3_PRESIGN_TTL_SEC", 0),
+		S3TimeoutSec:    getEnvInt("S3_TIMEOUT_SEC", 30),
+
 		BratHashSecret:        getEnv("BRAT_HASH_SECRET", ""),
 		BratEncryptionKey:     getEnv("BRAT_ENCRYPTION_KEY", ""),
 		BratEncryptionIV:      getEnv("BRAT_ENCRYPTION_IV", ""),
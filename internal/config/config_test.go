@@ -12,10 +12,20 @@ func TestLoad_Defaults(t *testing.T) {
 	os.Unsetenv("LOG_DIR")
 	os.Unsetenv("CACHE_DIR")
 	os.Unsetenv("MAX_FILE_SIZE_MB")
+	os.Unsetenv("MAX_IMAGE_WIDTH")
+	os.Unsetenv("MAX_IMAGE_HEIGHT")
+	os.Unsetenv("MAX_IMAGE_MEGAPIXELS")
 	os.Unsetenv("MAX_DISK_GB")
 	os.Unsetenv("CLEANUP_TARGET_GB")
+	os.Unsetenv("SCRUB_INTERVAL_HOURS")
+	os.Unsetenv("SCRUB_REPAIR")
+	os.Unsetenv("TRASH_RETENTION_DAYS")
 	os.Unsetenv("BASE_URL")
 	os.Unsetenv("KEEP_ORIGINAL_FORMAT")
+	os.Unsetenv("DEDUP_SCOPE")
+	os.Unsetenv("DEDUP_MAX_DISTANCE")
+	os.Unsetenv("IMAGE_PRESETS")
+	os.Unsetenv("TRANSFORM_SECRET")
 	os.Unsetenv("ALLOWED_ORIGINS")
 	os.Unsetenv("PUBLIC_UPLOAD")
 	os.Unsetenv("BRAT_HASH_SECRET")
@@ -44,18 +54,36 @@ func TestLoad_Defaults(t *testing.T) {
 	if cfg.MaxFileSizeMB != 20 {
 		t.Errorf("MaxFileSizeMB = %d, want %d", cfg.MaxFileSizeMB, 20)
 	}
+	if cfg.MaxImageWidth != 16384 || cfg.MaxImageHeight != 16384 {
+		t.Errorf("MaxImageWidth/Height = %d/%d, want 16384/16384", cfg.MaxImageWidth, cfg.MaxImageHeight)
+	}
+	if cfg.MaxImageMegapixels != 100 {
+		t.Errorf("MaxImageMegapixels = %f, want %f", cfg.MaxImageMegapixels, 100.0)
+	}
 	if cfg.MaxDiskGB != 50.0 {
 		t.Errorf("MaxDiskGB = %f, want %f", cfg.MaxDiskGB, 50.0)
 	}
 	if cfg.CleanupTarget != 45.0 {
 		t.Errorf("CleanupTarget = %f, want %f", cfg.CleanupTarget, 45.0)
 	}
+	if cfg.ScrubIntervalHours != 168 || cfg.ScrubRepair != "flag" {
+		t.Errorf("ScrubIntervalHours/Repair = %d/%q, want 168/flag", cfg.ScrubIntervalHours, cfg.ScrubRepair)
+	}
+	if cfg.TrashRetentionDays != 30 {
+		t.Errorf("TrashRetentionDays = %d, want 30", cfg.TrashRetentionDays)
+	}
 	if cfg.BaseURL != "" {
 		t.Errorf("BaseURL = %q, want empty", cfg.BaseURL)
 	}
 	if !cfg.KeepOriginalFormat {
 		t.Errorf("KeepOriginalFormat = %v, want true", cfg.KeepOriginalFormat)
 	}
+	if cfg.DedupScope != "user" || cfg.DedupMaxDistance != -1 {
+		t.Errorf("DedupScope/MaxDistance = %q/%d, want user/-1", cfg.DedupScope, cfg.DedupMaxDistance)
+	}
+	if cfg.ImagePresets != "" || cfg.TransformSecret != "" {
+		t.Errorf("ImagePresets/TransformSecret = %q/%q, want empty", cfg.ImagePresets, cfg.TransformSecret)
+	}
 	if cfg.AllowedOrigins != nil {
 		t.Errorf("AllowedOrigins = %v, want nil", cfg.AllowedOrigins)
 	}
@@ -85,10 +113,17 @@ func TestLoad_FromEnv(t *testing.T) {
 	os.Setenv("LOG_DIR", "/tmp/logs")
 	os.Setenv("CACHE_DIR", "/tmp/cache")
 	os.Setenv("MAX_FILE_SIZE_MB", "50")
+	os.Setenv("MAX_IMAGE_WIDTH", "8000")
+	os.Setenv("MAX_IMAGE_HEIGHT", "6000")
+	os.Setenv("MAX_IMAGE_MEGAPIXELS", "40.5")
 	os.Setenv("MAX_DISK_GB", "100.5")
 	os.Setenv("CLEANUP_TARGET_GB", "90.0")
 	os.Setenv("BASE_URL", "https://example.com")
 	os.Setenv("KEEP_ORIGINAL_FORMAT", "0")
+	os.Setenv("DEDUP_SCOPE", "global")
+	os.Setenv("DEDUP_MAX_DISTANCE", "4")
+	os.Setenv("IMAGE_PRESETS", "original:2048,eager")
+	os.Setenv("TRANSFORM_SECRET", "t0p")
 	os.Setenv("BRAT_HASH_SECRET", "test_hash_secret")
 	os.Setenv("BRAT_ENCRYPTION_KEY", "test_encryption_key")
 	os.Setenv("BRAT_ENCRYPTION_IV", "1234567890123456")
@@ -103,10 +138,17 @@ func TestLoad_FromEnv(t *testing.T) {
 		os.Unsetenv("LOG_DIR")
 		os.Unsetenv("CACHE_DIR")
 		os.Unsetenv("MAX_FILE_SIZE_MB")
+		os.Unsetenv("MAX_IMAGE_WIDTH")
+		os.Unsetenv("MAX_IMAGE_HEIGHT")
+		os.Unsetenv("MAX_IMAGE_MEGAPIXELS")
 		os.Unsetenv("MAX_DISK_GB")
 		os.Unsetenv("CLEANUP_TARGET_GB")
 		os.Unsetenv("BASE_URL")
 		os.Unsetenv("KEEP_ORIGINAL_FORMAT")
+		os.Unsetenv("DEDUP_SCOPE")
+		os.Unsetenv("DEDUP_MAX_DISTANCE")
+		os.Unsetenv("IMAGE_PRESETS")
+		os.Unsetenv("TRANSFORM_SECRET")
 		os.Unsetenv("BRAT_HASH_SECRET")
 		os.Unsetenv("BRAT_ENCRYPTION_KEY")
 		os.Unsetenv("BRAT_ENCRYPTION_IV")
@@ -134,6 +176,12 @@ func TestLoad_FromEnv(t *testing.T) {
 	if cfg.MaxFileSizeMB != 50 {
 		t.Errorf("MaxFileSizeMB = %d, want %d", cfg.MaxFileSizeMB, 50)
 	}
+	if cfg.MaxImageWidth != 8000 || cfg.MaxImageHeight != 6000 {
+		t.Errorf("MaxImageWidth/Height = %d/%d, want 8000/6000", cfg.MaxImageWidth, cfg.MaxImageHeight)
+	}
+	if cfg.MaxImageMegapixels != 40.5 {
+		t.Errorf("MaxImageMegapixels = %f, want %f", cfg.MaxImageMegapixels, 40.5)
+	}
 	if cfg.MaxDiskGB != 100.5 {
 		t.Errorf("MaxDiskGB = %f, want %f", cfg.MaxDiskGB, 100.5)
 	}
@@ -146,6 +194,15 @@ func TestLoad_FromEnv(t *testing.T) {
 	if cfg.KeepOriginalFormat {
 		t.Errorf("KeepOriginalFormat = %v, want false", cfg.KeepOriginalFormat)
 	}
+	if cfg.DedupScope != "global" || cfg.DedupMaxDistance != 4 {
+		t.Errorf("DedupScope/MaxDistance = %q/%d, want global/4", cfg.DedupScope, cfg.DedupMaxDistance)
+	}
+	if cfg.ImagePresets != "original:2048,eager" {
+		t.Errorf("ImagePresets = %q, want %q", cfg.ImagePresets, "original:2048,eager")
+	}
+	if cfg.TransformSecret != "t0p" {
+		t.Errorf("TransformSecret = %q, want %q", cfg.TransformSecret, "t0p")
+	}
 	if cfg.BratHashSecret != "test_hash_secret" {
 		t.Errorf("BratHashSecret = %q, want %q", cfg.BratHashSecret, "test_hash_secret")
 	}
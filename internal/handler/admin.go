@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,7 +14,10 @@ import (
 	"strings"
 	"time"
 
+	"dajtu/internal/cleanup"
 	"dajtu/internal/config"
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
 	"dajtu/internal/middleware"
 	"dajtu/internal/storage"
 )
@@ -23,16 +27,21 @@ type AdminHandler struct {
 	db                *storage.DB
 	fs                *storage.Filesystem
 	traffic           *middleware.TrafficStats
+	processor         *image.Processor
+	scrubber          *cleanup.Scrubber
 	dashboardTmpl     *template.Template
 	usersTmpl         *template.Template
 	userDetailTmpl    *template.Template
 	galleriesTmpl     *template.Template
 	galleryDetailTmpl *template.Template
 	imagesTmpl        *template.Template
+	duplicatesTmpl    *template.Template
+	integrityTmpl     *template.Template
+	trashTmpl         *template.Template
 	logsTmpl          *template.Template
 }
 
-func NewAdminHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem, traffic *middleware.TrafficStats) *AdminHandler {
+func NewAdminHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem, traffic *middleware.TrafficStats, processor *image.Processor, scrubber *cleanup.Scrubber) *AdminHandler {
 	funcMap := template.FuncMap{
 		"divf": func(a, b int64) float64 {
 			if b == 0 {
@@ -86,6 +95,16 @@ func NewAdminHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem,
 				return fmt.Sprintf("%.2f B/s", bps)
 			}
 		},
+		"formatDuration": func(d time.Duration) string {
+			if d >= time.Second {
+				return fmt.Sprintf("%.1f s", d.Seconds())
+			}
+			return fmt.Sprintf("%d ms", d.Milliseconds())
+		},
+		// trashExpiry to chwila, w której demon usunie wpis z kosza na dobre
+		"trashExpiry": func(deletedAt int64) int64 {
+			return time.Unix(deletedAt, 0).AddDate(0, 0, cfg.TrashRetentionDays).Unix()
+		},
 		"formatDate": func(ts int64) string {
 			if ts == 0 {
 				return "-"
@@ -105,12 +124,17 @@ func NewAdminHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem,
 		db:                db,
 		fs:                fs,
 		traffic:           traffic,
+		processor:         processor,
+		scrubber:          scrubber,
 		dashboardTmpl:     parseAdmin("dashboard", "templates/admin/dashboard.html"),
 		usersTmpl:         parseAdmin("users", "templates/admin/users.html"),
 		userDetailTmpl:    parseAdmin("user_detail", "templates/admin/user_detail.html"),
 		galleriesTmpl:     parseAdmin("galleries", "templates/admin/galleries.html"),
 		galleryDetailTmpl: parseAdmin("gallery_detail", "templates/admin/gallery_detail.html"),
 		imagesTmpl:        parseAdmin("images", "templates/admin/images.html"),
+		duplicatesTmpl:    parseAdmin("duplicates", "templates/admin/duplicates.html"),
+		integrityTmpl:     parseAdmin("integrity", "templates/admin/integrity.html"),
+		trashTmpl:         parseAdmin("trash", "templates/admin/trash.html"),
 		logsTmpl:          parseAdmin("logs", "templates/admin/logs.html"),
 	}
 }
@@ -129,6 +153,13 @@ func (h *AdminHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 		"Stats":   stats,
 		"Traffic": traffic,
 	}
+	if pool := h.processor.Pool(); pool != nil {
+		data["Processing"] = pool.Stats()
+	}
+	if counts, err := h.db.CountImagesByStatus(); err == nil {
+		data["PendingImages"] = counts[storage.ImageStatusPending]
+		data["FailedImages"] = counts[storage.ImageStatusFailed]
+	}
 	h.dashboardTmpl.ExecuteTemplate(w, "dashboard.html", data)
 }
 
@@ -319,11 +350,15 @@ func (h *AdminHandler) DeleteGallery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.db.TrashGallery(id, adminDeletedBy(r)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 	images, _ := h.db.GetImagesByGallery(id)
-	h.db.DeleteGalleryByID(id)
-
 	for _, img := range images {
-		h.fs.Delete(img.Slug)
+		if err := h.fs.Trash(img.Slug); err != nil {
+			logging.Get("admin").Printf("admin.DeleteGallery: trash files slug=%s: %v", img.Slug, err)
+		}
 	}
 
 	http.Redirect(w, r, "/admin/galleries", http.StatusSeeOther)
@@ -341,14 +376,20 @@ func (h *AdminHandler) Images(w http.ResponseWriter, r *http.Request) {
 		dir = "desc"
 	}
 	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	status := r.URL.Query().Get("status")
+	switch status {
+	case storage.ImageStatusPending, storage.ImageStatusReady, storage.ImageStatusFailed:
+	default:
+		status = ""
+	}
 
-	total, err := h.db.CountImagesAdminFiltered(query)
+	total, err := h.db.CountImagesAdminFiltered(query, status)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	totalPages, page, offset, pages := paginateAdmin(total, page, limit)
-	images, err := h.db.ListImagesAdminSortedFiltered(limit, offset, sortBy, dir, query)
+	images, err := h.db.ListImagesAdminSortedFiltered(limit, offset, sortBy, dir, query, status)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -372,7 +413,7 @@ func (h *AdminHandler) Images(w http.ResponseWriter, r *http.Request) {
 				nextDir = "asc"
 			}
 		}
-		return fmt.Sprintf("/admin/images?page=1&limit=%d&sort=%s&dir=%s&q=%s", limit, field, nextDir, url.QueryEscape(query))
+		return fmt.Sprintf("/admin/images?page=1&limit=%d&sort=%s&dir=%s&q=%s&status=%s", limit, field, nextDir, url.QueryEscape(query), status)
 	}
 
 	data := map[string]any{
@@ -389,6 +430,7 @@ func (h *AdminHandler) Images(w http.ResponseWriter, r *http.Request) {
 		"Sort":       sortBy,
 		"Dir":        dir,
 		"Query":      query,
+		"Status":     status,
 		"SortLinks": map[string]string{
 			"downloads": sortLink("downloads"),
 			"accessed":  sortLink("accessed"),
@@ -408,11 +450,291 @@ func (h *AdminHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 
 	img, err := h.db.GetImageByID(id)
 	if err == nil && img != nil {
-		h.db.DeleteImageByID(id)
-		h.fs.Delete(img.Slug)
+		if err := h.trashImage(r, img); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	target := "/admin/images"
+	if back := r.FormValue("return"); strings.HasPrefix(back, "/admin/") {
+		target = back
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// trashImage przenosi zdjęcie do kosza jako usunięte przez admina
+func (h *AdminHandler) trashImage(r *http.Request, img *storage.Image) error {
+	if err := h.db.TrashImage(img.Slug, adminDeletedBy(r)); err != nil {
+		return err
+	}
+	if err := h.fs.Trash(img.Slug); err != nil {
+		logging.Get("admin").Printf("admin: trash files slug=%s: %v", img.Slug, err)
+	}
+	return nil
+}
+
+// RetryImage ponawia przetwarzanie obrazu, którego warianty nie powstały
+func (h *AdminHandler) RetryImage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+	ref, err := h.db.GetImageByID(id)
+	if err != nil || ref == nil {
+		http.NotFound(w, r)
+		return
+	}
+	img, err := h.db.GetImageBySlug(ref.Slug)
+	if err != nil || img == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := retryProcessing(h.db, h.fs, h.processor, img); err != nil {
+		logging.Get("processing").Printf("admin retry %s: %v", img.Slug, err)
+		switch {
+		case errors.Is(err, errNotFailed):
+			http.Error(w, "Image has not failed", http.StatusConflict)
+		case errors.Is(err, image.ErrQueueFull):
+			http.Error(w, "Processing queue is full, try again later", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "Retry failed: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	target := "/admin/images?status=" + storage.ImageStatusPending
+	if back := r.FormValue("return"); strings.HasPrefix(back, "/admin/") {
+		target = back
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (h *AdminHandler) Duplicates(w http.ResponseWriter, r *http.Request) {
+	maxDistance := h.cfg.DedupMaxDistance
+	clusters, err := h.db.GetDuplicateClusters(maxDistance)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	redundant := 0
+	for _, c := range clusters {
+		redundant += len(c) - 1
+	}
+
+	data := map[string]any{
+		"Clusters":    clusters,
+		"Redundant":   redundant,
+		"MaxDistance": max(maxDistance, 0),
+	}
+	h.duplicatesTmpl.ExecuteTemplate(w, "duplicates.html", data)
+}
+
+// ResolveDuplicates rozwiązuje grupę duplikatów: zostawia zdjęcie keep,
+// a pozostałe z formularza (trash) przenosi do kosza, skąd można je
+// jeszcze przywrócić
+func (h *AdminHandler) ResolveDuplicates(w http.ResponseWriter, r *http.Request) {
+	keep, err := strconv.ParseInt(r.FormValue("keep"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+	if img, err := h.db.GetImageByID(keep); err != nil || img == nil {
+		http.Error(w, "kept image not found", http.StatusNotFound)
+		return
+	}
+
+	for _, value := range r.Form["trash"] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id == keep {
+			continue
+		}
+		img, err := h.db.GetImageByID(id)
+		if err != nil || img == nil {
+			continue
+		}
+		if err := h.trashImage(r, img); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	http.Redirect(w, r, "/admin/duplicates", http.StatusSeeOther)
+}
+
+// scrubProblemLabels opisuje rodzaje problemów ze skanowania integralności
+var scrubProblemLabels = map[string]string{
+	cleanup.ProblemMissing:     "brak pliku",
+	cleanup.ProblemUnreadable:  "błąd odczytu",
+	cleanup.ProblemChecksum:    "suma kontrolna",
+	cleanup.ProblemCorrupt:     "uszkodzony",
+	cleanup.ProblemOrphan:      "bez wpisu",
+	cleanup.ProblemOrphanBlob:  "blob bez wpisu",
+	cleanup.ProblemMissingBlob: "brak bloba",
+}
+
+// Integrity pokazuje ostatni raport skanowania magazynu i oznaczone zdjęcia
+func (h *AdminHandler) Integrity(w http.ResponseWriter, r *http.Request) {
+	if h.scrubber == nil {
+		http.NotFound(w, r)
+		return
+	}
+	flagged, err := h.db.GetFlaggedImages(500)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	data := map[string]any{
+		"Report":  h.scrubber.Last(),
+		"Running": h.scrubber.Running(),
+		"Busy":    r.URL.Query().Get("busy") != "",
+		"Flagged": flagged,
+		"Kinds":   scrubProblemLabels,
+	}
+	h.integrityTmpl.ExecuteTemplate(w, "integrity.html", data)
+}
+
+// StartScrub uruchamia skanowanie w tle z wybranymi naprawami
+func (h *AdminHandler) StartScrub(w http.ResponseWriter, r *http.Request) {
+	if h.scrubber == nil {
+		http.NotFound(w, r)
+		return
+	}
+	opts := cleanup.RepairOptions{
+		Regenerate:    r.FormValue("regenerate") != "",
+		DeleteOrphans: r.FormValue("orphans") != "",
+		Flag:          r.FormValue("flag") != "",
+	}
+	target := "/admin/integrity"
+	if !h.scrubber.Start(opts) {
+		target += "?busy=1"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// adminDeletedBy to deleted_by wpisów przeniesionych do kosza przez admina
+func adminDeletedBy(r *http.Request) string {
+	if user := middleware.GetUser(r); user != nil {
+		return "admin:" + user.DisplayName
+	}
+	return "admin"
+}
+
+// Trash pokazuje usunięte galerie i zdjęcia, które można jeszcze przywrócić
+func (h *AdminHandler) Trash(w http.ResponseWriter, r *http.Request) {
+	galleries, err := h.db.ListTrashedGalleries(500)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	images, err := h.db.ListTrashedImages(500)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	data := map[string]any{
+		"Galleries":     galleries,
+		"Images":        images,
+		"RetentionDays": h.cfg.TrashRetentionDays,
+	}
+	h.trashTmpl.ExecuteTemplate(w, "trash.html", data)
+}
+
+// RestoreImage przywraca zdjęcie z kosza razem z plikami
+func (h *AdminHandler) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+	img, err := h.db.GetImageByID(id)
+	if err != nil || img == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// zdjęcie z galerii w koszu wraca tylko razem z galerią
+	if err := h.db.RestoreImage(img.Slug); err != nil && !errors.Is(err, storage.ErrNotInTrash) {
+		http.Error(w, err.Error(), 500)
+		return
+	} else if err == nil {
+		if err := h.fs.Untrash(img.Slug); err != nil {
+			logging.Get("admin").Printf("admin.RestoreImage: restore files slug=%s: %v", img.Slug, err)
+		}
+	}
+	http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+}
+
+// PurgeImage usuwa zdjęcie z kosza na dobre, nie czekając na demona
+func (h *AdminHandler) PurgeImage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+	img, err := h.db.GetImageByID(id)
+	if err != nil || img == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if trashed, err := h.db.ImageTrashed(img.Slug); err != nil || !trashed {
+		http.NotFound(w, r)
+		return
 	}
 
-	http.Redirect(w, r, "/admin/images", http.StatusSeeOther)
+	if err := h.fs.PurgeImage(img.Slug); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+}
+
+// RestoreGallery przywraca galerię ze zdjęciami usuniętymi razem z nią
+func (h *AdminHandler) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+
+	slugs, err := h.db.RestoreGallery(id)
+	if errors.Is(err, storage.ErrNotInTrash) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, slug := range slugs {
+		if err := h.fs.Untrash(slug); err != nil {
+			logging.Get("admin").Printf("admin.RestoreGallery: restore files slug=%s: %v", slug, err)
+		}
+	}
+	http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+}
+
+// PurgeGallery usuwa galerię z kosza na dobre, ze wszystkimi zdjęciami
+func (h *AdminHandler) PurgeGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", 400)
+		return
+	}
+	if g, err := h.db.GetTrashedGallery(id); err != nil || g == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.fs.PurgeGallery(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
 }
 
 func (h *AdminHandler) Logs(w http.ResponseWriter, r *http.Request) {
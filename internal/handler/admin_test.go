@@ -3,11 +3,14 @@ package handler
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"dajtu/internal/cleanup"
+	"dajtu/internal/image"
 	"dajtu/internal/middleware"
 	"dajtu/internal/storage"
 	"dajtu/internal/testutil"
@@ -16,10 +19,13 @@ import (
 func testAdminSetup(t *testing.T) (*storage.DB, *storage.Filesystem, *AdminHandler) {
 	t.Helper()
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 	cfg := testutil.TestConfig(t)
 	traffic := middleware.NewTrafficStats()
-	return db, fs, NewAdminHandler(cfg, db, fs, traffic)
+	pool := image.NewPool(1, 4, 0)
+	t.Cleanup(pool.Close)
+	processor := image.NewPooledProcessor(pool)
+	return db, fs, NewAdminHandler(cfg, db, fs, traffic, processor, cleanup.NewScrubber(db, fs, processor))
 }
 
 func seedAdminData(t *testing.T, db *storage.DB) (*storage.User, *storage.Gallery, *storage.Image) {
@@ -90,6 +96,9 @@ func TestAdminHandler_Dashboard(t *testing.T) {
 	if !strings.Contains(rec.Body.String(), "Dashboard") {
 		t.Errorf("expected dashboard content")
 	}
+	if !strings.Contains(rec.Body.String(), "Przetwarzanie obrazów") || !strings.Contains(rec.Body.String(), "0 / 4") {
+		t.Errorf("expected processing queue stats")
+	}
 }
 
 func TestAdminHandler_Users(t *testing.T) {
@@ -208,8 +217,11 @@ func TestAdminHandler_DeleteGallery(t *testing.T) {
 	if got, _ := db.GetGalleryByID(gallery.ID); got != nil {
 		t.Fatalf("gallery still exists after delete")
 	}
-	if fs.Exists(image.Slug) {
-		t.Errorf("image files still exist after delete")
+	if trashed, _ := db.ImageTrashed(image.Slug); !trashed {
+		t.Errorf("image of the gallery not moved to the trash")
+	}
+	if !fs.Exists(image.Slug) {
+		t.Errorf("image files deleted before the trash expired")
 	}
 }
 
@@ -230,11 +242,252 @@ func TestAdminHandler_DeleteImage(t *testing.T) {
 	if rec.Code != http.StatusSeeOther {
 		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
 	}
-	if got, _ := db.GetImageByID(image.ID); got != nil {
+	if got, _ := db.GetImageBySlug(image.Slug); got != nil {
 		t.Fatalf("image still exists after delete")
 	}
+	trash, _ := db.ListTrashedImages(10)
+	if len(trash) != 1 || trash[0].DeletedBy != "admin" {
+		t.Fatalf("trash = %+v, want the image deleted by an admin", trash)
+	}
+	if !fs.Exists(image.Slug) {
+		t.Errorf("image files deleted before the trash expired")
+	}
+}
+
+func TestAdminHandler_TrashRestoreImage(t *testing.T) {
+	db, fs, h := testAdminSetup(t)
+	_, _, image := seedAdminData(t, db)
+	legacy := fs.Key(image.Slug, "thumb")
+	fs.Store().Put(legacy, []byte("legacy"))
+
+	req := httptest.NewRequest("POST", "/admin/images/delete", nil)
+	req.SetPathValue("id", int64ToString(t, image.ID))
+	h.DeleteImage(httptest.NewRecorder(), req)
+	if _, err := fs.Store().Stat(legacy); err == nil {
+		t.Fatal("legacy file not moved to the trash area")
+	}
+
+	rec := httptest.NewRecorder()
+	h.Trash(rec, httptest.NewRequest("GET", "/admin/trash", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), image.OriginalName) {
+		t.Fatalf("trash page = %d, want the deleted image listed", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/admin/trash/images/restore", nil)
+	req.SetPathValue("id", int64ToString(t, image.ID))
+	rec = httptest.NewRecorder()
+	h.RestoreImage(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if got, _ := db.GetImageBySlug(image.Slug); got == nil {
+		t.Fatal("image not restored")
+	}
+	if data, err := fs.Read(legacy); err != nil || string(data) != "legacy" {
+		t.Errorf("restored file = %q, %v", data, err)
+	}
+}
+
+func TestAdminHandler_PurgeImage(t *testing.T) {
+	db, fs, h := testAdminSetup(t)
+	_, _, image := seedAdminData(t, db)
+	fs.Save(image.Slug, "original", []byte("data"))
+
+	// only trashed images can be purged
+	req := httptest.NewRequest("POST", "/admin/trash/images/purge", nil)
+	req.SetPathValue("id", int64ToString(t, image.ID))
+	rec := httptest.NewRecorder()
+	h.PurgeImage(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("purge of a live image: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	db.TrashImage(image.Slug, "admin")
+	rec = httptest.NewRecorder()
+	h.PurgeImage(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if exists, _ := db.SlugExists("images", image.Slug); exists {
+		t.Error("image row left after purge")
+	}
 	if fs.Exists(image.Slug) {
-		t.Errorf("image files still exist after delete")
+		t.Error("image files left after purge")
+	}
+}
+
+func TestAdminHandler_TrashGallery(t *testing.T) {
+	db, fs, h := testAdminSetup(t)
+	_, gallery, image := seedAdminData(t, db)
+	fs.Save(image.Slug, "original", []byte("data"))
+
+	req := httptest.NewRequest("POST", "/admin/galleries/delete", nil)
+	req.SetPathValue("id", int64ToString(t, gallery.ID))
+	h.DeleteGallery(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	h.Trash(rec, httptest.NewRequest("GET", "/admin/trash", nil))
+	if !strings.Contains(rec.Body.String(), gallery.Title) {
+		t.Fatal("trash page does not list the gallery")
+	}
+
+	req = httptest.NewRequest("POST", "/admin/trash/galleries/restore", nil)
+	req.SetPathValue("id", int64ToString(t, gallery.ID))
+	rec = httptest.NewRecorder()
+	h.RestoreGallery(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if got, _ := db.GetGalleryByID(gallery.ID); got == nil {
+		t.Fatal("gallery not restored")
+	}
+	if got, _ := db.GetImageBySlug(image.Slug); got == nil {
+		t.Fatal("image not restored with its gallery")
+	}
+
+	// restoring twice is not found, purging a live gallery too
+	rec = httptest.NewRecorder()
+	h.RestoreGallery(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("second restore: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	rec = httptest.NewRecorder()
+	h.PurgeGallery(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("purge of a live gallery: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	db.TrashGallery(gallery.ID, "admin")
+	rec = httptest.NewRecorder()
+	h.PurgeGallery(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if exists, _ := db.SlugExists("galleries", gallery.Slug); exists {
+		t.Error("gallery row left after purge")
+	}
+	if fs.Exists(image.Slug) {
+		t.Error("image files left after purge")
+	}
+}
+
+func TestAdminHandler_Duplicates(t *testing.T) {
+	db, _, h := testAdminSetup(t)
+
+	now := time.Now().Unix()
+	for i, slug := range []string{"meme1", "meme2", "other"} {
+		hash, sha := uint64(0xABCD), "same"
+		if slug == "other" {
+			hash, sha = 0x1234567890, "unique"
+		}
+		db.InsertImage(&storage.Image{Slug: slug, OriginalName: slug + ".jpg", MimeType: "image/jpeg",
+			PHash: hash, PixelSHA: sha, CreatedAt: now + int64(i), AccessedAt: now})
+	}
+
+	req := httptest.NewRequest("GET", "/admin/duplicates", nil)
+	rec := httptest.NewRecorder()
+
+	h.Duplicates(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"meme1.jpg", "meme2.jpg", "identyczne piksele", "1 zbędnych kopii"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in response", want)
+		}
+	}
+	if strings.Contains(body, "other.jpg") {
+		t.Errorf("unique image should not be listed")
+	}
+}
+
+func TestAdminHandler_ResolveDuplicates(t *testing.T) {
+	db, _, h := testAdminSetup(t)
+	now := time.Now().Unix()
+	ids := map[string]int64{}
+	for i, slug := range []string{"meme1", "meme2", "meme3"} {
+		ids[slug], _ = db.InsertImage(&storage.Image{Slug: slug, MimeType: "image/jpeg",
+			PHash: 0xABCD, PixelSHA: "same", CreatedAt: now + int64(i), AccessedAt: now})
+	}
+
+	form := url.Values{
+		"keep":  {int64ToString(t, ids["meme1"])},
+		"trash": {int64ToString(t, ids["meme1"]), int64ToString(t, ids["meme2"]), int64ToString(t, ids["meme3"])},
+	}
+	req := httptest.NewRequest("POST", "/admin/duplicates/resolve", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ResolveDuplicates(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if img, _ := db.GetImageBySlug("meme1"); img == nil {
+		t.Error("kept image trashed")
+	}
+	trash, _ := db.ListTrashedImages(10)
+	if len(trash) != 2 {
+		t.Errorf("trash = %+v, want meme2 and meme3", trash)
+	}
+	if clusters, _ := db.GetDuplicateClusters(4); len(clusters) != 0 {
+		t.Errorf("clusters after resolve = %d, want 0", len(clusters))
+	}
+}
+
+func TestAdminHandler_Integrity(t *testing.T) {
+	db, fs, h := testAdminSetup(t)
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "lost1", OriginalName: "lost.jpg", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("lost1", "thumb", testutil.SampleWebP())
+
+	rec := httptest.NewRecorder()
+	h.Integrity(rec, httptest.NewRequest("GET", "/admin/integrity", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "nie było jeszcze uruchamiane") {
+		t.Fatalf("before a scrub: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest("POST", "/admin/integrity/scrub", strings.NewReader("flag=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.StartScrub(rec, req)
+	if rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), "/admin/integrity") {
+		t.Fatalf("StartScrub() = %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for (h.scrubber.Last() == nil || h.scrubber.Running()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec = httptest.NewRecorder()
+	h.Integrity(rec, httptest.NewRequest("GET", "/admin/integrity", nil))
+	body := rec.Body.String()
+	for _, want := range []string{"brak pliku", "lo/lost1/original.webp", "Oznaczone zdjęcia (1)", "original.webp: missing"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in response", want)
+		}
+	}
+}
+
+func TestAdminHandler_DeleteImage_Return(t *testing.T) {
+	db, _, h := testAdminSetup(t)
+	_, _, image := seedAdminData(t, db)
+
+	for _, tt := range []struct{ back, want string }{
+		{"/admin/duplicates", "/admin/duplicates"},
+		{"https://evil.example/", "/admin/images"},
+	} {
+		req := httptest.NewRequest("POST", "/admin/images/delete", strings.NewReader("return="+tt.back))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetPathValue("id", int64ToString(t, image.ID))
+		rec := httptest.NewRecorder()
+
+		h.DeleteImage(rec, req)
+
+		if got := rec.Header().Get("Location"); got != tt.want {
+			t.Errorf("return=%q: Location = %q, want %q", tt.back, got, tt.want)
+		}
 	}
 }
 
@@ -27,11 +27,14 @@ func NewBratUploadHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesy
 }
 
 type BratUploadResponse struct {
-	URL      string `json:"url"`
-	ViewURL  string `json:"view_url"`
-	ThumbURL string `json:"thumbUrl"`
-	Filename string `json:"filename"`
-	Slug     string `json:"slug"`
+	URL       string                 `json:"url"`
+	ViewURL   string                 `json:"view_url"`
+	ThumbURL  string                 `json:"thumbUrl"`
+	Filename  string                 `json:"filename"`
+	Slug      string                 `json:"slug"`
+	Metadata  *storage.ImageMetadata `json:"metadata,omitempty"`
+	Embed     EmbedCodes             `json:"embed"`
+	Duplicate bool                   `json:"duplicate,omitempty"`
 }
 
 func (h *BratUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -115,6 +118,14 @@ func (h *BratUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "validation error", http.StatusBadRequest)
 		return
 	}
+	if err := image.CheckDimensions(data, imageLimits(h.cfg)); err != nil {
+		if err == image.ErrImageTooLarge {
+			jsonError(w, imageTooLargeMessage(h.cfg), http.StatusRequestEntityTooLarge)
+			return
+		}
+		jsonError(w, "invalid image format", http.StatusBadRequest)
+		return
+	}
 
 	dbUser, err := h.db.GetOrCreateBratUser(user.Pseudonim)
 	if err != nil {
@@ -131,6 +142,8 @@ func (h *BratUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	slug := h.db.GenerateUniqueSlug("images", 5)
+	// Pliki powstają przed rekordem; scrubber nie może ich wziąć za sieroty
+	defer h.fs.Claim(slug)()
 
 	var originalSize int64
 	if h.cfg.KeepOriginalFormat {
@@ -142,45 +155,70 @@ func (h *BratUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	results, err := h.processor.ProcessWithTransform(data, image.TransformParams{})
+	wm, watermarkKey := imageWatermark(h.db, &gallery.ID, &dbUser.ID)
+	results, err := h.processor.ProcessUpload(r.Context(), data, image.TransformParams{Watermark: wm})
 	if err != nil {
 		logging.Get("brat").Printf("process error: %v", err)
 		h.fs.Delete(slug)
+		if ProcessingBusy(w, h.processor, err) {
+			return
+		}
 		jsonError(w, "image processing failed", http.StatusInternalServerError)
 		return
 	}
 
+	fingerprint := imageFingerprint(results)
+	if dup := findDuplicate(h.cfg, h.db, fingerprint, &dbUser.ID); dup != nil {
+		h.fs.Delete(slug)
+		logging.Get("brat").Printf("duplicate of %s, discarding %s", dup.Slug, slug)
+
+		baseURL := getBaseURL(h.cfg, r)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BratUploadResponse{
+			URL:       buildImageURL(baseURL, dup.Slug, "1200"),
+			ViewURL:   baseURL + "/i/" + dup.Slug,
+			ThumbURL:  buildImageURL(baseURL, dup.Slug, "thumb"),
+			Filename:  header.Filename,
+			Slug:      dup.Slug,
+			Embed:     buildEmbedCodes(baseURL, dup, embedSize),
+			Duplicate: true,
+		})
+		return
+	}
+
 	totalSize := originalSize
 	for _, res := range results {
-		if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-			logging.Get("brat").Printf("save error: %v", err)
-			h.fs.Delete(slug)
-			jsonError(w, "save failed", http.StatusInternalServerError)
-			return
-		}
 		totalSize += int64(len(res.Data))
 	}
 
 	now := time.Now().Unix()
+	placeholder := imagePlaceholder(results)
 	img := &storage.Image{
-		Slug:         slug,
-		OriginalName: header.Filename,
-		MimeType:     string(format),
-		FileSize:     totalSize,
-		Width:        results[0].Width,
-		Height:       results[0].Height,
-		UserID:       &dbUser.ID,
-		GalleryID:    &gallery.ID,
-		CreatedAt:    now,
-		AccessedAt:   now,
-	}
-
-	if _, err := h.db.InsertImage(img); err != nil {
-		logging.Get("brat").Printf("insert image error: %v", err)
-		h.fs.Delete(slug)
-		jsonError(w, "database error", http.StatusInternalServerError)
+		Slug:          slug,
+		OriginalName:  header.Filename,
+		MimeType:      string(format),
+		FileSize:      totalSize,
+		Width:         results[0].Width,
+		Height:        results[0].Height,
+		Frames:        results[0].Frames,
+		UserID:        &dbUser.ID,
+		GalleryID:     &gallery.ID,
+		CreatedAt:     now,
+		AccessedAt:    now,
+		LQIP:          placeholder.LQIP,
+		DominantColor: placeholder.Color,
+		PHash:         fingerprint.DHash,
+		PixelSHA:      fingerprint.PixelHash,
+		WatermarkKey:  watermarkKey,
+	}
+
+	imageID, err := storeImage(h.db, h.fs, img, results)
+	if err != nil {
+		logging.Get("brat").Printf("store image error: %v", err)
+		jsonError(w, "save failed", http.StatusInternalServerError)
 		return
 	}
+	metadata := saveImageMetadata(h.db, imageID, image.ExtractMetadata(data), r.FormValue("keep_gps") == "true")
 
 	baseURL := getBaseURL(h.cfg, r)
 
@@ -190,6 +228,8 @@ func (h *BratUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ThumbURL: buildImageURL(baseURL, slug, "thumb"),
 		Filename: header.Filename,
 		Slug:     slug,
+		Metadata: metadata,
+		Embed:    buildEmbedCodes(baseURL, img, embedSize),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -2,12 +2,19 @@ package handler
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"dajtu/internal/auth"
 	"dajtu/internal/testutil"
@@ -16,7 +23,7 @@ import (
 func TestBratUpload_InvalidToken(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -58,7 +65,7 @@ func TestBratUpload_InvalidToken(t *testing.T) {
 func TestBratUpload_MissingImage(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -92,7 +99,7 @@ func TestBratUpload_MissingImage(t *testing.T) {
 func TestBratUpload_InvalidPath(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -135,7 +142,7 @@ func TestBratUpload_InvalidPath(t *testing.T) {
 func TestBratUpload_CORSHeaders(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -187,7 +194,7 @@ func TestBratUpload_CORSHeaders(t *testing.T) {
 func TestBratUpload_CORSHeaders_InvalidOrigin(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -217,7 +224,7 @@ func TestBratUpload_CORSHeaders_InvalidOrigin(t *testing.T) {
 func TestBratUpload_OptionsRequest(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -251,7 +258,7 @@ func TestBratUpload_OptionsRequest(t *testing.T) {
 func TestBratUpload_DecoderNil(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	h := NewBratUploadHandler(cfg, db, fs, nil, nil)
 
@@ -298,7 +305,7 @@ func TestBratUpload_TitleDecoding(t *testing.T) {
 func TestBratUpload_MethodNotAllowed(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -326,7 +333,7 @@ func TestBratUpload_MethodNotAllowed(t *testing.T) {
 func TestBratUpload_InvalidImageFormat(t *testing.T) {
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 
 	decoder, _ := auth.NewBratDecoder(auth.BratConfig{
 		HashSecret:        "test",
@@ -377,3 +384,68 @@ func TestBratUpload_GenerateFunctions(t *testing.T) {
 		t.Errorf("token length = %d, want 32", len(token))
 	}
 }
+
+func TestBratUpload_AnimationTooLarge(t *testing.T) {
+	cfg := testutil.TestConfig(t)
+	cfg.MaxImageMegapixels = 1
+	db, _ := testutil.TestDB(t)
+	fs, _ := testutil.TestFilesystem(t, db)
+
+	bratCfg := auth.BratConfig{
+		HashSecret:        "test",
+		EncryptionKey:     "testkey",
+		EncryptionIV:      "1234567890123456",
+		Cipher:            "AES-256-CBC",
+		MaxSkewSeconds:    3600,
+		HashLength:        16,
+		HashBytes:         8,
+		MaxPseudonimBytes: 64,
+	}
+	decoder, _ := auth.NewBratDecoder(bratCfg)
+
+	h := NewBratUploadHandler(cfg, db, fs, decoder, nil)
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("image", "frames.gif")
+	part.Write(testutil.AnimatedGIF(500, 500, 10))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/brtup/"+bratToken(t, bratCfg, "tester")+"/123/nope", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// bratToken szyfruje payload SSO tak jak robi to forum
+func bratToken(t *testing.T, cfg auth.BratConfig, pseudonim string) string {
+	t.Helper()
+
+	ts := uint32(time.Now().Unix())
+	payload := binary.BigEndian.AppendUint32(nil, ts)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = append(payload, byte(len(pseudonim)))
+	payload = append(payload, pseudonim...)
+
+	mac := hmac.New(sha256.New, []byte(cfg.HashSecret))
+	fmt.Fprintf(mac, "%d|%d|%s", ts, 0, pseudonim)
+	payload = append(payload, mac.Sum(nil)[:cfg.HashBytes]...)
+
+	padLen := aes.BlockSize - len(payload)%aes.BlockSize
+	payload = append(payload, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+
+	key := sha256.Sum256([]byte(cfg.EncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatalf("NewCipher error: %v", err)
+	}
+	ciphertext := make([]byte, len(payload))
+	cipher.NewCBCEncrypter(block, []byte(cfg.EncryptionIV)).CryptBlocks(ciphertext, payload)
+
+	return base64.RawURLEncoding.EncodeToString(ciphertext)
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"archive/zip"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"dajtu/internal/logging"
+	"dajtu/internal/storage"
+)
+
+// maxZipNameRunes ogranicza długość nazwy pliku w archiwum (bez rozszerzenia)
+const maxZipNameRunes = 100
+
+// Download obsługuje GET /g/{slug}/download.zip: strumieniuje ZIP ze
+// wszystkimi gotowymi obrazami galerii. Bierzemy zachowany upload (orig_*),
+// a gdy go nie ma albo obraz jest edytowany lub ze znakiem wodnym, publiczny
+// original.webp. Pliki są już skompresowane, więc idą bez deflate.
+func (h *GalleryHandler) Download(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gallerySlug := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/g/"), "/download.zip")
+	if gallerySlug == "" || strings.Contains(gallerySlug, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := h.db.GetGalleryBySlug(gallerySlug)
+	if err != nil || gallery == nil {
+		galleryNotFound(w, r, h.db, gallerySlug)
+		return
+	}
+	images, err := h.db.GetGalleryImages(gallery.ID)
+	if err != nil {
+		http.Error(w, "error loading images", http.StatusInternalServerError)
+		return
+	}
+
+	archiveName := zipEntryName(gallery.Title, gallery.Slug) + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Nagłówki już poszły, więc błąd w trakcie tylko przerywa archiwum;
+	// klient dostaje niekompletny ZIP, którego nie da się otworzyć
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	written := 0
+	for _, img := range images {
+		if r.Context().Err() != nil {
+			return
+		}
+		if img.Status != "" && img.Status != storage.ImageStatusReady {
+			continue
+		}
+		key := h.zipSourceKey(img)
+		b, err := h.fs.Open(key)
+		if err != nil {
+			continue
+		}
+		name := uniqueZipName(names, zipImageName(img), strings.ToLower(path.Ext(key)))
+		err = addZipFile(zw, b, name, imageModTime(img))
+		b.Close()
+		if err != nil {
+			logging.Get("gallery").Printf("gallery.Download: slug=%s image=%s: %v", gallery.Slug, img.Slug, err)
+			return
+		}
+		written++
+	}
+	if err := zw.Close(); err != nil {
+		logging.Get("gallery").Printf("gallery.Download: slug=%s: %v", gallery.Slug, err)
+		return
+	}
+	logging.Get("gallery").Printf("gallery.Download: slug=%s files=%d", gallery.Slug, written)
+}
+
+// zipSourceKey wybiera plik obrazu do archiwum, tak jak ServeOriginal dla
+// kogoś bez prawa edycji
+func (h *GalleryHandler) zipSourceKey(img *storage.Image) string {
+	if img.WatermarkKey == "" && !img.Edited {
+		if key, err := h.fs.OriginalKey(img.Slug, "original"); err == nil {
+			return key
+		}
+	}
+	return h.fs.Key(img.Slug, "original")
+}
+
+func addZipFile(zw *zip.Writer, src io.Reader, name string, modified time.Time) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, src)
+	return err
+}
+
+// zipImageName to nazwa obrazu w archiwum bez rozszerzenia: nazwa
+// uploadu bez katalogów i rozszerzenia, a gdy jej nie ma, slug
+func zipImageName(img *storage.Image) string {
+	name := strings.ReplaceAll(img.OriginalName, "\\", "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	return zipEntryName(strings.TrimSuffix(name, path.Ext(name)), img.Slug)
+}
+
+// zipEntryName robi z nazwy od użytkownika bezpieczną nazwę pliku: bez
+// znaków sterujących, separatorów i znaków zakazanych w Windows; pusta
+// nazwa zamienia się w fallback
+func zipEntryName(name, fallback string) string {
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) || strings.ContainsRune(`<>:"/\|?*`, c) {
+			return '_'
+		}
+		return c
+	}, name)
+	if runes := []rune(name); len(runes) > maxZipNameRunes {
+		name = string(runes[:maxZipNameRunes])
+	}
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// uniqueZipName dokleja " (2)", " (3)"… do powtórzonych nazw; porównanie
+// ignoruje wielkość liter, bo tak rozpakowuje Windows i macOS
+func uniqueZipName(used map[string]bool, base, ext string) string {
+	name := base + ext
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		name = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
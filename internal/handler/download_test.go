@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/storage"
+)
+
+func TestGalleryHandler_Download(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "zipme", EditToken: "tok", Title: "Wakacje: 2024", CreatedAt: now, UpdatedAt: now})
+
+	images := []struct {
+		img  storage.Image
+		orig []byte // zachowany upload (orig_*.jpg)
+		webp []byte
+	}{
+		{storage.Image{Slug: "zip01", OriginalName: "photo.jpg"}, []byte("orig-1"), []byte("webp-1")},
+		{storage.Image{Slug: "zip02", OriginalName: "PHOTO.jpeg"}, []byte("orig-2"), []byte("webp-2")},
+		{storage.Image{Slug: "zip03", OriginalName: "marked.jpg", WatermarkKey: "wm"}, []byte("orig-3"), []byte("webp-3")},
+		{storage.Image{Slug: "zip04", OriginalName: `C:\Users\x\..\trip.png`}, nil, []byte("webp-4")},
+		{storage.Image{Slug: "zip05", OriginalName: ""}, nil, []byte("webp-5")},
+		{storage.Image{Slug: "zip06", OriginalName: "wait.jpg", Status: storage.ImageStatusPending}, nil, nil},
+		{storage.Image{Slug: "zip07", OriginalName: "gone.jpg"}, nil, nil},
+	}
+	for i, tt := range images {
+		img := tt.img
+		img.MimeType = "image/jpeg"
+		img.GalleryID = &galleryID
+		img.CreatedAt = now + int64(i)
+		img.AccessedAt = now
+		if _, err := db.InsertImage(&img); err != nil {
+			t.Fatalf("InsertImage(%s) error = %v", img.Slug, err)
+		}
+		if tt.orig != nil {
+			fs.SaveOriginal(img.Slug, "original", tt.orig, "image/jpeg")
+		}
+		if tt.webp != nil {
+			fs.Save(img.Slug, "original", tt.webp)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.Download(rec, httptest.NewRequest("GET", "/g/zipme/download.zip", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="Wakacje_ 2024.zip"` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("read zip: %v", err)
+	}
+	want := []struct{ name, content string }{
+		{"photo.jpg", "orig-1"},
+		{"PHOTO (2).jpg", "orig-2"},
+		{"marked.webp", "webp-3"},
+		{"trip.webp", "webp-4"},
+		{"zip05.webp", "webp-5"},
+	}
+	if len(zr.File) != len(want) {
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		t.Fatalf("zip entries = %q, want %d", names, len(want))
+	}
+	for i, f := range zr.File {
+		if f.Name != want[i].name {
+			t.Errorf("entry %d = %q, want %q", i, f.Name, want[i].name)
+		}
+		if f.Method != zip.Store {
+			t.Errorf("%s: method = %d, want store", f.Name, f.Method)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != want[i].content {
+			t.Errorf("%s = %q, want %q", f.Name, data, want[i].content)
+		}
+	}
+}
+
+func TestGalleryHandler_Download_Errors(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+	now := time.Now().Unix()
+	db.InsertGallery(&storage.Gallery{Slug: "empty", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/g/nope/download.zip", http.StatusNotFound},
+		{"GET", "/g/a/b/download.zip", http.StatusNotFound},
+		{"POST", "/g/empty/download.zip", http.StatusMethodNotAllowed},
+		{"GET", "/g/empty/download.zip", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.Download(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestZipEntryName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"photo", "photo"},
+		{"zdjęcie z wakacji", "zdjęcie z wakacji"},
+		{"a/b\\c", "a_b_c"},
+		{"what?*", "what__"},
+		{"tab\there", "tab_here"},
+		{" .. ", "fallback"},
+		{"", "fallback"},
+		{string(bytes.Repeat([]byte("ż"), 150)), string(bytes.Repeat([]byte("ż"), 100))},
+	}
+	for _, tt := range tests {
+		if got := zipEntryName(tt.name, "fallback"); got != tt.want {
+			t.Errorf("zipEntryName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueZipName(t *testing.T) {
+	used := make(map[string]bool)
+	for _, want := range []string{"a.jpg", "A (2).jpg", "a (3).jpg"} {
+		base := want[:1]
+		if got := uniqueZipName(used, base, ".jpg"); got != want {
+			t.Errorf("uniqueZipName(%q) = %q, want %q", base, got, want)
+		}
+	}
+	if got := uniqueZipName(used, "a", ".webp"); got != "a.webp" {
+		t.Errorf("other extension = %q, want a.webp", got)
+	}
+}
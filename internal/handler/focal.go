@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
+	"dajtu/internal/storage"
+)
+
+// ImageFocalPoint zwraca punkt ostrości obrazu dla presetów cover
+// (nil = według strategii kadrowania presetu)
+func ImageFocalPoint(img *storage.Image) *image.FocalPoint {
+	if img == nil || img.Focal == nil {
+		return nil
+	}
+	return &image.FocalPoint{X: img.Focal.X, Y: img.Focal.Y}
+}
+
+// FocalPointResponse to odpowiedź /i/{slug}/focal; Focal == nil po usunięciu
+type FocalPointResponse struct {
+	Slug  string            `json:"slug"`
+	Focal *image.FocalPoint `json:"focal"`
+}
+
+// FocalPoint obsługuje /i/{slug}/focal: POST {"x":0.5,"y":0.3} ustawia punkt
+// ostrości (ułamki szerokości i wysokości wariantu original), DELETE go
+// usuwa. Miniatury i inne zapisane warianty cover renderujemy od razu
+// z wersji bez znaku wodnego; leniwe presety mają punkt w kluczu cache.
+func (h *ImageEditHandler) FocalPoint(w http.ResponseWriter, r *http.Request, slug string) {
+	img, err := h.db.GetImageBySlug(slug)
+	if err != nil || img == nil {
+		jsonError(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if !canEditImage(h.db, r, img) {
+		jsonError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if imageNotReady(w, img) {
+		return
+	}
+
+	var focal *image.FocalPoint
+	switch r.Method {
+	case http.MethodPost:
+		var fp image.FocalPoint
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&fp); err != nil || !fp.Valid() {
+			jsonError(w, "focal point needs x and y between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		focal = &fp
+	case http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := h.fs.Read(h.fs.SourceKey(slug))
+	if err != nil {
+		logging.Get("upload").Printf("upload.FocalPoint: read source slug=%s: %v", slug, err)
+		jsonError(w, "source not found", http.StatusInternalServerError)
+		return
+	}
+	wm, _ := imageWatermark(h.db, img.GalleryID, img.UserID)
+	results, err := h.processor.ProcessCovers(r.Context(), data, wm, focal)
+	if err != nil {
+		if ProcessingBusy(w, h.processor, err) {
+			return
+		}
+		logging.Get("upload").Printf("upload.FocalPoint: render slug=%s: %v", slug, err)
+		jsonError(w, "processing failed", http.StatusInternalServerError)
+		return
+	}
+	for _, res := range results {
+		if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
+			jsonError(w, "save error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var stored *storage.FocalPoint
+	if focal != nil {
+		stored = &storage.FocalPoint{X: focal.X, Y: focal.Y}
+	}
+	if err := h.db.SetImageFocalPoint(slug, stored); err != nil {
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FocalPointResponse{Slug: slug, Focal: focal})
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+func focalRequest(method, slug, body, token string) *http.Request {
+	req := httptest.NewRequest(method, "/i/"+slug+"/focal", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Edit-Token", token)
+	}
+	return req
+}
+
+func TestImageEditHandler_FocalPoint_Validation(t *testing.T) {
+	_, db, _, h := testEditSetup(t)
+	insertRevisionImage(t, db, "fp001", nil)
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "fp002", MimeType: "image/jpeg", Status: storage.ImageStatusPending, EditToken: "tok-fp002", CreatedAt: now, AccessedAt: now})
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		slug   string
+		status int
+	}{
+		{"unknown image", focalRequest("POST", "nope1", `{"x":0.5,"y":0.5}`, "tok-fp001"), "nope1", http.StatusNotFound},
+		{"no token", focalRequest("POST", "fp001", `{"x":0.5,"y":0.5}`, ""), "fp001", http.StatusForbidden},
+		{"wrong method", focalRequest("GET", "fp001", "", "tok-fp001"), "fp001", http.StatusMethodNotAllowed},
+		{"bad json", focalRequest("POST", "fp001", `{"x":`, "tok-fp001"), "fp001", http.StatusBadRequest},
+		{"outside image", focalRequest("POST", "fp001", `{"x":1.5,"y":0.5}`, "tok-fp001"), "fp001", http.StatusBadRequest},
+		{"no source", focalRequest("POST", "fp001", `{"x":0.5,"y":0.5}`, "tok-fp001"), "fp001", http.StatusInternalServerError},
+		{"still processing", focalRequest("POST", "fp002", `{"x":0.5,"y":0.5}`, "tok-fp002"), "fp002", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.FocalPoint(rec, tt.req, tt.slug)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+
+	if img, _ := db.GetImageBySlug("fp001"); img.Focal != nil {
+		t.Errorf("focal after failed requests = %+v, want nil", img.Focal)
+	}
+}
+
+func TestImageEditHandler_FocalPoint_Busy(t *testing.T) {
+	cfg, db, fs, _ := testEditSetup(t)
+	h := NewImageEditHandler(db, fs, image.NewPooledProcessor(blockedPool(t, true)), cfg)
+	insertRevisionImage(t, db, "fp003", nil)
+	fs.Save("fp003", "original", testutil.SampleJPEG())
+
+	rec := httptest.NewRecorder()
+	h.FocalPoint(rec, focalRequest("POST", "fp003", `{"x":0.2,"y":0.3}`, "tok-fp003"), "fp003")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if img, _ := db.GetImageBySlug("fp003"); img.Focal != nil {
+		t.Error("focal point stored although the thumbs were not rendered")
+	}
+}
+
+func TestImageEditHandler_FocalPoint(t *testing.T) {
+	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	_, db, fs, h := testEditSetup(t)
+	insertRevisionImage(t, db, "fp004", nil)
+	fs.Save("fp004", "original", testutil.SampleJPEG())
+
+	rec := httptest.NewRecorder()
+	h.FocalPoint(rec, focalRequest("POST", "fp004", `{"x":0.2,"y":0.3}`, "tok-fp004"), "fp004")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp FocalPointResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Focal == nil || *resp.Focal != (image.FocalPoint{X: 0.2, Y: 0.3}) {
+		t.Errorf("response focal = %+v", resp.Focal)
+	}
+	img, _ := db.GetImageBySlug("fp004")
+	if img.Focal == nil || img.Focal.X != 0.2 || img.Focal.Y != 0.3 {
+		t.Errorf("stored focal = %+v", img.Focal)
+	}
+	if _, err := fs.Stat(fs.Key("fp004", "thumb")); err != nil {
+		t.Errorf("thumb was not rendered: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.FocalPoint(rec, focalRequest("DELETE", "fp004", "", "tok-fp004"), "fp004")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE status = %d", rec.Code)
+	}
+	if img, _ := db.GetImageBySlug("fp004"); img.Focal != nil {
+		t.Errorf("focal after DELETE = %+v, want nil", img.Focal)
+	}
+}
+
+func TestImageFocalPoint(t *testing.T) {
+	if ImageFocalPoint(&storage.Image{}) != nil {
+		t.Error("image without focal point should give nil")
+	}
+	got := ImageFocalPoint(&storage.Image{Focal: &storage.FocalPoint{X: 0.1, Y: 0.9}})
+	if got == nil || *got != (image.FocalPoint{X: 0.1, Y: 0.9}) {
+		t.Errorf("ImageFocalPoint() = %+v", got)
+	}
+}
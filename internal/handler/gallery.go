@@ -3,6 +3,7 @@ package handler
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"html/template"
 	"net/http"
 	"slices"
@@ -24,14 +25,15 @@ type GalleryHandler struct {
 	cfg         *config.Config
 	db          *storage.DB
 	fs          *storage.Filesystem
+	processor   *image.Processor
 	galleryTmpl *template.Template
 	indexTmpl   *template.Template
 }
 
-func NewGalleryHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem) *GalleryHandler {
+func NewGalleryHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem, processor *image.Processor) *GalleryHandler {
 	galleryTmpl := template.Must(template.ParseFS(templates, "templates/gallery.html", "templates/partials/*.html"))
 	indexTmpl := template.Must(template.ParseFS(templates, "templates/index.html", "templates/partials/*.html"))
-	return &GalleryHandler{cfg: cfg, db: db, fs: fs, galleryTmpl: galleryTmpl, indexTmpl: indexTmpl}
+	return &GalleryHandler{cfg: cfg, db: db, fs: fs, processor: processor, galleryTmpl: galleryTmpl, indexTmpl: indexTmpl}
 }
 
 // GET / - index page with upload form
@@ -134,6 +136,9 @@ func (h *GalleryHandler) Create(w http.ResponseWriter, r *http.Request) {
 	baseURL := getBaseURL(h.cfg, r)
 
 	var uploadedImages []UploadResponse
+	var tooLarge int
+	var busyErr error
+	keepGPS := r.FormValue("keep_gps") == "true"
 
 	// Handle existing image if provided
 	if existingImageSlug != "" {
@@ -170,15 +175,13 @@ func (h *GalleryHandler) Create(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sizes := make(map[string]string)
-		sizes["original"] = buildImageURL(baseURL, existingImageSlug, "original")
-		sizes["1200"] = buildImageURL(baseURL, existingImageSlug, "1200")
-		sizes["thumb"] = buildImageURL(baseURL, existingImageSlug, "thumb")
+		sizes := presetURLs(baseURL, existingImageSlug)
 
 		uploadedImages = append(uploadedImages, UploadResponse{
 			Slug:  existingImageSlug,
 			URL:   sizes["original"],
 			Sizes: sizes,
+			Embed: buildEmbedCodes(baseURL, existingImage, embedSize),
 		})
 	}
 
@@ -194,8 +197,16 @@ func (h *GalleryHandler) Create(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			continue // skip invalid files
 		}
+		if err := image.CheckDimensions(data, imageLimits(h.cfg)); err != nil {
+			if err == image.ErrImageTooLarge {
+				tooLarge++
+			}
+			continue
+		}
 
 		slug := h.db.GenerateUniqueSlug("images", 5)
+		// Pliki powstają przed rekordem; zwalniane na końcu żądania
+		defer h.fs.Claim(slug)()
 
 		var originalSize int64
 		if h.cfg.KeepOriginalFormat {
@@ -207,54 +218,103 @@ func (h *GalleryHandler) Create(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		results, err := image.Process(data)
+		if processInBackground(h.cfg, len(data)) {
+			img := &storage.Image{
+				Slug:         slug,
+				OriginalName: fileHeader.Filename,
+				MimeType:     string(format),
+				FileSize:     originalSize,
+				CreatedAt:    now,
+				AccessedAt:   now,
+				GalleryID:    &galleryID,
+			}
+			imageID, err := queuePendingImage(h.db, h.fs, h.processor, img, data, image.TransformParams{})
+			if err != nil {
+				if errors.Is(err, image.ErrQueueFull) {
+					busyErr = err
+					break
+				}
+				continue
+			}
+			metadata := saveImageMetadata(h.db, imageID, image.ExtractMetadata(data), keepGPS)
+			sizes := presetURLs(baseURL, slug)
+			resp := UploadResponse{Slug: slug, URL: sizes["original"], Sizes: sizes, Metadata: metadata, Embed: buildEmbedCodes(baseURL, img, embedSize)}
+			markProcessing(&resp, baseURL)
+			uploadedImages = append(uploadedImages, resp)
+			continue
+		}
+
+		wm, watermarkKey := imageWatermark(h.db, &galleryID, nil)
+		results, err := h.processor.ProcessUpload(r.Context(), data, image.TransformParams{Watermark: wm})
 		if err != nil {
 			h.fs.Delete(slug)
+			if errors.Is(err, image.ErrQueueFull) || errors.Is(err, image.ErrTimeout) {
+				// reszta plików też by nie przeszła
+				busyErr = err
+				break
+			}
 			continue
 		}
 
 		totalSize := originalSize
 		for _, res := range results {
-			if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-				h.fs.Delete(slug)
-				continue
-			}
 			totalSize += int64(len(res.Data))
 		}
 
+		placeholder := imagePlaceholder(results)
+		fingerprint := imageFingerprint(results)
 		img := &storage.Image{
-			Slug:         slug,
-			OriginalName: fileHeader.Filename,
-			MimeType:     string(format),
-			FileSize:     totalSize,
-			Width:        results[0].Width,
-			Height:       results[0].Height,
-			CreatedAt:    now,
-			AccessedAt:   now,
-			GalleryID:    &galleryID,
+			Slug:          slug,
+			OriginalName:  fileHeader.Filename,
+			MimeType:      string(format),
+			FileSize:      totalSize,
+			Width:         results[0].Width,
+			Height:        results[0].Height,
+			Frames:        results[0].Frames,
+			CreatedAt:     now,
+			AccessedAt:    now,
+			GalleryID:     &galleryID,
+			LQIP:          placeholder.LQIP,
+			DominantColor: placeholder.Color,
+			PHash:         fingerprint.DHash,
+			PixelSHA:      fingerprint.PixelHash,
+			WatermarkKey:  watermarkKey,
 		}
 
-		if _, err := h.db.InsertImage(img); err != nil {
-			h.fs.Delete(slug)
+		imageID, err := storeImage(h.db, h.fs, img, results)
+		if err != nil {
+			logging.Get("gallery").Printf("store image %s: %v", slug, err)
 			continue
 		}
+		metadata := saveImageMetadata(h.db, imageID, image.ExtractMetadata(data), keepGPS)
 
-		sizes := make(map[string]string)
-		for _, res := range results {
-			sizes[res.Name] = buildImageURL(baseURL, slug, res.Name)
-		}
+		sizes := presetURLs(baseURL, slug)
 
 		uploadedImages = append(uploadedImages, UploadResponse{
-			Slug:  slug,
-			URL:   sizes["original"],
-			Sizes: sizes,
+			Slug:     slug,
+			URL:      sizes["original"],
+			Sizes:    sizes,
+			Metadata: metadata,
+			Embed:    buildEmbedCodes(baseURL, img, embedSize),
 		})
 	}
 
+	if busyErr != nil && len(uploadedImages) > 0 {
+		logging.Get("gallery").Printf("gallery.Create: processing busy after %d of %d files: %v", len(uploadedImages), len(files), busyErr)
+	}
 	if len(uploadedImages) == 0 {
 		if delErr := h.db.DeleteGalleryByID(galleryID); delErr != nil {
 			logging.Get("gallery").Printf("failed to rollback gallery %d: %v", galleryID, delErr)
 		}
+		if ProcessingBusy(w, h.processor, busyErr) {
+			logging.Get("gallery").Printf("gallery.Create: processing busy: %v", busyErr)
+			return
+		}
+		if tooLarge > 0 {
+			logging.Get("gallery").Printf("gallery.Create: all %d images over dimension limits", tooLarge)
+			jsonError(w, imageTooLargeMessage(h.cfg), http.StatusRequestEntityTooLarge)
+			return
+		}
 		logging.Get("gallery").Printf("gallery.Create: no valid images uploaded")
 		jsonError(w, "no valid images uploaded", http.StatusBadRequest)
 		return
@@ -326,6 +386,9 @@ func (h *GalleryHandler) AddImages(w http.ResponseWriter, r *http.Request) {
 
 	now := time.Now().Unix()
 	var uploadedImages []UploadResponse
+	var tooLarge int
+	var busyErr error
+	keepGPS := r.FormValue("keep_gps") == "true"
 
 	for _, fileHeader := range files {
 		file, err := fileHeader.Open()
@@ -339,8 +402,16 @@ func (h *GalleryHandler) AddImages(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			continue
 		}
+		if err := image.CheckDimensions(data, imageLimits(h.cfg)); err != nil {
+			if err == image.ErrImageTooLarge {
+				tooLarge++
+			}
+			continue
+		}
 
 		slug := h.db.GenerateUniqueSlug("images", 5)
+		// Pliki powstają przed rekordem; zwalniane na końcu żądania
+		defer h.fs.Claim(slug)()
 
 		var originalSize int64
 		if h.cfg.KeepOriginalFormat {
@@ -352,50 +423,99 @@ func (h *GalleryHandler) AddImages(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		results, err := image.Process(data)
+		if processInBackground(h.cfg, len(data)) {
+			img := &storage.Image{
+				Slug:         slug,
+				OriginalName: fileHeader.Filename,
+				MimeType:     string(format),
+				FileSize:     originalSize,
+				CreatedAt:    now,
+				AccessedAt:   now,
+				GalleryID:    &gallery.ID,
+			}
+			imageID, err := queuePendingImage(h.db, h.fs, h.processor, img, data, image.TransformParams{})
+			if err != nil {
+				if errors.Is(err, image.ErrQueueFull) {
+					busyErr = err
+					break
+				}
+				continue
+			}
+			metadata := saveImageMetadata(h.db, imageID, image.ExtractMetadata(data), keepGPS)
+			sizes := presetURLs(baseURL, slug)
+			resp := UploadResponse{Slug: slug, URL: sizes["original"], Sizes: sizes, Metadata: metadata, Embed: buildEmbedCodes(baseURL, img, embedSize)}
+			markProcessing(&resp, baseURL)
+			uploadedImages = append(uploadedImages, resp)
+			continue
+		}
+
+		wm, watermarkKey := imageWatermark(h.db, &gallery.ID, nil)
+		results, err := h.processor.ProcessUpload(r.Context(), data, image.TransformParams{Watermark: wm})
 		if err != nil {
 			h.fs.Delete(slug)
+			if errors.Is(err, image.ErrQueueFull) || errors.Is(err, image.ErrTimeout) {
+				// reszta plików też by nie przeszła
+				busyErr = err
+				break
+			}
 			continue
 		}
 
 		totalSize := originalSize
 		for _, res := range results {
-			if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-				h.fs.Delete(slug)
-				continue
-			}
 			totalSize += int64(len(res.Data))
 		}
 
+		placeholder := imagePlaceholder(results)
+		fingerprint := imageFingerprint(results)
 		img := &storage.Image{
-			Slug:         slug,
-			OriginalName: fileHeader.Filename,
-			MimeType:     string(format),
-			FileSize:     totalSize,
-			Width:        results[0].Width,
-			Height:       results[0].Height,
-			CreatedAt:    now,
-			AccessedAt:   now,
-			GalleryID:    &gallery.ID,
+			Slug:          slug,
+			OriginalName:  fileHeader.Filename,
+			MimeType:      string(format),
+			FileSize:      totalSize,
+			Width:         results[0].Width,
+			Height:        results[0].Height,
+			Frames:        results[0].Frames,
+			CreatedAt:     now,
+			AccessedAt:    now,
+			GalleryID:     &gallery.ID,
+			LQIP:          placeholder.LQIP,
+			DominantColor: placeholder.Color,
+			PHash:         fingerprint.DHash,
+			PixelSHA:      fingerprint.PixelHash,
+			WatermarkKey:  watermarkKey,
 		}
 
-		if _, err := h.db.InsertImage(img); err != nil {
-			h.fs.Delete(slug)
+		imageID, err := storeImage(h.db, h.fs, img, results)
+		if err != nil {
+			logging.Get("gallery").Printf("store image %s: %v", slug, err)
 			continue
 		}
+		metadata := saveImageMetadata(h.db, imageID, image.ExtractMetadata(data), keepGPS)
 
-		sizes := make(map[string]string)
-		for _, res := range results {
-			sizes[res.Name] = buildImageURL(baseURL, slug, res.Name)
-		}
+		sizes := presetURLs(baseURL, slug)
 
 		uploadedImages = append(uploadedImages, UploadResponse{
-			Slug:  slug,
-			URL:   sizes["original"],
-			Sizes: sizes,
+			Slug:     slug,
+			URL:      sizes["original"],
+			Sizes:    sizes,
+			Metadata: metadata,
+			Embed:    buildEmbedCodes(baseURL, img, embedSize),
 		})
 	}
 
+	if busyErr != nil {
+		logging.Get("gallery").Printf("gallery.AddImages: processing busy after %d of %d files slug=%s: %v", len(uploadedImages), len(files), gallerySlug, busyErr)
+		if len(uploadedImages) == 0 && ProcessingBusy(w, h.processor, busyErr) {
+			return
+		}
+	}
+	if len(uploadedImages) == 0 && tooLarge > 0 {
+		logging.Get("gallery").Printf("gallery.AddImages: all %d images over dimension limits slug=%s", tooLarge, gallerySlug)
+		jsonError(w, imageTooLargeMessage(h.cfg), http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
 		"added":      uploadedImages,
@@ -445,9 +565,15 @@ func (h *GalleryHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete from filesystem and database
-	h.fs.Delete(imageSlug)
-	h.db.DeleteImageBySlug(imageSlug)
+	// Do kosza; admin może przywrócić obrazek, dopóki kosz nie wygaśnie
+	if err := h.db.TrashImage(imageSlug, storage.DeletedByOwner); err != nil {
+		logging.Get("gallery").Printf("gallery.DeleteImage: trash error slug=%s: %v", imageSlug, err)
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := h.fs.Trash(imageSlug); err != nil {
+		logging.Get("gallery").Printf("gallery.DeleteImage: trash files error slug=%s: %v", imageSlug, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"deleted": imageSlug})
@@ -500,6 +626,64 @@ func (h *GalleryHandler) UpdateTitle(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"title": newTitle})
 }
 
+// POST /gallery/:slug/watermark - set or remove the gallery watermark;
+// existing images are re-rendered by the cleanup daemon
+func (h *GalleryHandler) UpdateWatermark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/gallery/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "watermark" {
+		http.NotFound(w, r)
+		return
+	}
+
+	gallery, err := h.db.GetGalleryBySlug(parts[0])
+	if err != nil || gallery == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, image.MaxWatermarkImageBytes+64*1024)
+	editToken := r.Header.Get("X-Edit-Token")
+	if editToken == "" {
+		editToken = r.FormValue("edit_token")
+	}
+	if gallery.EditToken != editToken {
+		jsonError(w, "invalid edit token", http.StatusForbidden)
+		return
+	}
+
+	current, err := h.db.GetGalleryWatermark(gallery.ID)
+	if err != nil {
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	wm, err := parseWatermarkForm(r, current)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wm == nil {
+		err = h.db.DeleteGalleryWatermark(gallery.ID)
+	} else {
+		err = h.db.SetGalleryWatermark(gallery.ID, wm)
+	}
+	if err != nil {
+		logging.Get("gallery").Printf("gallery.UpdateWatermark: slug=%s: %v", gallery.Slug, err)
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	logging.Get("gallery").Printf("gallery.UpdateWatermark: slug=%s enabled=%v", gallery.Slug, wm != nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWatermarkSettings(wm))
+}
+
 // GET /g/:slug - view gallery
 func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 	gallerySlug := strings.TrimPrefix(r.URL.Path, "/g/")
@@ -510,7 +694,7 @@ func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 
 	gallery, err := h.db.GetGalleryBySlug(gallerySlug)
 	if err != nil || gallery == nil {
-		http.NotFound(w, r)
+		galleryNotFound(w, r, h.db, gallerySlug)
 		return
 	}
 
@@ -539,6 +723,10 @@ func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 		Width     int
 		Height    int
 		UpdatedAt int64
+		LQIP      template.URL
+		Color     string
+		Status    string
+		Focal     *image.FocalPoint
 	}
 
 	var imageData []ImageData
@@ -550,12 +738,25 @@ func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 			Width:     img.Width,
 			Height:    img.Height,
 			UpdatedAt: img.UpdatedAt,
+			LQIP:      template.URL(img.LQIP), // data: URI wygenerowany przez nas
+			Color:     img.DominantColor,
+			Status:    img.Status,
+			Focal:     ImageFocalPoint(img),
 		})
 	}
 
 	editToken := r.URL.Query().Get("edit")
 	editMode := editToken != "" && editToken == gallery.EditToken
 
+	var watermark watermarkSettings
+	if editMode {
+		current, err := h.db.GetGalleryWatermark(gallery.ID)
+		if err != nil {
+			logging.Get("gallery").Printf("gallery.View: watermark slug=%s: %v", gallery.Slug, err)
+		}
+		watermark = newWatermarkSettings(current)
+	}
+
 	data := map[string]any{
 		"Title":       gallery.Title,
 		"Description": gallery.Description,
@@ -564,9 +765,13 @@ func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 		"Slug":        gallery.Slug,
 		"EditToken":   editToken,
 		"EditMode":    editMode,
+		"Watermark":   watermark,
 		"CurrentPage": page,
 		"TotalPages":  totalPages,
 		"TotalImages": total,
+		"Share":       galleryShareMeta(baseURL, gallery, galleryCover(images), total),
+		"EmbedSizes":  embedSizes(),
+		"EmbedSize":   embedPreset(embedSize).Name,
 		"HasPrev":     page > 1,
 		"HasNext":     page < totalPages,
 		"PrevPage":    page - 1,
@@ -578,3 +783,30 @@ func (h *GalleryHandler) View(w http.ResponseWriter, r *http.Request) {
 		logging.Get("gallery").Printf("template error: %v", err)
 	}
 }
+
+// GET /g/{slug}/embed?size=800 - kody do wklejenia wszystkich gotowych
+// obrazków galerii w wybranym rozmiarze
+func (h *GalleryHandler) Embed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gallerySlug := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/g/"), "/embed")
+	gallery, err := h.db.GetGalleryBySlug(gallerySlug)
+	if err != nil || gallery == nil {
+		if trashed, _ := h.db.GalleryTrashed(gallerySlug); trashed {
+			jsonError(w, "gallery deleted", http.StatusGone)
+			return
+		}
+		jsonError(w, "gallery not found", http.StatusNotFound)
+		return
+	}
+	images, err := h.db.GetGalleryImages(gallery.ID)
+	if err != nil {
+		jsonError(w, "error loading images", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildGalleryEmbedCodes(getBaseURL(h.cfg, r), images, r.URL.Query().Get("size")))
+}
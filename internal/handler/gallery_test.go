@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"mime/multipart"
 	"net/http"
@@ -10,14 +11,16 @@ import (
 	"testing"
 	"time"
 
+	"dajtu/internal/image"
 	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
 )
 
 func TestGalleryHandler_Index(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/", nil)
 	rec := httptest.NewRecorder()
@@ -37,7 +40,7 @@ func TestGalleryHandler_Index_NotRoot(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/other", nil)
 	rec := httptest.NewRecorder()
@@ -53,7 +56,7 @@ func TestGalleryHandler_Create_MethodNotAllowed(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/gallery", nil)
 	rec := httptest.NewRecorder()
@@ -69,7 +72,7 @@ func TestGalleryHandler_Create_NoFiles(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
@@ -92,11 +95,65 @@ func TestGalleryHandler_Create_NoFiles(t *testing.T) {
 	}
 }
 
+func TestGalleryHandler_Create_DimensionsTooLarge(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxImageWidth = 1000
+
+	gif := append([]byte{}, testutil.SampleGIF()...)
+	binary.LittleEndian.PutUint16(gif[6:8], 4000)
+
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "wide.gif")
+	part.Write(gif)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/gallery", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	h.Create(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if n, _ := db.CountGalleriesAdminFiltered(""); n != 0 {
+		t.Errorf("galleries = %d, want 0 after rollback", n)
+	}
+}
+
+func TestGalleryHandler_Create_AnimationTooLarge(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxImageMegapixels = 1
+
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "frames.gif")
+	part.Write(testutil.AnimatedGIF(500, 500, 10))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/gallery", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	h.Create(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
 func TestGalleryHandler_View_NotFound(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/g/nonexistent", nil)
 	rec := httptest.NewRecorder()
@@ -112,7 +169,7 @@ func TestGalleryHandler_View_EmptySlug(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/g/", nil)
 	rec := httptest.NewRecorder()
@@ -128,7 +185,7 @@ func TestGalleryHandler_View_Success(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	// Create a gallery
 	now := time.Now().Unix()
@@ -161,7 +218,7 @@ func TestGalleryHandler_View_EditMode(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -187,7 +244,7 @@ func TestGalleryHandler_AddImages_MethodNotAllowed(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/gallery/test/add", nil)
 	rec := httptest.NewRecorder()
@@ -203,7 +260,7 @@ func TestGalleryHandler_AddImages_InvalidPath(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	tests := []string{
 		"/gallery/test",       // No /add
@@ -227,7 +284,7 @@ func TestGalleryHandler_AddImages_GalleryNotFound(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("POST", "/gallery/nonexistent/add", nil)
 	req.Header.Set("X-Edit-Token", "token")
@@ -244,7 +301,7 @@ func TestGalleryHandler_AddImages_InvalidToken(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -272,11 +329,44 @@ func TestGalleryHandler_AddImages_InvalidToken(t *testing.T) {
 	}
 }
 
+func TestGalleryHandler_AddImages_AnimationTooLarge(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxImageMegapixels = 1
+
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	db.InsertGallery(&storage.Gallery{
+		Slug:      "add2",
+		EditToken: "correct",
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "frames.gif")
+	part.Write(testutil.AnimatedGIF(500, 500, 10))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/gallery/add2/add", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Edit-Token", "correct")
+	rec := httptest.NewRecorder()
+
+	h.AddImages(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
 func TestGalleryHandler_DeleteImage_MethodNotAllowed(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("GET", "/gallery/test/img1", nil)
 	rec := httptest.NewRecorder()
@@ -292,7 +382,7 @@ func TestGalleryHandler_DeleteImage_InvalidPath(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("DELETE", "/gallery/test", nil)
 	rec := httptest.NewRecorder()
@@ -308,7 +398,7 @@ func TestGalleryHandler_DeleteImage_GalleryNotFound(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	req := httptest.NewRequest("DELETE", "/gallery/nonexistent/img1", nil)
 	req.Header.Set("X-Edit-Token", "token")
@@ -325,7 +415,7 @@ func TestGalleryHandler_DeleteImage_InvalidToken(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -351,7 +441,7 @@ func TestGalleryHandler_DeleteImage_ImageNotFound(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -377,7 +467,7 @@ func TestGalleryHandler_DeleteImage_Success(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 
@@ -424,9 +514,12 @@ func TestGalleryHandler_DeleteImage_Success(t *testing.T) {
 		t.Error("image still exists in DB after delete")
 	}
 
-	// Verify file is gone from disk
-	if fs.Exists("todel") {
-		t.Error("files still exist on disk after delete")
+	// Verify it waits in the trash with its files
+	if trashed, _ := db.ImageTrashed("todel"); !trashed {
+		t.Error("image not moved to the trash")
+	}
+	if !fs.Exists("todel") {
+		t.Error("files deleted before the trash expired")
 	}
 }
 
@@ -434,7 +527,7 @@ func TestGalleryHandler_GenerateUniqueSlug(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	slug := h.db.GenerateUniqueSlug("galleries", 4)
 	if len(slug) != 4 {
@@ -446,7 +539,7 @@ func TestGalleryHandler_UpdateTitle(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -485,7 +578,7 @@ func TestGalleryHandler_UpdateTitle_InvalidToken(t *testing.T) {
 	cfg, db, fs, cleanup := testSetup(t)
 	defer cleanup()
 
-	h := NewGalleryHandler(cfg, db, fs)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
 
 	now := time.Now().Unix()
 	g := &storage.Gallery{
@@ -4,11 +4,21 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"dajtu/internal/config"
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
+	"dajtu/internal/middleware"
+	"dajtu/internal/storage"
 )
 
 // jsonError wysyła błąd JSON
@@ -18,6 +28,41 @@ func jsonError(w http.ResponseWriter, message string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
+// ImageNotFound odpowiada na zapytanie o obrazek, którego GetImageBySlug nie
+// zwrócił: 410, gdy leży w koszu, w innym razie 404
+func ImageNotFound(w http.ResponseWriter, r *http.Request, db *storage.DB, slug string) {
+	if trashed, err := db.ImageTrashed(slug); err == nil && trashed {
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// galleryNotFound to ImageNotFound dla galerii
+func galleryNotFound(w http.ResponseWriter, r *http.Request, db *storage.DB, slug string) {
+	if trashed, err := db.GalleryTrashed(slug); err == nil && trashed {
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// ProcessingBusy odpowiada 503 z Retry-After, gdy kolejka przetwarzania
+// jest pełna albo zadanie przekroczyło limit czasu; przy innych błędach
+// zwraca false i odpowiedź zostaje po stronie wywołującego.
+func ProcessingBusy(w http.ResponseWriter, processor *image.Processor, err error) bool {
+	if !errors.Is(err, image.ErrQueueFull) && !errors.Is(err, image.ErrTimeout) {
+		return false
+	}
+	retryAfter := 5 * time.Second
+	if pool := processor.Pool(); pool != nil {
+		retryAfter = pool.RetryAfter()
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	jsonError(w, "server busy, try again later", http.StatusServiceUnavailable)
+	return true
+}
+
 // getBaseURL zwraca base URL z konfiguracji lub z requestu
 func getBaseURL(cfg *config.Config, r *http.Request) string {
 	if cfg.BaseURL != "" {
@@ -35,7 +80,149 @@ func buildImageURL(baseURL, slug, size string) string {
 	if size == "" || size == "original" {
 		return fmt.Sprintf("%s/i/%s.webp", baseURL, slug)
 	}
-	return fmt.Sprintf("%s/i/%s/%s.webp", baseURL, slug, size)
+	ext := "webp"
+	if p, ok := image.LookupPreset(size); ok && p.Format != "" {
+		ext = image.Extension(p.Format)
+	}
+	return fmt.Sprintf("%s/i/%s/%s.%s", baseURL, slug, size, ext)
+}
+
+// presetURLs zwraca URL-e wszystkich presetów obrazka
+func presetURLs(baseURL, slug string) map[string]string {
+	sizes := make(map[string]string)
+	for _, p := range image.Presets() {
+		sizes[p.Name] = buildImageURL(baseURL, slug, p.Name)
+	}
+	return sizes
+}
+
+// embedSize to domyślny rozmiar w kodach do wklejenia; 1200px mieści się
+// w poście na forum, a srcset i tak podsuwa większe ekranom retina
+const embedSize = "1200"
+
+// EmbedCodes to gotowe do wklejenia kody obrazka; dla galerii każdy obrazek
+// w osobnej linii
+type EmbedCodes struct {
+	Size     string `json:"size"`
+	Direct   string `json:"direct"`
+	BBCode   string `json:"bbcode"`
+	Markdown string `json:"markdown"`
+	HTML     string `json:"html"`
+}
+
+// embedSizes zwraca presety do wyboru w kodach; AVIF pomijamy, bo fora
+// i czytniki go nie pokażą
+func embedSizes() []string {
+	var sizes []string
+	for _, p := range image.Presets() {
+		if p.Format != image.FormatAVIF {
+			sizes = append(sizes, p.Name)
+		}
+	}
+	return sizes
+}
+
+// embedPreset zwraca preset size, a gdy go nie ma, embedSize albo original
+func embedPreset(size string) image.Preset {
+	for _, name := range []string{size, embedSize, "original"} {
+		if p, ok := image.LookupPreset(name); ok && p.Format != image.FormatAVIF {
+			return p
+		}
+	}
+	return image.Preset{Name: "original"}
+}
+
+// buildEmbedCodes buduje kody obrazka w rozmiarze size: link bezpośredni,
+// BBCode [url][img], Markdown i HTML <img srcset>, wszystkie z linkiem do
+// strony obrazka
+func buildEmbedCodes(baseURL string, img *storage.Image, size string) EmbedCodes {
+	p := embedPreset(size)
+	src := buildImageURL(baseURL, img.Slug, p.Name)
+	view := baseURL + "/i/" + img.Slug
+	alt := imageTitle(img)
+
+	var tag strings.Builder
+	fmt.Fprintf(&tag, `<a href="%s"><img src="%s"`, html.EscapeString(view), html.EscapeString(src))
+	if srcset, width := embedSrcset(baseURL, img, p); srcset != "" {
+		fmt.Fprintf(&tag, ` srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx"`, html.EscapeString(srcset), width, width)
+	}
+	if w, h := p.OutputSize(img.Width, img.Height); w > 0 && h > 0 {
+		fmt.Fprintf(&tag, ` width="%d" height="%d"`, w, h)
+	}
+	fmt.Fprintf(&tag, ` alt="%s"></a>`, html.EscapeString(alt))
+
+	mdAlt := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(alt)
+	return EmbedCodes{
+		Size:     p.Name,
+		Direct:   src,
+		BBCode:   "[url=" + view + "][img]" + src + "[/img][/url]",
+		Markdown: "[![" + mdAlt + "](" + src + ")](" + view + ")",
+		HTML:     tag.String(),
+	}
+}
+
+// embedSrcset składa srcset z presetów contain (szerokości bez powtórzeń)
+// i zwraca szerokość wybranego; pusty, gdy p nie jest contain albo nie ma
+// z czego wybierać
+func embedSrcset(baseURL string, img *storage.Image, p image.Preset) (string, int) {
+	if p.Fit == image.FitCover || p.Fit == image.FitFill {
+		return "", 0
+	}
+	width := func(p image.Preset) int {
+		if img.Width > 0 && img.Height > 0 {
+			w, _ := p.OutputSize(img.Width, img.Height)
+			return w
+		}
+		return p.Width
+	}
+
+	type candidate struct {
+		name  string
+		width int
+	}
+	var candidates []candidate
+	seen := make(map[int]bool)
+	for _, c := range image.Presets() {
+		if c.Fit == image.FitCover || c.Fit == image.FitFill || c.Format == image.FormatAVIF {
+			continue
+		}
+		if w := width(c); w > 0 && !seen[w] {
+			seen[w] = true
+			candidates = append(candidates, candidate{c.Name, w})
+		}
+	}
+	if len(candidates) < 2 {
+		return "", 0
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int { return a.width - b.width })
+
+	parts := make([]string, len(candidates))
+	for i, c := range candidates {
+		parts[i] = fmt.Sprintf("%s %dw", buildImageURL(baseURL, img.Slug, c.name), c.width)
+	}
+	return strings.Join(parts, ", "), width(p)
+}
+
+// buildGalleryEmbedCodes łączy kody gotowych obrazków galerii w rozmiarze size
+func buildGalleryEmbedCodes(baseURL string, images []*storage.Image, size string) EmbedCodes {
+	var direct, bbcode, markdown, tags []string
+	for _, img := range images {
+		if img.Status != "" && img.Status != storage.ImageStatusReady {
+			continue
+		}
+		codes := buildEmbedCodes(baseURL, img, size)
+		direct = append(direct, codes.Direct)
+		bbcode = append(bbcode, codes.BBCode)
+		markdown = append(markdown, codes.Markdown)
+		tags = append(tags, codes.HTML)
+	}
+	return EmbedCodes{
+		Size:     embedPreset(size).Name,
+		Direct:   strings.Join(direct, "\n"),
+		BBCode:   strings.Join(bbcode, "\n"),
+		Markdown: strings.Join(markdown, "\n"),
+		HTML:     strings.Join(tags, "\n"),
+	}
 }
 
 // generateEditToken generuje 32-znakowy token
@@ -46,3 +233,278 @@ func generateEditToken() (string, error) {
 	}
 	return hex.EncodeToString(b), nil
 }
+
+// imageLimits zwraca limity wymiarów obrazka z konfiguracji
+func imageLimits(cfg *config.Config) image.Limits {
+	return image.Limits{
+		MaxWidth:      cfg.MaxImageWidth,
+		MaxHeight:     cfg.MaxImageHeight,
+		MaxMegapixels: cfg.MaxImageMegapixels,
+	}
+}
+
+// imageTooLargeMessage opisuje przekroczony limit wymiarów dla odpowiedzi JSON
+func imageTooLargeMessage(cfg *config.Config) string {
+	return fmt.Sprintf("image dimensions too large (max %dx%d px, %g megapixels across all frames)",
+		cfg.MaxImageWidth, cfg.MaxImageHeight, cfg.MaxImageMegapixels)
+}
+
+// saveImageMetadata zapisuje whitelistę pól EXIF/XMP; GPS tylko gdy uploader wyraził zgodę
+func saveImageMetadata(db *storage.DB, imageID int64, meta *image.Metadata, keepGPS bool) *storage.ImageMetadata {
+	if meta == nil {
+		return nil
+	}
+	record := &storage.ImageMetadata{
+		ImageID:      imageID,
+		CameraMake:   meta.CameraMake,
+		CameraModel:  meta.CameraModel,
+		LensModel:    meta.LensModel,
+		TakenAt:      meta.TakenAt,
+		ExposureTime: meta.ExposureTime,
+		FNumber:      meta.FNumber,
+		ISO:          meta.ISO,
+		FocalLength:  meta.FocalLength,
+	}
+	if keepGPS {
+		record.GPSLat, record.GPSLon = meta.GPSLat, meta.GPSLon
+	}
+	if *record == (storage.ImageMetadata{ImageID: imageID}) {
+		return nil
+	}
+	if err := db.InsertImageMetadata(record); err != nil {
+		logging.Get("metadata").Printf("insert metadata image_id=%d: %v", imageID, err)
+		return nil
+	}
+	return record
+}
+
+// imagePlaceholder zwraca LQIP i dominujący kolor policzone w zadaniu
+// przetwarzania (image.Processor.ProcessUpload). Puste pole podchwyci
+// backfill w cleanup daemonie.
+func imagePlaceholder(results []image.ProcessResult) image.Placeholder {
+	for _, res := range results {
+		if res.Name == "original" {
+			return res.Placeholder
+		}
+	}
+	return image.Placeholder{}
+}
+
+// imageFingerprint zwraca hashe treści policzone w zadaniu przetwarzania
+// z wariantu original (bez znaku wodnego, jeśli jest); pusty odcisk = takiego
+// obrazu nie deduplikujemy, a backfill spróbuje ponownie.
+func imageFingerprint(results []image.ProcessResult) image.Fingerprint {
+	for _, res := range results {
+		if res.Name == "original" {
+			return res.Fingerprint
+		}
+	}
+	return image.Fingerprint{}
+}
+
+// findDuplicate zwraca istniejący obraz o tej samej treści zgodnie z DEDUP_SCOPE.
+// W zakresie "user" anonimowe uploady (uploaderID == nil) nie są deduplikowane.
+func findDuplicate(cfg *config.Config, db *storage.DB, fp image.Fingerprint, uploaderID *int64) *storage.Image {
+	if fp.PixelHash == "" {
+		return nil
+	}
+	var scope *int64
+	switch cfg.DedupScope {
+	case "user":
+		if uploaderID == nil {
+			return nil
+		}
+		scope = uploaderID
+	case "global":
+	default:
+		return nil
+	}
+	dup, err := db.FindDuplicateImage(fp.DHash, fp.PixelHash, cfg.DedupMaxDistance, scope)
+	if err != nil {
+		logging.Get("dedup").Printf("find duplicate: %v", err)
+		return nil
+	}
+	return dup
+}
+
+// sameOwner sprawdza, czy obraz należy do uploadera
+func sameOwner(img *storage.Image, uploaderID *int64) bool {
+	return img.UserID != nil && uploaderID != nil && *img.UserID == *uploaderID
+}
+
+// imageWatermark zwraca znak wodny dla obrazu w galerii/użytkownika i jego
+// klucz do zapisania w images.watermark_key; nil = warianty bez znaku.
+func imageWatermark(db *storage.DB, galleryID, userID *int64) (*image.Watermark, string) {
+	wm, err := db.GetEffectiveWatermark(galleryID, userID)
+	if err != nil {
+		logging.Get("watermark").Printf("get watermark: %v", err)
+		return nil, ""
+	}
+	if wm == nil {
+		return nil, ""
+	}
+	return toImageWatermark(wm), wm.Key
+}
+
+func toImageWatermark(wm *storage.Watermark) *image.Watermark {
+	return &image.Watermark{
+		Text:     wm.Text,
+		Image:    wm.Image,
+		Position: wm.Position,
+		Opacity:  wm.Opacity,
+		Scale:    wm.Scale,
+	}
+}
+
+// canEditImage: właściciel (sesja), token edycji obrazka lub token galerii,
+// do której obrazek należy (nagłówek X-Edit-Token albo ?edit=)
+func canEditImage(db *storage.DB, r *http.Request, img *storage.Image) bool {
+	if user := middleware.GetUser(r); user != nil && img.UserID != nil && user.ID == *img.UserID {
+		return true
+	}
+	editToken := r.Header.Get("X-Edit-Token")
+	if editToken == "" {
+		editToken = r.URL.Query().Get("edit")
+	}
+	if editToken == "" {
+		return false
+	}
+	if img.EditToken != "" && editToken == img.EditToken {
+		return true
+	}
+	if img.GalleryID != nil {
+		gallery, err := db.GetGalleryByID(*img.GalleryID)
+		if err == nil && gallery != nil && gallery.EditToken == editToken {
+			return true
+		}
+	}
+	return false
+}
+
+// watermarkSettings to dane formularza znaku wodnego w szablonach
+type watermarkSettings struct {
+	Enabled   bool     `json:"enabled"`
+	Text      string   `json:"text,omitempty"`
+	HasImage  bool     `json:"has_image"`
+	Position  string   `json:"position"`
+	Opacity   int      `json:"opacity"` // %
+	Scale     int      `json:"scale"`   // % szerokości wariantu
+	Positions []string `json:"-"`
+}
+
+func newWatermarkSettings(wm *storage.Watermark) watermarkSettings {
+	s := watermarkSettings{Position: image.PositionBottomRight, Opacity: 50, Scale: 20, Positions: image.WatermarkPositions}
+	if wm != nil {
+		s.Enabled = true
+		s.Text = wm.Text
+		s.HasImage = len(wm.Image) > 0
+		s.Position = wm.Position
+		s.Opacity = int(wm.Opacity*100 + 0.5)
+		s.Scale = int(wm.Scale*100 + 0.5)
+	}
+	return s
+}
+
+// parseWatermarkForm czyta formularz znaku wodnego: mode=none|text|image,
+// text, file (PNG), position, opacity i scale w procentach. Przy mode=image
+// bez nowego pliku zostaje dotychczasowy PNG (current). Zwraca nil dla
+// mode=none.
+func parseWatermarkForm(r *http.Request, current *storage.Watermark) (*storage.Watermark, error) {
+	if err := r.ParseMultipartForm(image.MaxWatermarkImageBytes + 64*1024); err != nil {
+		r.ParseForm()
+	}
+
+	wm := &image.Watermark{Position: r.FormValue("position")}
+	opacity, _ := strconv.ParseFloat(r.FormValue("opacity"), 64)
+	scale, _ := strconv.ParseFloat(r.FormValue("scale"), 64)
+	wm.Opacity, wm.Scale = opacity/100, scale/100
+
+	switch r.FormValue("mode") {
+	case "none":
+		return nil, nil
+	case "text":
+		wm.Text = r.FormValue("text")
+		if strings.TrimSpace(wm.Text) == "" {
+			return nil, fmt.Errorf("%w: text required", image.ErrInvalidWatermark)
+		}
+	case "image":
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			defer file.Close()
+			wm.Image, err = io.ReadAll(io.LimitReader(file, image.MaxWatermarkImageBytes+1))
+			if err != nil {
+				return nil, err
+			}
+		} else if current != nil {
+			wm.Image = current.Image
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown mode", image.ErrInvalidWatermark)
+	}
+
+	if err := wm.Normalize(); err != nil {
+		return nil, err
+	}
+	return &storage.Watermark{
+		Text:     wm.Text,
+		Image:    wm.Image,
+		Position: wm.Position,
+		Opacity:  wm.Opacity,
+		Scale:    wm.Scale,
+	}, nil
+}
+
+// storeImage zapisuje przetworzony obraz w dwóch fazach: najpierw rekord ze
+// statusem writing, potem warianty, a status ready dopiero gdy wszystkie są
+// trwale zapisane. Obraz przerwany awarią usuwa przy starcie
+// Filesystem.RecoverInterruptedWrites. Przy błędzie sprząta rekord i pliki.
+func storeImage(db *storage.DB, fs *storage.Filesystem, img *storage.Image, results []image.ProcessResult) (int64, error) {
+	img.Status = storage.ImageStatusWriting
+	imageID, err := db.InsertImage(img)
+	if err != nil {
+		fs.Delete(img.Slug)
+		return 0, fmt.Errorf("insert image: %w", err)
+	}
+	img.ID = imageID
+
+	for _, res := range results {
+		if err = fs.Save(img.Slug, res.Name, res.Data); err != nil {
+			err = fmt.Errorf("save %s: %w", res.Name, err)
+			break
+		}
+	}
+	if err == nil {
+		var ok bool
+		if ok, err = db.MarkImageReady(img.Slug); err == nil && !ok {
+			err = errors.New("image deleted while being stored")
+		}
+	}
+	if err != nil {
+		fs.Delete(img.Slug)
+		db.DeleteImageBySlug(img.Slug)
+		return 0, err
+	}
+	img.Status = storage.ImageStatusReady
+	return imageID, nil
+}
+
+// saveWatermarkedVariants nadpisuje warianty istniejącego obrazka i zapisuje
+// klucz znaku wodnego; bez znaku usuwa nieaktualną kopię clean.
+func saveWatermarkedVariants(db *storage.DB, fs *storage.Filesystem, slug string, results []image.ProcessResult, watermarkKey string) error {
+	hasClean := false
+	for _, res := range results {
+		if err := fs.Save(slug, res.Name, res.Data); err != nil {
+			return err
+		}
+		hasClean = hasClean || res.Name == image.CleanVariant
+	}
+	if !hasClean {
+		if err := fs.DeleteVariant(slug, image.CleanVariant); err != nil {
+			return err
+		}
+	}
+	if err := db.SetImageWatermarkKey(slug, watermarkKey); err != nil {
+		logging.Get("watermark").Printf("set watermark key %s: %v", slug, err)
+	}
+	return nil
+}
@@ -22,7 +22,7 @@ func testEditSetup(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 	t.Helper()
 	cfg := testutil.TestConfig(t)
 	db, _ := testutil.TestDB(t)
-	fs, _ := testutil.TestFilesystem(t)
+	fs, _ := testutil.TestFilesystem(t, db)
 	handler := NewImageEditHandler(db, fs, image.NewProcessor(), cfg)
 	return cfg, db, fs, handler
 }
@@ -105,6 +105,63 @@ func TestImageViewHandler_EditMode(t *testing.T) {
 	}
 }
 
+func TestImageViewHandler_Metadata(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	cfg := testutil.TestConfig(t)
+	h := NewImageViewHandler(db, cfg)
+
+	now := time.Now().Unix()
+	id, err := db.InsertImage(&storage.Image{Slug: "exif1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	if err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+	lat, lon := 52.2297, 21.0122
+	saveImageMetadata(db, id, &image.Metadata{
+		CameraMake:   "FUJIFILM",
+		CameraModel:  "X-T4",
+		ExposureTime: "1/250",
+		FNumber:      2,
+		GPSLat:       &lat,
+		GPSLon:       &lon,
+	}, true)
+
+	req := httptest.NewRequest("GET", "/i/exif1", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req, "exif1")
+
+	body := rec.Body.String()
+	for _, want := range []string{"FUJIFILM X-T4", "1/250 s", "f/2", "openstreetmap.org/?mlat=52.2297"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in response", want)
+		}
+	}
+}
+
+func TestImageViewHandler_Placeholder(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	cfg := testutil.TestConfig(t)
+	h := NewImageViewHandler(db, cfg)
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{
+		Slug: "lqip1", MimeType: "image/jpeg", Width: 800, Height: 600,
+		LQIP: "data:image/webp;base64,UklGRg==", DominantColor: "#336699",
+		CreatedAt: now, AccessedAt: now,
+	})
+
+	req := httptest.NewRequest("GET", "/i/lqip1", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req, "lqip1")
+
+	body := rec.Body.String()
+	want := `style="background: #336699 url(data:image/webp;base64,UklGRg==) center / contain no-repeat"`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected placeholder style %q in response", want)
+	}
+}
+
 func TestImageEditHandler_Unauthorized(t *testing.T) {
 	_, db, _, h := testEditSetup(t)
 
@@ -132,6 +189,44 @@ func TestImageEditHandler_Unauthorized(t *testing.T) {
 	}
 }
 
+func TestImageEditHandler_Trashed(t *testing.T) {
+	_, db, _, h := testEditSetup(t)
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "gone01", MimeType: "image/jpeg", EditToken: "tok", CreatedAt: now, AccessedAt: now})
+	db.TrashImage("gone01", storage.DeletedByOwner)
+
+	tests := []struct {
+		name string
+		slug string
+		want int
+	}{
+		{"trashed", "gone01", http.StatusGone},
+		{"missing", "nope01", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/i/"+tt.slug+"/edit?edit=tok", nil), tt.slug)
+			if rec.Code != tt.want {
+				t.Errorf("edit status = %d, want %d", rec.Code, tt.want)
+			}
+
+			rec = httptest.NewRecorder()
+			h.Revisions(rec, httptest.NewRequest("GET", "/i/"+tt.slug+"/revisions?edit=tok", nil), tt.slug, nil)
+			if rec.Code != tt.want {
+				t.Errorf("revisions status = %d, want %d", rec.Code, tt.want)
+			}
+
+			rec = httptest.NewRecorder()
+			h.RestoreOriginal(rec, httptest.NewRequest("POST", "/i/"+tt.slug+"/restore?edit=tok", nil), tt.slug)
+			if rec.Code != tt.want {
+				t.Errorf("restore status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
 func TestImageEditHandler_AuthorizedGet(t *testing.T) {
 	_, db, _, h := testEditSetup(t)
 
@@ -163,6 +258,64 @@ func TestImageEditHandler_AuthorizedGet(t *testing.T) {
 	}
 }
 
+func TestImageEditHandler_AnimatedRejected(t *testing.T) {
+	_, db, _, h := testEditSetup(t)
+
+	now := time.Now().Unix()
+	img := &storage.Image{
+		Slug:       "anim1",
+		MimeType:   "image/gif",
+		FileSize:   10,
+		Frames:     5,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		AccessedAt: now,
+		EditToken:  "token-anim",
+	}
+	if _, err := db.InsertImage(img); err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+
+	req := createEditMultipartRequest(t, "/i/anim1/edit", "file", "edit.jpg", testutil.SampleJPEG(), "overwrite")
+	req.Header.Set("X-Edit-Token", "token-anim")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req, "anim1")
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestImageEditHandler_AnimationTooLarge(t *testing.T) {
+	cfg, db, _, h := testEditSetup(t)
+	cfg.MaxImageMegapixels = 1
+
+	now := time.Now().Unix()
+	img := &storage.Image{
+		Slug:       "big1",
+		MimeType:   "image/jpeg",
+		FileSize:   10,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		AccessedAt: now,
+		EditToken:  "token-big",
+	}
+	if _, err := db.InsertImage(img); err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+
+	req := createEditMultipartRequest(t, "/i/big1/edit", "file", "frames.gif", testutil.AnimatedGIF(500, 500, 10), "overwrite")
+	req.Header.Set("X-Edit-Token", "token-big")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req, "big1")
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
 func TestImageEditHandler_PostNew(t *testing.T) {
 	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
 		t.Skipf("image processing unavailable: %v", err)
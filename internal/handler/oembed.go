@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"dajtu/internal/config"
+	"dajtu/internal/image"
+	"dajtu/internal/storage"
+)
+
+// shareImageWidth to domyślna maksymalna szerokość podglądu dla Discorda,
+// Facebooka i oEmbed bez maxwidth; więcej żaden z nich nie pokazuje
+const shareImageWidth = 1200
+
+// shareImage to wariant obrazka pokazywany w podglądzie linku
+type shareImage struct {
+	URL    string
+	Type   string // "" gdy format zależy od Accept
+	Width  int
+	Height int
+}
+
+// shareMeta to dane meta OpenGraph / Twitter Card strony (partial
+// social-meta) razem z adresem oEmbed do discovery
+type shareMeta struct {
+	Type        string // website albo article
+	Title       string
+	Description string
+	URL         string
+	Image       *shareImage
+	OEmbedURL   string
+}
+
+// shareVariant wybiera preset do podglądu: największy contain mieszczący
+// się w maxWidth x maxHeight (0 = bez limitu). Pomijamy AVIF, którego
+// crawlery nie czytają. Gdy nic się nie mieści, bierzemy najmniejszy
+// i skalujemy wymiary, które podajemy.
+func shareVariant(img *storage.Image, maxWidth, maxHeight int) (image.Preset, int, int, bool) {
+	var best, smallest image.Preset
+	var bestW, bestH, smallW, smallH int
+	for _, p := range image.Presets() {
+		if p.Fit == image.FitCover || p.Fit == image.FitFill || p.Format == image.FormatAVIF {
+			continue
+		}
+		w, h := p.OutputSize(img.Width, img.Height)
+		if smallW == 0 || w < smallW {
+			smallest, smallW, smallH = p, w, h
+		}
+		if (maxWidth > 0 && w > maxWidth) || (maxHeight > 0 && h > maxHeight) {
+			continue
+		}
+		if w > bestW {
+			best, bestW, bestH = p, w, h
+		}
+	}
+	if bestW > 0 {
+		return best, bestW, bestH, true
+	}
+	if smallW == 0 {
+		return image.Preset{}, 0, 0, false
+	}
+	// skala w dół, żeby zmieścić się w obu limitach
+	w, h := smallW, smallH
+	if maxWidth > 0 && w > maxWidth {
+		w, h = maxWidth, max(1, h*maxWidth/w)
+	}
+	if maxHeight > 0 && h > maxHeight {
+		w, h = max(1, w*maxHeight/h), maxHeight
+	}
+	return smallest, w, h, true
+}
+
+// imageShare zwraca podgląd obrazka; nil dopóki nie jest przetworzony
+func imageShare(baseURL string, img *storage.Image, maxWidth, maxHeight int) *shareImage {
+	if img == nil || img.Width <= 0 || img.Height <= 0 || (img.Status != "" && img.Status != storage.ImageStatusReady) {
+		return nil
+	}
+	p, w, h, ok := shareVariant(img, maxWidth, maxHeight)
+	if !ok {
+		return nil
+	}
+	return &shareImage{
+		URL:    fmt.Sprintf("%s?v=%d", buildImageURL(baseURL, img.Slug, p.Name), img.UpdatedAt),
+		Type:   string(p.Format),
+		Width:  w,
+		Height: h,
+	}
+}
+
+// oembedDiscoveryURL to adres /oembed dla strony pageURL
+func oembedDiscoveryURL(baseURL, pageURL string) string {
+	return baseURL + "/oembed?url=" + url.QueryEscape(pageURL) + "&format=json"
+}
+
+func imageShareMeta(baseURL string, img *storage.Image) shareMeta {
+	pageURL := baseURL + "/i/" + img.Slug
+	return shareMeta{
+		Type:        "article",
+		Title:       imageTitle(img),
+		Description: "Obrazek na dajtu",
+		URL:         pageURL,
+		Image:       imageShare(baseURL, img, shareImageWidth, 0),
+		OEmbedURL:   oembedDiscoveryURL(baseURL, pageURL),
+	}
+}
+
+// galleryShareMeta; cover to pierwszy gotowy obrazek galerii albo nil
+func galleryShareMeta(baseURL string, gallery *storage.Gallery, cover *storage.Image, total int) shareMeta {
+	pageURL := baseURL + "/g/" + gallery.Slug
+	description := gallery.Description
+	if description == "" {
+		description = fmt.Sprintf("Galeria na dajtu: %d zdjęć", total)
+	}
+	return shareMeta{
+		Type:        "website",
+		Title:       galleryTitle(gallery),
+		Description: description,
+		URL:         pageURL,
+		Image:       imageShare(baseURL, cover, shareImageWidth, 0),
+		OEmbedURL:   oembedDiscoveryURL(baseURL, pageURL),
+	}
+}
+
+// galleryCover zwraca pierwszy gotowy obrazek z listy
+func galleryCover(images []*storage.Image) *storage.Image {
+	for _, img := range images {
+		if img.Status == "" || img.Status == storage.ImageStatusReady {
+			return img
+		}
+	}
+	return nil
+}
+
+func imageTitle(img *storage.Image) string {
+	if img.OriginalName != "" {
+		return img.OriginalName
+	}
+	return img.Slug
+}
+
+func galleryTitle(gallery *storage.Gallery) string {
+	if gallery.Title != "" {
+		return gallery.Title
+	}
+	return "Galeria"
+}
+
+// OEmbedResponse to odpowiedź /oembed (https://oembed.com), typ photo dla
+// obrazków, rich dla galerii i link dla galerii bez gotowych zdjęć
+type OEmbedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	URL             string `json:"url,omitempty"`
+	HTML            string `json:"html,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+type OEmbedHandler struct {
+	cfg *config.Config
+	db  *storage.DB
+}
+
+func NewOEmbedHandler(cfg *config.Config, db *storage.DB) *OEmbedHandler {
+	return &OEmbedHandler{cfg: cfg, db: db}
+}
+
+// ServeHTTP obsługuje GET /oembed?url=...&format=json[&maxwidth=&maxheight=]
+// dla adresów /i/{slug} i /g/{slug} tego serwera
+func (h *OEmbedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "json" {
+		http.Error(w, "only format=json is supported", http.StatusNotImplemented)
+		return
+	}
+	maxWidth, _ := strconv.Atoi(q.Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(q.Get("maxheight"))
+	if maxWidth <= 0 && maxHeight <= 0 {
+		maxWidth = shareImageWidth
+	}
+
+	baseURL := getBaseURL(h.cfg, r)
+	kind, slug, ok := parseEmbedURL(baseURL, q.Get("url"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var resp *OEmbedResponse
+	switch kind {
+	case "i":
+		img, err := h.db.GetImageBySlug(slug)
+		if err != nil || img == nil {
+			break
+		}
+		resp = imageOEmbed(baseURL, img, maxWidth, maxHeight)
+	case "g":
+		gallery, err := h.db.GetGalleryBySlug(slug)
+		if err != nil || gallery == nil {
+			break
+		}
+		images, err := h.db.GetGalleryImages(gallery.ID)
+		if err != nil {
+			http.Error(w, "error loading images", http.StatusInternalServerError)
+			return
+		}
+		resp = galleryOEmbed(baseURL, gallery, galleryCover(images), maxWidth, maxHeight)
+	}
+	if resp == nil {
+		if kind == "g" {
+			galleryNotFound(w, r, h.db, slug)
+		} else {
+			ImageNotFound(w, r, h.db, slug)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseEmbedURL rozpoznaje /i/{slug}, /i/{slug}.webp, /i/{slug}/{preset}
+// i /g/{slug} na hoście baseURL; kind to "i" albo "g"
+func parseEmbedURL(baseURL, raw string) (kind, slug string, ok bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", "", false
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || (parts[0] != "i" && parts[0] != "g") {
+		return "", "", false
+	}
+	slug = parts[1]
+	if parts[0] == "i" {
+		slug = strings.TrimSuffix(slug, ".webp")
+	} else if len(parts) > 2 {
+		return "", "", false
+	}
+	if slug == "" {
+		return "", "", false
+	}
+	return parts[0], slug, true
+}
+
+func newOEmbedResponse(baseURL, kind, title string) *OEmbedResponse {
+	return &OEmbedResponse{
+		Type:         kind,
+		Version:      "1.0",
+		Title:        title,
+		ProviderName: "dajtu",
+		ProviderURL:  baseURL,
+	}
+}
+
+// setThumbnail dodaje miniaturę (preset thumb), jeśli taki jest
+func (resp *OEmbedResponse) setThumbnail(baseURL string, img *storage.Image) {
+	p, ok := image.LookupPreset("thumb")
+	if !ok {
+		return
+	}
+	resp.ThumbnailURL = fmt.Sprintf("%s?v=%d", buildImageURL(baseURL, img.Slug, p.Name), img.UpdatedAt)
+	resp.ThumbnailWidth, resp.ThumbnailHeight = p.OutputSize(img.Width, img.Height)
+}
+
+func imageOEmbed(baseURL string, img *storage.Image, maxWidth, maxHeight int) *OEmbedResponse {
+	share := imageShare(baseURL, img, maxWidth, maxHeight)
+	if share == nil {
+		return nil
+	}
+	resp := newOEmbedResponse(baseURL, "photo", imageTitle(img))
+	resp.URL = share.URL
+	resp.Width, resp.Height = share.Width, share.Height
+	resp.setThumbnail(baseURL, img)
+	return resp
+}
+
+// galleryOEmbed osadza okładkę galerii z linkiem do niej
+func galleryOEmbed(baseURL string, gallery *storage.Gallery, cover *storage.Image, maxWidth, maxHeight int) *OEmbedResponse {
+	title := galleryTitle(gallery)
+	share := imageShare(baseURL, cover, maxWidth, maxHeight)
+	if share == nil {
+		return newOEmbedResponse(baseURL, "link", title)
+	}
+	resp := newOEmbedResponse(baseURL, "rich", title)
+	resp.HTML = fmt.Sprintf(`<a href="%s" target="_blank"><img src="%s" width="%d" height="%d" alt="%s"></a>`,
+		html.EscapeString(baseURL+"/g/"+gallery.Slug), html.EscapeString(share.URL), share.Width, share.Height, html.EscapeString(title))
+	resp.Width, resp.Height = share.Width, share.Height
+	resp.setThumbnail(baseURL, cover)
+	return resp
+}
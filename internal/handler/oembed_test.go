@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+func TestShareVariant(t *testing.T) {
+	big := &storage.Image{Width: 4000, Height: 3000}
+	tests := []struct {
+		name                string
+		img                 *storage.Image
+		maxWidth, maxHeight int
+		preset              string
+		w, h                int
+	}{
+		{"default width", big, 1200, 0, "1200", 1200, 900},
+		{"between presets", big, 1000, 0, "800", 800, 600},
+		{"height limit", big, 0, 700, "800", 800, 600},
+		{"nothing fits", big, 400, 0, "800", 400, 300},
+		{"small image", &storage.Image{Width: 600, Height: 400}, 1200, 0, "original", 600, 400},
+	}
+	for _, tt := range tests {
+		p, w, h, ok := shareVariant(tt.img, tt.maxWidth, tt.maxHeight)
+		if !ok || p.Name != tt.preset || w != tt.w || h != tt.h {
+			t.Errorf("%s: shareVariant() = %s %dx%d %v, want %s %dx%d", tt.name, p.Name, w, h, ok, tt.preset, tt.w, tt.h)
+		}
+	}
+}
+
+func TestParseEmbedURL(t *testing.T) {
+	tests := []struct {
+		raw, kind, slug string
+		ok              bool
+	}{
+		{"http://localhost:8080/i/abc12", "i", "abc12", true},
+		{"http://LOCALHOST:8080/i/abc12.webp", "i", "abc12", true},
+		{"http://localhost:8080/i/abc12/thumb.webp", "i", "abc12", true},
+		{"http://localhost:8080/g/gal01", "g", "gal01", true},
+		{"http://localhost:8080/g/gal01/download.zip", "", "", false},
+		{"http://evil.example/i/abc12", "", "", false},
+		{"http://localhost:8080/u/someone", "", "", false},
+		{"/i/abc12", "", "", false},
+		{"http://localhost:8080/i/", "", "", false},
+	}
+	for _, tt := range tests {
+		kind, slug, ok := parseEmbedURL("http://localhost:8080", tt.raw)
+		if kind != tt.kind || slug != tt.slug || ok != tt.ok {
+			t.Errorf("parseEmbedURL(%q) = %q, %q, %v", tt.raw, kind, slug, ok)
+		}
+	}
+}
+
+func oembedRequest(h *OEmbedHandler, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/oembed?"+query, nil))
+	return rec
+}
+
+func TestOEmbedHandler(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	cfg := testutil.TestConfig(t)
+	h := NewOEmbedHandler(cfg, db)
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "gal01", EditToken: "tok", Title: `Wakacje "2024"`, CreatedAt: now, UpdatedAt: now})
+	db.InsertGallery(&storage.Gallery{Slug: "gal02", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+	db.InsertImage(&storage.Image{Slug: "emb01", OriginalName: "sunset.jpg", MimeType: "image/jpeg", Width: 4000, Height: 3000, GalleryID: &galleryID, CreatedAt: now, UpdatedAt: now, AccessedAt: now})
+	db.InsertImage(&storage.Image{Slug: "emb02", MimeType: "image/jpeg", Status: storage.ImageStatusPending, CreatedAt: now, AccessedAt: now})
+
+	pageURL := func(path string) string { return "url=" + url.QueryEscape("http://localhost:8080"+path) }
+
+	rec := oembedRequest(h, pageURL("/i/emb01")+"&format=json&maxwidth=1000")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("image status = %d", rec.Code)
+	}
+	var photo OEmbedResponse
+	json.NewDecoder(rec.Body).Decode(&photo)
+	if photo.Type != "photo" || photo.Version != "1.0" || photo.Title != "sunset.jpg" {
+		t.Errorf("photo = %+v", photo)
+	}
+	if !strings.HasPrefix(photo.URL, "http://localhost:8080/i/emb01/800.webp?v=") || photo.Width != 800 || photo.Height != 600 {
+		t.Errorf("photo variant = %s %dx%d", photo.URL, photo.Width, photo.Height)
+	}
+	if photo.ThumbnailWidth != 200 || !strings.Contains(photo.ThumbnailURL, "/i/emb01/thumb.webp") {
+		t.Errorf("thumbnail = %s %dx%d", photo.ThumbnailURL, photo.ThumbnailWidth, photo.ThumbnailHeight)
+	}
+
+	rec = oembedRequest(h, pageURL("/g/gal01"))
+	var rich OEmbedResponse
+	json.NewDecoder(rec.Body).Decode(&rich)
+	if rich.Type != "rich" || rich.Width != 1200 || rich.Height != 900 {
+		t.Errorf("gallery = %+v", rich)
+	}
+	if !strings.Contains(rich.HTML, `href="http://localhost:8080/g/gal01"`) || !strings.Contains(rich.HTML, `alt="Wakacje &#34;2024&#34;"`) {
+		t.Errorf("gallery html = %s", rich.HTML)
+	}
+
+	rec = oembedRequest(h, pageURL("/g/gal02"))
+	var link OEmbedResponse
+	json.NewDecoder(rec.Body).Decode(&link)
+	if link.Type != "link" || link.Title != "Galeria" || link.HTML != "" {
+		t.Errorf("empty gallery = %+v", link)
+	}
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{pageURL("/i/emb01") + "&format=xml", http.StatusNotImplemented},
+		{pageURL("/i/nope1"), http.StatusNotFound},
+		{pageURL("/i/emb02"), http.StatusNotFound},
+		{"url=" + url.QueryEscape("http://other.example/i/emb01"), http.StatusNotFound},
+		{"", http.StatusNotFound},
+	} {
+		if rec := oembedRequest(h, tt.query); rec.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.query, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestImageViewHandler_ShareMeta(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	cfg := testutil.TestConfig(t)
+	h := NewImageViewHandler(db, cfg)
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "og001", OriginalName: `"quoted" <name>.jpg`, MimeType: "image/jpeg", Width: 3000, Height: 2000, CreatedAt: now, UpdatedAt: now, AccessedAt: now})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/i/og001", nil), "og001")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`<meta property="og:image" content="http://localhost:8080/i/og001/1200.webp?v=`,
+		`<meta property="og:image:width" content="1200">`,
+		`<meta property="og:image:height" content="800">`,
+		`<meta property="og:title" content="&#34;quoted&#34; &lt;name&gt;.jpg">`,
+		`<meta name="twitter:card" content="summary_large_image">`,
+		`<link rel="alternate" type="application/json+oembed" href="http://localhost:8080/oembed?url=http%3A%2F%2Flocalhost%3A8080%2Fi%2Fog001&amp;format=json"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %s", want)
+		}
+	}
+}
+
+func TestGalleryHandler_View_ShareMeta(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	db.InsertGallery(&storage.Gallery{Slug: "ogg01", EditToken: "tok", Title: "Zlot", CreatedAt: now, UpdatedAt: now})
+
+	rec := httptest.NewRecorder()
+	h.View(rec, httptest.NewRequest("GET", "/g/ogg01", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `<meta property="og:title" content="Zlot">`) {
+		t.Error("gallery page lacks og:title")
+	}
+	if !strings.Contains(body, `<meta name="twitter:card" content="summary">`) || strings.Contains(body, "og:image") {
+		t.Error("empty gallery should get a summary card without og:image")
+	}
+	if !strings.Contains(body, "application/json+oembed") {
+		t.Error("gallery page lacks oEmbed discovery link")
+	}
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"dajtu/internal/config"
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
+	"dajtu/internal/storage"
+)
+
+// errNotFailed: ponowić można tylko obraz, którego przetwarzanie się nie udało
+var errNotFailed = errors.New("image processing has not failed")
+
+// processInBackground mówi, czy upload tej wielkości przetwarzamy w tle
+// (ASYNC_PROCESSING_MB, 0 = zawsze synchronicznie)
+func processInBackground(cfg *config.Config, size int) bool {
+	return cfg.AsyncProcessingMB > 0 && int64(size) >= int64(cfg.AsyncProcessingMB)*1024*1024
+}
+
+// queuePendingImage zapisuje upload jako źródło do ponowienia, wstawia rekord
+// ze statusem pending i kolejkuje przetwarzanie. Przy błędzie (też
+// image.ErrQueueFull) sprząta rekord i katalog obrazu. Takie obrazy nie są
+// deduplikowane: odcisk treści powstaje dopiero po przetworzeniu.
+func queuePendingImage(db *storage.DB, fs *storage.Filesystem, processor *image.Processor, img *storage.Image, data []byte, params image.TransformParams) (int64, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	if err := fs.SavePending(img.Slug, data, encoded); err != nil {
+		fs.Delete(img.Slug)
+		return 0, err
+	}
+
+	img.Status = storage.ImageStatusPending
+	imageID, err := db.InsertImage(img)
+	if err != nil {
+		fs.Delete(img.Slug)
+		return 0, err
+	}
+	img.ID = imageID
+
+	if err := startProcessing(db, fs, processor, img, data, params); err != nil {
+		// najpierw pliki: po usunięciu rekordu bloby zebrałby dopiero cleanup
+		fs.Delete(img.Slug)
+		if delErr := db.DeleteImageBySlug(img.Slug); delErr != nil {
+			logging.Get("processing").Printf("rollback pending image %s: %v", img.Slug, delErr)
+		}
+		return 0, err
+	}
+	return imageID, nil
+}
+
+// startProcessing kolejkuje warianty obrazu; znak wodny ustalamy przy
+// każdym podejściu, ponowienie bierze aktualny
+func startProcessing(db *storage.DB, fs *storage.Filesystem, processor *image.Processor, img *storage.Image, data []byte, params image.TransformParams) error {
+	var watermarkKey string
+	params.Watermark, watermarkKey = imageWatermark(db, img.GalleryID, img.UserID)
+	slug := img.Slug
+	return processor.ProcessAsync(data, params, func(results []image.ProcessResult, err error) {
+		finishProcessing(db, fs, slug, watermarkKey, results, err)
+	})
+}
+
+// finishProcessing zapisuje warianty i oznacza obraz jako gotowy albo
+// nieudany. Obraz usunięty w trakcie przetwarzania traci też katalog,
+// żeby nie zostały osierocone pliki.
+func finishProcessing(db *storage.DB, fs *storage.Filesystem, slug, watermarkKey string, results []image.ProcessResult, err error) {
+	log := logging.Get("processing")
+	fail := func(reason error) {
+		if err := fs.DeleteVariants(slug); err != nil {
+			log.Printf("delete variants %s: %v", slug, err)
+		}
+		found, err := db.FailImageProcessing(slug, reason.Error())
+		if err != nil {
+			log.Printf("mark %s failed: %v", slug, err)
+		} else if !found {
+			fs.Delete(slug)
+		}
+		log.Printf("processing failed slug=%s: %v", slug, reason)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var totalSize int64
+	if key, err := fs.OriginalKey(slug, "original"); err == nil {
+		if info, err := fs.Stat(key); err == nil {
+			totalSize = info.Size
+		}
+	}
+	for _, res := range results {
+		if err := fs.Save(slug, res.Name, res.Data); err != nil {
+			fail(err)
+			return
+		}
+		totalSize += int64(len(res.Data))
+	}
+
+	placeholder := imagePlaceholder(results)
+	fingerprint := imageFingerprint(results)
+	found, err := db.CompleteImageProcessing(&storage.Image{
+		Slug:          slug,
+		FileSize:      totalSize,
+		Width:         results[0].Width,
+		Height:        results[0].Height,
+		Frames:        results[0].Frames,
+		LQIP:          placeholder.LQIP,
+		DominantColor: placeholder.Color,
+		PHash:         fingerprint.DHash,
+		PixelSHA:      fingerprint.PixelHash,
+		WatermarkKey:  watermarkKey,
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	if !found {
+		log.Printf("image %s deleted while processing, removing files", slug)
+		fs.Delete(slug)
+		return
+	}
+	if err := fs.DeletePending(slug); err != nil {
+		log.Printf("delete pending source %s: %v", slug, err)
+	}
+	log.Printf("processing completed slug=%s variants=%d", slug, len(results))
+}
+
+// requeueImage kolejkuje ponownie obraz z zachowanego źródła
+func requeueImage(db *storage.DB, fs *storage.Filesystem, processor *image.Processor, img *storage.Image) error {
+	data, encoded, err := fs.ReadPending(img.Slug)
+	if err != nil {
+		return err
+	}
+	var params image.TransformParams
+	if err := json.Unmarshal(encoded, &params); err != nil {
+		return err
+	}
+	return startProcessing(db, fs, processor, img, data, params)
+}
+
+// retryProcessing ponawia nieudane przetwarzanie (panel admina). Gdy
+// kolejka jest pełna, obraz wraca do stanu failed.
+func retryProcessing(db *storage.DB, fs *storage.Filesystem, processor *image.Processor, img *storage.Image) error {
+	ok, err := db.RetryImageProcessing(img.Slug)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotFailed
+	}
+	if err := requeueImage(db, fs, processor, img); err != nil {
+		db.FailImageProcessing(img.Slug, err.Error())
+		return err
+	}
+	return nil
+}
+
+// ResumePendingImages kolejkuje obrazy, które czekały na przetworzenie przy
+// poprzednim zamknięciu serwera. Te, które się nie zmieszczą w kolejce albo
+// nie mają źródła, są oznaczane jako nieudane do ponowienia z panelu.
+func ResumePendingImages(db *storage.DB, fs *storage.Filesystem, processor *image.Processor) (int, error) {
+	images, err := db.GetImagesByStatus(storage.ImageStatusPending, 10000)
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, img := range images {
+		if err := requeueImage(db, fs, processor, img); err != nil {
+			logging.Get("processing").Printf("resume %s: %v", img.Slug, err)
+			db.FailImageProcessing(img.Slug, err.Error())
+			continue
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// markProcessing uzupełnia odpowiedź uploadu obrazu przetwarzanego w tle
+func markProcessing(resp *UploadResponse, baseURL string) {
+	resp.Status = "processing"
+	resp.StatusURL = baseURL + "/i/" + resp.Slug + "/status"
+}
+
+// imageNotReady odpowiada 409, gdy obraz nie ma jeszcze wariantów
+func imageNotReady(w http.ResponseWriter, img *storage.Image) bool {
+	if img.Status == "" || img.Status == storage.ImageStatusReady {
+		return false
+	}
+	jsonError(w, "image is still processing", http.StatusConflict)
+	return true
+}
+
+// ImageStatusResponse to odpowiedź GET /i/{slug}/status
+type ImageStatusResponse struct {
+	Slug    string            `json:"slug"`
+	Status  string            `json:"status"` // pending, ready albo failed
+	Width   int               `json:"width,omitempty"`
+	Height  int               `json:"height,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	ViewURL string            `json:"view_url,omitempty"`
+	Sizes   map[string]string `json:"sizes,omitempty"`
+}
+
+// Status obsługuje GET /i/{slug}/status; przyczyny błędu nie pokazujemy
+// publicznie, widać ją w panelu admina
+func (h *UploadHandler) Status(w http.ResponseWriter, r *http.Request, slug string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	img, err := h.db.GetImageBySlug(slug)
+	if err != nil || img == nil {
+		jsonError(w, "image not found", http.StatusNotFound)
+		return
+	}
+
+	resp := ImageStatusResponse{Slug: slug, Status: img.Status}
+	if img.Status == storage.ImageStatusReady {
+		baseURL := getBaseURL(h.cfg, r)
+		resp.Width, resp.Height = img.Width, img.Height
+		resp.Sizes = presetURLs(baseURL, slug)
+		resp.URL = resp.Sizes["original"]
+		resp.ViewURL = baseURL + "/i/" + slug
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/middleware"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+// blockedPool returns a one-worker pool whose worker (and, with fillQueue,
+// its only queue slot) is held until the test ends.
+func blockedPool(t *testing.T, fillQueue bool) *image.Pool {
+	t.Helper()
+	pool := image.NewPool(1, 1, 0)
+	unblock := make(chan struct{})
+	t.Cleanup(func() {
+		close(unblock)
+		pool.Close()
+	})
+	block := func() error {
+		<-unblock
+		return nil
+	}
+	for s := pool.Stats(); s.Active == 0; s = pool.Stats() {
+		if s.Queued == 0 {
+			pool.Go(block)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if fillQueue {
+		pool.Go(block)
+	}
+	return pool
+}
+
+// insertPendingImage stores a pending image with its upload kept for retries.
+func insertPendingImage(t *testing.T, db *storage.DB, fs *storage.Filesystem, slug, status string) *storage.Image {
+	t.Helper()
+	now := time.Now().Unix()
+	img := &storage.Image{Slug: slug, MimeType: "image/jpeg", Status: status, CreatedAt: now, AccessedAt: now}
+	id, err := db.InsertImage(img)
+	if err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+	img.ID = id
+	if err := fs.SavePending(slug, testutil.SampleJPEG(), []byte(`{"filters":{}}`)); err != nil {
+		t.Fatalf("SavePending() error = %v", err)
+	}
+	return img
+}
+
+// waitForStatus polls until the image leaves the pending state.
+func waitForStatus(t *testing.T, db *storage.DB, slug string) *storage.Image {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		img, _ := db.GetImageBySlug(slug)
+		if img == nil || img.Status != storage.ImageStatusPending {
+			return img
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("image %s still pending", slug)
+	return nil
+}
+
+// paddedJPEG is a valid JPEG grown past size bytes with trailing data,
+// which decoders ignore.
+func paddedJPEG(size int) []byte {
+	data := testutil.SampleJPEG()
+	return append(data, bytes.Repeat([]byte{0}, size-len(data))...)
+}
+
+func TestUploadHandler_Async(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.AsyncProcessingMB = 1
+
+	h := NewUploadHandler(cfg, db, fs, image.NewProcessor())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, createMultipartRequest(t, "file", "big.jpg", paddedJPEG(1024*1024)))
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", rec.Code, rec.Body.String())
+	}
+	var resp UploadResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Status != "processing" || resp.StatusURL != "http://test.local/i/"+resp.Slug+"/status" || resp.EditToken == "" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	img := waitForStatus(t, db, resp.Slug)
+	if img == nil {
+		t.Fatal("image row gone after processing")
+	}
+	_, _, pendingErr := fs.ReadPending(resp.Slug)
+	switch img.Status {
+	case storage.ImageStatusReady:
+		if img.Width == 0 || !fs.Exists(resp.Slug) || pendingErr == nil {
+			t.Errorf("ready image: width=%d pending source err=%v", img.Width, pendingErr)
+		}
+		if _, err := fs.Stat(fs.Key(resp.Slug, "original")); err != nil {
+			t.Errorf("original variant missing: %v", err)
+		}
+	case storage.ImageStatusFailed:
+		// libvips unavailable: the upload stays for a retry, no variants
+		if pendingErr != nil || img.ProcessingError == "" {
+			t.Errorf("failed image: pending source err=%v reason=%q", pendingErr, img.ProcessingError)
+		}
+		if _, err := fs.Stat(fs.Key(resp.Slug, "original")); err == nil {
+			t.Error("failed processing left a variant")
+		}
+	default:
+		t.Errorf("status = %q", img.Status)
+	}
+}
+
+func TestUploadHandler_AsyncQueueFull(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.AsyncProcessingMB = 1
+	cfg.KeepOriginalFormat = true
+
+	h := NewUploadHandler(cfg, db, fs, image.NewPooledProcessor(blockedPool(t, true)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, createMultipartRequest(t, "file", "big.jpg", paddedJPEG(1024*1024)))
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if count, _ := db.CountImagesAdmin(); count != 0 {
+		t.Errorf("images after rejected upload = %d", count)
+	}
+	slugDirs, _ := filepath.Glob(filepath.Join(cfg.DataDir, "images", "*", "*"))
+	if len(slugDirs) != 0 {
+		t.Errorf("rejected upload left %v", slugDirs)
+	}
+}
+
+func TestGalleryHandler_CreateAsync(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.AsyncProcessingMB = 1
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "big.jpg")
+	part.Write(paddedJPEG(1024 * 1024))
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/gallery", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	NewGalleryHandler(cfg, db, fs, image.NewPooledProcessor(blockedPool(t, false))).Create(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp GalleryCreateResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Images) != 1 || resp.Images[0].Status != "processing" {
+		t.Fatalf("images = %+v", resp.Images)
+	}
+	img, _ := db.GetImageBySlug(resp.Images[0].Slug)
+	if img == nil || img.Status != storage.ImageStatusPending || img.GalleryID == nil {
+		t.Errorf("queued image = %+v", img)
+	}
+}
+
+func TestUploadHandler_Status(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	h := NewUploadHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "ready", MimeType: "image/jpeg", Width: 40, Height: 30, CreatedAt: now, AccessedAt: now})
+	insertPendingImage(t, db, fs, "wait1", storage.ImageStatusPending)
+	db.FailImageProcessing("wait1", "vips: /data/images/secret")
+
+	tests := []struct {
+		slug   string
+		code   int
+		status string
+	}{
+		{"ready", http.StatusOK, storage.ImageStatusReady},
+		{"wait1", http.StatusOK, storage.ImageStatusFailed},
+		{"nope1", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.Status(rec, httptest.NewRequest(http.MethodGet, "/i/"+tt.slug+"/status", nil), tt.slug)
+		if rec.Code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.slug, rec.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var resp ImageStatusResponse
+		json.NewDecoder(bytes.NewReader(rec.Body.Bytes())).Decode(&resp)
+		if resp.Status != tt.status {
+			t.Errorf("%s: status = %q, want %q", tt.slug, resp.Status, tt.status)
+		}
+		if strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("%s: failure reason leaked: %s", tt.slug, rec.Body.String())
+		}
+		if ready := tt.status == storage.ImageStatusReady; ready != (resp.URL != "") || (ready && resp.Width != 40) {
+			t.Errorf("%s: response = %+v", tt.slug, resp)
+		}
+	}
+}
+
+func TestFinishProcessing(t *testing.T) {
+	_, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	results := []image.ProcessResult{
+		{Name: "original", Data: []byte("webp"), Width: 800, Height: 600, Frames: 1},
+		{Name: "thumb", Data: []byte("tiny"), Width: 200, Height: 150, Frames: 1},
+	}
+
+	insertPendingImage(t, db, fs, "done1", storage.ImageStatusPending)
+	finishProcessing(db, fs, "done1", "", results, nil)
+	img, _ := db.GetImageBySlug("done1")
+	if img.Status != storage.ImageStatusReady || img.Width != 800 || img.FileSize != 8 {
+		t.Errorf("completed image = %+v", img)
+	}
+	if _, _, err := fs.ReadPending("done1"); err == nil {
+		t.Error("pending source kept after success")
+	}
+
+	insertPendingImage(t, db, fs, "fail1", storage.ImageStatusPending)
+	fs.Save("fail1", "thumb", []byte("partial"))
+	finishProcessing(db, fs, "fail1", "", nil, errors.New("vips error"))
+	img, _ = db.GetImageBySlug("fail1")
+	if img.Status != storage.ImageStatusFailed || img.ProcessingError != "vips error" {
+		t.Errorf("failed image = %+v", img)
+	}
+	if _, err := fs.Stat(fs.Key("fail1", "thumb")); err == nil {
+		t.Error("partial variant kept after failure")
+	}
+	if _, _, err := fs.ReadPending("fail1"); err != nil {
+		t.Errorf("pending source lost after failure: %v", err)
+	}
+
+	// deleted while processing: no orphaned directory either way
+	for _, err := range []error{nil, errors.New("vips error")} {
+		insertPendingImage(t, db, fs, "gone1", storage.ImageStatusPending)
+		db.DeleteImageBySlug("gone1")
+		finishProcessing(db, fs, "gone1", "", results, err)
+		if fs.Exists("gone1") {
+			t.Errorf("directory of a deleted image left (err=%v)", err)
+		}
+	}
+}
+
+func TestResumePendingImages(t *testing.T) {
+	_, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	insertPendingImage(t, db, fs, "wait1", storage.ImageStatusPending)
+	insertPendingImage(t, db, fs, "lost1", storage.ImageStatusPending)
+	fs.DeletePending("lost1")
+
+	processor := image.NewPooledProcessor(blockedPool(t, false))
+	queued, err := ResumePendingImages(db, fs, processor)
+	if err != nil || queued != 1 {
+		t.Fatalf("ResumePendingImages() = %d, %v; want 1", queued, err)
+	}
+	if img, _ := db.GetImageBySlug("wait1"); img.Status != storage.ImageStatusPending {
+		t.Errorf("queued image status = %q", img.Status)
+	}
+	if img, _ := db.GetImageBySlug("lost1"); img.Status != storage.ImageStatusFailed {
+		t.Errorf("image without source status = %q, want failed", img.Status)
+	}
+}
+
+func TestAdminHandler_RetryImage(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	fs, _ := testutil.TestFilesystem(t, db)
+	cfg := testutil.TestConfig(t)
+	pool := blockedPool(t, false)
+	h := NewAdminHandler(cfg, db, fs, middleware.NewTrafficStats(), image.NewPooledProcessor(pool), nil)
+
+	failed := insertPendingImage(t, db, fs, "fail1", storage.ImageStatusPending)
+	db.FailImageProcessing("fail1", "vips error")
+
+	retry := func(img *storage.Image) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/images/"+itoa(img.ID)+"/retry", nil)
+		req.SetPathValue("id", itoa(img.ID))
+		rec := httptest.NewRecorder()
+		h.RetryImage(rec, req)
+		return rec
+	}
+
+	if rec := retry(failed); rec.Code != http.StatusSeeOther {
+		t.Fatalf("retry status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if img, _ := db.GetImageBySlug("fail1"); img.Status != storage.ImageStatusPending || img.ProcessingError != "" {
+		t.Errorf("after retry = %q %q", img.Status, img.ProcessingError)
+	}
+	if pool.Stats().Queued != 1 {
+		t.Errorf("Queued = %d, want the retried job", pool.Stats().Queued)
+	}
+
+	// a second click while it is queued does nothing
+	if rec := retry(failed); rec.Code != http.StatusConflict {
+		t.Errorf("retry of a pending image status = %d, want 409", rec.Code)
+	}
+
+	// the queue is full now: the image goes back to failed
+	other := insertPendingImage(t, db, fs, "fail2", storage.ImageStatusPending)
+	db.FailImageProcessing("fail2", "vips error")
+	if rec := retry(other); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("retry with full queue status = %d, want 503", rec.Code)
+	}
+	if img, _ := db.GetImageBySlug("fail2"); img.Status != storage.ImageStatusFailed {
+		t.Errorf("after rejected retry status = %q", img.Status)
+	}
+}
+
+func TestPendingPlaceholders(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "gal1", EditToken: "t", CreatedAt: now, UpdatedAt: now})
+	img := insertPendingImage(t, db, fs, "wait1", storage.ImageStatusPending)
+	db.AddImageToGallery(galleryID, img.ID)
+
+	rec := httptest.NewRecorder()
+	NewImageViewHandler(db, cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/i/wait1", nil), "wait1")
+	if body := rec.Body.String(); !strings.Contains(body, "processingPlaceholder") || strings.Contains(body, `src="/i/wait1/1200`) {
+		t.Errorf("image page of a pending image has no placeholder")
+	}
+
+	rec = httptest.NewRecorder()
+	NewGalleryHandler(cfg, db, fs, image.NewProcessor()).View(rec, httptest.NewRequest(http.MethodGet, "/g/gal1", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "gallery-item pending") || strings.Contains(body, "/i/wait1/thumb.webp") {
+		t.Errorf("gallery tile of a pending image has no placeholder")
+	}
+
+	// the editor waits for the variants
+	db.InsertImage(&storage.Image{Slug: "wait2", MimeType: "image/jpeg", EditToken: "tok", Status: storage.ImageStatusPending, CreatedAt: now, AccessedAt: now})
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/i/wait2/edit", nil)
+	req.Header.Set("X-Edit-Token", "tok")
+	NewImageEditHandler(db, fs, image.NewProcessor(), cfg).ServeHTTP(rec, req, "wait2")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("edit of an unprocessed image status = %d, want 409", rec.Code)
+	}
+}
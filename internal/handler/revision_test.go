@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goimage "image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/middleware"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+func insertRevisionImage(t *testing.T, db *storage.DB, slug string, owner *int64) *storage.Image {
+	t.Helper()
+	now := time.Now().Unix()
+	img := &storage.Image{Slug: slug, MimeType: "image/png", UserID: owner, CreatedAt: now, UpdatedAt: now, AccessedAt: now, EditToken: "tok-" + slug}
+	id, err := db.InsertImage(img)
+	if err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+	img.ID = id
+	return img
+}
+
+func revisionRequest(method, url, token string) *http.Request {
+	req := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("X-Edit-Token", token)
+	}
+	return req
+}
+
+func TestImageEditHandler_Revisions_List(t *testing.T) {
+	_, db, fs, h := testEditSetup(t)
+	img := insertRevisionImage(t, db, "rev01", nil)
+	other := insertRevisionImage(t, db, "rev02", nil)
+
+	first := &storage.ImageRevision{ImageID: img.ID, Params: `{"rotation":90}`, FromSource: true, Width: 20, Height: 10}
+	db.InsertImageRevision(first)
+	db.InsertImageRevision(&storage.ImageRevision{ImageID: img.ID, RevertedFrom: &first.ID})
+	foreign := &storage.ImageRevision{ImageID: other.ID}
+	db.InsertImageRevision(foreign)
+	fs.Save("rev01", "original", []byte("x"))
+	fs.SaveRevision("rev01", first.ID, []byte("revision-bytes"))
+
+	rec := httptest.NewRecorder()
+	h.Revisions(rec, revisionRequest("GET", "/i/rev01/revisions", ""), "rev01", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("list without token = %d, want 403", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Revisions(rec, revisionRequest("GET", "/i/rev01/revisions", "tok-rev01"), "rev01", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list status = %d, want 200", rec.Code)
+	}
+	var list []revisionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(list) != 2 || list[1].ID != first.ID || list[0].RevertedFrom == nil || *list[0].RevertedFrom != first.ID {
+		t.Fatalf("list = %+v", list)
+	}
+	if string(list[1].Params) != `{"rotation":90}` || !list[1].FromSource || list[1].URL != "/i/rev01/revisions/"+itoa(first.ID) {
+		t.Errorf("first revision = %+v", list[1])
+	}
+
+	rec = httptest.NewRecorder()
+	h.Revisions(rec, revisionRequest("GET", "/i/rev01/revisions/x", "tok-rev01"), "rev01", []string{itoa(first.ID)})
+	if rec.Code != http.StatusOK || rec.Body.String() != "revision-bytes" {
+		t.Errorf("revision file = %d %q", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "private, no-cache" {
+		t.Errorf("revision file Cache-Control = %q", cc)
+	}
+
+	for name, parts := range map[string][]string{
+		"other image's revision": {itoa(foreign.ID)},
+		"unknown revision":       {"999"},
+		"not a number":           {"abc"},
+		"unknown action":         {itoa(first.ID), "delete"},
+	} {
+		rec = httptest.NewRecorder()
+		h.Revisions(rec, revisionRequest("GET", "/i/rev01/revisions/x", "tok-rev01"), "rev01", parts)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", name, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.Revisions(rec, revisionRequest("GET", "/i/rev01/revisions/x/revert", "tok-rev01"), "rev01", []string{itoa(first.ID), "revert"})
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET revert = %d, want 405", rec.Code)
+	}
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// widePNG is 4x2, so a quarter turn shows in the stored dimensions
+func widePNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, goimage.NewNRGBA(goimage.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func postFromSource(t *testing.T, h *ImageEditHandler, slug, token string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("from_source", "true")
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", "/i/"+slug+"/edit", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Edit-Token", token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req, slug)
+	return rec
+}
+
+func TestImageEditHandler_FromSourceAndRevert(t *testing.T) {
+	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	_, db, fs, h := testEditSetup(t)
+	img := insertRevisionImage(t, db, "src01", nil)
+	results, err := image.Process(widePNG(t))
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	for _, res := range results {
+		fs.Save("src01", res.Name, res.Data)
+	}
+
+	rec := postFromSource(t, h, "src01", "tok-src01", map[string]string{"rotation": "90", "mode": "overwrite"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first edit = %d %s", rec.Code, rec.Body.String())
+	}
+	// the second edit starts from the source again, not from the rotated result
+	rec = postFromSource(t, h, "src01", "tok-src01", map[string]string{"flipH": "true", "mode": "overwrite"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second edit = %d %s", rec.Code, rec.Body.String())
+	}
+	edited, _ := db.GetImageBySlug("src01")
+	if !edited.Edited || edited.Width != 4 || edited.Height != 2 {
+		t.Errorf("after second edit edited=%v %dx%d, want 4x2", edited.Edited, edited.Width, edited.Height)
+	}
+	if !fs.HasBackup("src01") {
+		t.Error("no backup of the source")
+	}
+
+	revs, _ := db.GetImageRevisions(img.ID)
+	if len(revs) != 2 || !revs[1].FromSource || !strings.Contains(revs[1].Params, `"rotation":90`) {
+		t.Fatalf("revisions = %+v", revs)
+	}
+	if _, err := fs.Stat(fs.RevisionKey("src01", revs[1].ID)); err != nil {
+		t.Errorf("revision file missing: %v", err)
+	}
+
+	req := revisionRequest("POST", "/i/src01/revisions/x/revert", "tok-src01")
+	rec = httptest.NewRecorder()
+	h.Revisions(rec, req, "src01", []string{itoa(revs[1].ID), "revert"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revert = %d %s", rec.Code, rec.Body.String())
+	}
+	reverted, _ := db.GetImageBySlug("src01")
+	if reverted.Width != 2 || reverted.Height != 4 {
+		t.Errorf("after revert %dx%d, want the rotated 2x4", reverted.Width, reverted.Height)
+	}
+	revs, _ = db.GetImageRevisions(img.ID)
+	if len(revs) != 3 || revs[0].RevertedFrom == nil || *revs[0].RevertedFrom != revs[2].ID {
+		t.Errorf("revert not recorded: %+v", revs[0])
+	}
+}
+
+func TestImageEditHandler_RestoreRecordsRevision(t *testing.T) {
+	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	_, db, fs, h := testEditSetup(t)
+	user, _ := db.GetOrCreateBratUser("restorer")
+	img := insertRevisionImage(t, db, "rst01", &user.ID)
+	fs.Save("rst01", "original", widePNG(t))
+
+	rec := postFromSource(t, h, "rst01", "tok-rst01", map[string]string{"rotation": "270", "mode": "overwrite"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("edit = %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest("POST", "/i/rst01/restore", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, user))
+	rec = httptest.NewRecorder()
+	h.RestoreOriginal(rec, req, "rst01")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore = %d %s", rec.Code, rec.Body.String())
+	}
+
+	restored, _ := db.GetImageBySlug("rst01")
+	if restored.Edited || restored.Width != 4 {
+		t.Errorf("after restore edited=%v width=%d", restored.Edited, restored.Width)
+	}
+	revs, _ := db.GetImageRevisions(img.ID)
+	if len(revs) != 2 || revs[0].Params == revs[1].Params {
+		t.Errorf("revisions = %+v", revs)
+	}
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"dajtu/internal/storage"
+)
+
+// etagCacheLimit bounds the memoized file hashes; the map is simply reset
+// when full, hashes are recomputed on the next request.
+const etagCacheLimit = 10000
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+var (
+	etagMu    sync.Mutex
+	etagCache = make(map[string]etagEntry)
+)
+
+// contentETag zwraca silny ETag z hasha zawartości
+func contentETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// contentETagFor hashuje zawartość raz na (nazwa, mtime, rozmiar); edycja
+// nadpisuje plik, więc zmienia też ETag
+func contentETagFor(name string, content io.ReadSeeker, modTime time.Time, size int64) (string, error) {
+	etagMu.Lock()
+	entry, ok := etagCache[name]
+	etagMu.Unlock()
+	if ok && entry.modTime.Equal(modTime) && entry.size == size {
+		return entry.etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := contentETag(h.Sum(nil))
+
+	etagMu.Lock()
+	if len(etagCache) >= etagCacheLimit {
+		etagCache = make(map[string]etagEntry)
+	}
+	etagCache[name] = etagEntry{modTime: modTime, size: size, etag: etag}
+	etagMu.Unlock()
+	return etag, nil
+}
+
+// imageModTime to Last-Modified obrazka: updated_at, a dla starszych
+// rekordów bez niego created_at
+func imageModTime(img *storage.Image) time.Time {
+	ts := max(img.UpdatedAt, img.CreatedAt)
+	if ts <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
+
+// setImageCacheHeaders ustawia nagłówki cache. Adresy z ?v={updated_at}
+// (jak w szablonach) są niezmienne; bez wersji przeglądarka po godzinie
+// rewaliduje ETagiem, żeby edycja była widoczna. Cache-Control ustawiony
+// wcześniej przez wywołującego (np. private) zostaje.
+func setImageCacheHeaders(w http.ResponseWriter, r *http.Request, img *storage.Image, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
+	if v := r.URL.Query().Get("v"); v != "" && v == strconv.FormatInt(img.UpdatedAt, 10) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+}
+
+// ServeImageFile serwuje plik z lokalnego dysku (cache wariantów)
+func ServeImageFile(w http.ResponseWriter, r *http.Request, img *storage.Image, path, contentType string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	etag, err := contentETagFor(path, f, info.ModTime(), info.Size())
+	if err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	serveImageContent(w, r, img, etag, f, contentType)
+}
+
+// ServeImageBlob serwuje obrazek z magazynu obrazów. Gdy magazyn umie
+// podpisywać adresy i przekierowania są włączone, klient dostaje 302 na
+// podpisany adres i pobiera plik prosto z bucketu.
+func ServeImageBlob(w http.ResponseWriter, r *http.Request, fs *storage.Filesystem, img *storage.Image, key, contentType string) {
+	if u, ok := fs.PresignedURL(key); ok {
+		// podpis wygasa, więc przekierowania nie wolno cache'ować na długo
+		w.Header().Set("Cache-Control", "private, no-cache")
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+	b, err := fs.Open(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer b.Close()
+	etag, err := blobETag(b)
+	if err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	serveImageContent(w, r, img, etag, b, contentType)
+}
+
+// blobETag bierze ETag z metadanych: hash bloba adresowanego treścią albo
+// ETag z HEAD-a S3. Hashowanie całej zawartości zostaje dla plików bez
+// takiej informacji (lokalne pliki spoza blobów) — przy S3 byłoby to
+// drugie pobranie całego obiektu.
+func blobETag(b storage.Blob) (string, error) {
+	info := b.Info()
+	if info.ETag != "" {
+		return `"` + info.ETag + `"`, nil
+	}
+	return contentETagFor("blob:"+info.Key, b, info.ModTime, info.Size)
+}
+
+// serveImageContent dokłada ETag i Last-Modified; If-None-Match,
+// If-Modified-Since i Range obsługuje http.ServeContent
+func serveImageContent(w http.ResponseWriter, r *http.Request, img *storage.Image, etag string, content io.ReadSeeker, contentType string) {
+	setImageCacheHeaders(w, r, img, contentType)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", imageModTime(img), content)
+}
+
+// ServeImageBytes serwuje obrazek wygenerowany w pamięci (gdy zapis do cache się nie udał)
+func ServeImageBytes(w http.ResponseWriter, r *http.Request, img *storage.Image, data []byte, contentType string) {
+	sum := sha256.Sum256(data)
+	setImageCacheHeaders(w, r, img, contentType)
+	w.Header().Set("ETag", contentETag(sum[:]))
+	http.ServeContent(w, r, "", imageModTime(img), bytes.NewReader(data))
+}
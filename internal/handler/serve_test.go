@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/storage"
+	"dajtu/internal/storage/s3test"
+	"dajtu/internal/testutil"
+)
+
+func serveFile(t *testing.T, img *storage.Image, path string, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ServeImageFile(rec, req, img, path, "image/webp")
+	return rec
+}
+
+func TestServeImageFile_Validators(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "original.webp")
+	os.WriteFile(path, []byte("RIFF....WEBPVP8 first"), 0644)
+	updated := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+	img := &storage.Image{Slug: "abcd", CreatedAt: updated - 100, UpdatedAt: updated}
+
+	rec := serveFile(t, img, path, httptest.NewRequest("GET", "/i/abcd.webp", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+	if len(etag) != 34 || !strings.HasPrefix(etag, `"`) {
+		t.Errorf("ETag = %q, want strong 32-hex tag", etag)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != "Sat, 01 Mar 2025 12:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", got)
+	}
+	if cc := rec.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+		t.Errorf("unversioned URL Cache-Control = %q, must not be immutable", cc)
+	}
+
+	req := httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("If-None-Match", etag)
+	if rec := serveFile(t, img, path, req); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("If-Modified-Since", "Sat, 01 Mar 2025 12:00:00 GMT")
+	if rec := serveFile(t, img, path, req); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since status = %d, want 304", rec.Code)
+	}
+
+	// an edit rewrites the file and bumps updated_at
+	os.WriteFile(path, []byte("RIFF....WEBPVP8 edited"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	img.UpdatedAt = updated + 60
+
+	req = httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = serveFile(t, img, path, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match status = %d, want 200", rec.Code)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("ETag did not change after edit")
+	}
+}
+
+func TestServeImageFile_VersionedImmutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thumb.webp")
+	os.WriteFile(path, []byte("thumb"), 0644)
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+
+	rec := serveFile(t, img, path, httptest.NewRequest("GET", "/i/abcd/thumb?v=1700000000", nil))
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("current version Cache-Control = %q, want immutable", cc)
+	}
+	rec = serveFile(t, img, path, httptest.NewRequest("GET", "/i/abcd/thumb?v=1600000000", nil))
+	if cc := rec.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+		t.Errorf("old version Cache-Control = %q, must not be immutable", cc)
+	}
+}
+
+func TestServeImageFile_Range(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "original.jpg")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+
+	req := httptest.NewRequest("GET", "/i/abcd/original", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := serveFile(t, img, path, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("Range = %d %q, want 206 %q", rec.Code, rec.Body.String(), "2345")
+	}
+}
+
+func TestServeImageFile_Missing(t *testing.T) {
+	img := &storage.Image{Slug: "abcd"}
+	rec := serveFile(t, img, filepath.Join(t.TempDir(), "nope.webp"), httptest.NewRequest("GET", "/i/abcd.webp", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServeImageBytes_ETag(t *testing.T) {
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+
+	rec := httptest.NewRecorder()
+	ServeImageBytes(rec, httptest.NewRequest("GET", "/i/abcd/800", nil), img, []byte("avif"), "image/avif")
+	etag := rec.Header().Get("ETag")
+	if etag == "" || rec.Body.String() != "avif" || rec.Header().Get("Content-Type") != "image/avif" {
+		t.Fatalf("response = %q etag=%q type=%q", rec.Body.String(), etag, rec.Header().Get("Content-Type"))
+	}
+
+	req := httptest.NewRequest("GET", "/i/abcd/800", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	ServeImageBytes(rec, req, img, []byte("avif"), "image/avif")
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", rec.Code)
+	}
+}
+
+func s3Filesystem(t *testing.T, presignTTL time.Duration) (*storage.Filesystem, *s3test.Server) {
+	t.Helper()
+	srv := s3test.NewServer(t)
+	store, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:  srv.URL,
+		Region:    s3test.Region,
+		Bucket:    s3test.Bucket,
+		AccessKey: s3test.AccessKey,
+		SecretKey: s3test.SecretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store() error = %v", err)
+	}
+	db, _ := testutil.TestDB(t)
+	return storage.NewBlobFilesystem(store, db, presignTTL), srv
+}
+
+func TestServeImageBlob_S3(t *testing.T) {
+	fs, _ := s3Filesystem(t, 0)
+	fs.Save("abcd", "original", []byte("0123456789"))
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+	key := fs.Key("abcd", "original")
+
+	rec := httptest.NewRecorder()
+	ServeImageBlob(rec, httptest.NewRequest("GET", "/i/abcd.webp", nil), fs, img, key, "image/webp")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" || etag == "" {
+		t.Fatalf("GET = %d %q etag=%q", rec.Code, rec.Body.String(), etag)
+	}
+
+	req := httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("Range", "bytes=7-")
+	rec = httptest.NewRecorder()
+	ServeImageBlob(rec, req, fs, img, key, "image/webp")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "789" {
+		t.Errorf("Range = %d %q, want 206 %q", rec.Code, rec.Body.String(), "789")
+	}
+
+	req = httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	ServeImageBlob(rec, req, fs, img, key, "image/webp")
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", rec.Code)
+	}
+
+	// nowa zawartość to nowy blob, więc i nowy ETag
+	fs.Save("abcd", "original", []byte("edited"))
+	req = httptest.NewRequest("GET", "/i/abcd.webp", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	ServeImageBlob(rec, req, fs, img, key, "image/webp")
+	if rec.Code != http.StatusOK || rec.Body.String() != "edited" || rec.Header().Get("ETag") == etag {
+		t.Errorf("after edit = %d %q etag=%q", rec.Code, rec.Body.String(), rec.Header().Get("ETag"))
+	}
+
+	rec = httptest.NewRecorder()
+	ServeImageBlob(rec, httptest.NewRequest("GET", "/i/nope.webp", nil), fs, img, fs.Key("nope1", "original"), "image/webp")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing blob status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServeImageBlob_S3ETagWithoutDownload(t *testing.T) {
+	fs, srv := s3Filesystem(t, 0)
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+	fs.Save("abcd", "original", []byte("0123456789"))
+	// plik sprzed adresowania treścią leży pod własnym kluczem
+	legacy := fs.Key("abcd", "thumb")
+	fs.Store().Put(legacy, []byte("legacy"))
+
+	for _, key := range []string{fs.Key("abcd", "original"), legacy} {
+		rec := httptest.NewRecorder()
+		ServeImageBlob(rec, httptest.NewRequest("GET", "/i/abcd.webp", nil), fs, img, key, "image/webp")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: GET = %d etag=%q", key, rec.Code, etag)
+		}
+
+		gets := srv.Requests(http.MethodGet)
+		req := httptest.NewRequest("GET", "/i/abcd.webp", nil)
+		req.Header.Set("If-None-Match", etag)
+		rec = httptest.NewRecorder()
+		ServeImageBlob(rec, req, fs, img, key, "image/webp")
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: If-None-Match status = %d, want 304", key, rec.Code)
+		}
+		if n := srv.Requests(http.MethodGet) - gets; n != 0 {
+			t.Errorf("%s: 304 downloaded the object %d times", key, n)
+		}
+	}
+	// jedno pobranie na odpowiedź 200, bez hashowania całego obiektu
+	if n := srv.Requests(http.MethodGet); n != 2 {
+		t.Errorf("GET requests = %d, want 2", n)
+	}
+}
+
+func TestServeImageBlob_Presigned(t *testing.T) {
+	fs, _ := s3Filesystem(t, 10*time.Minute)
+	fs.Save("abcd", "original", []byte("webp"))
+	img := &storage.Image{Slug: "abcd", UpdatedAt: 1700000000}
+
+	rec := httptest.NewRecorder()
+	ServeImageBlob(rec, httptest.NewRequest("GET", "/i/abcd.webp", nil), fs, img, fs.Key("abcd", "original"), "image/webp")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", rec.Code)
+	}
+	resp, err := http.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("follow redirect: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "webp" {
+		t.Errorf("presigned GET = %d %q", resp.StatusCode, body)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "no-cache") {
+		t.Errorf("redirect Cache-Control = %q", cc)
+	}
+}
@@ -1,10 +1,12 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"html/template"
 	"net/http"
-	"path/filepath"
+	"path"
 	"strconv"
 	"time"
 
@@ -27,11 +29,17 @@ func NewUploadHandler(cfg *config.Config, db *storage.DB, fs *storage.Filesystem
 }
 
 type UploadResponse struct {
-	Slug      string            `json:"slug"`
-	URL       string            `json:"url,omitempty"`
-	ViewURL   string            `json:"view_url,omitempty"`
-	Sizes     map[string]string `json:"sizes,omitempty"`
-	EditToken string            `json:"edit_token,omitempty"`
+	Slug      string                 `json:"slug"`
+	URL       string                 `json:"url,omitempty"`
+	ViewURL   string                 `json:"view_url,omitempty"`
+	Sizes     map[string]string      `json:"sizes,omitempty"`
+	EditToken string                 `json:"edit_token,omitempty"`
+	Metadata  *storage.ImageMetadata `json:"metadata,omitempty"`
+	Embed     EmbedCodes             `json:"embed"`
+	Duplicate bool                   `json:"duplicate,omitempty"` // slug istniejącego obrazu o tej samej treści
+	// Status "processing": warianty powstają w tle, stan pod StatusURL
+	Status    string `json:"status,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
 }
 
 var extToMime = map[string]string{
@@ -40,6 +48,9 @@ var extToMime = map[string]string{
 	".gif":  "image/gif",
 	".webp": "image/webp",
 	".avif": "image/avif",
+	".heic": "image/heic",
+	".tiff": "image/tiff",
+	".bmp":  "image/bmp",
 }
 
 func parseTransformParams(r *http.Request) image.TransformParams {
@@ -75,6 +86,26 @@ func parseTransformParams(r *http.Request) image.TransformParams {
 		}
 	}
 
+	// Filtry kolorów; zakresy przycina image.Filters.Clamp
+	intField := func(name string) int {
+		value, _ := strconv.Atoi(r.FormValue(name))
+		return value
+	}
+	floatField := func(name string) float64 {
+		value, _ := strconv.ParseFloat(r.FormValue(name), 64)
+		return value
+	}
+	params.Filters = image.Filters{
+		Brightness: intField("brightness"),
+		Contrast:   intField("contrast"),
+		Saturation: intField("saturation"),
+		Gamma:      floatField("gamma"),
+		Sharpen:    floatField("sharpen"),
+		Blur:       floatField("blur"),
+		Grayscale:  r.FormValue("grayscale") == "true",
+		Sepia:      r.FormValue("sepia") == "true",
+	}.Clamp()
+
 	return params
 }
 
@@ -133,8 +164,25 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reject decompression bombs before libvips allocates the canvas
+	if err := image.CheckDimensions(data, imageLimits(h.cfg)); err != nil {
+		if err == image.ErrImageTooLarge {
+			logging.Get("upload").Printf("upload.Create: image dimensions too large")
+			jsonError(w, imageTooLargeMessage(h.cfg), http.StatusRequestEntityTooLarge)
+			return
+		}
+		logging.Get("upload").Printf("upload.Create: unreadable image header: %v", err)
+		jsonError(w, "invalid image format", http.StatusBadRequest)
+		return
+	}
+
+	// Read EXIF/XMP now; processing strips it
+	meta := image.ExtractMetadata(data)
+
 	// Generate unique slug (5 chars for images)
 	slug := h.db.GenerateUniqueSlug("images", 5)
+	// Pliki powstają przed rekordem; scrubber nie może ich wziąć za sieroty
+	defer h.fs.Claim(slug)()
 
 	var originalSize int64
 	if h.cfg.KeepOriginalFormat {
@@ -146,34 +194,137 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var userID *int64
+	if user := middleware.GetUser(r); user != nil {
+		userID = &user.ID
+	}
+
+	transformParams := parseTransformParams(r)
+
+	// Large files: answer now, the variants are generated in the background
+	if processInBackground(h.cfg, len(data)) {
+		if transformParams.HasTransforms() && image.FrameCount(data) > 1 {
+			h.fs.Delete(slug)
+			jsonError(w, "animated images cannot be edited", http.StatusBadRequest)
+			return
+		}
+		h.queueUpload(w, r, slug, header.Filename, format, originalSize, userID, data, transformParams, meta)
+		return
+	}
+
 	// Process image (re-encode + resize)
 	processStart := time.Now()
-	transformParams := parseTransformParams(r)
-	results, err := h.processor.ProcessWithTransform(data, transformParams)
+	var watermarkKey string
+	transformParams.Watermark, watermarkKey = imageWatermark(h.db, nil, userID)
+	results, err := h.processor.ProcessUpload(r.Context(), data, transformParams)
 	if err != nil {
 		logging.Get("upload").Printf("process error: %v", err)
 		h.fs.Delete(slug)
+		if ProcessingBusy(w, h.processor, err) {
+			return
+		}
+		if errors.Is(err, image.ErrAnimatedTransform) {
+			jsonError(w, "animated images cannot be edited", http.StatusBadRequest)
+			return
+		}
 		jsonError(w, "image processing failed", http.StatusInternalServerError)
 		return
 	}
 	logging.Get("upload").Printf("upload.Create: processing completed slug=%s variants=%d elapsed=%s", slug, len(results), time.Since(processStart))
 
-	// Save all sizes
+	// Same picture uploaded again: hand back the existing slug instead of
+	// storing another set of variants
+	fingerprint := imageFingerprint(results)
+	if dup := findDuplicate(h.cfg, h.db, fingerprint, userID); dup != nil {
+		h.fs.Delete(slug)
+		logging.Get("upload").Printf("upload.Create: duplicate of %s, discarding %s", dup.Slug, slug)
+
+		baseURL := getBaseURL(h.cfg, r)
+		sizes := presetURLs(baseURL, dup.Slug)
+		resp := UploadResponse{
+			Slug:      dup.Slug,
+			URL:       sizes["original"],
+			ViewURL:   baseURL + "/i/" + dup.Slug,
+			Sizes:     sizes,
+			Embed:     buildEmbedCodes(baseURL, dup, embedSize),
+			Duplicate: true,
+		}
+		// edit rights only for the owner, never for someone else's copy
+		if sameOwner(dup, userID) {
+			resp.EditToken = dup.EditToken
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
 	totalSize := originalSize
 	for _, res := range results {
-		if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-			logging.Get("upload").Printf("save error: %v", err)
-			h.fs.Delete(slug) // cleanup on failure
-			jsonError(w, "storage error", http.StatusInternalServerError)
-			return
-		}
 		totalSize += int64(len(res.Data))
 	}
 
 	// Store metadata
 	now := time.Now().Unix()
 	originalResult := results[0]
+	placeholder := imagePlaceholder(results)
+
+	editToken, err := generateEditToken()
+	if err != nil {
+		logging.Get("upload").Printf("generate token error: %v", err)
+		h.fs.Delete(slug)
+		jsonError(w, "token generation error", http.StatusInternalServerError)
+		return
+	}
 
+	img := &storage.Image{
+		Slug:          slug,
+		OriginalName:  header.Filename,
+		MimeType:      string(format),
+		FileSize:      totalSize,
+		Width:         originalResult.Width,
+		Height:        originalResult.Height,
+		Frames:        originalResult.Frames,
+		CreatedAt:     now,
+		AccessedAt:    now,
+		EditToken:     editToken,
+		LQIP:          placeholder.LQIP,
+		DominantColor: placeholder.Color,
+		PHash:         fingerprint.DHash,
+		PixelSHA:      fingerprint.PixelHash,
+		WatermarkKey:  watermarkKey,
+	}
+
+	// Save all sizes; the image is ready only once they are durable
+	imageID, err := storeImage(h.db, h.fs, img, results)
+	if err != nil {
+		logging.Get("upload").Printf("upload.Create: store error: %v", err)
+		jsonError(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	metadata := saveImageMetadata(h.db, imageID, meta, r.FormValue("keep_gps") == "true")
+
+	// Build response
+	baseURL := getBaseURL(h.cfg, r)
+
+	sizes := presetURLs(baseURL, slug)
+
+	resp := UploadResponse{
+		Slug:      slug,
+		URL:       sizes["original"],
+		ViewURL:   baseURL + "/i/" + slug,
+		Sizes:     sizes,
+		EditToken: editToken,
+		Metadata:  metadata,
+		Embed:     buildEmbedCodes(baseURL, img, embedSize),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// queueUpload stores a large upload as pending and answers with its slug
+// and status "processing".
+func (h *UploadHandler) queueUpload(w http.ResponseWriter, r *http.Request, slug, name string, format image.Format, originalSize int64, userID *int64, data []byte, params image.TransformParams, meta *image.Metadata) {
 	editToken, err := generateEditToken()
 	if err != nil {
 		logging.Get("upload").Printf("generate token error: %v", err)
@@ -182,61 +333,80 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now().Unix()
 	img := &storage.Image{
 		Slug:         slug,
-		OriginalName: header.Filename,
+		OriginalName: name,
 		MimeType:     string(format),
-		FileSize:     totalSize,
-		Width:        originalResult.Width,
-		Height:       originalResult.Height,
+		FileSize:     originalSize,
+		UserID:       userID,
 		CreatedAt:    now,
 		AccessedAt:   now,
 		EditToken:    editToken,
 	}
-
-	if _, err := h.db.InsertImage(img); err != nil {
-		logging.Get("upload").Printf("upload.Create: db insert error: %v", err)
-		h.fs.Delete(slug)
-		jsonError(w, "database error", http.StatusInternalServerError)
+	imageID, err := queuePendingImage(h.db, h.fs, h.processor, img, data, params)
+	if err != nil {
+		logging.Get("upload").Printf("upload.Create: queue slug=%s: %v", slug, err)
+		if ProcessingBusy(w, h.processor, err) {
+			return
+		}
+		jsonError(w, "storage error", http.StatusInternalServerError)
 		return
 	}
+	logging.Get("upload").Printf("upload.Create: queued slug=%s size=%d", slug, len(data))
+	metadata := saveImageMetadata(h.db, imageID, meta, r.FormValue("keep_gps") == "true")
 
-	// Build response
 	baseURL := getBaseURL(h.cfg, r)
-
-	sizes := make(map[string]string)
-	for _, res := range results {
-		sizes[res.Name] = buildImageURL(baseURL, slug, res.Name)
-	}
-
+	sizes := presetURLs(baseURL, slug)
 	resp := UploadResponse{
 		Slug:      slug,
 		URL:       sizes["original"],
 		ViewURL:   baseURL + "/i/" + slug,
 		Sizes:     sizes,
 		EditToken: editToken,
+		Metadata:  metadata,
+		Embed:     buildEmbedCodes(baseURL, img, embedSize),
 	}
+	markProcessing(&resp, baseURL)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *UploadHandler) ServeOriginal(w http.ResponseWriter, r *http.Request, slug string) {
-	path, err := h.fs.GetOriginalPath(slug, "original")
+	img, err := h.db.GetImageBySlug(slug)
+	if err != nil || img == nil {
+		ImageNotFound(w, r, h.db, slug)
+		return
+	}
+
+	// Watermarked or edited image: someone who can edit it gets the
+	// untouched source the editor renders from; everyone else gets the
+	// public original.webp, since the kept upload predates the edit and
+	// the watermark
+	key, err := h.fs.OriginalKey(slug, "original")
+	if img.WatermarkKey != "" || img.Edited {
+		if !canEditImage(h.db, r, img) {
+			ServeImageBlob(w, r, h.fs, img, h.fs.Key(slug, "original"), "image/webp")
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("Vary", "Cookie")
+		key, err = h.fs.EditSourceKey(slug), nil
+	}
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	ext := filepath.Ext(path)
+	ext := path.Ext(key)
 	contentType := extToMime[ext]
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	http.ServeFile(w, r, path)
+	ServeImageBlob(w, r, h.fs, img, key, contentType)
 }
 
 type ImageViewHandler struct {
@@ -253,7 +423,7 @@ func NewImageViewHandler(db *storage.DB, cfg *config.Config) *ImageViewHandler {
 func (h *ImageViewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, slug string) {
 	img, err := h.db.GetImageBySlug(slug)
 	if err != nil || img == nil {
-		http.Error(w, "Not found", 404)
+		ImageNotFound(w, r, h.db, slug)
 		return
 	}
 
@@ -265,13 +435,23 @@ func (h *ImageViewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, slu
 	editToken := r.URL.Query().Get("edit")
 	editMode := editToken != "" && img.EditToken != "" && editToken == img.EditToken
 
+	metadata, err := h.db.GetImageMetadata(img.ID)
+	if err != nil {
+		logging.Get("upload").Printf("image view: metadata error slug=%s: %v", slug, err)
+	}
+
 	baseURL := getBaseURL(h.cfg, r)
 	data := map[string]interface{}{
-		"Image":     img,
-		"BaseURL":   baseURL,
-		"CanEdit":   canEdit,
-		"EditToken": editToken,
-		"EditMode":  editMode,
+		"Image":       img,
+		"Placeholder": template.URL(img.LQIP), // data: URI z naszej bazy
+		"Metadata":    metadata,
+		"BaseURL":     baseURL,
+		"CanEdit":     canEdit,
+		"EditToken":   editToken,
+		"EditMode":    editMode,
+		"Focal":       ImageFocalPoint(img),
+		"Share":       imageShareMeta(baseURL, img),
+		"Embed":       buildEmbedCodes(baseURL, img, embedSize),
 	}
 
 	if err := h.tmpl.ExecuteTemplate(w, "image.html", data); err != nil {
@@ -295,62 +475,76 @@ func NewImageEditHandler(db *storage.DB, fs *storage.Filesystem, processor *imag
 
 func (h *ImageEditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, slug string) {
 	img, err := h.db.GetImageBySlug(slug)
-	if err != nil {
-		http.Error(w, "Not found", 404)
+	if err != nil || img == nil {
+		ImageNotFound(w, r, h.db, slug)
 		return
 	}
 
 	// Check authorization: user owns image OR valid edit token
-	authorized := false
 	user := middleware.GetUser(r)
-	if user != nil && img.UserID != nil && user.ID == *img.UserID {
-		authorized = true
-	}
-
-	// Check edit token from header or query param
-	if !authorized {
-		editToken := r.Header.Get("X-Edit-Token")
-		if editToken == "" {
-			editToken = r.URL.Query().Get("edit")
-		}
-		// Accept image's own edit token
-		if editToken != "" && img.EditToken != "" && editToken == img.EditToken {
-			authorized = true
-		}
-		// Accept gallery's edit token if image belongs to gallery
-		if !authorized && editToken != "" && img.GalleryID != nil {
-			gallery, err := h.db.GetGalleryByID(*img.GalleryID)
-			if err == nil && gallery != nil && gallery.EditToken == editToken {
-				authorized = true
-			}
-		}
-	}
-
-	if !authorized {
+	if !canEditImage(h.db, r, img) {
 		logging.Get("upload").Printf("upload.ImageEdit: unauthorized slug=%s has_edit_token=%v", slug, r.Header.Get("X-Edit-Token") != "" || r.URL.Query().Get("edit") != "")
 		http.Error(w, "Forbidden", 403)
 		return
 	}
 
+	// Nothing to edit until the background job stored the variants
+	if imageNotReady(w, img) {
+		return
+	}
+
 	if r.Method == "GET" {
+		editToken := r.Header.Get("X-Edit-Token")
+		if editToken == "" {
+			editToken = r.URL.Query().Get("edit")
+		}
 		h.tmpl.ExecuteTemplate(w, "edit_image.html", map[string]interface{}{
-			"Image": img,
+			"Image":     img,
+			"EditToken": editToken,
+			"Focal":     ImageFocalPoint(img),
 		})
 		return
 	}
 
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "No file", 400)
+	// The editor works on a single canvas frame; saving would flatten the animation
+	if img.IsAnimated() {
+		jsonError(w, "animated images cannot be edited", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	maxSize := int64(h.cfg.MaxFileSizeMB) * 1024 * 1024
-	_, data, err := image.ValidateAndDetect(file, maxSize)
-	if err != nil {
-		http.Error(w, "Invalid file", 400)
-		return
+	// Edytor wysyła parametry i serwer renderuje je z nietkniętego źródła;
+	// starsi klienci przysyłają gotowy plik
+	fromSource := r.FormValue("from_source") == "true"
+	var data []byte
+	if fromSource {
+		data, err = h.fs.Read(h.fs.EditSourceKey(slug))
+		if err != nil {
+			logging.Get("upload").Printf("upload.ImageEdit: read source slug=%s: %v", slug, err)
+			http.Error(w, "Source not found", 500)
+			return
+		}
+	} else {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "No file", 400)
+			return
+		}
+		defer file.Close()
+
+		maxSize := int64(h.cfg.MaxFileSizeMB) * 1024 * 1024
+		_, data, err = image.ValidateAndDetect(file, maxSize)
+		if err != nil {
+			http.Error(w, "Invalid file", 400)
+			return
+		}
+		if err := image.CheckDimensions(data, imageLimits(h.cfg)); err != nil {
+			if err == image.ErrImageTooLarge {
+				jsonError(w, imageTooLargeMessage(h.cfg), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid file", 400)
+			return
+		}
 	}
 
 	mode := r.FormValue("mode")
@@ -363,38 +557,43 @@ func (h *ImageEditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, slu
 		}
 
 		transformParams := parseTransformParams(r)
-		results, err := h.processor.ProcessWithTransform(data, transformParams)
+		var watermarkKey string
+		transformParams.Watermark, watermarkKey = imageWatermark(h.db, img.GalleryID, userID)
+		results, err := h.processor.ProcessUpload(r.Context(), data, transformParams)
 		if err != nil {
-			http.Error(w, "Process error", 500)
-			return
-		}
-
-		for _, res := range results {
-			if err := h.fs.Save(newSlug, res.Name, res.Data); err != nil {
-				h.fs.Delete(newSlug)
-				http.Error(w, "Save error", 500)
+			if ProcessingBusy(w, h.processor, err) {
 				return
 			}
+			http.Error(w, "Process error", 500)
+			return
 		}
 
 		originalResult := results[0]
+		placeholder := imagePlaceholder(results)
+		fingerprint := imageFingerprint(results)
 		newImg := &storage.Image{
-			Slug:         newSlug,
-			OriginalName: img.OriginalName,
-			MimeType:     "image/webp",
-			FileSize:     int64(len(data)),
-			Width:        originalResult.Width,
-			Height:       originalResult.Height,
-			UserID:       userID,
-			CreatedAt:    time.Now().Unix(),
-			AccessedAt:   time.Now().Unix(),
-			Edited:       true,
-			GalleryID:    img.GalleryID,
-		}
-
-		if _, err := h.db.InsertImage(newImg); err != nil {
-			h.fs.Delete(newSlug)
-			http.Error(w, "DB error", 500)
+			Slug:          newSlug,
+			OriginalName:  img.OriginalName,
+			MimeType:      "image/webp",
+			FileSize:      int64(len(data)),
+			Width:         originalResult.Width,
+			Height:        originalResult.Height,
+			Frames:        originalResult.Frames,
+			UserID:        userID,
+			CreatedAt:     time.Now().Unix(),
+			AccessedAt:    time.Now().Unix(),
+			Edited:        true,
+			GalleryID:     img.GalleryID,
+			LQIP:          placeholder.LQIP,
+			DominantColor: placeholder.Color,
+			PHash:         fingerprint.DHash,
+			PixelSHA:      fingerprint.PixelHash,
+			WatermarkKey:  watermarkKey,
+		}
+
+		if _, err := storeImage(h.db, h.fs, newImg, results); err != nil {
+			logging.Get("upload").Printf("edit: store %s: %v", newSlug, err)
+			http.Error(w, "Save error", 500)
 			return
 		}
 
@@ -403,56 +602,113 @@ func (h *ImageEditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, slu
 		return
 	}
 
-	if !img.Edited {
+	// The first backup is the source of every later edit, never replace it
+	if !h.fs.HasBackup(slug) {
 		if err := h.fs.SaveBackup(slug); err != nil {
 			logging.Get("upload").Printf("backup failed: %v", err)
 		}
 	}
 
-	transformParams := parseTransformParams(r)
-	results, err := h.processor.ProcessWithTransform(data, transformParams)
-	if err != nil {
-		http.Error(w, "Process error", 500)
+	if _, ok := h.applyEdit(r.Context(), w, img, data, parseTransformParams(r), fromSource, nil); !ok {
 		return
 	}
 
-	for _, res := range results {
-		if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-			http.Error(w, "Save error", 500)
-			return
+	if err := h.db.MarkImageEdited(slug); err != nil {
+		http.Error(w, "DB error", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"slug": slug})
+}
+
+// applyEdit renders data with params into the variants of img, updates its
+// metadata and records the result as a new revision. It writes the error
+// response itself and reports whether the edit went through.
+func (h *ImageEditHandler) applyEdit(ctx context.Context, w http.ResponseWriter, img *storage.Image, data []byte, params image.TransformParams, fromSource bool, revertedFrom *int64) (*storage.ImageRevision, bool) {
+	slug := img.Slug
+	var watermarkKey string
+	params.Watermark, watermarkKey = imageWatermark(h.db, img.GalleryID, img.UserID)
+	results, err := h.processor.ProcessUpload(ctx, data, params)
+	if err != nil {
+		if ProcessingBusy(w, h.processor, err) {
+			return nil, false
 		}
+		http.Error(w, "Process error", 500)
+		return nil, false
+	}
+
+	if err := saveWatermarkedVariants(h.db, h.fs, slug, results, watermarkKey); err != nil {
+		http.Error(w, "Save error", 500)
+		return nil, false
 	}
 
 	// Update metadata with new dimensions and file size
 	totalSize := int64(0)
 	var origWidth, origHeight int
+	var clean []byte
 	for _, res := range results {
 		totalSize += int64(len(res.Data))
-		if res.Name == "original" {
+		switch res.Name {
+		case "original":
 			origWidth = res.Width
 			origHeight = res.Height
+			if clean == nil {
+				clean = res.Data
+			}
+		case image.CleanVariant:
+			clean = res.Data
 		}
 	}
 	if origWidth > 0 && origHeight > 0 {
 		if err := h.db.UpdateImageMetadata(slug, origWidth, origHeight, totalSize); err != nil {
 			http.Error(w, "DB metadata update error", 500)
-			return
+			return nil, false
 		}
 	}
-
-	if err := h.db.MarkImageEdited(slug); err != nil {
-		http.Error(w, "DB error", 500)
-		return
+	placeholder := imagePlaceholder(results)
+	if err := h.db.UpdateImagePlaceholder(slug, placeholder.LQIP, placeholder.Color); err != nil {
+		logging.Get("upload").Printf("update placeholder %s: %v", slug, err)
+	}
+	fingerprint := imageFingerprint(results)
+	if err := h.db.UpdateImageFingerprint(slug, fingerprint.DHash, fingerprint.PixelHash); err != nil {
+		logging.Get("upload").Printf("update fingerprint %s: %v", slug, err)
+	}
+	// the edit reframes the image, the old focal point would miss the subject
+	if img.Focal != nil {
+		if err := h.db.SetImageFocalPoint(slug, nil); err != nil {
+			logging.Get("upload").Printf("clear focal point %s: %v", slug, err)
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"slug": slug})
+	// The revision keeps the unmarked result; a lost revision does not undo the edit
+	if params.Filters.IsZero() {
+		params.Filters = image.Filters{}
+	}
+	paramsJSON, _ := json.Marshal(params)
+	rev := &storage.ImageRevision{
+		ImageID:      img.ID,
+		Params:       string(paramsJSON),
+		FromSource:   fromSource,
+		RevertedFrom: revertedFrom,
+		Width:        origWidth,
+		Height:       origHeight,
+		FileSize:     int64(len(clean)),
+	}
+	if err := h.db.InsertImageRevision(rev); err != nil {
+		logging.Get("upload").Printf("record revision %s: %v", slug, err)
+		return nil, true
+	}
+	if err := h.fs.SaveRevision(slug, rev.ID, clean); err != nil {
+		logging.Get("upload").Printf("save revision %s/%d: %v", slug, rev.ID, err)
+	}
+	return rev, true
 }
 
 func (h *ImageEditHandler) RestoreOriginal(w http.ResponseWriter, r *http.Request, slug string) {
 	img, err := h.db.GetImageBySlug(slug)
-	if err != nil {
-		http.Error(w, "Not found", 404)
+	if err != nil || img == nil {
+		ImageNotFound(w, r, h.db, slug)
 		return
 	}
 
@@ -462,12 +718,6 @@ func (h *ImageEditHandler) RestoreOriginal(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Must have backup
-	if !h.fs.HasBackup(slug) {
-		http.Error(w, "No backup available", 400)
-		return
-	}
-
 	// Check authorization
 	user := middleware.GetUser(r)
 	if user == nil || img.UserID == nil || user.ID != *img.UserID {
@@ -475,53 +725,179 @@ func (h *ImageEditHandler) RestoreOriginal(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Read backup and reprocess
-	backupData, err := h.fs.ReadBackup(slug)
+	// Reprocess all sizes from the untouched source
+	sourceData, err := h.fs.Read(h.fs.EditSourceKey(slug))
 	if err != nil {
 		http.Error(w, "Restore error", 500)
 		return
 	}
+	if _, ok := h.applyEdit(r.Context(), w, img, sourceData, image.TransformParams{}, true, nil); !ok {
+		return
+	}
 
-	// Reprocess all sizes from backup
-	results, err := h.processor.ProcessWithTransform(backupData, image.TransformParams{})
-	if err != nil {
-		http.Error(w, "Process error", 500)
+	// Clear edited flag
+	if err := h.db.UnmarkImageEdited(slug); err != nil {
+		http.Error(w, "DB error", 500)
 		return
 	}
 
-	// Save all sizes
-	for _, res := range results {
-		if err := h.fs.Save(slug, res.Name, res.Data); err != nil {
-			http.Error(w, "Save error", 500)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// revisionResponse is one entry of GET /i/{slug}/revisions.
+type revisionResponse struct {
+	ID           int64           `json:"id"`
+	Params       json.RawMessage `json:"params"`
+	FromSource   bool            `json:"from_source"`
+	RevertedFrom *int64          `json:"reverted_from,omitempty"`
+	Width        int             `json:"width"`
+	Height       int             `json:"height"`
+	FileSize     int64           `json:"file_size"`
+	CreatedAt    int64           `json:"created_at"`
+	URL          string          `json:"url"`
+}
+
+// Revisions serves the edit history of an image:
+// GET /i/{slug}/revisions lists it, GET /i/{slug}/revisions/{id} returns
+// the stored result and POST /i/{slug}/revisions/{id}/revert makes a
+// revision current again. parts are the path segments after "revisions".
+func (h *ImageEditHandler) Revisions(w http.ResponseWriter, r *http.Request, slug string, parts []string) {
+	img, err := h.db.GetImageBySlug(slug)
+	if err != nil || img == nil {
+		ImageNotFound(w, r, h.db, slug)
+		return
+	}
+	if !canEditImage(h.db, r, img) {
+		jsonError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		h.listRevisions(w, img)
+		return
 	}
 
-	// Update metadata
-	totalSize := int64(0)
-	var origWidth, origHeight int
-	for _, res := range results {
-		totalSize += int64(len(res.Data))
-		if res.Name == "original" {
-			origWidth = res.Width
-			origHeight = res.Height
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "revert") {
+		http.NotFound(w, r)
+		return
+	}
+	rev, err := h.db.GetImageRevision(img.ID, id)
+	if err != nil {
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if rev == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("Vary", "Cookie")
+		ServeImageBlob(w, r, h.fs, img, h.fs.RevisionKey(slug, rev.ID), "image/webp")
+		return
 	}
-	if origWidth > 0 && origHeight > 0 {
-		if err := h.db.UpdateImageMetadata(slug, origWidth, origHeight, totalSize); err != nil {
-			http.Error(w, "DB metadata update error", 500)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.revertRevision(r.Context(), w, img, rev)
+}
+
+func (h *ImageEditHandler) listRevisions(w http.ResponseWriter, img *storage.Image) {
+	revisions, err := h.db.GetImageRevisions(img.ID)
+	if err != nil {
+		logging.Get("upload").Printf("upload.Revisions: list slug=%s: %v", img.Slug, err)
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]revisionResponse, 0, len(revisions))
+	for _, rev := range revisions {
+		resp = append(resp, revisionResponse{
+			ID:           rev.ID,
+			Params:       json.RawMessage(rev.Params),
+			FromSource:   rev.FromSource,
+			RevertedFrom: rev.RevertedFrom,
+			Width:        rev.Width,
+			Height:       rev.Height,
+			FileSize:     rev.FileSize,
+			CreatedAt:    rev.CreatedAt,
+			URL:          "/i/" + img.Slug + "/revisions/" + strconv.FormatInt(rev.ID, 10),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// revertRevision re-renders a revision from the source when it was made
+// from its parameters, otherwise re-processes its stored result, and
+// records the outcome as a new revision.
+func (h *ImageEditHandler) revertRevision(ctx context.Context, w http.ResponseWriter, img *storage.Image, rev *storage.ImageRevision) {
+	if img.IsAnimated() {
+		jsonError(w, "animated images cannot be edited", http.StatusBadRequest)
+		return
+	}
+
+	var params image.TransformParams
+	key := h.fs.RevisionKey(img.Slug, rev.ID)
+	if rev.FromSource {
+		if err := json.Unmarshal([]byte(rev.Params), &params); err != nil {
+			logging.Get("upload").Printf("upload.Revert: bad params slug=%s rev=%d: %v", img.Slug, rev.ID, err)
+			jsonError(w, "invalid revision", http.StatusInternalServerError)
 			return
 		}
+		params.Filters = params.Filters.Clamp()
+		key = h.fs.EditSourceKey(img.Slug)
+	}
+	data, err := h.fs.Read(key)
+	if err != nil {
+		logging.Get("upload").Printf("upload.Revert: read %s: %v", key, err)
+		jsonError(w, "revision file missing", http.StatusGone)
+		return
 	}
 
-	// Clear edited flag
-	if err := h.db.UnmarkImageEdited(slug); err != nil {
-		http.Error(w, "DB error", 500)
+	if !h.fs.HasBackup(img.Slug) {
+		if err := h.fs.SaveBackup(img.Slug); err != nil {
+			logging.Get("upload").Printf("backup failed: %v", err)
+		}
+	}
+
+	newRev, ok := h.applyEdit(ctx, w, img, data, params, rev.FromSource, &rev.ID)
+	if !ok {
+		return
+	}
+
+	// a revision of the untouched source without transforms is the original
+	if rev.FromSource && !params.HasTransforms() {
+		err = h.db.UnmarkImageEdited(img.Slug)
+	} else {
+		err = h.db.MarkImageEdited(img.Slug)
+	}
+	if err != nil {
+		jsonError(w, "database error", http.StatusInternalServerError)
 		return
 	}
 
+	resp := map[string]interface{}{"slug": img.Slug, "reverted_from": rev.ID}
+	if newRev != nil {
+		resp["revision"] = newRev.ID
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *UploadHandler) DeleteImage(w http.ResponseWriter, r *http.Request, slug string) {
@@ -537,7 +913,7 @@ func (h *UploadHandler) DeleteImage(w http.ResponseWriter, r *http.Request, slug
 
 	img, err := h.db.GetImageBySlug(slug)
 	if err != nil || img == nil {
-		http.NotFound(w, r)
+		ImageNotFound(w, r, h.db, slug)
 		return
 	}
 
@@ -547,16 +923,17 @@ func (h *UploadHandler) DeleteImage(w http.ResponseWriter, r *http.Request, slug
 		return
 	}
 
-	if err := h.fs.Delete(slug); err != nil {
-		logging.Get("upload").Printf("delete files error: %v", err)
-	}
-
-	if err := h.db.DeleteImageBySlug(slug); err != nil {
-		logging.Get("upload").Printf("upload.DeleteImage: db delete error slug=%s: %v", slug, err)
+	// Do kosza; admin może przywrócić obrazek, dopóki kosz nie wygaśnie
+	if err := h.db.TrashImage(slug, storage.DeletedByOwner); err != nil {
+		logging.Get("upload").Printf("upload.DeleteImage: trash error slug=%s: %v", slug, err)
 		jsonError(w, "database error", http.StatusInternalServerError)
 		return
 	}
 
+	if err := h.fs.Trash(slug); err != nil {
+		logging.Get("upload").Printf("trash files error: %v", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"deleted": slug})
 }
@@ -2,15 +2,21 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"dajtu/internal/config"
 	"dajtu/internal/image"
 	"dajtu/internal/storage"
+	"dajtu/internal/storage/s3test"
 	"dajtu/internal/testutil"
 )
 
@@ -33,7 +39,7 @@ func testSetup(t *testing.T) (*config.Config, *storage.DB, *storage.Filesystem,
 		t.Fatalf("create db: %v", err)
 	}
 
-	fs, err := storage.NewFilesystem(dir)
+	fs, err := storage.NewFilesystem(dir, db)
 	if err != nil {
 		t.Fatalf("create fs: %v", err)
 	}
@@ -125,6 +131,84 @@ func TestUploadHandler_InvalidFormat(t *testing.T) {
 	}
 }
 
+func TestUploadHandler_DimensionsTooLarge(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxImageMegapixels = 1
+
+	// PNG header declaring a 50000x50000 canvas
+	png := append([]byte{}, testutil.SamplePNG()...)
+	binary.BigEndian.PutUint32(png[16:20], 50000)
+	binary.BigEndian.PutUint32(png[20:24], 50000)
+
+	h := NewUploadHandler(cfg, db, fs, nil)
+	req := createMultipartRequest(t, "file", "bomb.png", png)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !strings.HasPrefix(resp["error"], "image dimensions too large") {
+		t.Errorf("error = %q, want image dimensions error", resp["error"])
+	}
+}
+
+func TestUploadHandler_AnimationTooLarge(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.MaxImageMegapixels = 1
+
+	// 0.25 MP per frame, 2.5 MP once every frame is decoded
+	gif := testutil.AnimatedGIF(500, 500, 10)
+
+	h := NewUploadHandler(cfg, db, fs, nil)
+	req := createMultipartRequest(t, "file", "frames.gif", gif)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestSaveImageMetadata_GPSOptIn(t *testing.T) {
+	_, db, _, cleanup := testSetup(t)
+	defer cleanup()
+
+	lat, lon := 52.2297, 21.0122
+	meta := &image.Metadata{CameraModel: "Pixel 8", GPSLat: &lat, GPSLon: &lon}
+
+	for _, keepGPS := range []bool{false, true} {
+		now := time.Now().Unix()
+		id, err := db.InsertImage(&storage.Image{Slug: storage.GenerateSlug(5), MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+		if err != nil {
+			t.Fatalf("InsertImage() error = %v", err)
+		}
+
+		saved := saveImageMetadata(db, id, meta, keepGPS)
+		stored, err := db.GetImageMetadata(id)
+		if err != nil || stored == nil || saved == nil {
+			t.Fatalf("metadata not stored: %v", err)
+		}
+		if stored.HasGPS() != keepGPS || saved.HasGPS() != keepGPS {
+			t.Errorf("keepGPS=%v: stored GPS = %v, response GPS = %v", keepGPS, stored.HasGPS(), saved.HasGPS())
+		}
+	}
+
+	// GPS alone is not worth a row when it gets dropped
+	now := time.Now().Unix()
+	id, _ := db.InsertImage(&storage.Image{Slug: storage.GenerateSlug(5), MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	if got := saveImageMetadata(db, id, &image.Metadata{GPSLat: &lat, GPSLon: &lon}, false); got != nil {
+		t.Errorf("saveImageMetadata(gps only) = %+v, want nil", got)
+	}
+}
+
 func TestJsonError(t *testing.T) {
 	rec := httptest.NewRecorder()
 	jsonError(rec, "test error", http.StatusBadRequest)
@@ -213,11 +297,50 @@ func TestUploadHandler_SavesOriginal(t *testing.T) {
 		t.Fatalf("decode response: %v", err)
 	}
 
-	if _, err := fs.GetOriginalPath(resp.Slug, "original"); err != nil {
+	if _, err := fs.OriginalKey(resp.Slug, "original"); err != nil {
 		t.Fatalf("original file not found: %v", err)
 	}
 }
 
+func TestStoreImage(t *testing.T) {
+	_, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	results := []image.ProcessResult{{Name: "original", Data: []byte("o")}, {Name: "thumb", Data: []byte("t")}}
+
+	img := &storage.Image{Slug: "st001", MimeType: "image/jpeg"}
+	id, err := storeImage(db, fs, img, results)
+	if err != nil || id == 0 {
+		t.Fatalf("storeImage() = %d, %v", id, err)
+	}
+	got, _ := db.GetImageBySlug("st001")
+	if got.Status != storage.ImageStatusReady || img.Status != storage.ImageStatusReady {
+		t.Errorf("status = %q, want ready", got.Status)
+	}
+	if _, err := fs.Stat(fs.Key("st001", "thumb")); err != nil {
+		t.Errorf("variant missing: %v", err)
+	}
+}
+
+func TestStoreImage_SaveFails(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	srv := s3test.NewServer(t)
+	store, _ := storage.NewS3Store(storage.S3Config{
+		Endpoint: srv.URL, Region: s3test.Region, Bucket: s3test.Bucket,
+		AccessKey: s3test.AccessKey, SecretKey: s3test.SecretKey, PathStyle: true,
+	})
+	fs := storage.NewBlobFilesystem(store, db, 0)
+	srv.Close()
+
+	img := &storage.Image{Slug: "st002", MimeType: "image/jpeg"}
+	if _, err := storeImage(db, fs, img, []image.ProcessResult{{Name: "original", Data: []byte("o")}}); err == nil {
+		t.Fatal("storeImage() succeeded without storage")
+	}
+	// nie może zostać rekord wskazujący na brakujące pliki
+	if got, _ := db.GetImageBySlug("st002"); got != nil {
+		t.Errorf("row left with status %q", got.Status)
+	}
+}
+
 func TestUploadHandler_ResponseFields(t *testing.T) {
 	if _, err := image.Process(testutil.SampleJPEG()); err != nil {
 		t.Skipf("image processing unavailable: %v", err)
@@ -261,4 +384,269 @@ func TestUploadHandler_ResponseFields(t *testing.T) {
 	if len(resp.Sizes) == 0 {
 		t.Error("expected Sizes in response")
 	}
+
+	if !strings.Contains(resp.Embed.BBCode, "[img]http://test.local/i/"+resp.Slug+"/") {
+		t.Errorf("Embed.BBCode = %q", resp.Embed.BBCode)
+	}
+}
+
+func TestUploadHandler_ProcessingBusy(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	cfg.KeepOriginalFormat = true
+
+	// one worker and one queue slot, both taken by blocked jobs
+	pool := image.NewPool(1, 1, 0)
+	defer pool.Close()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	for s := pool.Stats(); s.Active == 0 || s.Queued == 0; s = pool.Stats() {
+		go pool.Do(context.Background(), func() error {
+			<-unblock
+			return nil
+		})
+		time.Sleep(time.Millisecond)
+	}
+	rejected := pool.Stats().Rejected
+
+	h := NewUploadHandler(cfg, db, fs, image.NewPooledProcessor(pool))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, createMultipartRequest(t, "file", "test.jpg", testutil.SampleJPEG()))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After")
+	}
+	if count, _ := db.CountImagesAdmin(); count != 0 {
+		t.Errorf("images after rejected upload = %d", count)
+	}
+	if got := pool.Stats().Rejected; got <= rejected {
+		t.Errorf("Rejected = %d, want more than %d", got, rejected)
+	}
+}
+
+func TestPresetURLs(t *testing.T) {
+	t.Cleanup(func() { image.LoadPresets("") })
+	if err := image.LoadPresets("original:2048,eager;sq:300x300,fit=cover;og:1200x630,fit=cover,format=jpeg"); err != nil {
+		t.Fatalf("LoadPresets() error = %v", err)
+	}
+
+	got := presetURLs("https://x.pl", "abcd")
+	want := map[string]string{
+		"original": "https://x.pl/i/abcd.webp",
+		"sq":       "https://x.pl/i/abcd/sq.webp",
+		"og":       "https://x.pl/i/abcd/og.jpg",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("presetURLs() = %v, want %v", got, want)
+	}
+	for name, url := range want {
+		if got[name] != url {
+			t.Errorf("presetURLs()[%s] = %q, want %q", name, got[name], url)
+		}
+	}
+}
+
+func TestBuildEmbedCodes(t *testing.T) {
+	img := &storage.Image{Slug: "abcd", OriginalName: "wakacje [1].jpg", Width: 3000, Height: 2000}
+	codes := buildEmbedCodes("https://x.pl", img, "1200")
+
+	if codes.Size != "1200" || codes.Direct != "https://x.pl/i/abcd/1200.webp" {
+		t.Errorf("size, direct = %q, %q", codes.Size, codes.Direct)
+	}
+	if want := "[url=https://x.pl/i/abcd][img]https://x.pl/i/abcd/1200.webp[/img][/url]"; codes.BBCode != want {
+		t.Errorf("BBCode = %q, want %q", codes.BBCode, want)
+	}
+	if want := `[![wakacje \[1\].jpg](https://x.pl/i/abcd/1200.webp)](https://x.pl/i/abcd)`; codes.Markdown != want {
+		t.Errorf("Markdown = %q, want %q", codes.Markdown, want)
+	}
+	want := `<a href="https://x.pl/i/abcd"><img src="https://x.pl/i/abcd/1200.webp"` +
+		` srcset="https://x.pl/i/abcd/800.webp 800w, https://x.pl/i/abcd/1200.webp 1200w, https://x.pl/i/abcd/1600.webp 1600w, https://x.pl/i/abcd/2400.webp 2400w, https://x.pl/i/abcd.webp 3000w"` +
+		` sizes="(max-width: 1200px) 100vw, 1200px" width="1200" height="800" alt="wakacje [1].jpg"></a>`
+	if codes.HTML != want {
+		t.Errorf("HTML = %s\nwant  %s", codes.HTML, want)
+	}
+
+	// every contain variant of a small image is the same file size-wise
+	small := buildEmbedCodes("https://x.pl", &storage.Image{Slug: "abcd", Width: 600, Height: 400}, "800")
+	if strings.Contains(small.HTML, "srcset") || !strings.Contains(small.HTML, `width="600" height="400" alt="abcd"`) {
+		t.Errorf("small image HTML = %s", small.HTML)
+	}
+
+	thumb := buildEmbedCodes("https://x.pl", img, "thumb")
+	if strings.Contains(thumb.HTML, "srcset") || !strings.Contains(thumb.HTML, `width="200" height="200"`) {
+		t.Errorf("thumb HTML = %s", thumb.HTML)
+	}
+
+	if got := buildEmbedCodes("https://x.pl", img, "nope").Size; got != embedSize {
+		t.Errorf("unknown size falls back to %q, want %q", got, embedSize)
+	}
+
+	// still processing: no dimensions yet, srcset from the preset widths
+	pending := buildEmbedCodes("https://x.pl", &storage.Image{Slug: "abcd"}, "1200")
+	if !strings.Contains(pending.HTML, "https://x.pl/i/abcd.webp 4096w") || strings.Contains(pending.HTML, "height=") {
+		t.Errorf("pending HTML = %s", pending.HTML)
+	}
+}
+
+func TestBuildGalleryEmbedCodes(t *testing.T) {
+	images := []*storage.Image{
+		{Slug: "aa01", Width: 100, Height: 100},
+		{Slug: "aa02", Status: storage.ImageStatusPending},
+		{Slug: "aa03", Width: 100, Height: 100},
+	}
+	codes := buildGalleryEmbedCodes("https://x.pl", images, "thumb")
+	if codes.Size != "thumb" {
+		t.Errorf("Size = %q", codes.Size)
+	}
+	if want := "https://x.pl/i/aa01/thumb.webp\nhttps://x.pl/i/aa03/thumb.webp"; codes.Direct != want {
+		t.Errorf("Direct = %q, want %q", codes.Direct, want)
+	}
+	if lines := strings.Split(codes.BBCode, "\n"); len(lines) != 2 || !strings.Contains(lines[1], "aa03") {
+		t.Errorf("BBCode = %q", codes.BBCode)
+	}
+}
+
+func TestGalleryHandler_Embed(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "emb", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+	db.InsertImage(&storage.Image{Slug: "gi001", MimeType: "image/jpeg", Width: 2000, Height: 1000, GalleryID: &galleryID, CreatedAt: now, AccessedAt: now})
+
+	rec := httptest.NewRecorder()
+	h.Embed(rec, httptest.NewRequest("GET", "/g/emb/embed?size=800", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var codes EmbedCodes
+	json.NewDecoder(rec.Body).Decode(&codes)
+	if codes.Size != "800" || codes.Direct != "http://test.local/i/gi001/800.webp" {
+		t.Errorf("codes = %+v", codes)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Embed(rec, httptest.NewRequest("GET", "/g/nope/embed", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown gallery status = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.View(rec, httptest.NewRequest("GET", "/g/emb", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `<option value="1200" selected>`) || !strings.Contains(body, `data-embed="bbcode"`) {
+		t.Error("gallery page lacks the embed code section")
+	}
+}
+
+func TestFindDuplicate_Scope(t *testing.T) {
+	db, _ := testutil.TestDB(t)
+	cfg := testutil.TestConfig(t)
+	cfg.DedupMaxDistance = 4
+
+	owner, _ := db.GetOrCreateBratUser("owner")
+	other, _ := db.GetOrCreateBratUser("other")
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "orig1", MimeType: "image/png", UserID: &owner.ID,
+		PHash: 0xF0F0, PixelSHA: "px", EditToken: "tok", CreatedAt: now, AccessedAt: now})
+
+	fp := image.Fingerprint{DHash: 0xF0F1, PixelHash: "different"}
+	tests := []struct {
+		scope    string
+		uploader *int64
+		want     string
+	}{
+		{"off", &owner.ID, ""},
+		{"user", &owner.ID, "orig1"},
+		{"user", &other.ID, ""},
+		{"user", nil, ""},
+		{"global", nil, "orig1"},
+		{"global", &other.ID, "orig1"},
+	}
+	for _, tt := range tests {
+		cfg.DedupScope = tt.scope
+		var got string
+		if dup := findDuplicate(cfg, db, fp, tt.uploader); dup != nil {
+			got = dup.Slug
+		}
+		if got != tt.want {
+			t.Errorf("scope=%s uploader=%v: got %q, want %q", tt.scope, tt.uploader, got, tt.want)
+		}
+	}
+
+	// failed fingerprint never matches
+	cfg.DedupScope = "global"
+	if dup := findDuplicate(cfg, db, image.Fingerprint{}, nil); dup != nil {
+		t.Errorf("empty fingerprint matched %s", dup.Slug)
+	}
+}
+
+func TestParseTransformParams_Filters(t *testing.T) {
+	form := url.Values{
+		"brightness": {"35"},
+		"contrast":   {"-500"},
+		"saturation": {"abc"},
+		"gamma":      {"1.456"},
+		"sharpen":    {"9"},
+		"blur":       {"-2"},
+		"grayscale":  {"true"},
+		"sepia":      {"1"},
+	}
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	got := parseTransformParams(req).Filters
+	want := image.Filters{Brightness: 35, Contrast: -100, Gamma: 1.46, Sharpen: 5, Grayscale: true}
+	if got != want {
+		t.Errorf("Filters = %+v, want %+v", got, want)
+	}
+	if !parseTransformParams(req).HasTransforms() {
+		t.Error("filters alone are not a transform")
+	}
+}
+
+func TestUploadHandler_DeleteImage_Gone(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "del01", MimeType: "image/jpeg", EditToken: "tok", CreatedAt: now, AccessedAt: now})
+	fs.Save("del01", "original", []byte("data"))
+	h := NewUploadHandler(cfg, db, fs, nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/i/del01", nil)
+	req.Header.Set("X-Edit-Token", "tok")
+	rec := httptest.NewRecorder()
+	h.DeleteImage(rec, req, "del01")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !fs.Exists("del01") {
+		t.Error("files deleted before the trash expired")
+	}
+
+	rec = httptest.NewRecorder()
+	NewImageViewHandler(db, cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/i/del01", nil), "del01")
+	if rec.Code != http.StatusGone {
+		t.Errorf("view status = %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestUploadHandler_ServeOriginal_Gone(t *testing.T) {
+	cfg, db, fs, cleanup := testSetup(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "gone02", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("gone02", "original", []byte("data"))
+	db.TrashImage("gone02", storage.DeletedByOwner)
+
+	rec := httptest.NewRecorder()
+	NewUploadHandler(cfg, db, fs, nil).ServeOriginal(rec, httptest.NewRequest(http.MethodGet, "/i/gone02/original", nil), "gone02")
+	if rec.Code != http.StatusGone {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGone)
+	}
 }
@@ -1,12 +1,16 @@
 package handler
 
 import (
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"strings"
 	"time"
 
 	"dajtu/internal/config"
+	"dajtu/internal/image"
+	"dajtu/internal/logging"
+	"dajtu/internal/middleware"
 	"dajtu/internal/storage"
 )
 
@@ -28,6 +32,10 @@ func (h *UserHandler) View(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if len(parts) == 2 && parts[1] == "watermark" {
+		h.UpdateWatermark(w, r, parts[0])
+		return
+	}
 	if len(parts) > 1 && parts[1] != "" {
 		http.NotFound(w, r)
 		return
@@ -40,6 +48,17 @@ func (h *UserHandler) View(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Ustawienia znaku wodnego widzi tylko właściciel profilu
+	var watermark *watermarkSettings
+	if viewer := middleware.GetUser(r); viewer != nil && viewer.ID == user.ID {
+		current, err := h.db.GetUserWatermark(user.ID)
+		if err != nil {
+			logging.Get("user").Printf("user.View: watermark slug=%s: %v", slug, err)
+		}
+		settings := newWatermarkSettings(current)
+		watermark = &settings
+	}
+
 	galleries, _ := h.db.GetUserGalleries(user.ID)
 
 	type GalleryData struct {
@@ -66,8 +85,51 @@ func (h *UserHandler) View(w http.ResponseWriter, r *http.Request) {
 	data := map[string]any{
 		"DisplayName": user.DisplayName,
 		"Galleries":   galleryList,
+		"Slug":        user.Slug,
+		"Watermark":   watermark,
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	h.userTmpl.Execute(w, data)
 }
+
+// POST /u/:slug/watermark - znak wodny zalogowanego użytkownika; obejmuje jego
+// obrazki poza galeriami z własnym znakiem, istniejące przerabia daemon
+func (h *UserHandler) UpdateWatermark(w http.ResponseWriter, r *http.Request, slug string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	viewer := middleware.GetUser(r)
+	if viewer == nil || viewer.Slug != slug {
+		jsonError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, image.MaxWatermarkImageBytes+64*1024)
+	current, err := h.db.GetUserWatermark(viewer.ID)
+	if err != nil {
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	wm, err := parseWatermarkForm(r, current)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wm == nil {
+		err = h.db.DeleteUserWatermark(viewer.ID)
+	} else {
+		err = h.db.SetUserWatermark(viewer.ID, wm)
+	}
+	if err != nil {
+		logging.Get("user").Printf("user.UpdateWatermark: slug=%s: %v", slug, err)
+		jsonError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWatermarkSettings(wm))
+}
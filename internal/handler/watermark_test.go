@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	goimage "image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dajtu/internal/image"
+	"dajtu/internal/middleware"
+	"dajtu/internal/storage"
+	"dajtu/internal/testutil"
+)
+
+func watermarkRequest(t *testing.T, url string, fields map[string]string, file []byte) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	if file != nil {
+		part, _ := writer.CreateFormFile("file", "mark.png")
+		part.Write(file)
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", url, &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func markPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, goimage.NewNRGBA(goimage.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseWatermarkForm(t *testing.T) {
+	pngData := markPNG(t)
+	current := &storage.Watermark{Image: pngData}
+
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		file    []byte
+		current *storage.Watermark
+		wantErr bool
+		check   func(*storage.Watermark) bool
+	}{
+		{"none", map[string]string{"mode": "none"}, nil, nil, false, func(wm *storage.Watermark) bool { return wm == nil }},
+		{"text with percents", map[string]string{"mode": "text", "text": "dajtu.com", "position": "top-left", "opacity": "80", "scale": "30"}, nil, nil, false,
+			func(wm *storage.Watermark) bool {
+				return wm.Text == "dajtu.com" && wm.Position == "top-left" && wm.Opacity == 0.8 && wm.Scale == 0.3
+			}},
+		{"text clamped", map[string]string{"mode": "text", "text": "x", "opacity": "500", "scale": "90"}, nil, nil, false,
+			func(wm *storage.Watermark) bool { return wm.Opacity == 1 && wm.Scale == 0.5 }},
+		{"png upload", map[string]string{"mode": "image"}, pngData, nil, false,
+			func(wm *storage.Watermark) bool { return bytes.Equal(wm.Image, pngData) && wm.Text == "" }},
+		{"png kept from current", map[string]string{"mode": "image", "position": "center"}, nil, current, false,
+			func(wm *storage.Watermark) bool { return bytes.Equal(wm.Image, pngData) && wm.Position == "center" }},
+		{"empty text", map[string]string{"mode": "text", "text": " "}, nil, nil, true, nil},
+		{"image without file", map[string]string{"mode": "image"}, nil, nil, true, nil},
+		{"not a png", map[string]string{"mode": "image"}, []byte("GIF89a...."), nil, true, nil},
+		{"unknown mode", map[string]string{"mode": "emboss"}, nil, nil, true, nil},
+	}
+	for _, tt := range tests {
+		req := watermarkRequest(t, "/gallery/abcd/watermark", tt.fields, tt.file)
+		wm, err := parseWatermarkForm(req, tt.current)
+		if tt.wantErr {
+			if !errors.Is(err, image.ErrInvalidWatermark) {
+				t.Errorf("%s: error = %v, want ErrInvalidWatermark", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if !tt.check(wm) {
+			t.Errorf("%s: watermark = %+v", tt.name, wm)
+		}
+	}
+}
+
+func TestGalleryHandler_UpdateWatermark(t *testing.T) {
+	cfg := testutil.TestConfig(t)
+	db, _ := testutil.TestDB(t)
+	fs, _ := testutil.TestFilesystem(t, db)
+	h := NewGalleryHandler(cfg, db, fs, image.NewProcessor())
+
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&storage.Gallery{Slug: "gal1", EditToken: "secret", CreatedAt: now, UpdatedAt: now})
+
+	fields := map[string]string{"mode": "text", "text": "dajtu", "opacity": "40"}
+
+	rec := httptest.NewRecorder()
+	h.UpdateWatermark(rec, watermarkRequest(t, "/gallery/gal1/watermark", fields, nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without token status = %d, want 403", rec.Code)
+	}
+
+	req := watermarkRequest(t, "/gallery/gal1/watermark", fields, nil)
+	req.Header.Set("X-Edit-Token", "secret")
+	rec = httptest.NewRecorder()
+	h.UpdateWatermark(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	var resp watermarkSettings
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !resp.Enabled || resp.Opacity != 40 || resp.Position != image.PositionBottomRight {
+		t.Errorf("response = %+v", resp)
+	}
+	if wm, _ := db.GetGalleryWatermark(galleryID); wm == nil || wm.Text != "dajtu" {
+		t.Errorf("stored watermark = %+v", wm)
+	}
+
+	req = watermarkRequest(t, "/gallery/gal1/watermark", map[string]string{"mode": "text"}, nil)
+	req.Header.Set("X-Edit-Token", "secret")
+	rec = httptest.NewRecorder()
+	h.UpdateWatermark(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid form status = %d, want 400", rec.Code)
+	}
+
+	req = watermarkRequest(t, "/gallery/gal1/watermark", map[string]string{"mode": "none", "edit_token": "secret"}, nil)
+	rec = httptest.NewRecorder()
+	h.UpdateWatermark(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("remove status = %d", rec.Code)
+	}
+	if wm, _ := db.GetGalleryWatermark(galleryID); wm != nil {
+		t.Error("watermark not removed")
+	}
+}
+
+func TestUserHandler_UpdateWatermark(t *testing.T) {
+	cfg := testutil.TestConfig(t)
+	db, _ := testutil.TestDB(t)
+	h := NewUserHandler(cfg, db)
+
+	owner, _ := db.GetOrCreateBratUser("artist")
+	other, _ := db.GetOrCreateBratUser("someone")
+	fields := map[string]string{"mode": "text", "text": "artist"}
+
+	tests := []struct {
+		name   string
+		viewer *storage.User
+		want   int
+	}{
+		{"anonymous", nil, http.StatusForbidden},
+		{"other user", other, http.StatusForbidden},
+		{"owner", owner, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := watermarkRequest(t, "/u/"+owner.Slug+"/watermark", fields, nil)
+		if tt.viewer != nil {
+			req = req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, tt.viewer))
+		}
+		rec := httptest.NewRecorder()
+		h.View(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if wm, _ := db.GetUserWatermark(owner.ID); wm == nil || wm.Text != "artist" {
+		t.Errorf("stored watermark = %+v", wm)
+	}
+	if wm, _ := db.GetUserWatermark(other.ID); wm != nil {
+		t.Error("watermark stored for the wrong user")
+	}
+
+	// the form is shown to the owner only
+	req := httptest.NewRequest("GET", "/u/"+owner.Slug, nil)
+	rec := httptest.NewRecorder()
+	h.View(rec, req)
+	if strings.Contains(rec.Body.String(), "watermarkForm") {
+		t.Error("anonymous viewer sees the watermark form")
+	}
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, owner))
+	rec = httptest.NewRecorder()
+	h.View(rec, req)
+	if !strings.Contains(rec.Body.String(), "watermarkForm") {
+		t.Error("owner does not see the watermark form")
+	}
+}
+
+func TestUploadHandler_ServeOriginal_Watermarked(t *testing.T) {
+	cfg := testutil.TestConfig(t)
+	db, _ := testutil.TestDB(t)
+	fs, _ := testutil.TestFilesystem(t, db)
+	h := NewUploadHandler(cfg, db, fs, nil)
+
+	owner, _ := db.GetOrCreateBratUser("artist")
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "wmimg", MimeType: "image/jpeg", UserID: &owner.ID, EditToken: "tok",
+		WatermarkKey: "abc", CreatedAt: now, UpdatedAt: now, AccessedAt: now})
+	fs.Save("wmimg", "original", []byte("marked"))
+	fs.Save("wmimg", image.CleanVariant, []byte("clean"))
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeOriginal(rec, req, "wmimg")
+		return rec
+	}
+
+	rec := serve(httptest.NewRequest("GET", "/i/wmimg/original", nil))
+	if rec.Body.String() != "marked" || strings.Contains(rec.Header().Get("Cache-Control"), "private") {
+		t.Errorf("public original = %q (%s), want marked", rec.Body.String(), rec.Header().Get("Cache-Control"))
+	}
+
+	rec = serve(httptest.NewRequest("GET", "/i/wmimg/original?edit=tok", nil))
+	if rec.Body.String() != "clean" || !strings.Contains(rec.Header().Get("Cache-Control"), "private") {
+		t.Errorf("edit token original = %q (%s), want private clean", rec.Body.String(), rec.Header().Get("Cache-Control"))
+	}
+
+	// the kept source file wins over clean.webp for the owner
+	fs.SaveOriginal("wmimg", "original", []byte("source"), "image/jpeg")
+	req := httptest.NewRequest("GET", "/i/wmimg/original", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, owner))
+	rec = serve(req)
+	if rec.Body.String() != "source" || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("owner original = %q (%s), want source jpeg", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+	if rec := serve(httptest.NewRequest("GET", "/i/wmimg/original", nil)); rec.Body.String() != "marked" {
+		t.Errorf("public original with kept source = %q, want marked", rec.Body.String())
+	}
+}
+
+func TestUploadHandler_ServeOriginal_Edited(t *testing.T) {
+	cfg := testutil.TestConfig(t)
+	db, _ := testutil.TestDB(t)
+	fs, _ := testutil.TestFilesystem(t, db)
+	h := NewUploadHandler(cfg, db, fs, nil)
+
+	now := time.Now().Unix()
+	db.InsertImage(&storage.Image{Slug: "edimg", MimeType: "image/jpeg", EditToken: "tok", Edited: true,
+		CreatedAt: now, UpdatedAt: now, AccessedAt: now})
+	fs.SaveOriginal("edimg", "original", []byte("upload"), "image/jpeg")
+	fs.Save("edimg", "original", []byte("edited"))
+
+	rec := httptest.NewRecorder()
+	h.ServeOriginal(rec, httptest.NewRequest("GET", "/i/edimg/original", nil), "edimg")
+	if rec.Body.String() != "edited" || rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("public original = %q (%s), want edited webp", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,115 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrAnimatedTransform = errors.New("transforms are not supported on animated images")
+
+// FrameCount returns the number of frames in a GIF or WebP image.
+// Static images and other formats report 1.
+func FrameCount(data []byte) int {
+	switch detectFormat(data) {
+	case FormatGIF:
+		if n := gifFrameCount(data); n > 0 {
+			return n
+		}
+	case FormatWebP:
+		if n := webpFrameCount(data); n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// IsAnimated reports whether a WebP or GIF header declares an animation.
+// Only the first 32 bytes are needed for WebP, which makes it cheap to call
+// on a stored variant without reading the whole file.
+func IsAnimated(header []byte) bool {
+	if len(header) >= 21 && bytes.HasPrefix(header, magicBytes[FormatWebP]) &&
+		bytes.Equal(header[8:12], []byte("WEBP")) && bytes.Equal(header[12:16], []byte("VP8X")) {
+		return header[20]&0x02 != 0
+	}
+	if bytes.HasPrefix(header, magicBytes[FormatGIF]) {
+		return gifFrameCount(header) > 1
+	}
+	return false
+}
+
+func gifFrameCount(data []byte) int {
+	// Header (6) + logical screen descriptor (7)
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	if packed := data[10]; packed&0x80 != 0 {
+		pos += 3 * (1 << ((packed & 0x07) + 1))
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: introducer, label, sub-blocks
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return frames
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 * (1 << ((packed & 0x07) + 1))
+			}
+			// LZW minimum code size, then image data sub-blocks
+			pos = skipGIFSubBlocks(data, pos+1)
+			frames++
+		case 0x3B: // trailer
+			return frames
+		default:
+			return frames
+		}
+		if pos < 0 {
+			return frames
+		}
+	}
+	return frames
+}
+
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos
+		}
+		pos += size
+	}
+	return -1
+}
+
+func webpFrameCount(data []byte) int {
+	if len(data) < 16 || !bytes.Equal(data[12:16], []byte("VP8X")) {
+		return 1
+	}
+
+	frames := 0
+	pos := 12
+	for pos+8 <= len(data) {
+		fourCC := data[pos : pos+4]
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if bytes.Equal(fourCC, []byte("ANMF")) {
+			frames++
+		}
+		next := pos + 8 + size + size&1
+		if next <= pos {
+			break
+		}
+		pos = next
+	}
+	if frames == 0 {
+		return 1
+	}
+	return frames
+}
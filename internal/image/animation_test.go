@@ -0,0 +1,88 @@
+package image
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+// animatedGIF builds a minimal GIF with n 1x1 frames.
+func animatedGIF(n int) []byte {
+	return testutil.AnimatedGIF(1, 1, n)
+}
+
+// animatedWebP builds a VP8X container with n empty ANMF chunks.
+func animatedWebP(n int) []byte {
+	chunk := func(fourCC string, payload []byte) []byte {
+		out := []byte(fourCC)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(payload)))
+		out = append(out, payload...)
+		if len(payload)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 // animation flag
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", vp8x)...)
+	body = append(body, chunk("ANIM", make([]byte, 6))...)
+	for i := 0; i < n; i++ {
+		body = append(body, chunk("ANMF", make([]byte, 16))...)
+	}
+
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestFrameCount(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"static jpeg", testutil.SampleJPEG(), 1},
+		{"static gif", testutil.SampleGIF(), 1},
+		{"static webp", testutil.SampleWebP(), 1},
+		{"animated gif", animatedGIF(3), 3},
+		{"animated webp", animatedWebP(4), 4},
+		{"truncated gif", animatedGIF(2)[:20], 1},
+		{"empty", nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FrameCount(tt.data); got != tt.want {
+				t.Errorf("FrameCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAnimated(t *testing.T) {
+	webp := animatedWebP(2)
+	if !IsAnimated(webp[:32]) {
+		t.Error("IsAnimated(animated webp header) = false, want true")
+	}
+	if IsAnimated(testutil.SampleWebP()) {
+		t.Error("IsAnimated(static webp) = true, want false")
+	}
+	if !IsAnimated(animatedGIF(2)) {
+		t.Error("IsAnimated(animated gif) = false, want true")
+	}
+	if IsAnimated(testutil.SampleGIF()) {
+		t.Error("IsAnimated(static gif) = true, want false")
+	}
+}
+
+func TestProcessWithTransform_AnimatedRejected(t *testing.T) {
+	p := NewProcessor()
+	_, err := p.ProcessWithTransform(context.Background(), animatedGIF(2), TransformParams{Rotation: 90})
+	if err != ErrAnimatedTransform {
+		t.Errorf("ProcessWithTransform() error = %v, want %v", err, ErrAnimatedTransform)
+	}
+}
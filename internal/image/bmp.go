@@ -0,0 +1,154 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+	stdimage "image"
+	"image/color"
+	"math/bits"
+)
+
+var errUnsupportedBMP = errors.New("unsupported bmp variant")
+
+const (
+	bmpRGB            = 0
+	bmpBitfields      = 3
+	bmpAlphaBitfields = 6
+)
+
+// decodeBMP decodes uncompressed and bitfield BMPs (1/4/8/16/24/32 bpp).
+// RLE and embedded JPEG/PNG variants are rejected; they are rare in the wild.
+func decodeBMP(data []byte) (stdimage.Image, error) {
+	if len(data) < 26 {
+		return nil, errUnsupportedBMP
+	}
+	le := binary.LittleEndian
+	pixelOffset := int(le.Uint32(data[10:14]))
+	headerSize := int(le.Uint32(data[14:18]))
+
+	var width, height, bpp, compression, colorsUsed int
+	paletteEntry := 4
+	if headerSize == 12 {
+		width = int(le.Uint16(data[18:20]))
+		height = int(le.Uint16(data[20:22]))
+		bpp = int(le.Uint16(data[24:26]))
+		paletteEntry = 3
+	} else {
+		if len(data) < 54 || headerSize < 40 {
+			return nil, errUnsupportedBMP
+		}
+		width = int(int32(le.Uint32(data[18:22])))
+		height = int(int32(le.Uint32(data[22:26])))
+		bpp = int(le.Uint16(data[28:30]))
+		compression = int(le.Uint32(data[30:34]))
+		colorsUsed = int(le.Uint32(data[46:50]))
+	}
+
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || height <= 0 || width > 1<<16 || height > 1<<16 {
+		return nil, errUnsupportedBMP
+	}
+	if compression != bmpRGB && compression != bmpBitfields && compression != bmpAlphaBitfields {
+		return nil, errUnsupportedBMP
+	}
+
+	// Channel masks: explicit for bitfields, implicit otherwise
+	var masks [4]uint32
+	switch {
+	case compression != bmpRGB:
+		n := 3
+		if compression == bmpAlphaBitfields || headerSize >= 56 {
+			n = 4
+		}
+		if len(data) < 54+4*n {
+			return nil, errUnsupportedBMP
+		}
+		for i := 0; i < n; i++ {
+			masks[i] = le.Uint32(data[54+4*i:])
+		}
+	case bpp == 16:
+		masks = [4]uint32{0x7C00, 0x03E0, 0x001F, 0}
+	case bpp == 32:
+		masks = [4]uint32{0x00FF0000, 0x0000FF00, 0x000000FF, 0}
+	}
+
+	var palette []color.NRGBA
+	if bpp <= 8 {
+		if bpp != 1 && bpp != 4 && bpp != 8 {
+			return nil, errUnsupportedBMP
+		}
+		if colorsUsed == 0 || colorsUsed > 1<<bpp {
+			colorsUsed = 1 << bpp
+		}
+		start := 14 + headerSize
+		if start+colorsUsed*paletteEntry > len(data) {
+			return nil, errUnsupportedBMP
+		}
+		palette = make([]color.NRGBA, colorsUsed)
+		for i := range palette {
+			p := data[start+i*paletteEntry:]
+			palette[i] = color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xFF}
+		}
+	} else if bpp != 16 && bpp != 24 && bpp != 32 {
+		return nil, errUnsupportedBMP
+	}
+
+	stride := (width*bpp + 31) / 32 * 4
+	if pixelOffset < 14 || pixelOffset > len(data) || (len(data)-pixelOffset)/stride < height {
+		return nil, errUnsupportedBMP
+	}
+
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := data[pixelOffset+y*stride : pixelOffset+(y+1)*stride]
+		dy := y
+		if !topDown {
+			dy = height - 1 - y
+		}
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				idx := int(row[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if idx < len(palette) {
+					c = palette[idx]
+				}
+			case 24:
+				c = color.NRGBA{R: row[x*3+2], G: row[x*3+1], B: row[x*3], A: 0xFF}
+			case 16:
+				c = maskedColor(uint32(le.Uint16(row[x*2:])), masks)
+			case 32:
+				c = maskedColor(le.Uint32(row[x*4:]), masks)
+			}
+			img.SetNRGBA(x, dy, c)
+		}
+	}
+	return img, nil
+}
+
+func maskedColor(px uint32, masks [4]uint32) color.NRGBA {
+	c := color.NRGBA{
+		R: maskChannel(px, masks[0]),
+		G: maskChannel(px, masks[1]),
+		B: maskChannel(px, masks[2]),
+		A: 0xFF,
+	}
+	if masks[3] != 0 {
+		c.A = maskChannel(px, masks[3])
+	}
+	return c
+}
+
+// maskChannel extracts the channel selected by mask and scales it to 8 bits.
+func maskChannel(px, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	max := mask >> shift
+	return uint8(uint64((px&mask)>>shift) * 255 / uint64(max))
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// buildBMP assembles a BMP with a BITMAPINFOHEADER. height < 0 means top-down.
+func buildBMP(width, height, bpp, compression int, extra, pixels []byte) []byte {
+	le := binary.LittleEndian
+	header := make([]byte, 54)
+	copy(header, "BM")
+	le.PutUint32(header[2:], uint32(54+len(extra)+len(pixels)))
+	le.PutUint32(header[10:], uint32(54+len(extra)))
+	le.PutUint32(header[14:], 40)
+	le.PutUint32(header[18:], uint32(int32(width)))
+	le.PutUint32(header[22:], uint32(int32(height)))
+	le.PutUint16(header[26:], 1)
+	le.PutUint16(header[28:], uint16(bpp))
+	le.PutUint32(header[30:], uint32(compression))
+	out := append(header, extra...)
+	return append(out, pixels...)
+}
+
+func TestDecodeBMP_24bitBottomUp(t *testing.T) {
+	// 2x2, rows padded to 8 bytes; first stored row is the bottom one
+	pixels := []byte{
+		0, 0, 255, 0, 255, 0, 0, 0, // bottom: red, green
+		255, 0, 0, 255, 255, 255, 0, 0, // top: blue, white
+	}
+	img, err := decodeBMP(buildBMP(2, 2, 24, bmpRGB, nil, pixels))
+	if err != nil {
+		t.Fatalf("decodeBMP() error = %v", err)
+	}
+
+	want := map[[2]int]color.NRGBA{
+		{0, 0}: {0, 0, 255, 255},
+		{1, 0}: {255, 255, 255, 255},
+		{0, 1}: {255, 0, 0, 255},
+		{1, 1}: {0, 255, 0, 255},
+	}
+	for pos, c := range want {
+		if got := color.NRGBAModel.Convert(img.At(pos[0], pos[1])); got != c {
+			t.Errorf("At(%d,%d) = %v, want %v", pos[0], pos[1], got, c)
+		}
+	}
+}
+
+func TestDecodeBMP_8bitPalette(t *testing.T) {
+	palette := []byte{0, 0, 0, 0, 0, 255, 255, 0} // black, yellow
+	pixels := []byte{1, 0, 0, 0}                  // 1x1 + padding
+	data := buildBMP(1, 1, 8, bmpRGB, palette, pixels)
+	binary.LittleEndian.PutUint32(data[46:], 2)
+
+	img, err := decodeBMP(data)
+	if err != nil {
+		t.Fatalf("decodeBMP() error = %v", err)
+	}
+	if got := color.NRGBAModel.Convert(img.At(0, 0)); got != (color.NRGBA{255, 255, 0, 255}) {
+		t.Errorf("At(0,0) = %v, want yellow", got)
+	}
+}
+
+func TestDecodeBMP_32bitBitfieldsTopDown(t *testing.T) {
+	masks := make([]byte, 12)
+	binary.LittleEndian.PutUint32(masks[0:], 0x000000FF) // R
+	binary.LittleEndian.PutUint32(masks[4:], 0x0000FF00) // G
+	binary.LittleEndian.PutUint32(masks[8:], 0x00FF0000) // B
+	pixels := []byte{
+		10, 20, 30, 0, // top
+		40, 50, 60, 0, // bottom
+	}
+	img, err := decodeBMP(buildBMP(1, -2, 32, bmpBitfields, masks, pixels))
+	if err != nil {
+		t.Fatalf("decodeBMP() error = %v", err)
+	}
+	if got := color.NRGBAModel.Convert(img.At(0, 0)); got != (color.NRGBA{10, 20, 30, 255}) {
+		t.Errorf("At(0,0) = %v, want {10 20 30 255}", got)
+	}
+	if got := color.NRGBAModel.Convert(img.At(0, 1)); got != (color.NRGBA{40, 50, 60, 255}) {
+		t.Errorf("At(0,1) = %v, want {40 50 60 255}", got)
+	}
+}
+
+func TestDecodeBMP_Rejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"rle8", buildBMP(1, 1, 8, 1, make([]byte, 1024), []byte{0, 0, 0, 0})},
+		{"truncated pixels", buildBMP(100, 100, 24, bmpRGB, nil, make([]byte, 16))},
+		{"zero width", buildBMP(0, 1, 24, bmpRGB, nil, make([]byte, 4))},
+		{"odd bpp", buildBMP(1, 1, 7, bmpRGB, nil, make([]byte, 4))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeBMP(tt.data); err == nil {
+				t.Error("decodeBMP() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDecodableInput(t *testing.T) {
+	bmp := buildBMP(1, 1, 24, bmpRGB, nil, []byte{0, 0, 255, 0})
+	out, err := decodableInput(bmp)
+	if err != nil {
+		t.Fatalf("decodableInput(bmp) error = %v", err)
+	}
+	if detectFormat(out) != FormatPNG {
+		t.Fatalf("decodableInput(bmp) format = %q, want %q", detectFormat(out), FormatPNG)
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("png.Decode() error = %v", err)
+	}
+
+	heix := append([]byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'x'}, make([]byte, 20)...)
+	out, err = decodableInput(heix)
+	if err != nil {
+		t.Fatalf("decodableInput(heix) error = %v", err)
+	}
+	if string(out[8:12]) != "heic" {
+		t.Errorf("major brand = %q, want heic", out[8:12])
+	}
+	if string(heix[8:12]) != "heix" {
+		t.Error("decodableInput modified its input")
+	}
+
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if out, _ := decodableInput(jpeg); &out[0] != &jpeg[0] {
+		t.Error("decodableInput(jpeg) should pass data through")
+	}
+}
@@ -0,0 +1,41 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Crop is the strategy a fit=cover preset uses to pick the part of the
+// source that fills its box.
+type Crop string
+
+const (
+	CropCentre    Crop = "centre"    // the middle of the source
+	CropEntropy   Crop = "entropy"   // the region with the most detail
+	CropAttention Crop = "attention" // libvips smartcrop: skin tones, saturated colours, edges
+)
+
+func parseCrop(name string) (Crop, error) {
+	switch strings.ToLower(name) {
+	case "centre", "center":
+		return CropCentre, nil
+	case "entropy":
+		return CropEntropy, nil
+	case "attention":
+		return CropAttention, nil
+	}
+	return "", fmt.Errorf("unknown crop %q", name)
+}
+
+// FocalPoint is the subject of an image set by its owner, as fractions
+// (0-1) of the width and height of the original variant. Cover presets cut
+// their box around it instead of following their crop strategy.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Valid reports whether the point lies within the image.
+func (f FocalPoint) Valid() bool {
+	return f.X >= 0 && f.X <= 1 && f.Y >= 0 && f.Y <= 1
+}
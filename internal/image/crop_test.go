@@ -0,0 +1,35 @@
+package image
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCrop(t *testing.T) {
+	for name, want := range map[string]Crop{"centre": CropCentre, "center": CropCentre, "Entropy": CropEntropy, "attention": CropAttention} {
+		if got, err := parseCrop(name); err != nil || got != want {
+			t.Errorf("parseCrop(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := parseCrop("faces"); err == nil {
+		t.Error("parseCrop(faces) should fail")
+	}
+}
+
+func TestFocalPoint_Valid(t *testing.T) {
+	tests := []struct {
+		f    FocalPoint
+		want bool
+	}{
+		{FocalPoint{0.5, 0.5}, true},
+		{FocalPoint{0, 1}, true},
+		{FocalPoint{-0.1, 0.5}, false},
+		{FocalPoint{0.5, 1.01}, false},
+		{FocalPoint{math.NaN(), 0.5}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.Valid(); got != tt.want {
+			t.Errorf("%+v.Valid() = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
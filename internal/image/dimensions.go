@@ -0,0 +1,247 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrImageTooLarge = errors.New("image dimensions too large")
+
+// Limits caps decoded image size. Zero values disable the respective check.
+type Limits struct {
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels float64
+}
+
+// CheckDimensions reads the image size from the file header, without
+// decoding pixels, and rejects images exceeding limits. Every frame of an
+// animation is decoded, so the megapixel limit covers all of them.
+func CheckDimensions(data []byte, limits Limits) error {
+	width, height, err := Dimensions(data)
+	if err != nil {
+		return err
+	}
+	if limits.MaxWidth > 0 && width > limits.MaxWidth {
+		return ErrImageTooLarge
+	}
+	if limits.MaxHeight > 0 && height > limits.MaxHeight {
+		return ErrImageTooLarge
+	}
+	pixels := float64(width) * float64(height) * float64(FrameCount(data))
+	if limits.MaxMegapixels > 0 && pixels > limits.MaxMegapixels*1e6 {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// Dimensions returns the pixel size declared in the image header.
+func Dimensions(data []byte) (width, height int, err error) {
+	switch detectFormat(data) {
+	case FormatJPEG:
+		width, height = jpegDimensions(data)
+	case FormatPNG:
+		if len(data) >= 24 && bytes.Equal(data[12:16], []byte("IHDR")) {
+			width = int(binary.BigEndian.Uint32(data[16:20]))
+			height = int(binary.BigEndian.Uint32(data[20:24]))
+		}
+	case FormatGIF:
+		if len(data) >= 10 {
+			width = int(binary.LittleEndian.Uint16(data[6:8]))
+			height = int(binary.LittleEndian.Uint16(data[8:10]))
+		}
+	case FormatWebP:
+		width, height = webpDimensions(data)
+	case FormatAVIF, FormatHEIC:
+		width, height = heifDimensions(data)
+	case FormatTIFF:
+		width, height = tiffDimensions(data)
+	case FormatBMP:
+		width, height = bmpDimensions(data)
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, ErrInvalidFormat
+	}
+	return width, height, nil
+}
+
+func jpegDimensions(data []byte) (int, int) {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 0, 0
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF: // fill byte
+			pos++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8):
+			pos += 2
+			continue
+		case marker == 0xD9 || marker == 0xDA: // EOI, SOS: no frame header seen
+			return 0, 0
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		// SOF0-SOF15, except DHT (C4), JPG (C8) and DAC (CC)
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			if pos+9 > len(data) {
+				return 0, 0
+			}
+			height := int(binary.BigEndian.Uint16(data[pos+5 : pos+7]))
+			width := int(binary.BigEndian.Uint16(data[pos+7 : pos+9]))
+			return width, height
+		}
+		pos += 2 + length
+	}
+	return 0, 0
+}
+
+func webpDimensions(data []byte) (int, int) {
+	if len(data) < 30 {
+		return 0, 0
+	}
+	le := binary.LittleEndian
+	switch string(data[12:16]) {
+	case "VP8 ":
+		// frame tag (3) + start code 9d 01 2a
+		if !bytes.Equal(data[23:26], []byte{0x9D, 0x01, 0x2A}) {
+			return 0, 0
+		}
+		return int(le.Uint16(data[26:28]) & 0x3FFF), int(le.Uint16(data[28:30]) & 0x3FFF)
+	case "VP8L":
+		if data[20] != 0x2F {
+			return 0, 0
+		}
+		bits := le.Uint32(data[21:25])
+		return int(bits&0x3FFF) + 1, int((bits>>14)&0x3FFF) + 1
+	case "VP8X":
+		w := int(data[24]) | int(data[25])<<8 | int(data[26])<<16
+		h := int(data[27]) | int(data[28])<<8 | int(data[29])<<16
+		return w + 1, h + 1
+	}
+	return 0, 0
+}
+
+// heifDimensions walks meta/iprp/ipco and returns the largest ispe
+// (image spatial extents) property, which covers grid-tiled images.
+func heifDimensions(data []byte) (int, int) {
+	meta := isoBox(data, "meta")
+	if len(meta) < 4 {
+		return 0, 0
+	}
+	ipco := isoBox(isoBox(meta[4:], "iprp"), "ipco") // meta is a full box
+	var width, height int
+	for pos := 0; pos+8 <= len(ipco); {
+		size, header := isoBoxSize(ipco[pos:])
+		if size == 0 {
+			break
+		}
+		if string(ipco[pos+4:pos+8]) == "ispe" && size >= header+12 {
+			w := int(binary.BigEndian.Uint32(ipco[pos+header+4:]))
+			h := int(binary.BigEndian.Uint32(ipco[pos+header+8:]))
+			if w*h > width*height {
+				width, height = w, h
+			}
+		}
+		pos += size
+	}
+	return width, height
+}
+
+// isoBox returns the payload of the first ISO-BMFF box of type name.
+func isoBox(data []byte, name string) []byte {
+	for pos := 0; pos+8 <= len(data); {
+		size, header := isoBoxSize(data[pos:])
+		if size == 0 {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == name {
+			return data[pos+header : pos+size]
+		}
+		pos += size
+	}
+	return nil
+}
+
+// isoBoxSize returns the full box size and header length, or 0 when the box
+// is malformed or runs past the end of data.
+func isoBoxSize(data []byte) (size, header int) {
+	size, header = int(binary.BigEndian.Uint32(data[0:4])), 8
+	switch size {
+	case 0: // extends to end of data
+		size = len(data)
+	case 1: // 64-bit largesize
+		if len(data) < 16 {
+			return 0, 0
+		}
+		large := binary.BigEndian.Uint64(data[8:16])
+		if large > uint64(len(data)) {
+			return 0, 0
+		}
+		size, header = int(large), 16
+	}
+	if size < header || size > len(data) {
+		return 0, 0
+	}
+	return size, header
+}
+
+func tiffDimensions(data []byte) (int, int) {
+	if len(data) < 8 {
+		return 0, 0
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := int(order.Uint32(data[4:8]))
+	if ifd < 8 || ifd+2 > len(data) {
+		return 0, 0
+	}
+	count := int(order.Uint16(data[ifd : ifd+2]))
+	var width, height int
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(data) {
+			break
+		}
+		tag := order.Uint16(data[entry : entry+2])
+		if tag != 256 && tag != 257 {
+			continue
+		}
+		var value int
+		switch order.Uint16(data[entry+2 : entry+4]) {
+		case 3: // SHORT
+			value = int(order.Uint16(data[entry+8 : entry+10]))
+		case 4: // LONG
+			value = int(order.Uint32(data[entry+8 : entry+12]))
+		}
+		if tag == 256 {
+			width = value
+		} else {
+			height = value
+		}
+	}
+	return width, height
+}
+
+func bmpDimensions(data []byte) (int, int) {
+	le := binary.LittleEndian
+	if le.Uint32(data[14:18]) == 12 {
+		if len(data) < 22 {
+			return 0, 0
+		}
+		return int(le.Uint16(data[18:20])), int(le.Uint16(data[20:22]))
+	}
+	if len(data) < 26 {
+		return 0, 0
+	}
+	width := int(int32(le.Uint32(data[18:22])))
+	height := int(int32(le.Uint32(data[22:26])))
+	if height < 0 {
+		height = -height
+	}
+	return width, height
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+// isoBoxBytes builds an ISO-BMFF box around payload.
+func isoBoxBytes(name string, payload ...[]byte) []byte {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	out = append(out, name...)
+	return append(out, body...)
+}
+
+func ispe(width, height uint32) []byte {
+	payload := make([]byte, 12) // version/flags + width + height
+	binary.BigEndian.PutUint32(payload[4:], width)
+	binary.BigEndian.PutUint32(payload[8:], height)
+	return isoBoxBytes("ispe", payload)
+}
+
+func heifHeader(brand string, props ...[]byte) []byte {
+	ftyp := isoBoxBytes("ftyp", []byte(brand), make([]byte, 4), []byte("mif1"))
+	ipco := isoBoxBytes("ipco", props...)
+	meta := isoBoxBytes("meta", make([]byte, 4), isoBoxBytes("hdlr", make([]byte, 24)), isoBoxBytes("iprp", ipco))
+	return append(ftyp, meta...)
+}
+
+func TestDimensions(t *testing.T) {
+	tiffLE := []byte{'I', 'I', 0x2A, 0, 8, 0, 0, 0, 2, 0}
+	tiffLE = append(tiffLE, 0, 1, 3, 0, 1, 0, 0, 0, 0x20, 0x03, 0, 0) // width SHORT 800
+	tiffLE = append(tiffLE, 1, 1, 4, 0, 1, 0, 0, 0, 0x58, 0x02, 0, 0) // height LONG 600
+
+	tiffBE := []byte{'M', 'M', 0, 0x2A, 0, 0, 0, 8, 0, 2}
+	tiffBE = append(tiffBE, 1, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0x0F, 0xA0) // width LONG 4000
+	tiffBE = append(tiffBE, 1, 1, 0, 3, 0, 0, 0, 1, 0x0B, 0xB8, 0, 0) // height SHORT 3000
+
+	vp8x := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x00\x00\x00\x00")
+	vp8x = append(vp8x, 0x7F, 0x0C, 0x00, 0xFF, 0x0F, 0x00) // 3200x4096
+
+	vp8l := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2F")
+	vp8l = binary.LittleEndian.AppendUint32(vp8l, (640-1)|(480-1)<<14)
+	vp8l = append(vp8l, make([]byte, 8)...)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"jpeg", testutil.SampleJPEG(), 1, 1},
+		{"png", testutil.SamplePNG(), 1, 1},
+		{"gif", testutil.SampleGIF(), 1, 1},
+		{"webp vp8", testutil.SampleWebP(), 1, 1},
+		{"webp vp8l", vp8l, 640, 480},
+		{"webp vp8x", vp8x, 3200, 4096},
+		{"heic grid", heifHeader("heic", ispe(512, 512), ispe(4032, 3024)), 4032, 3024},
+		{"avif", heifHeader("avif", ispe(1920, 1080)), 1920, 1080},
+		{"tiff le", tiffLE, 800, 600},
+		{"tiff be", tiffBE, 4000, 3000},
+		{"bmp", buildBMP(3, -2, 24, bmpRGB, nil, make([]byte, 24)), 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, err := Dimensions(tt.data)
+			if err != nil {
+				t.Fatalf("Dimensions() error = %v", err)
+			}
+			if w != tt.width || h != tt.height {
+				t.Errorf("Dimensions() = %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestDimensions_Unreadable(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"jpeg without frame header", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x00, 0x00, 0, 0, 0, 0}},
+		{"heic without ispe", heifHeader("heic")},
+		{"truncated heic", heifHeader("heic", ispe(100, 100))[:40]},
+		{"unknown", make([]byte, 32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := Dimensions(tt.data); err != ErrInvalidFormat {
+				t.Errorf("Dimensions() error = %v, want %v", err, ErrInvalidFormat)
+			}
+		})
+	}
+}
+
+func TestCheckDimensions(t *testing.T) {
+	png := append([]byte{}, testutil.SamplePNG()...)
+	binary.BigEndian.PutUint32(png[16:20], 50000)
+	binary.BigEndian.PutUint32(png[20:24], 50000)
+
+	tests := []struct {
+		name   string
+		limits Limits
+		want   error
+	}{
+		{"no limits", Limits{}, nil},
+		{"within limits", Limits{MaxWidth: 60000, MaxHeight: 60000, MaxMegapixels: 3000}, nil},
+		{"too wide", Limits{MaxWidth: 16384}, ErrImageTooLarge},
+		{"too tall", Limits{MaxHeight: 16384}, ErrImageTooLarge},
+		{"too many pixels", Limits{MaxMegapixels: 100}, ErrImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckDimensions(png, tt.limits); err != tt.want {
+				t.Errorf("CheckDimensions() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDimensions_CountsFrames(t *testing.T) {
+	limits := Limits{MaxMegapixels: 1}
+
+	// 500x500 = 0.25 MP per frame
+	if err := CheckDimensions(testutil.AnimatedGIF(500, 500, 4), limits); err != nil {
+		t.Errorf("4 frames: error = %v, want nil", err)
+	}
+	if err := CheckDimensions(testutil.AnimatedGIF(500, 500, 5), limits); err != ErrImageTooLarge {
+		t.Errorf("5 frames: error = %v, want %v", err, ErrImageTooLarge)
+	}
+}
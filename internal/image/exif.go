@@ -0,0 +1,415 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Metadata is the whitelisted subset of EXIF/XMP kept after stripping.
+// GPS is only filled in when present; callers decide whether to store it.
+type Metadata struct {
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	TakenAt      string // "2006-01-02 15:04:05", camera local time
+	ExposureTime string // seconds, "1/250" or "2.5"
+	FNumber      float64
+	ISO          int
+	FocalLength  float64 // mm
+	GPSLat       *float64
+	GPSLon       *float64
+}
+
+const takenAtLayout = "2006-01-02 15:04:05"
+
+// EXIF tags read from IFD0, the Exif sub-IFD and the GPS sub-IFD
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+	tagGPSLatRef        = 0x0001
+	tagGPSLat           = 0x0002
+	tagGPSLonRef        = 0x0003
+	tagGPSLon           = 0x0004
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// ExtractMetadata parses EXIF and XMP from the source file, before it is
+// re-encoded without metadata. Returns nil when nothing useful is found.
+func ExtractMetadata(data []byte) *Metadata {
+	tiff, xmp := metadataBlocks(data)
+
+	m := &Metadata{}
+	if tiff != nil {
+		parseEXIF(tiff, m)
+	}
+	if xmp != nil {
+		parseXMP(xmp, m)
+	}
+	if m.IsEmpty() {
+		return nil
+	}
+	return m
+}
+
+// IsEmpty reports whether no field was extracted.
+func (m *Metadata) IsEmpty() bool {
+	return *m == Metadata{}
+}
+
+// metadataBlocks locates the raw EXIF (TIFF structure) and XMP packets.
+func metadataBlocks(data []byte) (tiff, xmp []byte) {
+	switch detectFormat(data) {
+	case FormatJPEG:
+		for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+			marker := data[pos+1]
+			if marker == 0xDA || marker == 0xD9 {
+				break
+			}
+			end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+			if end > len(data) {
+				break
+			}
+			if marker == 0xE1 {
+				payload := data[pos+4 : end]
+				switch {
+				case tiff == nil && bytes.HasPrefix(payload, exifHeader):
+					tiff = payload[len(exifHeader):]
+				case xmp == nil && bytes.HasPrefix(payload, xmpHeader):
+					xmp = payload[len(xmpHeader):]
+				}
+			}
+			pos = end
+		}
+	case FormatPNG:
+		for pos := 8; pos+12 <= len(data); {
+			size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+			end := pos + 12 + size
+			if size < 0 || end > len(data) {
+				break
+			}
+			payload := data[pos+8 : pos+8+size]
+			switch string(data[pos+4 : pos+8]) {
+			case "eXIf":
+				tiff = payload
+			case "iTXt":
+				// keyword\0 compression-flag method lang\0 translated\0 text
+				if rest, ok := bytes.CutPrefix(payload, []byte("XML:com.adobe.xmp\x00\x00\x00")); ok {
+					if parts := bytes.SplitN(rest, []byte{0}, 3); len(parts) == 3 {
+						xmp = parts[2]
+					}
+				}
+			case "IDAT":
+				return tiff, xmp // metadata after image data is rare; stop early
+			}
+			pos = end
+		}
+	case FormatWebP:
+		for pos := 12; pos+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+			end := pos + 8 + size
+			if size < 0 || end > len(data) {
+				break
+			}
+			switch string(data[pos : pos+4]) {
+			case "EXIF":
+				tiff = bytes.TrimPrefix(data[pos+8:end], exifHeader)
+			case "XMP ":
+				xmp = data[pos+8 : end]
+			}
+			pos = end + size&1
+		}
+	case FormatTIFF:
+		tiff = data
+	case FormatHEIC, FormatAVIF:
+		// The Exif item lives in mdat behind iloc offsets; the payload is
+		// prefixed with "Exif\0\0", so a header scan finds it without
+		// walking the item tables.
+		for off := 0; ; {
+			i := bytes.Index(data[off:], exifHeader)
+			if i < 0 {
+				break
+			}
+			start := off + i + len(exifHeader)
+			if start+4 <= len(data) && tiffByteOrder(data[start:]) != nil {
+				tiff = data[start:]
+				break
+			}
+			off = start
+		}
+		if i := bytes.Index(data, []byte("<x:xmpmeta")); i >= 0 {
+			xmp = data[i:]
+		}
+	}
+	return tiff, xmp
+}
+
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+	switch {
+	case bytes.HasPrefix(tiff, tiffMagic[0]):
+		return binary.LittleEndian
+	case bytes.HasPrefix(tiff, tiffMagic[1]):
+		return binary.BigEndian
+	}
+	return nil
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// readIFD returns the entries of the IFD at offset, keyed by tag.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]ifdEntry {
+	if offset < 8 || uint64(offset)+2 > uint64(len(tiff)) {
+		return nil
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	entries := make(map[uint16]ifdEntry, n)
+	for i := 0; i < n; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(tiff) {
+			break
+		}
+		typ := order.Uint16(tiff[pos+2:])
+		count := order.Uint32(tiff[pos+4:])
+		var unit int
+		switch typ {
+		case 1, 2, 7: // BYTE, ASCII, UNDEFINED
+			unit = 1
+		case 3: // SHORT
+			unit = 2
+		case 4, 9: // LONG, SLONG
+			unit = 4
+		case 5, 10: // RATIONAL, SRATIONAL
+			unit = 8
+		default:
+			continue
+		}
+		size := uint64(count) * uint64(unit)
+		var value []byte
+		if size <= 4 {
+			value = tiff[pos+8 : pos+8+int(size)]
+		} else {
+			start := uint64(order.Uint32(tiff[pos+8:]))
+			if start+size > uint64(len(tiff)) {
+				continue
+			}
+			value = tiff[start : start+size]
+		}
+		entries[order.Uint16(tiff[pos:])] = ifdEntry{typ: typ, count: count, value: value}
+	}
+	return entries
+}
+
+func parseEXIF(tiff []byte, m *Metadata) {
+	order := tiffByteOrder(tiff)
+	if order == nil || len(tiff) < 8 {
+		return
+	}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:8]))
+
+	m.CameraMake = ifdString(ifd0[tagMake])
+	m.CameraModel = ifdString(ifd0[tagModel])
+	m.TakenAt = parseTakenAt(ifdString(ifd0[tagDateTime]))
+
+	if ptr, ok := ifdUint(order, ifd0[tagExifIFD]); ok {
+		exif := readIFD(tiff, order, ptr)
+		if t := parseTakenAt(ifdString(exif[tagDateTimeOriginal])); t != "" {
+			m.TakenAt = t
+		}
+		m.LensModel = ifdString(exif[tagLensModel])
+		if num, den, ok := ifdRational(order, exif[tagExposureTime], 0); ok {
+			m.ExposureTime = formatExposure(num, den)
+		}
+		if num, den, ok := ifdRational(order, exif[tagFNumber], 0); ok {
+			m.FNumber = roundTo(float64(num)/float64(den), 1)
+		}
+		if iso, ok := ifdUint(order, exif[tagISO]); ok {
+			m.ISO = int(iso)
+		}
+		if num, den, ok := ifdRational(order, exif[tagFocalLength], 0); ok {
+			m.FocalLength = roundTo(float64(num)/float64(den), 1)
+		}
+	}
+
+	if ptr, ok := ifdUint(order, ifd0[tagGPSIFD]); ok {
+		gps := readIFD(tiff, order, ptr)
+		lat, latOK := gpsCoordinate(order, gps[tagGPSLat], ifdString(gps[tagGPSLatRef]), "S")
+		lon, lonOK := gpsCoordinate(order, gps[tagGPSLon], ifdString(gps[tagGPSLonRef]), "W")
+		if latOK && lonOK && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			m.GPSLat, m.GPSLon = &lat, &lon
+		}
+	}
+}
+
+func ifdString(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return cleanText(string(e.value))
+}
+
+func ifdUint(order binary.ByteOrder, e ifdEntry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func ifdRational(order binary.ByteOrder, e ifdEntry, i int) (uint32, uint32, bool) {
+	if e.typ != 5 || len(e.value) < (i+1)*8 {
+		return 0, 0, false
+	}
+	num := order.Uint32(e.value[i*8:])
+	den := order.Uint32(e.value[i*8+4:])
+	return num, den, den != 0
+}
+
+func gpsCoordinate(order binary.ByteOrder, e ifdEntry, ref, negative string) (float64, bool) {
+	var parts [3]float64
+	for i := range parts {
+		num, den, ok := ifdRational(order, e, i)
+		if !ok {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	v := parts[0] + parts[1]/60 + parts[2]/3600
+	if strings.EqualFold(ref, negative) {
+		v = -v
+	}
+	return roundTo(v, 6), true
+}
+
+func formatExposure(num, den uint32) string {
+	if num == 0 {
+		return ""
+	}
+	if num < den {
+		return "1/" + strconv.FormatFloat(math.Round(float64(den)/float64(num)), 'f', -1, 64)
+	}
+	return strconv.FormatFloat(roundTo(float64(num)/float64(den), 1), 'f', -1, 64)
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+var takenAtLayouts = []string{
+	"2006:01:02 15:04:05", // EXIF
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTakenAt normalises EXIF and XMP (ISO 8601) timestamps. Time zone
+// suffixes are dropped: cameras record local time and so do we.
+func parseTakenAt(s string) string {
+	if len(s) > 19 && (s[4] == '-' || s[4] == ':') {
+		s = s[:19]
+	}
+	for _, layout := range takenAtLayouts {
+		if t, err := time.Parse(layout, s); err == nil && t.Year() > 1900 {
+			return t.Format(takenAtLayout)
+		}
+	}
+	return ""
+}
+
+// cleanText trims padding and drops control characters; values are capped
+// at 64 runes since they end up in HTML and JSON.
+func cleanText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == unicode.ReplacementChar || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > 64 {
+		s = string(r[:64])
+	}
+	return s
+}
+
+// XMP fallbacks, used only for fields EXIF did not provide
+var xmpFields = []struct {
+	names []string
+	set   func(m *Metadata, v string)
+}{
+	{[]string{"tiff:Make"}, func(m *Metadata, v string) {
+		if m.CameraMake == "" {
+			m.CameraMake = v
+		}
+	}},
+	{[]string{"tiff:Model"}, func(m *Metadata, v string) {
+		if m.CameraModel == "" {
+			m.CameraModel = v
+		}
+	}},
+	{[]string{"exifEX:LensModel", "aux:Lens"}, func(m *Metadata, v string) {
+		if m.LensModel == "" {
+			m.LensModel = v
+		}
+	}},
+	{[]string{"exif:DateTimeOriginal", "xmp:CreateDate", "photoshop:DateCreated"}, func(m *Metadata, v string) {
+		if m.TakenAt == "" {
+			m.TakenAt = parseTakenAt(v)
+		}
+	}},
+}
+
+func parseXMP(xmp []byte, m *Metadata) {
+	if len(xmp) > 64<<10 {
+		xmp = xmp[:64<<10]
+	}
+	for _, f := range xmpFields {
+		for _, name := range f.names {
+			if v := xmpValue(xmp, name); v != "" {
+				f.set(m, v)
+				break
+			}
+		}
+	}
+}
+
+// xmpValue reads a simple property written either as an attribute
+// (name="value") or as an element (<name>value</name>).
+func xmpValue(xmp []byte, name string) string {
+	q := regexp.QuoteMeta(name)
+	re := regexp.MustCompile(fmt.Sprintf(`%s="([^"]*)"|<%s>([^<]*)</%s>`, q, q, q))
+	match := re.FindSubmatch(xmp)
+	if match == nil {
+		return ""
+	}
+	v := match[1]
+	if len(v) == 0 {
+		v = match[2]
+	}
+	return cleanText(string(v))
+}
@@ -0,0 +1,248 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortField(tag, v uint16) tiffField {
+	return tiffField{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func rationalField(tag uint16, pairs ...uint32) tiffField {
+	var data []byte
+	for _, v := range pairs {
+		data = binary.LittleEndian.AppendUint32(data, v)
+	}
+	return tiffField{tag, 5, uint32(len(pairs) / 2), data}
+}
+
+// buildTIFF lays out IFD0, an Exif IFD and a GPS IFD in one little-endian
+// TIFF structure, appending pointer tags to IFD0 as needed.
+func buildTIFF(ifd0, exif, gps []tiffField) []byte {
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+	n0 := len(ifd0)
+	if exif != nil {
+		n0++
+	}
+	if gps != nil {
+		n0++
+	}
+	exifOff := 8 + ifdSize(n0)
+	gpsOff := exifOff
+	if exif != nil {
+		gpsOff += ifdSize(len(exif))
+	}
+	dataOff := gpsOff
+	if gps != nil {
+		dataOff += ifdSize(len(gps))
+	}
+
+	if exif != nil {
+		ifd0 = append(ifd0, tiffField{tagExifIFD, 4, 1, binary.LittleEndian.AppendUint32(nil, uint32(exifOff))})
+	}
+	if gps != nil {
+		ifd0 = append(ifd0, tiffField{tagGPSIFD, 4, 1, binary.LittleEndian.AppendUint32(nil, uint32(gpsOff))})
+	}
+
+	out := []byte{'I', 'I', 0x2A, 0, 8, 0, 0, 0}
+	var extra []byte
+	writeIFD := func(fields []tiffField) {
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(fields)))
+		for _, f := range fields {
+			out = binary.LittleEndian.AppendUint16(out, f.tag)
+			out = binary.LittleEndian.AppendUint16(out, f.typ)
+			out = binary.LittleEndian.AppendUint32(out, f.count)
+			if len(f.data) <= 4 {
+				out = append(out, append(f.data, make([]byte, 4-len(f.data))...)...)
+			} else {
+				out = binary.LittleEndian.AppendUint32(out, uint32(dataOff+len(extra)))
+				extra = append(extra, f.data...)
+			}
+		}
+		out = append(out, 0, 0, 0, 0)
+	}
+	writeIFD(ifd0)
+	if exif != nil {
+		writeIFD(exif)
+	}
+	if gps != nil {
+		writeIFD(gps)
+	}
+	return append(out, extra...)
+}
+
+// jpegWithAPP1 inserts APP1 segments right after SOI of the sample JPEG.
+func jpegWithAPP1(payloads ...[]byte) []byte {
+	sample := testutil.SampleJPEG()
+	out := append([]byte{}, sample[:2]...)
+	for _, p := range payloads {
+		out = append(out, 0xFF, 0xE1)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(p)+2))
+		out = append(out, p...)
+	}
+	return append(out, sample[2:]...)
+}
+
+func sampleEXIF() []byte {
+	return buildTIFF(
+		[]tiffField{
+			asciiField(tagMake, "Canon"),
+			asciiField(tagModel, "Canon EOS R5"),
+			asciiField(tagDateTime, "2024:05:01 08:00:00"),
+		},
+		[]tiffField{
+			rationalField(tagExposureTime, 1, 250),
+			rationalField(tagFNumber, 28, 10),
+			shortField(tagISO, 400),
+			asciiField(tagDateTimeOriginal, "2024:04:30 18:42:07"),
+			rationalField(tagFocalLength, 50, 1),
+			asciiField(tagLensModel, "RF50mm F1.8 STM"),
+		},
+		[]tiffField{
+			asciiField(tagGPSLatRef, "N"),
+			rationalField(tagGPSLat, 52, 1, 13, 1, 5634, 100),
+			asciiField(tagGPSLonRef, "E"),
+			rationalField(tagGPSLon, 21, 1, 0, 1, 4230, 100),
+		},
+	)
+}
+
+func TestExtractMetadata_JPEG(t *testing.T) {
+	data := jpegWithAPP1(append([]byte("Exif\x00\x00"), sampleEXIF()...))
+
+	m := ExtractMetadata(data)
+	if m == nil {
+		t.Fatal("ExtractMetadata() = nil")
+	}
+
+	if m.CameraMake != "Canon" || m.CameraModel != "Canon EOS R5" {
+		t.Errorf("camera = %q %q", m.CameraMake, m.CameraModel)
+	}
+	if m.LensModel != "RF50mm F1.8 STM" {
+		t.Errorf("LensModel = %q", m.LensModel)
+	}
+	if m.TakenAt != "2024-04-30 18:42:07" {
+		t.Errorf("TakenAt = %q, want DateTimeOriginal", m.TakenAt)
+	}
+	if m.ExposureTime != "1/250" {
+		t.Errorf("ExposureTime = %q, want 1/250", m.ExposureTime)
+	}
+	if m.FNumber != 2.8 || m.ISO != 400 || m.FocalLength != 50 {
+		t.Errorf("FNumber/ISO/FocalLength = %v/%v/%v", m.FNumber, m.ISO, m.FocalLength)
+	}
+	if m.GPSLat == nil || m.GPSLon == nil {
+		t.Fatal("GPS not parsed")
+	}
+	if *m.GPSLat != 52.232317 || *m.GPSLon != 21.011750 {
+		t.Errorf("GPS = %v, %v", *m.GPSLat, *m.GPSLon)
+	}
+}
+
+func TestExtractMetadata_GPSSouthWest(t *testing.T) {
+	tiff := buildTIFF(nil, nil, []tiffField{
+		asciiField(tagGPSLatRef, "S"),
+		rationalField(tagGPSLat, 33, 1, 51, 1, 0, 1),
+		asciiField(tagGPSLonRef, "W"),
+		rationalField(tagGPSLon, 70, 1, 30, 1, 0, 1),
+	})
+	m := ExtractMetadata(jpegWithAPP1(append([]byte("Exif\x00\x00"), tiff...)))
+	if m == nil || m.GPSLat == nil {
+		t.Fatal("GPS not parsed")
+	}
+	if *m.GPSLat != -33.85 || *m.GPSLon != -70.5 {
+		t.Errorf("GPS = %v, %v, want -33.85, -70.5", *m.GPSLat, *m.GPSLon)
+	}
+}
+
+func TestExtractMetadata_XMPFallback(t *testing.T) {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF><rdf:Description
+		tiff:Make="FUJIFILM" xmp:CreateDate="2023-12-24T17:05:00+01:00">
+		<tiff:Model>X-T4</tiff:Model><aux:Lens>XF23mmF2 R WR</aux:Lens>
+		</rdf:Description></rdf:RDF></x:xmpmeta>`
+	data := jpegWithAPP1(append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...))
+
+	m := ExtractMetadata(data)
+	if m == nil {
+		t.Fatal("ExtractMetadata() = nil")
+	}
+	if m.CameraMake != "FUJIFILM" || m.CameraModel != "X-T4" || m.LensModel != "XF23mmF2 R WR" {
+		t.Errorf("camera/lens = %q %q %q", m.CameraMake, m.CameraModel, m.LensModel)
+	}
+	if m.TakenAt != "2023-12-24 17:05:00" {
+		t.Errorf("TakenAt = %q", m.TakenAt)
+	}
+}
+
+func TestExtractMetadata_PNG(t *testing.T) {
+	tiff := buildTIFF([]tiffField{asciiField(tagModel, "Pixel 8")}, nil, nil)
+	sample := testutil.SamplePNG()
+	// signature + IHDR, then eXIf
+	data := append([]byte{}, sample[:33]...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(tiff)))
+	data = append(data, "eXIf"...)
+	data = append(data, tiff...)
+	data = append(data, 0, 0, 0, 0) // CRC is not checked
+	data = append(data, sample[33:]...)
+
+	m := ExtractMetadata(data)
+	if m == nil || m.CameraModel != "Pixel 8" {
+		t.Errorf("ExtractMetadata() = %+v, want model Pixel 8", m)
+	}
+}
+
+func TestExtractMetadata_None(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"jpeg": testutil.SampleJPEG(),
+		"png":  testutil.SamplePNG(),
+		"webp": testutil.SampleWebP(),
+	} {
+		if m := ExtractMetadata(data); m != nil {
+			t.Errorf("ExtractMetadata(%s) = %+v, want nil", name, m)
+		}
+	}
+}
+
+func TestExtractMetadata_Malformed(t *testing.T) {
+	tiff := sampleEXIF()
+	// Point the Exif IFD far past the end; parsing must not panic
+	for i := 8; i+12 <= len(tiff); i++ {
+		if binary.LittleEndian.Uint16(tiff[i:]) == tagExifIFD {
+			binary.LittleEndian.PutUint32(tiff[i+8:], 0xFFFFFF00)
+			break
+		}
+	}
+	m := ExtractMetadata(jpegWithAPP1(append([]byte("Exif\x00\x00"), tiff...)))
+	if m == nil || m.CameraMake != "Canon" || m.LensModel != "" {
+		t.Errorf("ExtractMetadata() = %+v, want IFD0 fields only", m)
+	}
+
+	truncated := jpegWithAPP1(append([]byte("Exif\x00\x00"), sampleEXIF()[:40]...))
+	ExtractMetadata(truncated)
+}
+
+func TestCleanText(t *testing.T) {
+	if got := cleanText("  Canon\x00\x00 "); got != "Canon" {
+		t.Errorf("cleanText() = %q, want Canon", got)
+	}
+	long := ""
+	for i := 0; i < 100; i++ {
+		long += "x"
+	}
+	if got := cleanText(long); len(got) != 64 {
+		t.Errorf("len(cleanText(long)) = %d, want 64", len(got))
+	}
+}
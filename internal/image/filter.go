@@ -0,0 +1,105 @@
+package image
+
+import "math"
+
+// Filters are colour adjustments applied after the geometric transform.
+// The zero value changes nothing. Percentages follow the CSS filter
+// functions the editor previews with: brightness and contrast scale by
+// 1+v/100, saturation 0 keeps colours, -100 removes them.
+type Filters struct {
+	Brightness int     `json:"brightness,omitempty"` // -100..100
+	Contrast   int     `json:"contrast,omitempty"`   // -100..100
+	Saturation int     `json:"saturation,omitempty"` // -100..100
+	Gamma      float64 `json:"gamma,omitempty"`      // 0.2..5, 0 or 1 = unchanged; >1 lifts shadows
+	Sharpen    float64 `json:"sharpen,omitempty"`    // sigma 0..5
+	Blur       float64 `json:"blur,omitempty"`       // sigma 0..20
+	Grayscale  bool    `json:"grayscale,omitempty"`
+	Sepia      bool    `json:"sepia,omitempty"`
+}
+
+// Clamp returns the filters limited to supported ranges, with the float
+// values rounded to two decimals so that re-submitting the same form
+// reproduces the same pixels.
+func (f Filters) Clamp() Filters {
+	f.Brightness = min(max(f.Brightness, -100), 100)
+	f.Contrast = min(max(f.Contrast, -100), 100)
+	f.Saturation = min(max(f.Saturation, -100), 100)
+	if math.IsNaN(f.Gamma) || f.Gamma == 0 {
+		f.Gamma = 1
+	}
+	f.Gamma = round2(math.Min(math.Max(f.Gamma, 0.2), 5))
+	f.Sharpen = round2(clampSigma(f.Sharpen, 5))
+	f.Blur = round2(clampSigma(f.Blur, 20))
+	return f
+}
+
+func clampSigma(v, limit float64) float64 {
+	if math.IsNaN(v) || v < 0 {
+		return 0
+	}
+	return math.Min(v, limit)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// IsZero reports whether the filters leave the image unchanged.
+func (f Filters) IsZero() bool {
+	return f.Brightness == 0 && f.Contrast == 0 && f.Saturation == 0 &&
+		(f.Gamma == 0 || f.Gamma == 1) && f.Sharpen == 0 && f.Blur == 0 &&
+		!f.Grayscale && !f.Sepia
+}
+
+// colourMatrix folds brightness, contrast, saturation, grayscale and sepia
+// into one affine transform of sRGB values: out = m[:3]·rgb + m[3], in that
+// order, using the CSS filter matrices (Rec. 709 luma).
+func (f Filters) colourMatrix() [3][4]float64 {
+	b := 1 + float64(f.Brightness)/100
+	c := 1 + float64(f.Contrast)/100
+	s := 1 + float64(f.Saturation)/100
+	if f.Grayscale {
+		s = 0
+	}
+
+	sat := [3][3]float64{
+		{0.213 + 0.787*s, 0.715 - 0.715*s, 0.072 - 0.072*s},
+		{0.213 - 0.213*s, 0.715 + 0.285*s, 0.072 - 0.072*s},
+		{0.213 - 0.213*s, 0.715 - 0.715*s, 0.072 + 0.928*s},
+	}
+	m := sat
+	if f.Sepia {
+		sepia := [3][3]float64{
+			{0.393, 0.769, 0.189},
+			{0.349, 0.686, 0.168},
+			{0.272, 0.534, 0.131},
+		}
+		for i := range m {
+			for j := range m[i] {
+				m[i][j] = sepia[i][0]*sat[0][j] + sepia[i][1]*sat[1][j] + sepia[i][2]*sat[2][j]
+			}
+		}
+	}
+
+	// brightness then contrast around mid-grey: x*b*c + 127.5*(1-c), the
+	// offset passes through the colour matrix too
+	offset := 127.5 * (1 - c)
+	var out [3][4]float64
+	for i := range m {
+		var rowSum float64
+		for j := range m[i] {
+			out[i][j] = m[i][j] * b * c
+			rowSum += m[i][j]
+		}
+		out[i][3] = rowSum * offset
+	}
+	return out
+}
+
+// applyFilters runs the filters on an encoded image and returns a PNG, a
+// lossless intermediate for the variant encoder. The order is fixed: gamma,
+// colour matrix, blur, sharpen.
+func applyFilters(data []byte, f Filters) ([]byte, error) {
+	m := f.colourMatrix()
+	return filterImage(data, f.Gamma, m, f.Blur, f.Sharpen)
+}
@@ -0,0 +1,138 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	goimage "image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+func TestFilters_Clamp(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Filters
+		want Filters
+	}{
+		{"zero", Filters{}, Filters{Gamma: 1}},
+		{"ranges", Filters{Brightness: 250, Contrast: -300, Saturation: 101, Gamma: 9, Sharpen: 8, Blur: 50},
+			Filters{Brightness: 100, Contrast: -100, Saturation: 100, Gamma: 5, Sharpen: 5, Blur: 20}},
+		{"negative sigmas", Filters{Gamma: 0.01, Sharpen: -1, Blur: -3}, Filters{Gamma: 0.2}},
+		{"nan", Filters{Gamma: math.NaN(), Sharpen: math.NaN(), Blur: math.Inf(1)}, Filters{Gamma: 1, Blur: 20}},
+		{"rounding", Filters{Gamma: 1.23456, Sharpen: 0.999, Blur: 1.004}, Filters{Gamma: 1.23, Sharpen: 1, Blur: 1}},
+		{"flags kept", Filters{Grayscale: true, Sepia: true}, Filters{Gamma: 1, Grayscale: true, Sepia: true}},
+	}
+	for _, tt := range tests {
+		if got := tt.in.Clamp(); got != tt.want {
+			t.Errorf("%s: Clamp() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilters_IsZero(t *testing.T) {
+	for _, f := range []Filters{{}, {Gamma: 1}, Filters{}.Clamp()} {
+		if !f.IsZero() {
+			t.Errorf("%+v.IsZero() = false", f)
+		}
+	}
+	for _, f := range []Filters{{Brightness: 1}, {Gamma: 1.1}, {Blur: 0.5}, {Sepia: true}, {Grayscale: true}} {
+		if f.IsZero() {
+			t.Errorf("%+v.IsZero() = true", f)
+		}
+	}
+	if !(TransformParams{Filters: Filters{Contrast: 10}}).HasTransforms() {
+		t.Error("HasTransforms() ignores filters")
+	}
+}
+
+func applyMatrix(m [3][4]float64, rgb [3]float64) [3]float64 {
+	var out [3]float64
+	for i := range m {
+		out[i] = m[i][0]*rgb[0] + m[i][1]*rgb[1] + m[i][2]*rgb[2] + m[i][3]
+	}
+	return out
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 0.01 }
+
+func TestFilters_ColourMatrix(t *testing.T) {
+	colour := [3]float64{200, 100, 50}
+
+	if got := applyMatrix(Filters{}.colourMatrix(), colour); !near(got[0], 200) || !near(got[1], 100) || !near(got[2], 50) {
+		t.Errorf("neutral filters changed colour to %v", got)
+	}
+
+	got := applyMatrix(Filters{Brightness: 50}.colourMatrix(), colour)
+	if !near(got[0], 300) || !near(got[1], 150) || !near(got[2], 75) {
+		t.Errorf("brightness +50%% = %v, want 1.5x", got)
+	}
+
+	// contrast pivots around mid-grey
+	grey := applyMatrix(Filters{Contrast: 80}.colourMatrix(), [3]float64{127.5, 127.5, 127.5})
+	if !near(grey[0], 127.5) {
+		t.Errorf("contrast moved mid-grey to %v", grey)
+	}
+	dark := applyMatrix(Filters{Contrast: 100}.colourMatrix(), [3]float64{27.5, 27.5, 27.5})
+	if !near(dark[0], -72.5) {
+		t.Errorf("contrast +100%% of 27.5 = %v, want -72.5", dark[0])
+	}
+
+	for _, f := range []Filters{{Grayscale: true}, {Saturation: -100}} {
+		got := applyMatrix(f.colourMatrix(), colour)
+		if !near(got[0], got[1]) || !near(got[1], got[2]) {
+			t.Errorf("%+v gave coloured output %v", f, got)
+		}
+	}
+
+	got = applyMatrix(Filters{Sepia: true}.colourMatrix(), [3]float64{100, 100, 100})
+	if !(got[0] > got[1] && got[1] > got[2]) {
+		t.Errorf("sepia of grey = %v, want warm tint", got)
+	}
+}
+
+func TestProcessWithTransform_Filters(t *testing.T) {
+	src := goimage.NewRGBA(goimage.Rect(0, 0, 300, 200))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 60, 40, 30, 255
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95})
+	data := buf.Bytes()
+
+	if _, err := Process(data); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+
+	p := NewProcessor()
+	params := TransformParams{Filters: Filters{Brightness: 60, Gamma: 1.4, Saturation: -100, Sharpen: 1}}
+	first, err := p.ProcessWithTransform(context.Background(), data, params)
+	if err != nil {
+		t.Fatalf("ProcessWithTransform() error = %v", err)
+	}
+	second, err := p.ProcessWithTransform(context.Background(), data, params)
+	if err != nil {
+		t.Fatalf("ProcessWithTransform() second run error = %v", err)
+	}
+	for i := range first {
+		if !bytes.Equal(first[i].Data, second[i].Data) {
+			t.Errorf("%s differs between identical edits", first[i].Name)
+		}
+	}
+
+	out, err := Convert(first[0].Data, 95, FormatJPEG)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	img, _, err := goimage.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	r, g, b, _ := img.At(150, 100).RGBA()
+	if r>>8 <= 60 {
+		t.Errorf("red = %d, brightness/gamma did not lift the image", r>>8)
+	}
+	if diff := int(r>>8) - int(b>>8); diff > 3 || diff < -3 || int(g>>8)-int(b>>8) > 3 {
+		t.Errorf("rgb = %d,%d,%d, want grey after saturation -100", r>>8, g>>8, b>>8)
+	}
+}
@@ -0,0 +1,128 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	stdimage "image"
+	"image/png"
+	"math/bits"
+
+	"github.com/h2non/bimg"
+)
+
+// Fingerprint identifies image content independently of how it was encoded.
+type Fingerprint struct {
+	DHash     uint64 // difference hash; survives re-compression and resizing
+	PixelHash string // hex SHA-256 of the decoded RGBA pixels
+}
+
+// ComputeFingerprint decodes data (any format bimg reads; animated input
+// uses the first frame) and hashes its pixels.
+func ComputeFingerprint(data []byte) (Fingerprint, error) {
+	decoded, err := bimg.NewImage(data).Process(bimg.Options{
+		Type:          bimg.PNG,
+		Compression:   1,
+		StripMetadata: true,
+	})
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("fingerprint decode: %w", err)
+	}
+	img, err := png.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("fingerprint decode png: %w", err)
+	}
+	return fingerprintImage(img), nil
+}
+
+// HammingDistance returns the number of differing bits between two hashes.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// fingerprintImage walks the pixels once, feeding 8-bit non-premultiplied
+// RGBA rows to SHA-256 (prefixed with the size, so the hash does not depend
+// on the PNG colour type libvips picked) and averaging luma into the 9x8
+// grid of the difference hash: one bit per cell brighter than its right
+// neighbour.
+func fingerprintImage(img stdimage.Image) Fingerprint {
+	const cols, rows = 9, 8
+	var sum, count [rows][cols]uint64
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	sha := sha256.New()
+	var size [8]byte
+	binary.BigEndian.PutUint32(size[0:4], uint32(w))
+	binary.BigEndian.PutUint32(size[4:8], uint32(h))
+	sha.Write(size[:])
+
+	row := make([]byte, 4*w)
+	for y := 0; y < h; y++ {
+		readRow(img, b.Min.Y+y, row)
+		sha.Write(row)
+
+		cy := y * rows / h
+		for x := 0; x < w; x++ {
+			px := row[4*x : 4*x+4]
+			cx := x * cols / w
+			// ITU-R 601 luma
+			sum[cy][cx] += (299*uint64(px[0]) + 587*uint64(px[1]) + 114*uint64(px[2])) / 1000
+			count[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols-1; x++ {
+			hash <<= 1
+			if cellMean(sum[y][x], count[y][x]) > cellMean(sum[y][x+1], count[y][x+1]) {
+				hash |= 1
+			}
+		}
+	}
+	return Fingerprint{DHash: hash, PixelHash: hex.EncodeToString(sha.Sum(nil))}
+}
+
+func cellMean(sum, n uint64) uint64 {
+	if n == 0 {
+		return 0
+	}
+	return sum / n
+}
+
+// readRow fills row with 8-bit NRGBA pixels of line y. Fully transparent
+// pixels are zeroed, their colour carries no information.
+func readRow(img stdimage.Image, y int, row []byte) {
+	b := img.Bounds()
+	switch src := img.(type) {
+	case *stdimage.NRGBA:
+		copy(row, src.Pix[src.PixOffset(b.Min.X, y):])
+	case *stdimage.RGBA:
+		copy(row, src.Pix[src.PixOffset(b.Min.X, y):])
+		for i := 0; i < len(row); i += 4 {
+			if a := uint32(row[i+3]); a > 0 && a < 0xFF {
+				row[i] = uint8(uint32(row[i]) * 0xFF / a)
+				row[i+1] = uint8(uint32(row[i+1]) * 0xFF / a)
+				row[i+2] = uint8(uint32(row[i+2]) * 0xFF / a)
+			}
+		}
+	default:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a > 0 && a < 0xFFFF {
+				r, g, bl = r*0xFFFF/a, g*0xFFFF/a, bl*0xFFFF/a
+			}
+			i := 4 * (x - b.Min.X)
+			row[i], row[i+1], row[i+2], row[i+3] = uint8(r>>8), uint8(g>>8), uint8(bl>>8), uint8(a>>8)
+		}
+	}
+	for i := 0; i < len(row); i += 4 {
+		if row[i+3] == 0 {
+			row[i], row[i+1], row[i+2] = 0, 0, 0
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package image
+
+import (
+	stdimage "image"
+	"image/color"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+func gradient(w, h int, noise uint8) *stdimage.NRGBA {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*7 + y*3) % 256)
+			if (x+y)%5 == 0 {
+				v += noise
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: 255 - v, B: uint8(y * 4), A: 255})
+		}
+	}
+	return img
+}
+
+func TestFingerprint_ColorModelIndependent(t *testing.T) {
+	nrgba := gradient(64, 48, 0)
+	rgba := stdimage.NewRGBA(nrgba.Bounds())
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			rgba.Set(x, y, nrgba.At(x, y))
+		}
+	}
+
+	a, b := fingerprintImage(nrgba), fingerprintImage(rgba)
+	if a != b {
+		t.Errorf("fingerprints differ: %+v vs %+v", a, b)
+	}
+}
+
+func TestFingerprint_NearDuplicate(t *testing.T) {
+	orig := fingerprintImage(gradient(64, 48, 0))
+	noisy := fingerprintImage(gradient(64, 48, 3))
+
+	if orig.PixelHash == noisy.PixelHash {
+		t.Error("pixel hash should change when pixels change")
+	}
+	if d := HammingDistance(orig.DHash, noisy.DHash); d > 4 {
+		t.Errorf("near-duplicate distance = %d, want <= 4", d)
+	}
+
+	// mirrored image is a different picture
+	flipped := gradient(64, 48, 0)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 32; x++ {
+			l, r := flipped.NRGBAAt(x, y), flipped.NRGBAAt(63-x, y)
+			flipped.SetNRGBA(x, y, r)
+			flipped.SetNRGBA(63-x, y, l)
+		}
+	}
+	if d := HammingDistance(orig.DHash, fingerprintImage(flipped).DHash); d <= 4 {
+		t.Errorf("mirrored distance = %d, want > 4", d)
+	}
+}
+
+func TestFingerprint_TransparentPixelsIgnored(t *testing.T) {
+	a := stdimage.NewNRGBA(stdimage.Rect(0, 0, 2, 1))
+	b := stdimage.NewNRGBA(stdimage.Rect(0, 0, 2, 1))
+	a.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 0})
+	b.SetNRGBA(0, 0, color.NRGBA{B: 255, A: 0})
+
+	if fingerprintImage(a).PixelHash != fingerprintImage(b).PixelHash {
+		t.Error("colour of fully transparent pixels should not affect the hash")
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xFF, 0x0F, 4},
+		{0, ^uint64(0), 64},
+	}
+	for _, tt := range tests {
+		if got := HammingDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("HammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestComputeFingerprint(t *testing.T) {
+	a, err := ComputeFingerprint(testutil.SampleJPEG())
+	if err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	b, err := ComputeFingerprint(testutil.SampleJPEG())
+	if err != nil {
+		t.Fatalf("ComputeFingerprint() error = %v", err)
+	}
+	if a != b {
+		t.Errorf("fingerprint not deterministic: %+v vs %+v", a, b)
+	}
+	if len(a.PixelHash) != 64 {
+		t.Errorf("PixelHash = %q, want 64 hex chars", a.PixelHash)
+	}
+}
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// OutputFormats lists the formats variants can be encoded to, in order of
+// preference when the client accepts more than one.
+var OutputFormats = []Format{FormatAVIF, FormatWebP, FormatJPEG}
+
+// Extension returns the file extension (without dot) used for cached files
+// encoded in the given format.
+func Extension(f Format) string {
+	switch f {
+	case FormatAVIF:
+		return "avif"
+	case FormatJPEG:
+		return "jpg"
+	default:
+		return "webp"
+	}
+}
+
+func bimgType(f Format) (bimg.ImageType, error) {
+	switch f {
+	case FormatWebP:
+		return bimg.WEBP, nil
+	case FormatAVIF:
+		return bimg.AVIF, nil
+	case FormatJPEG:
+		return bimg.JPEG, nil
+	}
+	return bimg.UNKNOWN, fmt.Errorf("unsupported output format: %s", f)
+}
+
+// encodeOptions fills the format-specific encoder options.
+func encodeOptions(opts *bimg.Options, f Format) error {
+	t, err := bimgType(f)
+	if err != nil {
+		return err
+	}
+	opts.Type = t
+	switch f {
+	case FormatAVIF:
+		// libvips defaults to the slowest AVIF effort, far too slow for on-demand encoding
+		opts.Speed = 6
+	case FormatJPEG:
+		opts.Interlace = true
+		opts.Background = bimg.Color{R: 255, G: 255, B: 255}
+	}
+	return nil
+}
+
+// NegotiateFormat picks the output format for an Accept header: the
+// accepted format with the highest q, ties going to AVIF, then WebP, then
+// JPEG. AVIF and WebP count only when listed by name, wildcards merely
+// give JPEG a q; clients that accept nothing else get JPEG. A missing
+// Accept header (curl, hotlink proxies) gets WebP, the stored format.
+func NegotiateFormat(accept string) Format {
+	accept = strings.TrimSpace(accept)
+	if accept == "" {
+		return FormatWebP
+	}
+
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if v, ok := strings.CutPrefix(param, "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if prev, ok := quality[mediaType]; !ok || q > prev {
+			quality[mediaType] = q
+		}
+	}
+
+	// JPEG without its own entry takes the most specific wildcard
+	if _, ok := quality[string(FormatJPEG)]; !ok {
+		for _, wildcard := range []string{"image/*", "*/*"} {
+			if q, ok := quality[wildcard]; ok {
+				quality[string(FormatJPEG)] = q
+				break
+			}
+		}
+	}
+
+	best, bestQ := FormatJPEG, 0.0
+	for _, f := range OutputFormats {
+		if q := quality[string(f)]; q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
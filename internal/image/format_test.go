@@ -0,0 +1,52 @@
+package image
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   Format
+	}{
+		{"empty", "", FormatWebP},
+		{"chrome", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", FormatAVIF},
+		{"webp only", "image/webp,*/*", FormatWebP},
+		{"old browser", "image/png,image/*;q=0.8,*/*;q=0.5", FormatJPEG},
+		{"wildcard", "*/*", FormatJPEG},
+		{"avif refused", "image/avif;q=0,image/webp", FormatWebP},
+		{"case insensitive", "Image/WebP", FormatWebP},
+		{"jpeg preferred", "image/webp;q=0.1, image/jpeg;q=0.9", FormatJPEG},
+		{"wildcard preferred", "image/avif;q=0.5,image/*;q=0.9", FormatJPEG},
+		{"webp over avif", "image/avif;q=0.5,image/webp;q=0.8,*/*;q=0.1", FormatWebP},
+		{"tie goes to avif", "image/webp;q=0.7,image/avif;q=0.7", FormatAVIF},
+		{"webp below unlisted jpeg", "image/webp;q=0.5", FormatWebP},
+		{"all refused", "image/webp;q=0,*/*;q=0", FormatJPEG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateFormat(tt.accept); got != tt.want {
+				t.Errorf("NegotiateFormat(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension(t *testing.T) {
+	tests := map[Format]string{
+		FormatWebP: "webp",
+		FormatAVIF: "avif",
+		FormatJPEG: "jpg",
+	}
+	for f, want := range tests {
+		if got := Extension(f); got != want {
+			t.Errorf("Extension(%q) = %q, want %q", f, got, want)
+		}
+	}
+}
+
+func TestConvert_UnsupportedFormat(t *testing.T) {
+	if _, err := Convert([]byte("data"), 90, FormatGIF); err == nil {
+		t.Error("expected error for unsupported output format")
+	}
+}
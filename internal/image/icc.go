@@ -0,0 +1,95 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// srgbColorants are the D50-adapted primaries of sRGB IEC61966-2.1, the
+// rXYZ, gXYZ and bXYZ tags of every sRGB profile whatever it is called.
+var srgbColorants = [3][3]float64{
+	{0.4361, 0.2225, 0.0139},
+	{0.3851, 0.7169, 0.0971},
+	{0.1431, 0.0606, 0.7141},
+}
+
+// srgbInput converts data to sRGB when it carries an ICC profile of
+// another colour space. bimg strips metadata without converting, so photos
+// from Display P3 phones or Adobe RGB cameras would be shown as if they
+// were sRGB and look washed out. The result is a lossless PNG with the EXIF
+// orientation applied. Images without a profile or with an sRGB one pass
+// through untouched, and so do animations.
+func srgbInput(data []byte) ([]byte, error) {
+	if FrameCount(data) > 1 {
+		return data, nil
+	}
+	icc, err := embeddedProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("read icc profile: %w", err)
+	}
+	if !needsSRGB(icc) {
+		return data, nil
+	}
+	converted, err := transformToSRGB(data)
+	if err != nil {
+		return nil, fmt.Errorf("convert to srgb: %w", err)
+	}
+	return converted, nil
+}
+
+// needsSRGB reports whether pixels tagged with the ICC profile icc must be
+// converted: CMYK profiles and RGB ones with primaries other than sRGB
+// (LUT-based RGB profiles too, their primaries are unknown). Grey profiles
+// and a missing or unreadable profile leave the pixels as they are.
+func needsSRGB(icc []byte) bool {
+	if len(icc) < 132 {
+		return false
+	}
+	switch string(icc[16:20]) {
+	case "CMYK":
+		return true
+	case "RGB ":
+	default:
+		return false
+	}
+
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := iccXYZ(icc, sig)
+		if !ok {
+			return true
+		}
+		for j := range xyz {
+			if math.Abs(xyz[j]-srgbColorants[i][j]) > 0.01 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// iccXYZ reads an XYZType tag (three s15Fixed16 numbers) from the tag
+// table of a profile.
+func iccXYZ(icc []byte, sig string) ([3]float64, bool) {
+	var xyz [3]float64
+	count := binary.BigEndian.Uint32(icc[128:132])
+	for i := uint32(0); i < count; i++ {
+		entry := 132 + int(i)*12
+		if entry+12 > len(icc) {
+			break
+		}
+		if string(icc[entry:entry+4]) != sig {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(icc[entry+4 : entry+8]))
+		if offset < 0 || offset+20 > len(icc) || string(icc[offset:offset+4]) != "XYZ " {
+			return xyz, false
+		}
+		for j := range xyz {
+			v := int32(binary.BigEndian.Uint32(icc[offset+8+j*4:]))
+			xyz[j] = float64(v) / 65536
+		}
+		return xyz, true
+	}
+	return xyz, false
+}
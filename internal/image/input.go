@@ -0,0 +1,39 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"slices"
+)
+
+// Major brands bimg recognises as HEIF; anything else is rewritten to heic
+// before decoding (libheif itself goes by the coded items, not the brand).
+var bimgHEIFBrands = []string{"heic", "heis", "hevc", "mif1", "msf1"}
+
+// decodableInput returns data in a form bimg can load. Formats libvips reads
+// natively pass through untouched; BMP (only readable via ImageMagick) is
+// converted to PNG, and HEIC files with brands unknown to bimg get their
+// major brand rewritten.
+func decodableInput(data []byte) ([]byte, error) {
+	switch detectFormat(data) {
+	case FormatBMP:
+		img, err := decodeBMP(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode bmp: %w", err)
+		}
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err := enc.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("encode bmp as png: %w", err)
+		}
+		return buf.Bytes(), nil
+	case FormatHEIC:
+		if !slices.Contains(bimgHEIFBrands, string(data[8:12])) {
+			out := slices.Clone(data)
+			copy(out[8:12], "heic")
+			return out, nil
+		}
+	}
+	return data, nil
+}
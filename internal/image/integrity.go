@@ -0,0 +1,82 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrTruncated means the file ends before the structure its header
+// announces does, e.g. a write cut short or a damaged disk block.
+var ErrTruncated = errors.New("image data truncated")
+
+// ErrUndecodable means the container is complete but its pixel data is
+// not, e.g. a damaged block in the middle of a JPEG.
+var ErrUndecodable = errors.New("image data cannot be decoded")
+
+// CheckIntegrity reports whether data looks like a complete image: a known
+// format with a readable size in its header and, for JPEG, PNG, GIF and
+// WebP, the end of the stream where the format puts it. It parses the
+// container only, without decoding pixels, so it is cheap enough to run
+// over every stored file; CheckDecode catches damage inside the pixel
+// data.
+func CheckIntegrity(data []byte) error {
+	format := detectFormat(data)
+	if format == "" {
+		return ErrInvalidFormat
+	}
+	if _, _, err := Dimensions(data); err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatJPEG:
+		// EOI; encoders may append data after it, so look for the last one
+		if bytes.LastIndex(data, []byte{0xFF, 0xD9}) < 2 {
+			return ErrTruncated
+		}
+	case FormatPNG:
+		// IEND and its CRC
+		if end := bytes.LastIndex(data, []byte("IEND")); end < 12 || end+8 > len(data) {
+			return ErrTruncated
+		}
+	case FormatGIF:
+		// the trailer byte, before any zero padding
+		if trimmed := bytes.TrimRight(data, "\x00"); trimmed[len(trimmed)-1] != 0x3B {
+			return ErrTruncated
+		}
+	case FormatWebP:
+		return checkWebPChunks(data)
+	}
+	return nil
+}
+
+// checkWebPChunks walks the RIFF chunks: the file must be as long as the
+// RIFF header says and every chunk must fit in it.
+func checkWebPChunks(data []byte) error {
+	end := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	if end > len(data) {
+		return ErrTruncated
+	}
+	pos := 12
+	for pos+8 <= end {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if pos+8+size > end {
+			return ErrTruncated
+		}
+		pos += 8 + size + size&1
+	}
+	return nil
+}
+
+// CheckDecode decodes the pixels of data (the first frame of an
+// animation) and reports ErrUndecodable when the decoder hits damaged
+// data. It is libvips work; callers outside tests go through
+// Processor.CheckDecode.
+func CheckDecode(data []byte) error {
+	if err := decodeCheck(data); err != nil {
+		return fmt.Errorf("%w: %v", ErrUndecodable, err)
+	}
+	return nil
+}
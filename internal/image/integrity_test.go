@@ -0,0 +1,79 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	goimage "image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	jpeg := testutil.SampleJPEG()
+	png := testutil.SamplePNG()
+	gif := testutil.SampleGIF()
+	webp := testutil.SampleWebP()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"jpeg", jpeg, nil},
+		{"jpeg trailing data", append(append([]byte(nil), jpeg...), "junk"...), nil},
+		{"jpeg truncated", jpeg[:len(jpeg)-2], ErrTruncated},
+		{"png", png, nil},
+		{"png without IEND", png[:len(png)-12], ErrTruncated},
+		{"png CRC cut", png[:len(png)-2], ErrTruncated},
+		{"gif", gif, nil},
+		{"gif zero padded", append(append([]byte(nil), gif...), 0, 0), nil},
+		{"gif truncated", gif[:len(gif)-1], ErrTruncated},
+		{"webp", webp, nil},
+		{"webp truncated", webp[:30], ErrTruncated},
+		{"not an image", []byte("<html>not an image</html>"), ErrInvalidFormat},
+		{"empty", nil, ErrInvalidFormat},
+		{"header only", webp[:12], ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckIntegrity(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("CheckIntegrity() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIntegrity_WebPChunkOverflow(t *testing.T) {
+	data := testutil.SampleWebP()
+	data[16] = 0x40 // VP8 chunk claims more than the RIFF holds
+	if err := CheckIntegrity(data); !errors.Is(err, ErrTruncated) {
+		t.Errorf("CheckIntegrity() = %v, want ErrTruncated", err)
+	}
+}
+
+func TestCheckDecode(t *testing.T) {
+	img := goimage.NewRGBA(goimage.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 31)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	data := buf.Bytes()
+	if err := CheckDecode(data); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+
+	// half of the scan gone, but the container still ends in EOI
+	damaged := append(append([]byte(nil), data[:len(data)/2]...), 0xFF, 0xD9)
+	if err := CheckIntegrity(damaged); err != nil {
+		t.Fatalf("CheckIntegrity() = %v, want the container to pass", err)
+	}
+	if err := CheckDecode(damaged); !errors.Is(err, ErrUndecodable) {
+		t.Errorf("CheckDecode() = %v, want ErrUndecodable", err)
+	}
+}
@@ -0,0 +1,93 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	stdimage "image"
+	"image/png"
+
+	"github.com/h2non/bimg"
+)
+
+// LQIP is rendered this wide; the browser blurs it while scaling up.
+const placeholderWidth = 16
+
+// Placeholder is a tiny preview shown before the real image loads.
+type Placeholder struct {
+	LQIP  string // data:image/webp;base64,... URI
+	Color string // dominant colour as #rrggbb
+}
+
+// MakePlaceholder builds a low-quality preview and the dominant colour
+// from an already processed image (any format bimg can read).
+func MakePlaceholder(data []byte) (Placeholder, error) {
+	small, err := bimg.NewImage(data).Process(bimg.Options{
+		Width:         placeholderWidth,
+		Type:          bimg.PNG,
+		StripMetadata: true,
+	})
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("placeholder resize: %w", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(small))
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("placeholder decode: %w", err)
+	}
+
+	lqip, err := bimg.NewImage(small).Process(bimg.Options{
+		Type:          bimg.WEBP,
+		Quality:       40,
+		StripMetadata: true,
+	})
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("placeholder encode: %w", err)
+	}
+
+	return Placeholder{
+		LQIP:  "data:image/webp;base64," + base64.StdEncoding.EncodeToString(lqip),
+		Color: dominantColor(img),
+	}, nil
+}
+
+// dominantColor buckets pixels by their top 3 bits per channel and returns
+// the average colour of the most populated bucket. Transparent pixels are
+// ignored; a fully transparent image yields "".
+func dominantColor(img stdimage.Image) string {
+	type bucket struct {
+		n       int
+		r, g, b int
+	}
+	var buckets [512]bucket
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// un-premultiply to 8-bit
+			r8, g8, b8 := int(r*0xFF/a), int(g*0xFF/a), int(b*0xFF/a)
+			idx := (r8>>5)<<6 | (g8>>5)<<3 | b8>>5
+			bk := &buckets[idx]
+			bk.n++
+			bk.r += r8
+			bk.g += g8
+			bk.b += b8
+		}
+	}
+
+	best := -1
+	for i := range buckets {
+		if buckets[i].n > 0 && (best < 0 || buckets[i].n > buckets[best].n) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	bk := buckets[best]
+	return fmt.Sprintf("#%02x%02x%02x", bk.r/bk.n, bk.g/bk.n, bk.b/bk.n)
+}
@@ -0,0 +1,57 @@
+package image
+
+import (
+	stdimage "image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+func TestDominantColor(t *testing.T) {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 200, G: 30, B: 30, A: 255})
+		}
+	}
+	// minority colour must not win
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0, G: 0, B: 255, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 0, G: 0, B: 255, A: 255})
+
+	if got := dominantColor(img); got != "#c81e1e" {
+		t.Errorf("dominantColor = %q, want #c81e1e", got)
+	}
+}
+
+func TestDominantColor_IgnoresTransparent(t *testing.T) {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 0})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 0})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 16, G: 32, B: 48, A: 255})
+
+	if got := dominantColor(img); got != "#102030" {
+		t.Errorf("dominantColor = %q, want #102030", got)
+	}
+}
+
+func TestDominantColor_FullyTransparent(t *testing.T) {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, 2, 2))
+	if got := dominantColor(img); got != "" {
+		t.Errorf("dominantColor = %q, want empty", got)
+	}
+}
+
+func TestMakePlaceholder(t *testing.T) {
+	p, err := MakePlaceholder(testutil.SampleJPEG())
+	if err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	if !strings.HasPrefix(p.LQIP, "data:image/webp;base64,") {
+		t.Errorf("LQIP = %q, want webp data URI", p.LQIP)
+	}
+	if len(p.Color) != 7 || p.Color[0] != '#' {
+		t.Errorf("Color = %q, want #rrggbb", p.Color)
+	}
+}
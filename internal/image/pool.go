@@ -0,0 +1,235 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"dajtu/internal/logging"
+)
+
+var (
+	// ErrQueueFull is returned when every worker is busy and the queue is
+	// at capacity; callers answer 503 with Retry-After.
+	ErrQueueFull = errors.New("image processing queue is full")
+	// ErrTimeout is returned when a job did not finish within the pool's
+	// per-job timeout, queueing included.
+	ErrTimeout = errors.New("image processing timed out")
+)
+
+// latencyWindow is how many finished jobs the latency figures cover.
+const latencyWindow = 200
+
+// Pool runs libvips work on a fixed number of workers behind a bounded
+// queue, so that a burst of uploads cannot take every CPU from serving.
+type Pool struct {
+	jobs    chan *poolJob
+	workers int
+	timeout time.Duration
+
+	mu        sync.Mutex
+	active    int
+	completed int64
+	failed    int64
+	rejected  int64
+	timedOut  int64
+	waits     []time.Duration // ring of the last latencyWindow jobs
+	runs      []time.Duration
+	next      int
+	closeOnce sync.Once
+}
+
+type poolJob struct {
+	ctx    context.Context
+	fn     func() error
+	queued time.Time
+	done   chan error
+}
+
+// PoolStats is a snapshot of the pool for the admin dashboard. Latencies
+// cover the last jobs only.
+type PoolStats struct {
+	Workers   int
+	Active    int
+	Queued    int
+	QueueSize int
+	Completed int64
+	Failed    int64
+	Rejected  int64
+	TimedOut  int64
+	AvgWait   time.Duration
+	AvgRun    time.Duration
+	P95Run    time.Duration
+}
+
+// NewPool starts workers goroutines (at least one) with room for queueSize
+// waiting jobs. A timeout of 0 disables the per-job limit.
+func NewPool(workers, queueSize int, timeout time.Duration) *Pool {
+	workers = max(workers, 1)
+	p := &Pool{
+		jobs:    make(chan *poolJob, max(queueSize, 0)),
+		workers: workers,
+		timeout: timeout,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Do queues fn and waits for it. It fails fast with ErrQueueFull when the
+// queue is full. When ctx ends first, a job still waiting in the queue is
+// dropped; a running one cannot be interrupted inside libvips, it finishes
+// on its worker and its result is discarded, so fn must not publish
+// anything the caller reads after an error.
+func (p *Pool) Do(ctx context.Context, fn func() error) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	job := &poolJob{ctx: ctx, fn: fn, queued: time.Now(), done: make(chan error, 1)}
+	select {
+	case p.jobs <- job:
+	default:
+		p.mu.Lock()
+		p.rejected++
+		p.mu.Unlock()
+		return ErrQueueFull
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			p.mu.Lock()
+			p.timedOut++
+			p.mu.Unlock()
+			return ErrTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// Go queues fn without waiting for it, for work whose result nobody is
+// waiting on. It fails fast with ErrQueueFull like Do; the per-job timeout
+// does not apply, there is no caller to give up.
+func (p *Pool) Go(fn func() error) error {
+	job := &poolJob{ctx: context.Background(), fn: fn, queued: time.Now(), done: make(chan error, 1)}
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		p.mu.Lock()
+		p.rejected++
+		p.mu.Unlock()
+		return ErrQueueFull
+	}
+}
+
+func (p *Pool) work() {
+	for job := range p.jobs {
+		if err := job.ctx.Err(); err != nil {
+			job.done <- err
+			continue
+		}
+		wait := time.Since(job.queued)
+
+		p.mu.Lock()
+		p.active++
+		p.mu.Unlock()
+
+		start := time.Now()
+		err := p.runJob(job)
+		run := time.Since(start)
+
+		p.mu.Lock()
+		p.active--
+		if err != nil {
+			p.failed++
+		} else {
+			p.completed++
+		}
+		if len(p.runs) < latencyWindow {
+			p.waits = append(p.waits, wait)
+			p.runs = append(p.runs, run)
+		} else {
+			p.waits[p.next] = wait
+			p.runs[p.next] = run
+		}
+		p.next = (p.next + 1) % latencyWindow
+		p.mu.Unlock()
+
+		job.done <- err
+	}
+}
+
+// runJob keeps a worker alive when a job panics.
+func (p *Pool) runJob(job *poolJob) error {
+	return recovered(job.fn)
+}
+
+// recovered runs fn and turns a panic into an error.
+func recovered(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logging.Get("image").Printf("processing job panic: %v", v)
+			err = fmt.Errorf("image processing panic: %v", v)
+		}
+	}()
+	return fn()
+}
+
+// Stats returns the current queue depth, counters and recent latencies.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := PoolStats{
+		Workers:   p.workers,
+		Active:    p.active,
+		Queued:    len(p.jobs),
+		QueueSize: cap(p.jobs),
+		Completed: p.completed,
+		Failed:    p.failed,
+		Rejected:  p.rejected,
+		TimedOut:  p.timedOut,
+	}
+	if n := len(p.runs); n > 0 {
+		var wait, run time.Duration
+		for i := 0; i < n; i++ {
+			wait += p.waits[i]
+			run += p.runs[i]
+		}
+		s.AvgWait = wait / time.Duration(n)
+		s.AvgRun = run / time.Duration(n)
+
+		sorted := append([]time.Duration(nil), p.runs...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		s.P95Run = sorted[(n*95-1)/100]
+	}
+	return s
+}
+
+// RetryAfter estimates when a slot frees up: the queued and running work
+// spread over the workers, between 1 and 60 seconds.
+func (p *Pool) RetryAfter() time.Duration {
+	s := p.Stats()
+	avg := s.AvgRun
+	if avg == 0 {
+		avg = time.Second
+	}
+	estimate := avg * time.Duration(s.Queued+s.Active) / time.Duration(s.Workers)
+	return min(max(estimate.Round(time.Second), time.Second), time.Minute)
+}
+
+// Close stops the workers once the queued jobs are done. Do must not be
+// called afterwards.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() { close(p.jobs) })
+}
@@ -0,0 +1,211 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool_RunsJobs(t *testing.T) {
+	p := NewPool(2, 4, 0)
+	defer p.Close()
+
+	wantErr := errors.New("boom")
+	if err := p.Do(context.Background(), func() error { return nil }); err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if err := p.Do(context.Background(), func() error { return wantErr }); err != wantErr {
+		t.Fatalf("Do() error = %v, want %v", err, wantErr)
+	}
+
+	s := p.Stats()
+	if s.Workers != 2 || s.QueueSize != 4 || s.Completed != 1 || s.Failed != 1 || s.Active != 0 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+// blockPool occupies the only worker until the returned func is called.
+func blockPool(t *testing.T, p *Pool) (release func()) {
+	t.Helper()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	go p.Do(context.Background(), func() error {
+		close(started)
+		<-unblock
+		return nil
+	})
+	<-started
+	return func() { close(unblock) }
+}
+
+func TestPool_QueueFull(t *testing.T) {
+	p := NewPool(1, 1, 0)
+	defer p.Close()
+	release := blockPool(t, p)
+
+	queued := make(chan error, 1)
+	go func() { queued <- p.Do(context.Background(), func() error { return nil }) }()
+	for p.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Do(context.Background(), func() error { return nil }); err != ErrQueueFull {
+		t.Fatalf("Do() on a full queue error = %v, want ErrQueueFull", err)
+	}
+	if s := p.Stats(); s.Rejected != 1 || s.Active != 1 || s.Queued != 1 {
+		t.Errorf("Stats() = %+v", s)
+	}
+	if d := p.RetryAfter(); d < time.Second || d > time.Minute {
+		t.Errorf("RetryAfter() = %v", d)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued job error = %v", err)
+	}
+}
+
+func TestPool_Timeout(t *testing.T) {
+	p := NewPool(1, 1, 20*time.Millisecond)
+	defer p.Close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	err := p.Do(context.Background(), func() error {
+		<-unblock
+		return nil
+	})
+	if err != ErrTimeout {
+		t.Fatalf("Do() error = %v, want ErrTimeout", err)
+	}
+	if s := p.Stats(); s.TimedOut != 1 {
+		t.Errorf("TimedOut = %d, want 1", s.TimedOut)
+	}
+}
+
+func TestPool_CancelledWhileQueued(t *testing.T) {
+	p := NewPool(1, 1, 0)
+	defer p.Close()
+	release := blockPool(t, p)
+
+	var ran atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Do(ctx, func() error {
+			ran.Store(true)
+			return nil
+		})
+	}()
+	for p.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Do() error = %v, want context.Canceled", err)
+	}
+
+	release()
+	// the dropped job holds its queue slot until a worker skips it
+	for p.Stats().Queued > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Do(context.Background(), func() error { return nil }); err != nil {
+		t.Fatalf("Do() after cancel error = %v", err)
+	}
+	if ran.Load() {
+		t.Error("cancelled job ran")
+	}
+}
+
+func TestPool_PanicKeepsWorker(t *testing.T) {
+	p := NewPool(1, 1, 0)
+	defer p.Close()
+
+	if err := p.Do(context.Background(), func() error { panic("vips") }); err == nil {
+		t.Fatal("Do() of a panicking job returned nil")
+	}
+	if err := p.Do(context.Background(), func() error { return nil }); err != nil {
+		t.Fatalf("Do() after panic error = %v", err)
+	}
+}
+
+func TestRecovered(t *testing.T) {
+	if err := recovered(func() error { panic("vips") }); err == nil || !strings.Contains(err.Error(), "vips") {
+		t.Errorf("recovered() of a panic = %v", err)
+	}
+	if err := recovered(func() error { return nil }); err != nil {
+		t.Errorf("recovered() = %v", err)
+	}
+}
+
+func TestProcessor_Pooled(t *testing.T) {
+	pool := NewPool(1, 1, 0)
+	defer pool.Close()
+	release := blockPool(t, pool)
+	filled := make(chan error, 1)
+	go func() { filled <- pool.Do(context.Background(), func() error { return nil }) }()
+	defer func() {
+		release()
+		<-filled
+	}()
+	for pool.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p := NewPooledProcessor(pool)
+	if _, err := p.Convert(context.Background(), nil, 80, FormatWebP); err != ErrQueueFull {
+		t.Errorf("Convert() with busy pool error = %v, want ErrQueueFull", err)
+	}
+	if _, err := p.ProcessUpload(context.Background(), nil, TransformParams{}); err != ErrQueueFull {
+		t.Errorf("ProcessUpload() with busy pool error = %v, want ErrQueueFull", err)
+	}
+	if NewProcessor().Pool() != nil || p.Pool() != pool {
+		t.Error("Pool() mismatch")
+	}
+}
+
+func TestPool_Go(t *testing.T) {
+	p := NewPool(1, 1, 0)
+	defer p.Close()
+	release := blockPool(t, p)
+
+	ran := make(chan struct{})
+	if err := p.Go(func() error {
+		close(ran)
+		return nil
+	}); err != nil {
+		t.Fatalf("Go() error = %v", err)
+	}
+	if err := p.Go(func() error { return nil }); err != ErrQueueFull {
+		t.Fatalf("Go() on a full queue error = %v, want ErrQueueFull", err)
+	}
+
+	release()
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued job did not run")
+	}
+}
+
+func TestProcessor_ProcessAsync(t *testing.T) {
+	done := make(chan error, 1)
+	err := NewProcessor().ProcessAsync([]byte("not an image"), TransformParams{}, func(results []ProcessResult, err error) {
+		done <- err
+	})
+	if err != nil {
+		t.Fatalf("ProcessAsync() error = %v", err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("processing garbage succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("done was not called")
+	}
+}
@@ -0,0 +1,345 @@
+package image
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// Fit controls how a preset maps the source onto its box.
+type Fit string
+
+const (
+	FitContain Fit = "contain" // scale down to fit inside the box, keep aspect ratio
+	FitCover   Fit = "cover"   // fill the box, cropping the overflow (see Crop)
+	FitFill    Fit = "fill"    // stretch to exactly the box
+)
+
+// Preset is a named output variant, served at /i/{slug}/{name}.
+type Preset struct {
+	Name    string
+	Width   int
+	Height  int // 0 = follow the aspect ratio
+	Fit     Fit
+	Quality int
+	Format  Format // "" = negotiated from the Accept header
+	Eager   bool   // rendered at upload and stored; lazy presets render on first request into CacheDir
+	Crop    Crop   // fit=cover only, "" = CropCentre
+
+	// Focal is the focal point of the image being rendered, see WithFocal.
+	Focal *FocalPoint
+}
+
+// DefaultPresets is used when IMAGE_PRESETS is empty. Syntax: presets
+// separated by ";", each "name:W[xH]" followed by comma-separated options
+// fit=contain|cover|fill, crop=centre|entropy|attention (fit=cover only),
+// q=1-100, format=webp|avif|jpeg, eager|lazy.
+const DefaultPresets = "original:4096,q=90,eager;thumb:200x200,fit=cover,crop=attention,q=85,eager;800:800;1200:1200;1600:1600;2400:2400"
+
+// reservedPresetNames collide with other /i/{slug}/... routes, stored
+// files (CleanVariant) or the cache files of signed transform URLs.
+var reservedPresetNames = []string{"edit", "restore", "max", CleanVariant, TransformPresetName}
+
+var presets = mustParsePresets(DefaultPresets)
+
+func mustParsePresets(spec string) []Preset {
+	p, err := ParsePresets(spec)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// LoadPresets replaces the preset registry; an empty spec restores the
+// defaults. Call it once at startup, before serving requests.
+func LoadPresets(spec string) error {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultPresets
+	}
+	p, err := ParsePresets(spec)
+	if err != nil {
+		return err
+	}
+	presets = p
+	return nil
+}
+
+// Presets returns all presets in configured order.
+func Presets() []Preset {
+	return append([]Preset(nil), presets...)
+}
+
+// LookupPreset finds a preset by name.
+func LookupPreset(name string) (Preset, bool) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// eagerPresets lists presets rendered at upload, "original" first so that
+// results[0] of processing is always the original variant.
+func eagerPresets() []Preset {
+	var result []Preset
+	for _, p := range presets {
+		if p.Eager && p.Name == "original" {
+			result = append([]Preset{p}, result...)
+		} else if p.Eager {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// coverPresets lists the eager fit=cover presets, the stored variants that
+// depend on the focal point.
+func coverPresets() []Preset {
+	var result []Preset
+	for _, p := range presets {
+		if p.Eager && p.Fit == FitCover {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// ParsePresets parses a preset spec (see DefaultPresets). An eager
+// "original" preset is required: every other variant is derived from it.
+func ParsePresets(spec string) ([]Preset, error) {
+	var result []Preset
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p, err := parsePreset(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("preset %q: duplicate name", p.Name)
+		}
+		seen[p.Name] = true
+		result = append(result, p)
+	}
+
+	original := -1
+	for i, p := range result {
+		if p.Name == "original" {
+			original = i
+		}
+	}
+	if original < 0 {
+		return nil, fmt.Errorf("presets: %q is required", "original")
+	}
+	if !result[original].Eager || result[original].Fit != FitContain || result[original].Format != "" {
+		return nil, fmt.Errorf("preset %q must be eager, fit=contain, without a fixed format", "original")
+	}
+	return result, nil
+}
+
+func parsePreset(entry string) (Preset, error) {
+	name, rest, ok := strings.Cut(entry, ":")
+	name = strings.TrimSpace(name)
+	if !ok || !validPresetName(name) {
+		return Preset{}, fmt.Errorf("preset %q: expected name:WxH with name of [a-z0-9_-]", entry)
+	}
+	return parsePresetParams(name, rest)
+}
+
+// parsePresetParams parses "W[xH],option,..." for the named preset.
+func parsePresetParams(name, rest string) (Preset, error) {
+	p := Preset{Name: name, Fit: FitContain, Quality: 90}
+
+	fields := strings.Split(rest, ",")
+	w, h, hasH := strings.Cut(strings.TrimSpace(fields[0]), "x")
+	var err error
+	if p.Width, err = strconv.Atoi(w); err != nil || p.Width <= 0 {
+		return Preset{}, fmt.Errorf("preset %q: invalid width %q", name, w)
+	}
+	if hasH {
+		if p.Height, err = strconv.Atoi(h); err != nil || p.Height <= 0 {
+			return Preset{}, fmt.Errorf("preset %q: invalid height %q", name, h)
+		}
+	}
+
+	for _, opt := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "fit":
+			p.Fit = Fit(value)
+			if p.Fit != FitContain && p.Fit != FitCover && p.Fit != FitFill {
+				return Preset{}, fmt.Errorf("preset %q: unknown fit %q", name, value)
+			}
+		case "crop":
+			if p.Crop, err = parseCrop(value); err != nil {
+				return Preset{}, fmt.Errorf("preset %q: %w", name, err)
+			}
+		case "q":
+			if p.Quality, err = strconv.Atoi(value); err != nil || p.Quality < 1 || p.Quality > 100 {
+				return Preset{}, fmt.Errorf("preset %q: quality must be 1-100", name)
+			}
+		case "format":
+			if p.Format, err = parseFormatName(value); err != nil {
+				return Preset{}, fmt.Errorf("preset %q: %w", name, err)
+			}
+		case "eager":
+			p.Eager = true
+		case "lazy":
+			p.Eager = false
+		default:
+			return Preset{}, fmt.Errorf("preset %q: unknown option %q", name, opt)
+		}
+	}
+
+	if p.Fit != FitContain && p.Height == 0 {
+		return Preset{}, fmt.Errorf("preset %q: fit=%s needs WxH", name, p.Fit)
+	}
+	if p.Crop != "" && p.Fit != FitCover {
+		return Preset{}, fmt.Errorf("preset %q: crop needs fit=cover", name)
+	}
+	return p, nil
+}
+
+func validPresetName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, r := range reservedPresetNames {
+		if name == r {
+			return false
+		}
+	}
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFormatName(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "webp":
+		return FormatWebP, nil
+	case "avif":
+		return FormatAVIF, nil
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	}
+	return "", fmt.Errorf("unsupported format %q", name)
+}
+
+// focalKeySep separates the focal point hash Key appends to BaseKey.
+const focalKeySep = "-f"
+
+// Key identifies the rendering parameters, so cached renders are not reused
+// after a preset is reconfigured or the focal point moves.
+func (p Preset) Key() string {
+	if p.Focal == nil {
+		return p.BaseKey()
+	}
+	focal := fmt.Sprintf("%.4f,%.4f", p.Focal.X, p.Focal.Y)
+	return fmt.Sprintf("%s%s%08x", p.BaseKey(), focalKeySep, crc32.ChecksumIEEE([]byte(focal)))
+}
+
+// BaseKey is Key without the focal point: the same for every image rendered
+// with the configured preset, so it tells whether a render is stale.
+func (p Preset) BaseKey() string {
+	params := fmt.Sprintf("%d|%d|%s|%d", p.Width, p.Height, p.Fit, p.Quality)
+	if p.Fit == FitCover && p.Crop != "" && p.Crop != CropCentre {
+		params += "|" + string(p.Crop)
+	}
+	return fmt.Sprintf("%s-%08x", p.Name, crc32.ChecksumIEEE([]byte(params)))
+}
+
+// BaseKeyOf returns the BaseKey part of a key returned by Key. The base ends
+// in "-" and 8 hex digits, so a focal suffix cannot be mistaken for it.
+func BaseKeyOf(key string) string {
+	n := len(focalKeySep) + 8
+	if len(key) > n && key[len(key)-n:len(key)-8] == focalKeySep && isHex(key[len(key)-8:]) {
+		return key[:len(key)-n]
+	}
+	return key
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithFocal returns p cropping around focal, the focal point of the image
+// it renders; nil or a preset that does not crop returns p unchanged.
+func (p Preset) WithFocal(focal *FocalPoint) Preset {
+	if p.Fit == FitCover && focal != nil {
+		p.Focal = focal
+	}
+	return p
+}
+
+// smartCrop reports whether a fit=cover preset picks its box some other way
+// than bimg's centre crop, with coverCrop.
+func (p Preset) smartCrop() bool {
+	return p.Fit == FitCover && (p.Focal != nil || (p.Crop != "" && p.Crop != CropCentre))
+}
+
+// KeepsSize reports whether rendering p from a source of the given size
+// leaves the dimensions unchanged (contain never upscales).
+func (p Preset) KeepsSize(srcWidth, srcHeight int) bool {
+	return p.Fit == FitContain && p.containWidth(srcWidth, srcHeight) >= srcWidth
+}
+
+// OutputSize is the size of p rendered from a source of the given size.
+func (p Preset) OutputSize(srcWidth, srcHeight int) (int, int) {
+	if p.Fit == FitCover || p.Fit == FitFill {
+		return p.Width, p.Height
+	}
+	w := p.containWidth(srcWidth, srcHeight)
+	if srcWidth <= 0 {
+		return w, srcHeight
+	}
+	return w, max(1, (srcHeight*w+srcWidth/2)/srcWidth)
+}
+
+// containWidth is the output width for fit=contain; bimg derives the height.
+// A zero Width keeps the source size.
+func (p Preset) containWidth(srcWidth, srcHeight int) int {
+	if p.Width <= 0 {
+		return srcWidth
+	}
+	w := min(p.Width, srcWidth)
+	if p.Height > 0 && srcHeight > 0 && srcHeight*w > p.Height*srcWidth {
+		w = max(1, p.Height*srcWidth/srcHeight)
+	}
+	return w
+}
+
+// options builds the bimg resize options for a source of the given size.
+func (p Preset) options(srcWidth, srcHeight int) bimg.Options {
+	opts := bimg.Options{
+		Quality:       p.Quality,
+		StripMetadata: true,
+	}
+	switch p.Fit {
+	case FitCover:
+		opts.Width, opts.Height = p.Width, p.Height
+		opts.Crop = true
+		opts.Gravity = bimg.GravityCentre
+	case FitFill:
+		opts.Width, opts.Height = p.Width, p.Height
+		opts.Force = true
+	default:
+		opts.Width = p.containWidth(srcWidth, srcHeight)
+	}
+	return opts
+}
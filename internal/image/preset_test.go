@@ -0,0 +1,227 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePresets_Defaults(t *testing.T) {
+	presets, err := ParsePresets(DefaultPresets)
+	if err != nil {
+		t.Fatalf("ParsePresets(DefaultPresets) error = %v", err)
+	}
+	want := map[string]Preset{
+		"original": {Name: "original", Width: 4096, Fit: FitContain, Quality: 90, Eager: true},
+		"thumb":    {Name: "thumb", Width: 200, Height: 200, Fit: FitCover, Quality: 85, Eager: true, Crop: CropAttention},
+		"1200":     {Name: "1200", Width: 1200, Fit: FitContain, Quality: 90},
+	}
+	for _, p := range presets {
+		if w, ok := want[p.Name]; ok && p != w {
+			t.Errorf("preset %s = %+v, want %+v", p.Name, p, w)
+		}
+	}
+	if len(presets) != 6 {
+		t.Errorf("len(presets) = %d, want 6", len(presets))
+	}
+}
+
+func TestParsePresets_Options(t *testing.T) {
+	presets, err := ParsePresets("original:2048,eager; card:600x315,fit=fill,q=70,format=jpeg,eager ; avatar:64x64,fit=cover,crop=entropy,lazy")
+	if err != nil {
+		t.Fatalf("ParsePresets() error = %v", err)
+	}
+	card := presets[1]
+	if card.Width != 600 || card.Height != 315 || card.Fit != FitFill || card.Quality != 70 || card.Format != FormatJPEG || !card.Eager {
+		t.Errorf("card = %+v", card)
+	}
+	if presets[2].Eager || presets[2].Crop != CropEntropy {
+		t.Errorf("avatar = %+v, want lazy with entropy crop", presets[2])
+	}
+}
+
+func TestParsePresets_Invalid(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"thumb:200x200,fit=cover", "required"},
+		{"original:1000", "must be eager"},
+		{"original:1000,eager,fit=cover", "needs WxH"},
+		{"original:1000,eager;a:100;a:200", "duplicate"},
+		{"original:1000,eager;edit:100", "expected name"},
+		{"original:1000,eager;Big:100", "expected name"},
+		{"original:1000,eager;x:0", "invalid width"},
+		{"original:1000,eager;x:100xabc", "invalid height"},
+		{"original:1000,eager;x:100,q=0", "quality"},
+		{"original:1000,eager;x:100,format=gif", "unsupported format"},
+		{"original:1000,eager;x:100x100,fit=stretch", "unknown fit"},
+		{"original:1000,eager;x:100,sharpen", "unknown option"},
+		{"original:1000,eager;x:100x100,fit=cover,crop=faces", "unknown crop"},
+		{"original:1000,eager;x:100x100,crop=attention", "crop needs fit=cover"},
+	}
+	for _, tt := range tests {
+		_, err := ParsePresets(tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParsePresets(%q) error = %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestLoadPresets(t *testing.T) {
+	t.Cleanup(func() { LoadPresets("") })
+
+	if err := LoadPresets("thumb:100x100"); err == nil {
+		t.Error("LoadPresets() accepted spec without original")
+	}
+	if _, ok := LookupPreset("1200"); !ok {
+		t.Error("invalid spec must keep the previous registry")
+	}
+
+	if err := LoadPresets("tiny:50x50,fit=cover,eager;original:1024,eager"); err != nil {
+		t.Fatalf("LoadPresets() error = %v", err)
+	}
+	if _, ok := LookupPreset("1200"); ok {
+		t.Error("1200 should be gone after reload")
+	}
+	eager := eagerPresets()
+	if len(eager) != 2 || eager[0].Name != "original" {
+		t.Errorf("eagerPresets() = %+v, want original first", eager)
+	}
+}
+
+func TestPreset_Key(t *testing.T) {
+	a := Preset{Name: "x", Width: 100, Fit: FitContain, Quality: 90}
+	b := a
+	b.Quality = 80
+	if a.Key() == b.Key() {
+		t.Error("key should change with quality")
+	}
+	if !strings.HasPrefix(a.Key(), "x-") {
+		t.Errorf("Key() = %q, want x- prefix", a.Key())
+	}
+	c := a
+	c.Eager = true
+	if a.Key() != c.Key() {
+		t.Error("eager flag does not change the rendering")
+	}
+
+	cover := Preset{Name: "thumb", Width: 200, Height: 200, Fit: FitCover, Quality: 85}
+	centre := cover
+	centre.Crop = CropCentre
+	if cover.Key() != centre.Key() {
+		t.Error("explicit centre crop is the default")
+	}
+	smart := cover
+	smart.Crop = CropAttention
+	if smart.Key() == cover.Key() {
+		t.Error("key should change with the crop strategy")
+	}
+	focused := smart.WithFocal(&FocalPoint{X: 0.5, Y: 0.2})
+	moved := smart.WithFocal(&FocalPoint{X: 0.5, Y: 0.6})
+	if focused.Key() == smart.Key() || focused.Key() == moved.Key() {
+		t.Error("key should change with the focal point")
+	}
+	if focused.BaseKey() != smart.Key() {
+		t.Errorf("BaseKey() = %q, want the key without focal %q", focused.BaseKey(), smart.Key())
+	}
+	if got := BaseKeyOf(focused.Key()); got != smart.Key() {
+		t.Errorf("BaseKeyOf(focal key) = %q, want %q", got, smart.Key())
+	}
+	if got := BaseKeyOf(smart.Key()); got != smart.Key() {
+		t.Errorf("BaseKeyOf(base key) = %q, want it unchanged", got)
+	}
+	named := Preset{Name: "a-f12345678", Width: 10, Fit: FitContain, Quality: 90}
+	if got := BaseKeyOf(named.Key()); got != named.Key() {
+		t.Errorf("BaseKeyOf(%q) = %q, want it unchanged", named.Key(), got)
+	}
+}
+
+func TestPreset_WithFocal(t *testing.T) {
+	focal := &FocalPoint{X: 0.3, Y: 0.2}
+	cover := Preset{Name: "thumb", Width: 200, Height: 200, Fit: FitCover}
+	if got := cover.WithFocal(focal); got.Focal != focal || !got.smartCrop() {
+		t.Errorf("cover.WithFocal() = %+v", got)
+	}
+	if got := cover.WithFocal(nil); got != cover || got.smartCrop() {
+		t.Errorf("cover.WithFocal(nil) = %+v, want unchanged", got)
+	}
+	contain := Preset{Name: "800", Width: 800, Fit: FitContain}
+	if got := contain.WithFocal(focal); got != contain {
+		t.Errorf("contain.WithFocal() = %+v, want unchanged", got)
+	}
+	if !(Preset{Width: 200, Height: 200, Fit: FitCover, Crop: CropEntropy}).smartCrop() {
+		t.Error("entropy crop should use coverCrop")
+	}
+}
+
+func TestCoverPresets(t *testing.T) {
+	t.Cleanup(func() { LoadPresets("") })
+	if err := LoadPresets("original:1024,eager;thumb:100x100,fit=cover,eager;card:600x300,fit=cover;wide:800x200,fit=fill,eager"); err != nil {
+		t.Fatal(err)
+	}
+	covers := coverPresets()
+	if len(covers) != 1 || covers[0].Name != "thumb" {
+		t.Errorf("coverPresets() = %+v, want only the eager thumb", covers)
+	}
+}
+
+func TestPreset_ContainWidth(t *testing.T) {
+	tests := []struct {
+		p          Preset
+		srcW, srcH int
+		want       int
+	}{
+		{Preset{Width: 800, Fit: FitContain}, 4000, 3000, 800},
+		{Preset{Width: 800, Fit: FitContain}, 600, 400, 600}, // no upscale
+		{Preset{Width: 800, Height: 300, Fit: FitContain}, 4000, 3000, 400},
+		{Preset{Fit: FitContain}, 640, 480, 640},
+	}
+	for _, tt := range tests {
+		if got := tt.p.containWidth(tt.srcW, tt.srcH); got != tt.want {
+			t.Errorf("%+v.containWidth(%d, %d) = %d, want %d", tt.p, tt.srcW, tt.srcH, got, tt.want)
+		}
+	}
+
+	if !(Preset{Width: 800, Fit: FitContain}).KeepsSize(600, 400) {
+		t.Error("contain larger than source should keep size")
+	}
+	if (Preset{Width: 200, Height: 200, Fit: FitCover}).KeepsSize(100, 100) {
+		t.Error("cover always renders")
+	}
+}
+
+func TestPreset_OutputSize(t *testing.T) {
+	tests := []struct {
+		p            Preset
+		srcW, srcH   int
+		wantW, wantH int
+	}{
+		{Preset{Width: 1200, Fit: FitContain}, 4000, 3000, 1200, 900},
+		{Preset{Width: 1200, Fit: FitContain}, 600, 400, 600, 400},
+		{Preset{Width: 800, Height: 300, Fit: FitContain}, 4000, 3000, 400, 300},
+		{Preset{Width: 800, Fit: FitContain}, 3000, 1, 800, 1},
+		{Preset{Width: 200, Height: 200, Fit: FitCover}, 4000, 3000, 200, 200},
+		{Preset{Width: 300, Height: 100, Fit: FitFill}, 50, 50, 300, 100},
+	}
+	for _, tt := range tests {
+		w, h := tt.p.OutputSize(tt.srcW, tt.srcH)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("%+v.OutputSize(%d, %d) = %dx%d, want %dx%d", tt.p, tt.srcW, tt.srcH, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestPreset_Options(t *testing.T) {
+	cover := Preset{Width: 200, Height: 100, Fit: FitCover, Quality: 80}.options(1000, 1000)
+	if !cover.Crop || cover.Width != 200 || cover.Height != 100 || cover.Quality != 80 {
+		t.Errorf("cover options = %+v", cover)
+	}
+	fill := Preset{Width: 200, Height: 100, Fit: FitFill}.options(1000, 1000)
+	if !fill.Force || fill.Crop {
+		t.Errorf("fill options = %+v", fill)
+	}
+	contain := Preset{Width: 200, Fit: FitContain}.options(1000, 500)
+	if contain.Width != 200 || contain.Height != 0 || contain.Crop || contain.Force {
+		t.Errorf("contain options = %+v", contain)
+	}
+}
@@ -1,6 +1,7 @@
 package image
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -9,107 +10,342 @@ import (
 	"github.com/h2non/bimg"
 )
 
-type Size struct {
-	Name    string
-	Width   int
-	Height  int
-	Quality int
-}
-
-var Sizes = []Size{
-	{Name: "original", Width: 4096, Height: 0, Quality: 90},
-	{Name: "thumb", Width: 200, Height: 200, Quality: 85},
-}
-
 type ProcessResult struct {
 	Name   string
 	Data   []byte
 	Width  int
 	Height int
+	Frames int
+
+	// Placeholder and Fingerprint are only set on the original variant of
+	// an upload (ProcessUpload, ProcessAsync); empty when computing failed.
+	Placeholder Placeholder
+	Fingerprint Fingerprint
 }
 
+// TransformParams describe an edit. The JSON form uses the editor's field
+// names and is what image revisions record.
 type TransformParams struct {
-	Rotation int
-	FlipH    bool
-	FlipV    bool
-	CropX    int
-	CropY    int
-	CropW    int
-	CropH    int
+	Rotation int  `json:"rotation,omitempty"`
+	FlipH    bool `json:"flipH,omitempty"`
+	FlipV    bool `json:"flipV,omitempty"`
+	CropX    int  `json:"cropX,omitempty"`
+	CropY    int  `json:"cropY,omitempty"`
+	CropW    int  `json:"cropW,omitempty"`
+	CropH    int  `json:"cropH,omitempty"`
+
+	// Filters run after rotation, flips and crop
+	Filters Filters `json:"filters"`
+
+	// Watermark is burned into the public variants after the transform;
+	// nil leaves them clean.
+	Watermark *Watermark `json:"-"`
+
+	// Focal is the focal point for the cover presets; nil leaves them to
+	// their crop strategy.
+	Focal *FocalPoint `json:"-"`
 }
 
 func (p TransformParams) HasTransforms() bool {
-	return p.Rotation != 0 || p.FlipH || p.FlipV || (p.CropW > 0 && p.CropH > 0)
+	return p.Rotation != 0 || p.FlipH || p.FlipV || (p.CropW > 0 && p.CropH > 0) || !p.Filters.Clamp().IsZero()
 }
 
-type Processor struct{}
+// Processor is the processing service used by the handlers. With a pool
+// every job runs on its workers; without one (tests, tools) it runs in the
+// calling goroutine.
+type Processor struct {
+	pool *Pool
+}
 
 func NewProcessor() *Processor {
 	return &Processor{}
 }
 
+// NewPooledProcessor runs all processing on pool.
+func NewPooledProcessor(pool *Pool) *Processor {
+	return &Processor{pool: pool}
+}
+
+// Pool returns the worker pool, nil for an unpooled processor.
+func (p *Processor) Pool() *Pool {
+	if p == nil {
+		return nil
+	}
+	return p.pool
+}
+
+// runJob runs fn on the pool. Results are only read after the job has
+// finished, a timed-out job may still be running.
+func runJob[T any](ctx context.Context, p *Processor, fn func() (T, error)) (T, error) {
+	var zero T
+	if p == nil || p.pool == nil {
+		return fn()
+	}
+	var out T
+	err := p.pool.Do(ctx, func() error {
+		var err error
+		out, err = fn()
+		return err
+	})
+	if err != nil {
+		return zero, err
+	}
+	return out, nil
+}
+
+// Render renders preset p from data on a worker for the on-demand routes.
+// It waits for a free worker and fails with ErrQueueFull or ErrTimeout
+// under load.
+func (p *Processor) Render(ctx context.Context, data []byte, preset Preset, format Format) ([]byte, error) {
+	return runJob(ctx, p, func() ([]byte, error) {
+		return Render(data, preset, format)
+	})
+}
+
+// Convert re-encodes data to format on a worker, keeping its size; like
+// Render it waits for the pool and may fail with ErrQueueFull or ErrTimeout.
+func (p *Processor) Convert(ctx context.Context, data []byte, quality int, format Format) ([]byte, error) {
+	return runJob(ctx, p, func() ([]byte, error) {
+		return Convert(data, quality, format)
+	})
+}
+
+// MakePlaceholder builds the LQIP and dominant colour of data on a worker,
+// for the backfill of older images. Blocks on the pool, ErrQueueFull or
+// ErrTimeout when it is saturated.
+func (p *Processor) MakePlaceholder(ctx context.Context, data []byte) (Placeholder, error) {
+	return runJob(ctx, p, func() (Placeholder, error) {
+		return MakePlaceholder(data)
+	})
+}
+
+// ComputeFingerprint hashes the pixels of data on a worker, for the
+// backfill of older images. Blocks on the pool, ErrQueueFull or ErrTimeout
+// when it is saturated.
+func (p *Processor) ComputeFingerprint(ctx context.Context, data []byte) (Fingerprint, error) {
+	return runJob(ctx, p, func() (Fingerprint, error) {
+		return ComputeFingerprint(data)
+	})
+}
+
+// CheckDecode decodes data on a worker to verify its pixels, for the
+// integrity scrub. Blocks on the pool, ErrQueueFull or ErrTimeout when it
+// is saturated.
+func (p *Processor) CheckDecode(ctx context.Context, data []byte) error {
+	_, err := runJob(ctx, p, func() (struct{}, error) {
+		return struct{}{}, CheckDecode(data)
+	})
+	return err
+}
+
 func Process(data []byte) ([]ProcessResult, error) {
-	return processVariants(data, false)
+	return processVariants(data, false, FormatWebP, nil, nil)
+}
+
+// ProcessWatermarked is Process with wm drawn onto the variants. When a mark
+// is applied, the results also hold the unmarked original as CleanVariant.
+func ProcessWatermarked(data []byte, wm *Watermark) ([]ProcessResult, error) {
+	return processVariants(data, false, FormatWebP, wm, nil)
+}
+
+// ProcessWithTransform renders all eager variants with params on a worker,
+// for re-renders that need no placeholder or fingerprint (scrub repairs,
+// watermark changes). It waits for the pool and fails with ErrQueueFull or
+// ErrTimeout under load.
+func (p *Processor) ProcessWithTransform(ctx context.Context, data []byte, params TransformParams) ([]ProcessResult, error) {
+	return runJob(ctx, p, func() ([]ProcessResult, error) {
+		return ProcessWithTransform(data, params)
+	})
+}
+
+// ProcessCovers re-renders the cover presets around a new focal point on a
+// worker. It waits for the pool and fails with ErrQueueFull or ErrTimeout
+// under load.
+func (p *Processor) ProcessCovers(ctx context.Context, data []byte, wm *Watermark, focal *FocalPoint) ([]ProcessResult, error) {
+	return runJob(ctx, p, func() ([]ProcessResult, error) {
+		return ProcessCovers(data, wm, focal)
+	})
+}
+
+// ProcessUpload is ProcessWithTransform for a new upload or an edit: the
+// same job also computes the placeholder and the fingerprint, so storing
+// an image does no libvips work outside the pool. Handlers answer its
+// ErrQueueFull and ErrTimeout with 503.
+func (p *Processor) ProcessUpload(ctx context.Context, data []byte, params TransformParams) ([]ProcessResult, error) {
+	return runJob(ctx, p, func() ([]ProcessResult, error) {
+		return processUpload(data, params)
+	})
+}
+
+// ProcessAsync queues ProcessUpload and returns at once; done gets the
+// results on the worker when processing ends. ErrQueueFull means done
+// will never be called. A panic while processing reaches done as an error.
+// An unpooled processor runs the job in a new goroutine.
+func (p *Processor) ProcessAsync(data []byte, params TransformParams, done func([]ProcessResult, error)) error {
+	job := func() error {
+		var results []ProcessResult
+		err := recovered(func() error {
+			var err error
+			results, err = processUpload(data, params)
+			return err
+		})
+		done(results, err)
+		return err
+	}
+	if p == nil || p.pool == nil {
+		go recovered(job)
+		return nil
+	}
+	return p.pool.Go(job)
+}
+
+func processUpload(data []byte, params TransformParams) ([]ProcessResult, error) {
+	results, err := ProcessWithTransform(data, params)
+	if err != nil {
+		return nil, err
+	}
+	analyzeUpload(results)
+	return results, nil
+}
+
+// analyzeUpload stores the placeholder of the original variant and the
+// fingerprint of its unmarked form on the original result. Failures are
+// only logged, the cleanup daemon backfills empty fields.
+func analyzeUpload(results []ProcessResult) {
+	original, source := -1, -1
+	for i, res := range results {
+		switch res.Name {
+		case "original":
+			original = i
+			if source < 0 {
+				source = i
+			}
+		case CleanVariant:
+			source = i
+		}
+	}
+	if original < 0 {
+		return
+	}
+	var err error
+	if results[original].Placeholder, err = MakePlaceholder(results[original].Data); err != nil {
+		logging.Get("placeholder").Printf("make placeholder: %v", err)
+	}
+	if results[original].Fingerprint, err = ComputeFingerprint(results[source].Data); err != nil {
+		logging.Get("dedup").Printf("compute fingerprint: %v", err)
+	}
 }
 
-func (p *Processor) ProcessWithTransform(data []byte, params TransformParams) ([]ProcessResult, error) {
+// ProcessWithTransform renders the variants of data with the edit, the
+// watermark and the focal point in params.
+func ProcessWithTransform(data []byte, params TransformParams) ([]ProcessResult, error) {
 	if !params.HasTransforms() {
-		return Process(data)
+		return processVariants(data, false, FormatWebP, params.Watermark, params.Focal)
 	}
+	if FrameCount(data) > 1 {
+		return nil, ErrAnimatedTransform
+	}
+	filters := params.Filters.Clamp()
 
-	opts := bimg.Options{
-		StripMetadata: true,
+	data, err := decodableInput(data)
+	if err != nil {
+		return nil, err
+	}
+	// applyGeometry strips the profile, so convert while it is still there
+	if data, err = srgbInput(data); err != nil {
+		return nil, err
 	}
 
-	rotation := ((params.Rotation % 360) + 360) % 360
-	switch rotation {
-	case 90:
-		opts.Rotate = bimg.D90
-	case 180:
-		opts.Rotate = bimg.D180
-	case 270:
-		opts.Rotate = bimg.D270
+	transformed, err := applyGeometry(data, params)
+	if err != nil {
+		return nil, fmt.Errorf("transform: %w", err)
 	}
 
-	if params.FlipH {
-		opts.Flip = true
+	if !filters.IsZero() {
+		if transformed, err = applyFilters(transformed, filters); err != nil {
+			return nil, fmt.Errorf("filters: %w", err)
+		}
 	}
-	if params.FlipV {
-		opts.Flop = true
+
+	return processVariants(transformed, true, FormatWebP, params.Watermark, params.Focal)
+}
+
+// ProcessCovers renders only the eager fit=cover presets, after the focal
+// point of an image moved; data is its unmarked original variant.
+func ProcessCovers(data []byte, wm *Watermark, focal *FocalPoint) ([]ProcessResult, error) {
+	return renderPresets(data, coverPresets(), false, FormatWebP, wm, focal)
+}
+
+// applyGeometry applies rotation, flips and crop and returns a lossless PNG,
+// so that re-rendering an edit from the source adds no generation loss. The
+// editor (cropper.js) mirrors first and rotates second, with the crop box in
+// the rotated frame; bimg rotates before mirroring, so the angle is adjusted.
+func applyGeometry(data []byte, params TransformParams) ([]byte, error) {
+	// EXIF orientation first, as the editor shows the image
+	if meta, err := bimg.NewImage(data).Metadata(); err == nil && meta.Orientation > 1 {
+		if data, err = bimg.NewImage(data).Process(bimg.Options{StripMetadata: true, Type: bimg.PNG}); err != nil {
+			return nil, err
+		}
 	}
 
-	cropX := params.CropX
-	cropY := params.CropY
-	cropW := params.CropW
-	cropH := params.CropH
-	if cropX < 0 {
-		cropX = 0
+	angle := ((params.Rotation % 360) + 360) % 360 / 90 * 90
+	flipH, flipV := params.FlipH, params.FlipV
+	switch {
+	case flipH && flipV:
+		// both mirrors are a half turn
+		flipH, flipV = false, false
+		angle = (angle + 180) % 360
+	case flipH || flipV:
+		angle = (360 - angle) % 360
 	}
-	if cropY < 0 {
-		cropY = 0
+
+	size, err := bimg.NewImage(data).Size()
+	if err != nil {
+		return nil, err
 	}
-	if cropW < 0 {
-		cropW = 0
+	w, h := size.Width, size.Height
+	if angle == 90 || angle == 270 {
+		w, h = h, w
 	}
-	if cropH < 0 {
-		cropH = 0
+
+	opts := bimg.Options{
+		StripMetadata: true,
+		NoAutoRotate:  true,
+		Rotate:        bimg.Angle(angle),
+		Flip:          flipH,
+		Flop:          flipV,
+		Type:          bimg.PNG,
 	}
-	if cropW > 0 && cropH > 0 {
-		opts.Top = cropY
+
+	// the crop box may stick out by a rounding pixel
+	cropX := min(max(params.CropX, 0), w-1)
+	cropY := min(max(params.CropY, 0), h-1)
+	cropW := min(params.CropW, w-cropX)
+	cropH := min(params.CropH, h-cropY)
+	if cropW > 0 && cropH > 0 && (cropW < w || cropH < h) {
 		opts.Left = cropX
+		opts.Top = cropY
 		opts.AreaWidth = cropW
 		opts.AreaHeight = cropH
 	}
 
-	transformed, err := bimg.NewImage(data).Process(opts)
-	if err != nil {
-		return nil, fmt.Errorf("transform: %w", err)
-	}
+	return bimg.NewImage(data).Process(opts)
+}
 
-	return processVariants(transformed, true)
+func processVariants(data []byte, noAutoRotate bool, format Format, wm *Watermark, focal *FocalPoint) ([]ProcessResult, error) {
+	return renderPresets(data, eagerPresets(), noAutoRotate, format, wm, focal)
 }
 
-func processVariants(data []byte, noAutoRotate bool) ([]ProcessResult, error) {
+// renderPresets renders each of presets from data; cover presets crop
+// around focal when it is set.
+func renderPresets(data []byte, presets []Preset, noAutoRotate bool, format Format, wm *Watermark, focal *FocalPoint) ([]ProcessResult, error) {
+	data, err := decodableInput(data)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = srgbInput(data); err != nil {
+		return nil, err
+	}
 	img := bimg.NewImage(data)
 
 	// Get original dimensions
@@ -118,65 +354,93 @@ func processVariants(data []byte, noAutoRotate bool) ([]ProcessResult, error) {
 		return nil, fmt.Errorf("get size: %w", err)
 	}
 
+	frames := FrameCount(data)
+	animated := frames > 1 && format == FormatWebP
+
+	var overlay []byte
+	if wm != nil {
+		if overlay, err = wm.overlay(); err != nil {
+			return nil, fmt.Errorf("watermark overlay: %w", err)
+		}
+	}
+
 	var results []ProcessResult
+	var clean []byte
 
-	for _, s := range Sizes {
+	for _, p := range presets {
 		sizeStart := time.Now()
-		// Skip if original is smaller than target
-		targetWidth := s.Width
-		if size.Width < targetWidth {
-			targetWidth = size.Width
-		}
+		p = p.WithFocal(focal)
 
-		// Re-encode to WebP (this strips all metadata and potential malicious content)
-		opts := bimg.Options{
-			Width:         targetWidth,
-			Type:          bimg.WEBP,
-			Quality:       s.Quality,
-			StripMetadata: true,
-			NoAutoRotate:  noAutoRotate,
+		// Re-encode (this strips all metadata and potential malicious content)
+		opts := p.options(size.Width, size.Height)
+		opts.NoAutoRotate = noAutoRotate
+		if err := encodeOptions(&opts, format); err != nil {
+			return nil, err
 		}
 
-		if s.Height > 0 {
-			opts.Width = s.Width
-			opts.Height = s.Height
-			opts.Crop = true
-			opts.Gravity = bimg.GravityCentre
+		// Animated inputs stay animated; cropped and stretched presets get a
+		// static poster of the first frame, which is all bimg loads anyway.
+		resultFrames := 1
+		var processed []byte
+		input := data
+		if p.smartCrop() {
+			if input, err = coverCrop(data, p.Width, p.Height, p.Crop, p.Focal, noAutoRotate); err != nil {
+				return nil, fmt.Errorf("crop %s: %w", p.Name, err)
+			}
+		}
+		if animated && p.Fit == FitContain {
+			processed, err = resizeAnimated(data, opts.Width, p.Quality)
+			resultFrames = frames
+		} else {
+			processed, err = bimg.NewImage(input).Process(opts)
 		}
-
-		processed, err := bimg.NewImage(data).Process(opts)
 		if err != nil {
-			return nil, fmt.Errorf("process %s: %w", s.Name, err)
+			return nil, fmt.Errorf("process %s: %w", p.Name, err)
+		}
+
+		if overlay != nil {
+			if p.Name == "original" {
+				clean = processed
+			}
+			if processed, err = applyWatermark(processed, overlay, wm, p.Quality, format); err != nil {
+				return nil, fmt.Errorf("watermark %s: %w", p.Name, err)
+			}
 		}
 
 		// Get resulting dimensions
 		resultImg := bimg.NewImage(processed)
 		resultSize, err := resultImg.Size()
 		if err != nil {
-			return nil, fmt.Errorf("get result size %s: %w", s.Name, err)
+			return nil, fmt.Errorf("get result size %s: %w", p.Name, err)
 		}
 
 		results = append(results, ProcessResult{
-			Name:   s.Name,
+			Name:   p.Name,
 			Data:   processed,
 			Width:  resultSize.Width,
 			Height: resultSize.Height,
+			Frames: resultFrames,
 		})
 		logging.Get("image").Printf(
-			"image.process: variant=%s target=%dx%d result=%dx%d elapsed=%s",
-			s.Name,
+			"image.process: variant=%s target=%dx%d result=%dx%d frames=%d elapsed=%s",
+			p.Name,
 			opts.Width,
 			opts.Height,
 			resultSize.Width,
 			resultSize.Height,
+			resultFrames,
 			time.Since(sizeStart),
 		)
+	}
 
-		// If original was smaller than first target, we only need one version
-		if size.Width <= Sizes[0].Width && s.Name == "original" {
-			// Still generate smaller sizes from this
-			continue
-		}
+	if clean != nil {
+		results = append(results, ProcessResult{
+			Name:   CleanVariant,
+			Data:   clean,
+			Width:  results[0].Width,
+			Height: results[0].Height,
+			Frames: results[0].Frames,
+		})
 	}
 
 	return results, nil
@@ -1,6 +1,12 @@
 package image
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	goimage "image"
+	"image/jpeg"
+	"math"
 	"testing"
 
 	"dajtu/internal/testutil"
@@ -43,7 +49,7 @@ func TestProcessWithTransform_Rotation(t *testing.T) {
 		Rotation: 90,
 	}
 
-	results, err := p.ProcessWithTransform(testutil.SampleJPEG(), params)
+	results, err := p.ProcessWithTransform(context.Background(), testutil.SampleJPEG(), params)
 	if err != nil {
 		t.Fatalf("ProcessWithTransform: %v", err)
 	}
@@ -68,7 +74,7 @@ func TestProcessWithTransform_Crop(t *testing.T) {
 		CropH: 1,
 	}
 
-	results, err := p.ProcessWithTransform(testutil.SampleJPEG(), params)
+	results, err := p.ProcessWithTransform(context.Background(), testutil.SampleJPEG(), params)
 	if err != nil {
 		t.Fatalf("ProcessWithTransform: %v", err)
 	}
@@ -78,6 +84,19 @@ func TestProcessWithTransform_Crop(t *testing.T) {
 	}
 }
 
+func TestProcessor_ProcessUpload(t *testing.T) {
+	results, err := NewProcessor().ProcessUpload(context.Background(), testutil.SampleJPEG(), TransformParams{})
+	if err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+	for _, res := range results {
+		analyzed := res.Placeholder.LQIP != "" && res.Fingerprint.PixelHash != ""
+		if analyzed != (res.Name == "original") {
+			t.Errorf("%s: placeholder=%q fingerprint=%+v", res.Name, res.Placeholder.LQIP, res.Fingerprint)
+		}
+	}
+}
+
 func TestTransformParams_HasTransforms(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -123,3 +142,178 @@ func TestProcess_WebP(t *testing.T) {
 		t.Fatal("no results returned for WebP")
 	}
 }
+
+var (
+	p3Colorants = [3][3]float64{
+		{0.5151, 0.2412, -0.0011},
+		{0.2919, 0.6922, 0.0419},
+		{0.1571, 0.0666, 0.7841},
+	}
+	adobeColorants = [3][3]float64{
+		{0.6097, 0.3111, 0.0195},
+		{0.2053, 0.6257, 0.0609},
+		{0.1492, 0.0632, 0.7446},
+	}
+)
+
+// iccProfile builds a minimal matrix/TRC display profile (ICC v2) with the
+// given colour space and primaries; TRCs are plain gamma 2.2.
+func iccProfile(space string, colorants [3][3]float64) []byte {
+	xyz := func(v [3]float64) []byte {
+		b := []byte("XYZ \x00\x00\x00\x00")
+		for _, f := range v {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(f*65536))))
+		}
+		return b
+	}
+	curv := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33\x00\x00")
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{{"wtpt", xyz([3]float64{0.9642, 1.0, 0.8249})}}
+	if space == "RGB " {
+		tags = append(tags,
+			tag{"rXYZ", xyz(colorants[0])}, tag{"gXYZ", xyz(colorants[1])}, tag{"bXYZ", xyz(colorants[2])},
+			tag{"rTRC", curv}, tag{"gTRC", curv}, tag{"bTRC", curv})
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], space)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	for i, f := range [3]float64{0.9642, 1.0, 0.8249} {
+		binary.BigEndian.PutUint32(header[68+i*4:], uint32(int32(math.Round(f*65536))))
+	}
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 128 + 4 + 12*len(tags)
+	var body []byte
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		body = append(body, t.data...)
+	}
+
+	icc := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(icc[0:], uint32(len(icc)))
+	return icc
+}
+
+// profiledJPEG encodes a flat 64x64 image of c and embeds icc in an APP2
+// segment right after SOI (nil leaves the JPEG untagged).
+func profiledJPEG(c [3]uint8, icc []byte) []byte {
+	src := goimage.NewRGBA(goimage.Rect(0, 0, 64, 64))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = c[0], c[1], c[2], 255
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95})
+	data := buf.Bytes()
+	if icc == nil {
+		return data
+	}
+
+	seg := append([]byte("ICC_PROFILE\x00\x01\x01"), icc...)
+	app2 := []byte{0xFF, 0xE2}
+	app2 = binary.BigEndian.AppendUint16(app2, uint16(len(seg)+2))
+	app2 = append(app2, seg...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app2...)
+	return append(out, data[2:]...)
+}
+
+// originalPixel renders data and returns the centre pixel of its original
+// variant.
+func originalPixel(t *testing.T, data []byte) [3]int {
+	t.Helper()
+	results, err := Process(data)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	out, err := Convert(results[0].Data, 100, FormatJPEG)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	img, _, err := goimage.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	b := img.Bounds()
+	r, g, bl, _ := img.At(b.Dx()/2, b.Dy()/2).RGBA()
+	return [3]int{int(r >> 8), int(g >> 8), int(bl >> 8)}
+}
+
+func TestNeedsSRGB(t *testing.T) {
+	tests := []struct {
+		name string
+		icc  []byte
+		want bool
+	}{
+		{"no profile", nil, false},
+		{"truncated", iccProfile("RGB ", srgbColorants)[:100], false},
+		{"sRGB", iccProfile("RGB ", srgbColorants), false},
+		{"Display P3", iccProfile("RGB ", p3Colorants), true},
+		{"Adobe RGB", iccProfile("RGB ", adobeColorants), true},
+		{"CMYK", iccProfile("CMYK", [3][3]float64{}), true},
+		{"grey", iccProfile("GRAY", [3][3]float64{}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsSRGB(tt.icc); got != tt.want {
+				t.Errorf("needsSRGB() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// an RGB profile without colorant tags (LUT-based) is converted too
+	lut := iccProfile("RGB ", srgbColorants)
+	copy(lut[144:148], "A2B0") // the rXYZ entry, after wtpt
+	if !needsSRGB(lut) {
+		t.Error("RGB profile without rXYZ should need conversion")
+	}
+}
+
+func TestProcess_ICCProfiles(t *testing.T) {
+	red := [3]uint8{220, 60, 60}
+	plain := profiledJPEG(red, nil)
+	if _, err := Process(plain); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+
+	base := originalPixel(t, plain)
+
+	// sRGB-tagged pixels are already right and must not shift
+	srgb := originalPixel(t, profiledJPEG(red, iccProfile("RGB ", srgbColorants)))
+	for i := range base {
+		if d := srgb[i] - base[i]; d > 3 || d < -3 {
+			t.Errorf("sRGB-tagged pixel = %v, untagged = %v", srgb, base)
+			break
+		}
+	}
+
+	// the same numbers in Display P3 are a more saturated red than in sRGB;
+	// stripping the profile unconverted would give the untagged colour
+	p3 := originalPixel(t, profiledJPEG(red, iccProfile("RGB ", p3Colorants)))
+	if p3[0] < base[0]+10 || p3[1] > base[1]-10 {
+		t.Errorf("P3-tagged pixel = %v, untagged = %v: not converted to sRGB", p3, base)
+	}
+
+	// edits convert before the geometry strips the profile
+	results, err := ProcessWithTransform(profiledJPEG(red, iccProfile("RGB ", p3Colorants)), TransformParams{Rotation: 90})
+	if err != nil {
+		t.Fatalf("ProcessWithTransform() error = %v", err)
+	}
+	edited := originalPixel(t, results[0].Data)
+	for i := range p3 {
+		if d := edited[i] - p3[i]; d > 3 || d < -3 {
+			t.Errorf("edited P3 pixel = %v, want %v", edited, p3)
+			break
+		}
+	}
+}
@@ -14,17 +14,41 @@ func GetSize(data []byte) (int, int, error) {
 	return size.Width, size.Height, nil
 }
 
-func ResizeToWidth(data []byte, width int) ([]byte, error) {
-	opts := bimg.Options{
-		Width:         width,
-		Type:          bimg.WEBP,
-		Quality:       90,
-		StripMetadata: true,
+// Render produces preset p from data (normally the stored original) in the
+// given format. Animated input stays animated for fit=contain WebP output;
+// everything else gets the first frame. Cover presets crop around p.Focal
+// when the caller set it with WithFocal.
+func Render(data []byte, p Preset, format Format) ([]byte, error) {
+	size, err := bimg.NewImage(data).Size()
+	if err != nil {
+		return nil, fmt.Errorf("get size: %w", err)
+	}
+	opts := p.options(size.Width, size.Height)
+
+	if format == FormatWebP && p.Fit == FitContain && FrameCount(data) > 1 {
+		processed, err := resizeAnimated(data, opts.Width, p.Quality)
+		if err != nil {
+			return nil, fmt.Errorf("render animated %s: %w", p.Name, err)
+		}
+		return processed, nil
 	}
 
+	if p.smartCrop() {
+		if data, err = coverCrop(data, p.Width, p.Height, p.Crop, p.Focal, false); err != nil {
+			return nil, fmt.Errorf("crop %s: %w", p.Name, err)
+		}
+	}
+	if err := encodeOptions(&opts, format); err != nil {
+		return nil, err
+	}
 	processed, err := bimg.NewImage(data).Process(opts)
 	if err != nil {
-		return nil, fmt.Errorf("resize to %d: %w", width, err)
+		return nil, fmt.Errorf("render %s (%s): %w", p.Name, Extension(format), err)
 	}
 	return processed, nil
 }
+
+// Convert re-encodes data to format at the given quality, keeping its size.
+func Convert(data []byte, quality int, format Format) ([]byte, error) {
+	return Render(data, Preset{Name: "convert", Fit: FitContain, Quality: quality}, format)
+}
@@ -0,0 +1,56 @@
+package image
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// TransformPresetName names the ad-hoc presets of signed transform URLs
+// (/t/{signature}/{spec}/{slug}.{ext}); it keys their CacheDir renders.
+const TransformPresetName = "transform"
+
+// MaxTransformSize caps both dimensions of a transform, signed or not.
+const MaxTransformSize = 4096
+
+// ParseTransformSpec parses the spec part of a transform URL, using the
+// preset syntax without the name: "W[xH]" plus fit=, crop= and q= options.
+// The output format comes from the URL extension instead.
+func ParseTransformSpec(spec string) (Preset, error) {
+	p, err := parsePresetParams(TransformPresetName, spec)
+	if err != nil {
+		return Preset{}, err
+	}
+	if p.Eager || p.Format != "" {
+		return Preset{}, fmt.Errorf("transform %q: only size, fit, crop and q are allowed", spec)
+	}
+	if p.Width > MaxTransformSize || p.Height > MaxTransformSize {
+		return Preset{}, fmt.Errorf("transform %q: max size is %d", spec, MaxTransformSize)
+	}
+	return p, nil
+}
+
+// SignTransform returns the URL-safe signature of spec applied to file
+// ("{slug}.{ext}"): the first 16 bytes of HMAC-SHA256(secret, spec+"/"+file),
+// base64url without padding.
+func SignTransform(secret, spec, file string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(spec + "/" + file))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// VerifyTransform checks a signature in constant time. An empty secret
+// never verifies, so transforms stay disabled until one is configured.
+func VerifyTransform(secret, signature, spec, file string) bool {
+	if secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignTransform(secret, spec, file)))
+}
+
+// TransformURLPath builds the signed path of a transform URL.
+func TransformURLPath(secret, spec, slug string, format Format) string {
+	file := slug + "." + Extension(format)
+	return "/t/" + SignTransform(secret, spec, file) + "/" + spec + "/" + file
+}
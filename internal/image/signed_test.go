@@ -0,0 +1,65 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTransformSpec(t *testing.T) {
+	p, err := ParseTransformSpec("640x360,fit=cover,q=80")
+	if err != nil {
+		t.Fatalf("ParseTransformSpec() error = %v", err)
+	}
+	want := Preset{Name: TransformPresetName, Width: 640, Height: 360, Fit: FitCover, Quality: 80}
+	if p != want {
+		t.Errorf("ParseTransformSpec() = %+v, want %+v", p, want)
+	}
+
+	// same parameters in another order share the cache entry
+	q, _ := ParseTransformSpec("640x360,q=80,fit=cover")
+	if p.Key() != q.Key() {
+		t.Error("equivalent specs should have the same key")
+	}
+
+	for _, spec := range []string{"", "abc", "96x96,eager", "96,format=jpeg", "5000", "100x5000,fit=cover", "96,fit=cover"} {
+		if _, err := ParseTransformSpec(spec); err == nil {
+			t.Errorf("ParseTransformSpec(%q) accepted", spec)
+		}
+	}
+}
+
+func TestSignTransform(t *testing.T) {
+	sig := SignTransform("secret", "96x96,fit=cover", "abcd.webp")
+	if len(sig) != 22 || strings.ContainsAny(sig, "+/=") {
+		t.Errorf("SignTransform() = %q, want 22 url-safe chars", sig)
+	}
+	if !VerifyTransform("secret", sig, "96x96,fit=cover", "abcd.webp") {
+		t.Error("valid signature rejected")
+	}
+
+	tests := []struct {
+		name, secret, sig, spec, file string
+	}{
+		{"other spec", "secret", sig, "960x960,fit=cover", "abcd.webp"},
+		{"other file", "secret", sig, "96x96,fit=cover", "abce.webp"},
+		{"other format", "secret", sig, "96x96,fit=cover", "abcd.jpg"},
+		{"other secret", "secret2", sig, "96x96,fit=cover", "abcd.webp"},
+		{"no secret", "", SignTransform("", "96", "abcd.webp"), "96", "abcd.webp"},
+	}
+	for _, tt := range tests {
+		if VerifyTransform(tt.secret, tt.sig, tt.spec, tt.file) {
+			t.Errorf("%s: signature accepted", tt.name)
+		}
+	}
+}
+
+func TestTransformURLPath(t *testing.T) {
+	path := TransformURLPath("secret", "640x360,fit=cover", "abcd", FormatAVIF)
+	parts := strings.Split(strings.TrimPrefix(path, "/t/"), "/")
+	if len(parts) != 3 || parts[1] != "640x360,fit=cover" || parts[2] != "abcd.avif" {
+		t.Fatalf("TransformURLPath() = %q", path)
+	}
+	if !VerifyTransform("secret", parts[0], parts[1], parts[2]) {
+		t.Error("TransformURLPath() signature does not verify")
+	}
+}
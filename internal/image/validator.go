@@ -2,8 +2,10 @@ package image
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
+	"slices"
 )
 
 var (
@@ -19,6 +21,9 @@ const (
 	FormatGIF  Format = "image/gif"
 	FormatWebP Format = "image/webp"
 	FormatAVIF Format = "image/avif"
+	FormatHEIC Format = "image/heic"
+	FormatTIFF Format = "image/tiff"
+	FormatBMP  Format = "image/bmp"
 )
 
 var magicBytes = map[Format][]byte{
@@ -27,8 +32,17 @@ var magicBytes = map[Format][]byte{
 	FormatGIF:  {0x47, 0x49, 0x46, 0x38}, // GIF8
 	FormatWebP: {0x52, 0x49, 0x46, 0x46}, // RIFF (need to check WEBP at offset 8)
 	FormatAVIF: {0x00, 0x00, 0x00},       // ftyp box (need deeper check)
+	FormatBMP:  {0x42, 0x4D},             // BM (need to check DIB header size)
 }
 
+var tiffMagic = [][]byte{
+	{0x49, 0x49, 0x2A, 0x00}, // II*\0 little-endian
+	{0x4D, 0x4D, 0x00, 0x2A}, // MM\0* big-endian
+}
+
+// HEIF brands coded with HEVC; libvips decodes them through libheif.
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx"}
+
 func ValidateAndDetect(r io.Reader, maxSize int64) (Format, []byte, error) {
 	// Read entire file with size limit
 	limited := io.LimitReader(r, maxSize+1)
@@ -74,13 +88,53 @@ func detectFormat(data []byte) Format {
 		}
 	}
 
-	// AVIF: ftyp box with avif/avis brand
+	// AVIF/HEIC: ftyp box, major brand decides; generic mif1/msf1 fall back
+	// to the compatible brands list
 	if len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) {
 		brand := string(data[8:12])
-		if brand == "avif" || brand == "avis" || brand == "mif1" {
+		switch {
+		case brand == "avif" || brand == "avis":
+			return FormatAVIF
+		case slices.Contains(heicBrands, brand):
+			return FormatHEIC
+		case brand == "mif1" || brand == "msf1":
+			if hasCompatibleBrand(data, heicBrands...) && !hasCompatibleBrand(data, "avif", "avis") {
+				return FormatHEIC
+			}
 			return FormatAVIF
 		}
 	}
 
+	// TIFF
+	for _, magic := range tiffMagic {
+		if bytes.HasPrefix(data, magic) {
+			return FormatTIFF
+		}
+	}
+
+	// BMP: BM + known DIB header size
+	if bytes.HasPrefix(data, magicBytes[FormatBMP]) && len(data) >= 18 {
+		switch binary.LittleEndian.Uint32(data[14:18]) {
+		case 12, 40, 52, 56, 64, 108, 124:
+			return FormatBMP
+		}
+	}
+
 	return ""
 }
+
+// hasCompatibleBrand reports whether the ftyp box at the start of data lists
+// any of brands among its compatible brands.
+func hasCompatibleBrand(data []byte, brands ...string) bool {
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if size > len(data) {
+		size = len(data)
+	}
+	// size(4) ftyp(4) major(4) minor(4), then 4-byte compatible brands
+	for pos := 16; pos+4 <= size; pos += 4 {
+		if slices.Contains(brands, string(data[pos:pos+4])) {
+			return true
+		}
+	}
+	return false
+}
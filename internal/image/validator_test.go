@@ -217,6 +217,52 @@ func TestDetectFormat_TableDriven(t *testing.T) {
 			data:     append([]byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61}, make([]byte, 20)...),
 			expected: FormatGIF,
 		},
+		{
+			name:     "HEIC",
+			data:     append([]byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'c'}, make([]byte, 20)...),
+			expected: FormatHEIC,
+		},
+		{
+			name:     "HEIC 10-bit",
+			data:     append([]byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'x'}, make([]byte, 20)...),
+			expected: FormatHEIC,
+		},
+		{
+			name: "HEIC via mif1 compatible brand",
+			data: append([]byte{
+				0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'm', 'i', 'f', '1',
+				0x00, 0x00, 0x00, 0x00, 'm', 'i', 'f', '1', 'h', 'e', 'i', 'c',
+			}, make([]byte, 20)...),
+			expected: FormatHEIC,
+		},
+		{
+			name: "AVIF via mif1 compatible brand",
+			data: append([]byte{
+				0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'm', 'i', 'f', '1',
+				0x00, 0x00, 0x00, 0x00, 'm', 'i', 'f', '1', 'a', 'v', 'i', 'f',
+			}, make([]byte, 20)...),
+			expected: FormatAVIF,
+		},
+		{
+			name:     "TIFF little-endian",
+			data:     append([]byte{0x49, 0x49, 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00}, make([]byte, 20)...),
+			expected: FormatTIFF,
+		},
+		{
+			name:     "TIFF big-endian",
+			data:     append([]byte{0x4D, 0x4D, 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08}, make([]byte, 20)...),
+			expected: FormatTIFF,
+		},
+		{
+			name:     "BMP",
+			data:     append([]byte{'B', 'M', 0, 0, 0, 0, 0, 0, 0, 0, 54, 0, 0, 0, 40, 0, 0, 0}, make([]byte, 20)...),
+			expected: FormatBMP,
+		},
+		{
+			name:     "BM text",
+			data:     []byte("BM is not a bitmap header at all"),
+			expected: "",
+		},
 		{
 			name:     "Unknown",
 			data:     make([]byte, 20),
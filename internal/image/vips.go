@@ -0,0 +1,537 @@
+package image
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <string.h>
+#include <vips/vips.h>
+
+// bimg only ever loads the first page of a multi-page image, so animated
+// resizing goes straight to libvips: load all pages (n=-1), thumbnail keeps
+// page-height in sync, and webpsave writes the frames back as an animation.
+static int dajtu_resize_animated(void *buf, size_t len, int width, int quality, void **out, size_t *outlen) {
+	VipsImage *img = NULL;
+	int ret;
+
+	ret = vips_thumbnail_buffer(buf, len, &img, width,
+		"height", VIPS_MAX_COORD,
+		"size", VIPS_SIZE_DOWN,
+		"option_string", "n=-1",
+		NULL);
+	if (ret != 0) {
+		return ret;
+	}
+
+	ret = vips_webpsave_buffer(img, out, outlen,
+		"Q", quality,
+		"strip", TRUE,
+		NULL);
+	g_object_unref(img);
+	return ret;
+}
+
+// Draws a mark onto every frame of an animation. The mark, its alpha
+// scaled by opacity, is placed at (left, top) on a transparent frame-sized
+// canvas, which is repeated down the page-tall image and composited over
+// it; page-height survives so webpsave writes the frames back.
+static int dajtu_watermark_animated(void *buf, size_t len, void *mark_buf, size_t mark_len,
+		int left, int top, double opacity, int quality, void **out, size_t *outlen) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 12);
+	VipsImage *img, *mark;
+	double a[4] = { 1, 1, 1, opacity };
+	double b[4] = { 0, 0, 0, 0 };
+	int page_height;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", "n", -1, NULL)) ||
+		!(t[1] = vips_image_new_from_buffer(mark_buf, mark_len, "", NULL)) ||
+		vips_colourspace(t[1], &t[2], VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	img = t[0];
+	page_height = vips_image_get_page_height(img);
+
+	mark = t[2];
+	if (!vips_image_hasalpha(mark)) {
+		if (vips_addalpha(mark, &t[3], NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		mark = t[3];
+	}
+	if (vips_linear(mark, &t[4], a, b, 4, NULL) ||
+		vips_cast(t[4], &t[5], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_embed(t[5], &t[6], left, top, img->Xsize, page_height, NULL) ||
+		vips_replicate(t[6], &t[7], 1, img->Ysize / page_height) ||
+		vips_composite2(img, t[7], &t[8], VIPS_BLEND_MODE_OVER, NULL) ||
+		vips_cast(t[8], &t[9], VIPS_FORMAT_UCHAR, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	img = t[9];
+
+	// composite always adds alpha; drop it again for opaque frames
+	if (!vips_image_hasalpha(t[0])) {
+		if (vips_extract_band(img, &t[10], 0, "n", img->Bands - 1, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		img = t[10];
+	}
+
+	if (vips_copy(img, &t[11], NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	vips_image_set_int(t[11], VIPS_META_PAGE_HEIGHT, page_height);
+	if (vips_webpsave_buffer(t[11], out, outlen,
+			"Q", quality,
+			"strip", TRUE,
+			NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	g_object_unref(base);
+	return 0;
+}
+
+// Renders text as a PNG overlay: white glyphs on a translucent dark box
+// (alpha 110 behind, 255 on the glyphs), readable on any background.
+static int dajtu_text_overlay(const char *text, const char *font, void **out, size_t *outlen) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 6);
+	VipsImage *bands[4];
+	int pad;
+
+	if (vips_text(&t[0], text, "font", font, "dpi", 72, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	pad = t[0]->Ysize / 4 + 1;
+	if (vips_embed(t[0], &t[1], pad, pad, t[0]->Xsize + 2 * pad, t[0]->Ysize + 2 * pad, NULL) ||
+		vips_linear1(t[1], &t[2], 145.0 / 255.0, 110.0, NULL) ||
+		vips_cast(t[2], &t[3], VIPS_FORMAT_UCHAR, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	bands[0] = t[1];
+	bands[1] = t[1];
+	bands[2] = t[1];
+	bands[3] = t[3];
+	if (vips_bandjoin(bands, &t[4], 4, NULL) ||
+		vips_copy(t[4], &t[5], "interpretation", VIPS_INTERPRETATION_sRGB, NULL) ||
+		vips_pngsave_buffer(t[5], out, outlen, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	g_object_unref(base);
+	return 0;
+}
+
+// Colour filters on an sRGB image: gamma on the 8-bit values, then one
+// affine colour matrix (3x3 plus offsets, row-major in m), then blur and
+// sharpen. Alpha is split off and joined back unchanged. Saves a PNG.
+static int dajtu_filters(void *buf, size_t len, double gamma, const double *m,
+		double blur, double sharpen, void **out, size_t *outlen) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 13);
+	VipsImage *img, *alpha = NULL;
+	double offsets[3] = { m[3], m[7], m[11] };
+	double ones[3] = { 1, 1, 1 };
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_colourspace(t[0], &t[1], VIPS_INTERPRETATION_sRGB, NULL) ||
+		vips_cast(t[1], &t[2], VIPS_FORMAT_UCHAR, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	img = t[2];
+	if (img->Bands > 3) {
+		if (vips_extract_band(img, &t[3], 3, "n", 1, NULL) ||
+			vips_extract_band(img, &t[4], 0, "n", 3, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		alpha = t[3];
+		img = t[4];
+	}
+
+	if (gamma != 1.0) {
+		if (vips_gamma(img, &t[5], "exponent", gamma, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		img = t[5];
+	}
+
+	t[6] = vips_image_new_matrixv(3, 3, m[0], m[1], m[2], m[4], m[5], m[6], m[8], m[9], m[10]);
+	if (vips_recomb(img, &t[7], t[6], NULL) ||
+		vips_linear(t[7], &t[8], ones, offsets, 3, NULL) ||
+		vips_cast(t[8], &t[9], VIPS_FORMAT_UCHAR, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	img = t[9];
+
+	if (blur > 0) {
+		if (vips_gaussblur(img, &t[10], blur, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		img = t[10];
+	}
+	if (sharpen > 0) {
+		if (vips_sharpen(img, &t[11], "sigma", sharpen, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		img = t[11];
+	}
+
+	if (alpha) {
+		if (vips_bandjoin2(img, alpha, &t[12], NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		img = t[12];
+	}
+
+	if (vips_pngsave_buffer(img, out, outlen, "compression", 1, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	g_object_unref(base);
+	return 0;
+}
+// Cover crop of width x height for fit=cover presets. With a smart
+// strategy vips_thumbnail shrinks on load and keeps the most interesting
+// region. With VIPS_INTERESTING_NONE the image is shrunk until it just
+// covers the box, which is then cut around the focal point (fx, fy), given
+// as fractions of the oriented image. Never enlarges; saves a PNG.
+static int dajtu_cover_crop(void *buf, size_t len, int width, int height, int interesting,
+		double fx, double fy, int no_rotate, void **out, size_t *outlen) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+	VipsAngle angle;
+	double scale;
+	int w, h, cw, ch, left, top;
+
+	if (interesting != VIPS_INTERESTING_NONE) {
+		if (vips_thumbnail_buffer(buf, len, &t[0], width,
+				"height", height,
+				"size", VIPS_SIZE_DOWN,
+				"crop", interesting,
+				"no_rotate", no_rotate,
+				NULL) ||
+			vips_pngsave_buffer(t[0], out, outlen, "compression", 1, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		g_object_unref(base);
+		return 0;
+	}
+
+	// only the header is read here
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		g_object_unref(base);
+		return -1;
+	}
+	w = t[0]->Xsize;
+	h = t[0]->Ysize;
+	angle = no_rotate ? VIPS_ANGLE_D0 : vips_autorot_get_angle(t[0]);
+	if (angle == VIPS_ANGLE_D90 || angle == VIPS_ANGLE_D270) {
+		w = t[0]->Ysize;
+		h = t[0]->Xsize;
+	}
+	scale = VIPS_MIN(1.0, VIPS_MAX((double) width / w, (double) height / h));
+
+	if (vips_thumbnail_buffer(buf, len, &t[1], VIPS_CEIL(w * scale),
+			"height", VIPS_MAX_COORD,
+			"size", VIPS_SIZE_DOWN,
+			"no_rotate", no_rotate,
+			NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	cw = VIPS_MIN(width, t[1]->Xsize);
+	ch = VIPS_MIN(height, t[1]->Ysize);
+	left = VIPS_CLIP(0, (int) (fx * t[1]->Xsize - cw / 2.0), t[1]->Xsize - cw);
+	top = VIPS_CLIP(0, (int) (fy * t[1]->Ysize - ch / 2.0), t[1]->Ysize - ch);
+	if (vips_extract_area(t[1], &t[2], left, top, cw, ch) ||
+		vips_pngsave_buffer(t[2], out, outlen, "compression", 1, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	g_object_unref(base);
+	return 0;
+}
+
+// Copies the embedded ICC profile out of an image, reading only the header.
+// Returns 1 with the profile in out, 0 when there is none, -1 when the
+// image cannot be loaded.
+static int dajtu_icc_profile(void *buf, size_t len, void **out, size_t *outlen) {
+	VipsImage *img;
+	const void *data;
+	size_t size;
+
+	if (!(img = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		return -1;
+	}
+	if (!vips_image_get_typeof(img, VIPS_META_ICC_NAME) ||
+		vips_image_get_blob(img, VIPS_META_ICC_NAME, &data, &size)) {
+		g_object_unref(img);
+		return 0;
+	}
+	*out = g_malloc(size);
+	memcpy(*out, data, size);
+	*outlen = size;
+	g_object_unref(img);
+	return 1;
+}
+
+// Converts an image to sRGB with its embedded profile: EXIF orientation
+// first (the PNG keeps no EXIF), then vips_icc_transform to the built-in
+// sRGB profile at 8 bits. Alpha passes through. Saves a PNG.
+static int dajtu_to_srgb(void *buf, size_t len, void **out, size_t *outlen) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_icc_transform(t[1], &t[2], "srgb",
+			"embedded", TRUE,
+			"intent", VIPS_INTENT_RELATIVE,
+			"depth", 8,
+			NULL) ||
+		vips_pngsave_buffer(t[2], out, outlen, "compression", 1, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	g_object_unref(base);
+	return 0;
+}
+
+// Decodes every pixel of the first page: vips_avg pulls the whole image
+// through the loader, which with fail set stops at the first damaged
+// block instead of filling it with grey. Sequential access keeps memory to
+// a few scanlines.
+static int dajtu_decode_check(void *buf, size_t len) {
+	VipsImage *img;
+	double avg;
+	int ret;
+
+	if (!(img = vips_image_new_from_buffer(buf, len, "",
+			"access", VIPS_ACCESS_SEQUENTIAL,
+			"fail", TRUE,
+			NULL))) {
+		return -1;
+	}
+	ret = vips_avg(img, &avg, NULL);
+	g_object_unref(img);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"html"
+	"unsafe"
+)
+
+// resizeAnimated scales every frame of an animated GIF/WebP down to width
+// and encodes the result as animated WebP.
+func resizeAnimated(data []byte, width, quality int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	ret := C.dajtu_resize_animated(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(width), C.int(quality), &out, &outLen)
+	if ret != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// watermarkAnimated composites mark at (left, top) onto every frame of an
+// animated WebP and encodes it again as animated WebP.
+func watermarkAnimated(data, mark []byte, left, top int, opacity float64, quality int) ([]byte, error) {
+	if len(data) == 0 || len(mark) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	ret := C.dajtu_watermark_animated(unsafe.Pointer(&data[0]), C.size_t(len(data)),
+		unsafe.Pointer(&mark[0]), C.size_t(len(mark)),
+		C.int(left), C.int(top), C.double(opacity), C.int(quality), &out, &outLen)
+	if ret != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// watermarkFont is large enough that overlays are scaled down, not up.
+const watermarkFont = "sans bold 64"
+
+// renderText draws text as a PNG overlay for watermarks. vips_text parses
+// Pango markup, so the text is escaped.
+func renderText(text string) ([]byte, error) {
+	ctext := C.CString(html.EscapeString(text))
+	defer C.free(unsafe.Pointer(ctext))
+	cfont := C.CString(watermarkFont)
+	defer C.free(unsafe.Pointer(cfont))
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	if C.dajtu_text_overlay(ctext, cfont, &out, &outLen) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// filterImage runs dajtu_filters; m is the affine colour matrix from
+// Filters.colourMatrix.
+func filterImage(data []byte, gamma float64, m [3][4]float64, blur, sharpen float64) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	var cm [12]C.double
+	for i := range m {
+		for j := range m[i] {
+			cm[i*4+j] = C.double(m[i][j])
+		}
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	if C.dajtu_filters(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.double(gamma), &cm[0],
+		C.double(blur), C.double(sharpen), &out, &outLen) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// coverCrop cuts the width x height box of a fit=cover preset out of data as
+// a PNG: around focal when it is set, otherwise where crop finds the
+// subject. bimg then only has to encode it.
+func coverCrop(data []byte, width, height int, crop Crop, focal *FocalPoint, noAutoRotate bool) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	interesting := C.int(C.VIPS_INTERESTING_ATTENTION)
+	var fx, fy float64
+	switch {
+	case focal != nil:
+		interesting = C.int(C.VIPS_INTERESTING_NONE)
+		fx, fy = focal.X, focal.Y
+	case crop == CropEntropy:
+		interesting = C.int(C.VIPS_INTERESTING_ENTROPY)
+	}
+	noRotate := 0
+	if noAutoRotate {
+		noRotate = 1
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	if C.dajtu_cover_crop(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(width), C.int(height), interesting,
+		C.double(fx), C.double(fy), C.int(noRotate), &out, &outLen) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// embeddedProfile returns the ICC profile embedded in data, nil when there
+// is none.
+func embeddedProfile(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	switch C.dajtu_icc_profile(unsafe.Pointer(&data[0]), C.size_t(len(data)), &out, &outLen) {
+	case 0:
+		return nil, nil
+	case 1:
+		defer C.g_free(C.gpointer(out))
+		return C.GoBytes(out, C.int(outLen)), nil
+	}
+	msg := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+	return nil, errors.New(msg)
+}
+
+// transformToSRGB runs dajtu_to_srgb.
+func transformToSRGB(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	defer C.vips_thread_shutdown()
+
+	var out unsafe.Pointer
+	var outLen C.size_t
+	if C.dajtu_to_srgb(unsafe.Pointer(&data[0]), C.size_t(len(data)), &out, &outLen) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+// decodeCheck runs dajtu_decode_check.
+func decodeCheck(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty image")
+	}
+
+	defer C.vips_thread_shutdown()
+
+	if C.dajtu_decode_check(unsafe.Pointer(&data[0]), C.size_t(len(data))) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return errors.New(msg)
+	}
+	return nil
+}
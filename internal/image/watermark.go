@@ -0,0 +1,166 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/h2non/bimg"
+)
+
+// CleanVariant is the unwatermarked copy of "original" stored next to the
+// public variants of a watermarked image, for the owner, edits and
+// re-rendering when the watermark changes.
+const CleanVariant = "clean"
+
+// Watermark positions.
+const (
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+	PositionCenter      = "center"
+)
+
+// WatermarkPositions lists the accepted positions in UI order.
+var WatermarkPositions = []string{PositionBottomRight, PositionBottomLeft, PositionTopRight, PositionTopLeft, PositionCenter}
+
+const (
+	maxWatermarkText      = 100
+	maxWatermarkImageSide = 2048
+	// MaxWatermarkImageBytes caps uploaded PNG overlays.
+	MaxWatermarkImageBytes = 1 << 20
+	// variants narrower than this (thumb) stay clean, a mark would be illegible
+	minWatermarkWidth = 256
+)
+
+var ErrInvalidWatermark = errors.New("invalid watermark")
+
+// Watermark is a text or PNG overlay burned into public variants.
+type Watermark struct {
+	Text     string
+	Image    []byte // PNG with alpha, used when Text is empty
+	Position string
+	Opacity  float64 // 0-1
+	Scale    float64 // overlay width as a fraction of the variant width
+}
+
+// Normalize validates the overlay and clamps position, opacity and scale
+// to supported values.
+func (w *Watermark) Normalize() error {
+	w.Text = strings.TrimSpace(w.Text)
+	if w.Text != "" {
+		w.Image = nil
+		if utf8.RuneCountInString(w.Text) > maxWatermarkText {
+			return fmt.Errorf("%w: text longer than %d characters", ErrInvalidWatermark, maxWatermarkText)
+		}
+	} else {
+		if len(w.Image) == 0 {
+			return fmt.Errorf("%w: text or PNG image required", ErrInvalidWatermark)
+		}
+		if len(w.Image) > MaxWatermarkImageBytes {
+			return fmt.Errorf("%w: PNG larger than %d KB", ErrInvalidWatermark, MaxWatermarkImageBytes>>10)
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(w.Image))
+		if err != nil {
+			return fmt.Errorf("%w: not a PNG image", ErrInvalidWatermark)
+		}
+		if cfg.Width > maxWatermarkImageSide || cfg.Height > maxWatermarkImageSide {
+			return fmt.Errorf("%w: PNG larger than %dx%d", ErrInvalidWatermark, maxWatermarkImageSide, maxWatermarkImageSide)
+		}
+	}
+
+	valid := false
+	for _, p := range WatermarkPositions {
+		valid = valid || p == w.Position
+	}
+	if !valid {
+		w.Position = PositionBottomRight
+	}
+	if math.IsNaN(w.Opacity) || w.Opacity <= 0 {
+		w.Opacity = 0.5
+	}
+	w.Opacity = math.Min(math.Max(w.Opacity, 0.05), 1)
+	if math.IsNaN(w.Scale) || w.Scale <= 0 {
+		w.Scale = 0.2
+	}
+	w.Scale = math.Min(math.Max(w.Scale, 0.05), 0.5)
+	return nil
+}
+
+// overlay returns the PNG drawn onto variants.
+func (w *Watermark) overlay() ([]byte, error) {
+	if w.Text != "" {
+		return renderText(w.Text)
+	}
+	return w.Image, nil
+}
+
+// watermarkOffset places a mark of size mw x mh on a w x h image with a
+// margin of 2% of the shorter side.
+func watermarkOffset(position string, w, h, mw, mh int) (left, top int) {
+	margin := min(w, h) / 50
+	switch position {
+	case PositionTopLeft:
+		left, top = margin, margin
+	case PositionTopRight:
+		left, top = w-mw-margin, margin
+	case PositionBottomLeft:
+		left, top = margin, h-mh-margin
+	case PositionCenter:
+		left, top = (w-mw)/2, (h-mh)/2
+	default:
+		left, top = w-mw-margin, h-mh-margin
+	}
+	return max(left, 0), max(top, 0)
+}
+
+// applyWatermark draws overlay onto an encoded variant and re-encodes it;
+// on an animated WebP onto every frame. Variants narrower than
+// minWatermarkWidth are returned unchanged.
+func applyWatermark(data, overlay []byte, wm *Watermark, quality int, format Format) ([]byte, error) {
+	size, err := bimg.NewImage(data).Size()
+	if err != nil {
+		return nil, fmt.Errorf("watermark: %w", err)
+	}
+	if size.Width < minWatermarkWidth {
+		return data, nil
+	}
+
+	markWidth := max(1, int(float64(size.Width)*wm.Scale))
+	mark, err := bimg.NewImage(overlay).Process(bimg.Options{Width: markWidth, Enlarge: true, Type: bimg.PNG})
+	if err != nil {
+		return nil, fmt.Errorf("watermark overlay: %w", err)
+	}
+	markSize, err := bimg.NewImage(mark).Size()
+	if err != nil {
+		return nil, fmt.Errorf("watermark overlay: %w", err)
+	}
+	if markSize.Height > size.Height {
+		return data, nil
+	}
+
+	left, top := watermarkOffset(wm.Position, size.Width, size.Height, markSize.Width, markSize.Height)
+	if IsAnimated(data) {
+		return watermarkAnimated(data, mark, left, top, wm.Opacity, quality)
+	}
+	opts := bimg.Options{
+		Quality:       quality,
+		StripMetadata: true,
+		NoAutoRotate:  true,
+		WatermarkImage: bimg.WatermarkImage{
+			Left:    left,
+			Top:     top,
+			Buf:     mark,
+			Opacity: float32(wm.Opacity),
+		},
+	}
+	if err := encodeOptions(&opts, format); err != nil {
+		return nil, err
+	}
+	return bimg.NewImage(data).Process(opts)
+}
@@ -0,0 +1,193 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	goimage "image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"dajtu/internal/testutil"
+)
+
+func samplePNGMark(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := goimage.NewNRGBA(goimage.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWatermark_Normalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		wm      Watermark
+		wantErr bool
+		check   func(Watermark) bool
+	}{
+		{"defaults", Watermark{Text: " dajtu "}, false, func(w Watermark) bool {
+			return w.Text == "dajtu" && w.Position == PositionBottomRight && w.Opacity == 0.5 && w.Scale == 0.2
+		}},
+		{"clamps", Watermark{Text: "x", Position: PositionCenter, Opacity: 7, Scale: 0.01}, false, func(w Watermark) bool {
+			return w.Position == PositionCenter && w.Opacity == 1 && w.Scale == 0.05
+		}},
+		{"unknown position", Watermark{Text: "x", Position: "middle"}, false, func(w Watermark) bool {
+			return w.Position == PositionBottomRight
+		}},
+		{"text drops image", Watermark{Text: "x", Image: []byte("png")}, false, func(w Watermark) bool {
+			return w.Image == nil
+		}},
+		{"png", Watermark{Image: samplePNGMark(t, 10, 10)}, false, nil},
+		{"empty", Watermark{Text: "  "}, true, nil},
+		{"text too long", Watermark{Text: strings.Repeat("ż", maxWatermarkText+1)}, true, nil},
+		{"not png", Watermark{Image: []byte("GIF89a")}, true, nil},
+		{"png too large", Watermark{Image: samplePNGMark(t, maxWatermarkImageSide+1, 1)}, true, nil},
+	}
+	for _, tt := range tests {
+		wm := tt.wm
+		err := wm.Normalize()
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidWatermark) {
+				t.Errorf("%s: error = %v, want ErrInvalidWatermark", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if tt.check != nil && !tt.check(wm) {
+			t.Errorf("%s: normalized = %+v", tt.name, wm)
+		}
+	}
+}
+
+func TestWatermarkOffset(t *testing.T) {
+	// 1000x500 image, margin 10, mark 100x50
+	tests := []struct {
+		position  string
+		left, top int
+	}{
+		{PositionTopLeft, 10, 10},
+		{PositionTopRight, 890, 10},
+		{PositionBottomLeft, 10, 440},
+		{PositionBottomRight, 890, 440},
+		{PositionCenter, 450, 225},
+	}
+	for _, tt := range tests {
+		left, top := watermarkOffset(tt.position, 1000, 500, 100, 50)
+		if left != tt.left || top != tt.top {
+			t.Errorf("%s: offset = (%d,%d), want (%d,%d)", tt.position, left, top, tt.left, tt.top)
+		}
+	}
+
+	// a mark wider than the image never goes negative
+	if left, top := watermarkOffset(PositionBottomRight, 100, 100, 200, 20); left != 0 || top != 78 {
+		t.Errorf("oversized mark offset = (%d,%d), want (0,78)", left, top)
+	}
+}
+
+func TestProcessWatermarked(t *testing.T) {
+	src := goimage.NewRGBA(goimage.Rect(0, 0, 900, 600))
+	for i := range src.Pix {
+		src.Pix[i] = 0x40
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, src, nil)
+	data := buf.Bytes()
+
+	plain, err := Process(data)
+	if err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+
+	wm := &Watermark{Image: samplePNGMark(t, 40, 20), Position: PositionCenter, Opacity: 1, Scale: 0.2}
+	results, err := ProcessWatermarked(data, wm)
+	if err != nil {
+		t.Fatalf("ProcessWatermarked() error = %v", err)
+	}
+	if len(results) != len(plain)+1 {
+		t.Fatalf("got %d variants, want %d plus clean", len(results), len(plain))
+	}
+
+	byName := map[string]ProcessResult{}
+	for _, res := range results {
+		byName[res.Name] = res
+	}
+	clean, ok := byName[CleanVariant]
+	if !ok {
+		t.Fatal("missing clean variant")
+	}
+	if clean.Width != 900 || clean.Height != 600 {
+		t.Errorf("clean = %dx%d, want 900x600", clean.Width, clean.Height)
+	}
+
+	// a white mark in the centre of a dark image
+	marked, _, err := goimage.Decode(bytes.NewReader(mustConvertJPEG(t, byName["original"].Data)))
+	if err != nil {
+		t.Fatalf("decode marked original: %v", err)
+	}
+	if r, _, _, _ := marked.At(450, 300).RGBA(); r>>8 < 0xc0 {
+		t.Errorf("centre pixel red = %d, watermark missing", r>>8)
+	}
+	if r, _, _, _ := marked.At(20, 20).RGBA(); r>>8 > 0x60 {
+		t.Errorf("corner pixel red = %d, image changed outside the mark", r>>8)
+	}
+
+	// the thumb is too small for a legible mark and stays clean
+	if !bytes.Equal(byName["thumb"].Data, plainVariant(plain, "thumb")) {
+		t.Error("thumb was watermarked")
+	}
+}
+
+func TestProcessWatermarked_Animated(t *testing.T) {
+	data := testutil.AnimatedGIF(400, 300, 3)
+	if _, err := Process(data); err != nil {
+		t.Skipf("image processing unavailable: %v", err)
+	}
+
+	wm := &Watermark{Image: samplePNGMark(t, 40, 20), Position: PositionCenter, Opacity: 1, Scale: 0.2}
+	results, err := ProcessWatermarked(data, wm)
+	if err != nil {
+		t.Fatalf("ProcessWatermarked() error = %v", err)
+	}
+
+	byName := map[string]ProcessResult{}
+	for _, res := range results {
+		byName[res.Name] = res
+	}
+	marked, clean := byName["original"], byName[CleanVariant]
+	for _, res := range []ProcessResult{marked, clean} {
+		if res.Frames != 3 || !IsAnimated(res.Data) {
+			t.Errorf("%q frames = %d, animated = %v, want 3 animated", res.Name, res.Frames, IsAnimated(res.Data))
+		}
+	}
+	if bytes.Equal(marked.Data, clean.Data) {
+		t.Error("animated original was not watermarked")
+	}
+}
+
+func mustConvertJPEG(t *testing.T, webp []byte) []byte {
+	t.Helper()
+	out, err := Convert(webp, 95, FormatJPEG)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	return out
+}
+
+func plainVariant(results []ProcessResult, name string) []byte {
+	for _, res := range results {
+		if res.Name == name {
+			return res.Data
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix marks files WriteFileAtomic has not renamed into place yet.
+const tempPrefix = ".tmp-"
+
+// WriteFileAtomic writes data to path so that readers and crashes see either
+// the previous file or the complete new one: it writes a temporary file in
+// the same directory, fsyncs it, renames it over path and fsyncs the
+// directory. Directories it creates are made durable the same way.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := mkdirAllDurable(dir); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, tempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	if err = os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory, persisting the entries created, renamed or
+// removed in it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("sync dir %s: %w", dir, err)
+	}
+	return nil
+}
+
+// mkdirAllDurable is os.MkdirAll that also fsyncs the parent of every
+// directory it creates.
+func mkdirAllDurable(dir string) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirAllDurable(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// IsTempFile reports whether name is a file WriteFileAtomic is still
+// writing (or was, before a crash).
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), tempPrefix)
+}
+
+// RemoveTempFiles deletes the temporary files of writes interrupted by a
+// crash anywhere under dir and returns how many there were. Run it only
+// while nothing writes to dir, i.e. at startup.
+func RemoveTempFiles(dir string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !IsTempFile(p) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
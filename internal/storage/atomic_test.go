@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ab", "abcd", "original.webp")
+
+	if err := WriteFileAtomic(path, []byte("first"), 0644); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	if err := WriteFileAtomic(path, []byte("second"), 0644); err != nil {
+		t.Fatalf("WriteFileAtomic() over an existing file error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second" {
+		t.Errorf("content = %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("dir holds %d entries, want only the file", len(entries))
+	}
+}
+
+func TestWriteFileAtomic_Failure(t *testing.T) {
+	dir := t.TempDir()
+	// the target is a directory, so the rename fails after the write
+	target := filepath.Join(dir, "busy")
+	os.MkdirAll(filepath.Join(target, "child"), 0755)
+
+	if err := WriteFileAtomic(target, []byte("x"), 0644); err == nil {
+		t.Fatal("WriteFileAtomic() over a directory succeeded")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temp file left after a failed write: %v", entries)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewLocalStore(dir)
+	store.Put("ab/abcd/original.webp", []byte("ok"))
+	// what a crash between write and rename leaves behind
+	os.WriteFile(filepath.Join(dir, "ab", "abcd", tempPrefix+"thumb.webp-123"), []byte("trunc"), 0600)
+
+	if list, _ := store.List(""); len(list) != 1 {
+		t.Errorf("List() = %+v, want temp files hidden", list)
+	}
+	n, err := store.RemoveTempFiles()
+	if err != nil || n != 1 {
+		t.Errorf("RemoveTempFiles() = %d, %v, want 1", n, err)
+	}
+	if _, err := store.Stat("ab/abcd/original.webp"); err != nil {
+		t.Errorf("complete file removed: %v", err)
+	}
+	if n, _ := RemoveTempFiles(filepath.Join(dir, "missing")); n != 0 {
+		t.Errorf("RemoveTempFiles(missing dir) = %d", n)
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"time"
+)
+
+// BlobStore keeps image files under slash-separated keys such as
+// "ab/ab1c2/original.webp". Filesystem lays images out on top of it, so the
+// same tree can live on local disk (LocalStore) or in an S3-compatible
+// bucket (S3Store). Methods on a missing key return an error matching
+// fs.ErrNotExist, except Delete, for which a missing key is not an error.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix, sorted by key.
+	List(prefix string) ([]BlobInfo, error)
+	// Open returns a seekable reader, so http.ServeContent can answer
+	// Range requests without reading the whole blob.
+	Open(key string) (Blob, error)
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ETag identifies the content without reading it, unquoted: the hash of
+	// a content-addressed blob or the ETag an S3 store answers HEAD with.
+	// Empty when the store has none.
+	ETag string
+}
+
+// Blob is an open blob.
+type Blob interface {
+	io.ReadSeekCloser
+	Info() BlobInfo
+}
+
+// Presigner is implemented by stores whose blobs can be fetched by the
+// client directly, with a time-limited URL.
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
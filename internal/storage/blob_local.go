@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LocalStore is a BlobStore on local disk: key "ab/ab1c2/original.webp" is
+// the file <dir>/ab/ab1c2/original.webp. Put is atomic and durable (see
+// WriteFileAtomic).
+type LocalStore struct {
+	dir string
+	// dirs keeps Delete from pruning a directory that a concurrent Put has
+	// just created: Puts share it, pruning takes it exclusively.
+	dirs sync.RWMutex
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create blob dir: %w", err)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// validKey rejects keys that would escape the store directory.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *LocalStore) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	s.dirs.RLock()
+	defer s.dirs.RUnlock()
+	return WriteFileAtomic(s.path(key), data, 0644)
+}
+
+func (s *LocalStore) Get(key string) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.path(key))
+}
+
+func (s *LocalStore) Stat(key string) (BlobInfo, error) {
+	if err := validKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if info.IsDir() {
+		return BlobInfo{}, notExist("stat", key)
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file and the directories it leaves empty.
+func (s *LocalStore) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	p := s.path(key)
+	if err := os.Remove(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	s.dirs.Lock()
+	defer s.dirs.Unlock()
+	for dir := filepath.Dir(p); dir != s.dir && strings.HasPrefix(dir, s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) List(prefix string) ([]BlobInfo, error) {
+	// walk only the deepest directory the prefix names
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if err := validKey(prefix[:i]); err != nil {
+			return nil, err
+		}
+		root = s.path(prefix[:i])
+	}
+
+	var blobs []BlobInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || IsTempFile(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+// RemoveTempFiles deletes what writes interrupted by a crash left behind.
+func (s *LocalStore) RemoveTempFiles() (int, error) {
+	return RemoveTempFiles(s.dir)
+}
+
+type localBlob struct {
+	*os.File
+	info BlobInfo
+}
+
+func (b *localBlob) Info() BlobInfo { return b.info }
+
+func (s *LocalStore) Open(key string) (Blob, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, notExist("open", key)
+	}
+	return &localBlob{File: f, info: BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}}, nil
+}
@@ -0,0 +1,448 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body, sent with every
+// request that has none.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// defaultS3Timeout is S3Config.Timeout when it is unset.
+const defaultS3Timeout = 30 * time.Second
+
+// S3Config points S3Store at a bucket of AWS S3 or a compatible server
+// (MinIO, Ceph RGW, Garage, R2...).
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // key prefix inside the bucket, e.g. "images/"
+	// PathStyle puts the bucket in the path (http://minio:9000/bucket/key)
+	// instead of the host name; most self-hosted servers need it.
+	PathStyle bool
+	// Timeout bounds a request including its body (default 30s). Reads of
+	// an open blob stream for as long as the client reads; for them it
+	// bounds the wait for the response headers and for each read.
+	Timeout time.Duration
+}
+
+// S3Store is a BlobStore in an S3-compatible bucket. It speaks the REST API
+// directly with Signature Version 4, so it needs no SDK.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client // whole-request timeout
+	stream   *http.Client // no overall timeout, for Open
+	now      func() time.Time
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3: endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultS3Timeout
+	}
+	// dial and TLS handshake are bounded by the default transport already
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.Timeout
+	return &S3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		stream:   &http.Client{Transport: transport},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the host and the encoded path of key; an empty key
+// addresses the bucket itself.
+func (s *S3Store) objectURL(key string) (host, uri string) {
+	host = s.endpoint.Host
+	uri = s.endpoint.Path + "/"
+	if s.cfg.PathStyle {
+		uri += s.cfg.Bucket
+		if key != "" {
+			uri += "/"
+		}
+	} else {
+		host = s.cfg.Bucket + "." + host
+	}
+	if key != "" {
+		uri += uriEncode(s.cfg.Prefix+key, true)
+	}
+	return host, uri
+}
+
+// uriEncode percent-encodes everything except the unreserved characters,
+// as SigV4 canonical requests require.
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name.
+func canonicalQuery(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = uriEncode(name, false) + "=" + uriEncode(params[name], false)
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request made at time t.
+func (s *S3Store) signature(t time.Time, canonicalRequest string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format("20060102"))
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// newRequest builds a signed request; headers (lowercase names) are signed
+// along with host and the x-amz-* ones.
+func (s *S3Store) newRequest(method, key string, query map[string]string, headers map[string]string, body []byte) (*http.Request, error) {
+	host, uri := s.objectURL(key)
+	rawQuery := canonicalQuery(query)
+	target := s.endpoint.Scheme + "://" + host + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	t := s.now().UTC()
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+	signed := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           t.Format("20060102T150405Z"),
+	}
+	for name, value := range headers {
+		signed[name] = value
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(signed[name]) + "\n")
+		if name != "host" {
+			req.Header.Set(name, signed[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, uri, rawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, s.scope(t), signedHeaders, s.signature(t, canonicalRequest)))
+	return req, nil
+}
+
+// do sends a request with client and turns error statuses into errors;
+// 404 becomes fs.ErrNotExist.
+func (s *S3Store) do(client *http.Client, req *http.Request, key string) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", req.Method, key, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(req.Method), key)
+	}
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(body, &s3err) == nil && s3err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, key, s3err.Code, s3err.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", req.Method, key, resp.Status)
+}
+
+func (s *S3Store) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		headers["content-type"] = ct
+	}
+	req, err := s.newRequest(http.MethodPut, key, nil, headers, data)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(s.client, req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(key string) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(s.client, req, key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3Store) Stat(key string) (BlobInfo, error) {
+	if err := validKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	req, err := s.newRequest(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.do(s.client, req, key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+	info := BlobInfo{Key: key, Size: resp.ContentLength, ETag: strings.Trim(resp.Header.Get("ETag"), `"`)}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(s.client, req, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// List pages through ListObjectsV2; keys come back sorted already.
+func (s *S3Store) List(prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	query := map[string]string{"list-type": "2", "prefix": s.cfg.Prefix + prefix}
+	for {
+		req, err := s.newRequest(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(s.client, req, prefix)
+		if err != nil {
+			return nil, err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			blobs = append(blobs, BlobInfo{Key: strings.TrimPrefix(obj.Key, s.cfg.Prefix), Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		query["continuation-token"] = page.NextContinuationToken
+	}
+}
+
+func (s *S3Store) Open(key string) (Blob, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Blob{store: s, info: info}, nil
+}
+
+// PresignGet returns a query-signed GET URL valid for ttl (at most 7 days,
+// the SigV4 limit).
+func (s *S3Store) PresignGet(key string, ttl time.Duration) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	ttl = min(max(ttl, time.Second), 7*24*time.Hour)
+	host, uri := s.objectURL(key)
+	t := s.now().UTC()
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.cfg.AccessKey + "/" + s.scope(t),
+		"X-Amz-Date":          t.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(ttl / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	rawQuery := canonicalQuery(query)
+	canonicalRequest := strings.Join([]string{http.MethodGet, uri, rawQuery, "host:" + host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	return s.endpoint.Scheme + "://" + host + uri + "?" + rawQuery + "&X-Amz-Signature=" + s.signature(t, canonicalRequest), nil
+}
+
+// s3Blob reads an object lazily with ranged GETs: a Seek only moves the
+// offset, the next Read starts a new request from there.
+type s3Blob struct {
+	store  *S3Store
+	info   BlobInfo
+	offset int64
+	body   io.ReadCloser
+	cancel context.CancelFunc // aborts the request behind body
+}
+
+func (b *s3Blob) Info() BlobInfo { return b.info }
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.offset >= b.info.Size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		req, err := b.store.newRequest(http.MethodGet, b.info.Key, nil, map[string]string{"range": fmt.Sprintf("bytes=%d-", b.offset)}, nil)
+		if err != nil {
+			return 0, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		resp, err := b.store.do(b.store.stream, req.WithContext(ctx), b.info.Key)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && b.offset > 0 {
+			resp.Body.Close()
+			cancel()
+			return 0, fmt.Errorf("s3 get %s: range not honoured (%s)", b.info.Key, resp.Status)
+		}
+		b.body, b.cancel = resp.Body, cancel
+	}
+	// a read that stalls for the whole timeout aborts the request
+	stall := time.AfterFunc(b.store.cfg.Timeout, b.cancel)
+	n, err := b.body.Read(p)
+	stall.Stop()
+	b.offset += int64(n)
+	if err == io.EOF && b.offset < b.info.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative seek offset")
+	}
+	if offset != b.offset {
+		b.Close()
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.cancel()
+	b.body, b.cancel = nil, nil
+	return err
+}
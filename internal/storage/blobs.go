@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// BlobRef links a file of an image (e.g. "original.webp" of slug abc12) to
+// the content-addressed blob holding its bytes. UpdatedAt is in nanoseconds:
+// pointing a file at an older blob must still invalidate renders cached a
+// moment before.
+type BlobRef struct {
+	Slug      string
+	Name      string
+	Hash      string
+	Ext       string
+	Size      int64
+	UpdatedAt int64
+}
+
+const blobRefColumns = `r.slug, r.name, r.hash, b.ext, b.size, r.updated_at`
+
+func scanBlobRefs(rows *sql.Rows, err error) ([]*BlobRef, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []*BlobRef
+	for rows.Next() {
+		ref := &BlobRef{}
+		if err := rows.Scan(&ref.Slug, &ref.Name, &ref.Hash, &ref.Ext, &ref.Size, &ref.UpdatedAt); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// GetBlobRef returns nil when the file is not stored content-addressed.
+func (db *DB) GetBlobRef(slug, name string) (*BlobRef, error) {
+	refs, err := scanBlobRefs(db.conn.Query(`
+		SELECT `+blobRefColumns+` FROM blob_refs r JOIN blobs b ON b.hash = r.hash
+		WHERE r.slug = ? AND r.name = ?`, slug, name))
+	if err != nil || len(refs) == 0 {
+		return nil, err
+	}
+	return refs[0], nil
+}
+
+// GetBlobRefs returns the files of an image, sorted by name.
+func (db *DB) GetBlobRefs(slug string) ([]*BlobRef, error) {
+	return scanBlobRefs(db.conn.Query(`
+		SELECT `+blobRefColumns+` FROM blob_refs r JOIN blobs b ON b.hash = r.hash
+		WHERE r.slug = ? ORDER BY r.name`, slug))
+}
+
+// BlobKnown reports whether the blob has a row, even an unreferenced one
+// still waiting for collection; its file exists then.
+func (db *DB) BlobKnown(hash string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM blobs WHERE hash = ?`, hash).Scan(&n)
+	return n > 0, err
+}
+
+// RefBlob points slug/name at the blob hash, creating it with refcount 1
+// or taking one more reference. It returns the blob the file referenced
+// before, whose refcount went down, or "" when there was none or it is
+// the same one.
+func (db *DB) RefBlob(slug, name, hash, ext string, size int64) (string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow(`SELECT hash FROM blob_refs WHERE slug = ? AND name = ?`, slug, name).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if previous == hash {
+		return "", nil
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(`
+		INSERT INTO blobs (hash, ext, size, refcount, created_at) VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1`,
+		hash, ext, size, now.Unix()); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO blob_refs (slug, name, hash, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(slug, name) DO UPDATE SET hash = excluded.hash, updated_at = excluded.updated_at`,
+		slug, name, hash, now.UnixNano()); err != nil {
+		return "", err
+	}
+	if previous != "" {
+		if _, err := tx.Exec(`UPDATE blobs SET refcount = refcount - 1 WHERE hash = ?`, previous); err != nil {
+			return "", err
+		}
+	}
+	return previous, tx.Commit()
+}
+
+// UnrefBlob removes the file slug/name and returns the blob it referenced
+// ("" when there was none).
+func (db *DB) UnrefBlob(slug, name string) (string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRow(`SELECT hash FROM blob_refs WHERE slug = ? AND name = ?`, slug, name).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM blob_refs WHERE slug = ? AND name = ?`, slug, name); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE blobs SET refcount = refcount - 1 WHERE hash = ?`, hash); err != nil {
+		return "", err
+	}
+	return hash, tx.Commit()
+}
+
+// unrefSlugBlobs drops every file reference of slug inside tx.
+func unrefSlugBlobs(tx *sql.Tx, slug string) error {
+	if _, err := tx.Exec(`
+		UPDATE blobs SET refcount = refcount - (SELECT COUNT(*) FROM blob_refs r WHERE r.hash = blobs.hash AND r.slug = ?)
+		WHERE hash IN (SELECT hash FROM blob_refs WHERE slug = ?)`, slug, slug); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM blob_refs WHERE slug = ?`, slug)
+	return err
+}
+
+// DeleteUnusedBlob removes the row of a blob nobody references any more
+// and returns its extension; deleted is false when it is still in use.
+func (db *DB) DeleteUnusedBlob(hash string) (ext string, deleted bool, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var refcount int
+	err = tx.QueryRow(`SELECT ext, refcount FROM blobs WHERE hash = ?`, hash).Scan(&ext, &refcount)
+	if err == sql.ErrNoRows || (err == nil && refcount > 0) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+		return "", false, err
+	}
+	return ext, true, tx.Commit()
+}
+
+// GetUnusedBlobs returns blobs whose refcount dropped to zero without the
+// file being removed, e.g. after DeleteImageBySlug.
+func (db *DB) GetUnusedBlobs(limit int) ([]string, error) {
+	rows, err := db.conn.Query(`SELECT hash FROM blobs WHERE refcount <= 0 LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// GetOrphanBlobSlugs returns slugs that reference blobs but have no image
+// row: files of an upload interrupted before its row was inserted.
+func (db *DB) GetOrphanBlobSlugs() ([]string, error) {
+	rows, err := db.conn.Query(`
+		SELECT DISTINCT slug FROM blob_refs WHERE slug NOT IN (SELECT slug FROM images) ORDER BY slug`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
@@ -0,0 +1,92 @@
+package storage
+
+import "testing"
+
+func blobRefcount(t *testing.T, db *DB, hash string) int {
+	t.Helper()
+	var n int
+	if err := db.conn.QueryRow(`SELECT refcount FROM blobs WHERE hash = ?`, hash).Scan(&n); err != nil {
+		t.Fatalf("refcount of %s: %v", hash, err)
+	}
+	return n
+}
+
+func TestDB_RefBlob(t *testing.T) {
+	db := testDB(t)
+
+	if prev, err := db.RefBlob("abc12", "original.webp", "h1", ".webp", 10); err != nil || prev != "" {
+		t.Fatalf("RefBlob() = %q, %v", prev, err)
+	}
+	db.RefBlob("def34", "original.webp", "h1", ".webp", 10)
+	if n := blobRefcount(t, db, "h1"); n != 2 {
+		t.Errorf("refcount = %d, want 2", n)
+	}
+
+	// the same content again takes no extra reference
+	if prev, _ := db.RefBlob("abc12", "original.webp", "h1", ".webp", 10); prev != "" || blobRefcount(t, db, "h1") != 2 {
+		t.Errorf("re-ref returned %q, refcount %d", prev, blobRefcount(t, db, "h1"))
+	}
+
+	prev, err := db.RefBlob("abc12", "original.webp", "h2", ".webp", 20)
+	if err != nil || prev != "h1" {
+		t.Fatalf("replace = %q, %v, want h1", prev, err)
+	}
+	if blobRefcount(t, db, "h1") != 1 || blobRefcount(t, db, "h2") != 1 {
+		t.Errorf("refcounts = %d, %d", blobRefcount(t, db, "h1"), blobRefcount(t, db, "h2"))
+	}
+
+	ref, err := db.GetBlobRef("abc12", "original.webp")
+	if err != nil || ref == nil || ref.Hash != "h2" || ref.Size != 20 || ref.Ext != ".webp" {
+		t.Errorf("GetBlobRef() = %+v, %v", ref, err)
+	}
+	if ref, _ := db.GetBlobRef("abc12", "thumb.webp"); ref != nil {
+		t.Errorf("GetBlobRef(missing) = %+v", ref)
+	}
+}
+
+func TestDB_UnrefBlob(t *testing.T) {
+	db := testDB(t)
+	db.RefBlob("abc12", "original.webp", "h1", ".webp", 10)
+	db.RefBlob("abc12", "thumb.webp", "h1", ".webp", 10)
+
+	if hash, err := db.UnrefBlob("abc12", "thumb.webp"); err != nil || hash != "h1" {
+		t.Fatalf("UnrefBlob() = %q, %v", hash, err)
+	}
+	if hash, _ := db.UnrefBlob("abc12", "thumb.webp"); hash != "" {
+		t.Errorf("UnrefBlob() twice = %q", hash)
+	}
+	if _, deleted, _ := db.DeleteUnusedBlob("h1"); deleted {
+		t.Error("DeleteUnusedBlob() removed a referenced blob")
+	}
+
+	db.UnrefBlob("abc12", "original.webp")
+	ext, deleted, err := db.DeleteUnusedBlob("h1")
+	if err != nil || !deleted || ext != ".webp" {
+		t.Errorf("DeleteUnusedBlob() = %q, %v, %v", ext, deleted, err)
+	}
+	if known, _ := db.BlobKnown("h1"); known {
+		t.Error("blob row left after DeleteUnusedBlob()")
+	}
+}
+
+func TestDB_DeleteImageBySlug_Blobs(t *testing.T) {
+	db := testDB(t)
+	db.InsertImage(&Image{Slug: "abc12", OriginalName: "a.jpg", MimeType: "image/webp", FileSize: 1, Width: 1, Height: 1})
+	db.RefBlob("abc12", "original.webp", "h1", ".webp", 10)
+	db.RefBlob("abc12", "thumb.webp", "h1", ".webp", 10)
+	db.RefBlob("def34", "original.webp", "h1", ".webp", 10)
+	db.RefBlob("abc12", "orig_a.jpg", "h2", ".jpg", 30)
+
+	if err := db.DeleteImageBySlug("abc12"); err != nil {
+		t.Fatalf("DeleteImageBySlug() error = %v", err)
+	}
+	if refs, _ := db.GetBlobRefs("abc12"); len(refs) != 0 {
+		t.Errorf("refs left: %d", len(refs))
+	}
+	if blobRefcount(t, db, "h1") != 1 || blobRefcount(t, db, "h2") != 0 {
+		t.Errorf("refcounts = %d, %d, want 1, 0", blobRefcount(t, db, "h1"), blobRefcount(t, db, "h2"))
+	}
+	if unused, _ := db.GetUnusedBlobs(10); len(unused) != 1 || unused[0] != "h2" {
+		t.Errorf("GetUnusedBlobs() = %q", unused)
+	}
+}
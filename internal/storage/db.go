@@ -44,6 +44,36 @@ type Image struct {
 	GalleryID    *int64
 	Edited       bool
 	EditToken    string `json:"edit_token,omitempty"`
+	Frames       int
+	// LQIP is a tiny data-URI preview, DominantColor a #rrggbb hex.
+	// Both are empty until computed.
+	LQIP          string
+	DominantColor string
+	// PHash is a perceptual hash and PixelSHA a SHA-256 of the decoded
+	// pixels; PixelSHA is empty until computed.
+	PHash    uint64
+	PixelSHA string
+	// WatermarkKey is the Watermark.Key burned into the public variants,
+	// empty when they are clean.
+	WatermarkKey string
+	// Status is ImageStatusReady once the variants exist. Large uploads
+	// start as ImageStatusPending and are processed in the background;
+	// ProcessingError holds the reason of ImageStatusFailed. Uploads
+	// processed right away are ImageStatusWriting while their variants are
+	// being stored.
+	Status          string
+	ProcessingError string
+	// Focal is where cover crops (thumbs) are centred, nil when the owner
+	// has not set it.
+	Focal *FocalPoint
+	// IntegrityError is what the storage scrubber found wrong with the
+	// stored files and could not repair, empty when they are fine.
+	IntegrityError string
+}
+
+// IsAnimated reports whether the stored variants are animated WebP.
+func (img *Image) IsAnimated() bool {
+	return img.Frames > 1
 }
 
 type Gallery struct {
@@ -123,6 +153,49 @@ func (db *DB) migrate() error {
 		FOREIGN KEY (gallery_id) REFERENCES galleries(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS image_metadata (
+		image_id INTEGER PRIMARY KEY,
+		camera_make TEXT,
+		camera_model TEXT,
+		lens_model TEXT,
+		taken_at TEXT,
+		exposure_time TEXT,
+		f_number REAL,
+		iso INTEGER,
+		focal_length REAL,
+		gps_lat REAL,
+		gps_lon REAL,
+		FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS image_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		image_id INTEGER NOT NULL,
+		params TEXT NOT NULL DEFAULT '{}',
+		from_source INTEGER NOT NULL DEFAULT 0,
+		reverted_from INTEGER,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		file_size INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS watermarks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER UNIQUE,
+		gallery_id INTEGER UNIQUE,
+		text TEXT NOT NULL DEFAULT '',
+		image BLOB,
+		position TEXT NOT NULL,
+		opacity REAL NOT NULL,
+		scale REAL NOT NULL,
+		key TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (gallery_id) REFERENCES galleries(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS sessions (
 		token CHAR(64) PRIMARY KEY,
 		user_id INTEGER NOT NULL,
@@ -131,6 +204,23 @@ func (db *DB) migrate() error {
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash CHAR(64) PRIMARY KEY,
+		ext TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS blob_refs (
+		slug TEXT NOT NULL,
+		name TEXT NOT NULL,
+		hash CHAR(64) NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (slug, name),
+		FOREIGN KEY (hash) REFERENCES blobs(hash)
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_users_slug ON users(slug);
 	CREATE INDEX IF NOT EXISTS idx_images_created ON images(created_at);
 	CREATE INDEX IF NOT EXISTS idx_images_gallery ON images(gallery_id);
@@ -139,8 +229,11 @@ func (db *DB) migrate() error {
 	CREATE INDEX IF NOT EXISTS idx_galleries_slug ON galleries(slug);
 	CREATE INDEX IF NOT EXISTS idx_galleries_user ON galleries(user_id);
 	CREATE INDEX IF NOT EXISTS idx_galleries_edit ON galleries(edit_token);
+	CREATE INDEX IF NOT EXISTS idx_image_revisions_image ON image_revisions(image_id);
 	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
 	CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_blob_refs_hash ON blob_refs(hash);
+	CREATE INDEX IF NOT EXISTS idx_blobs_refcount ON blobs(refcount);
 	`
 	if _, err := db.conn.Exec(schema); err != nil {
 		return err
@@ -205,14 +298,139 @@ func (db *DB) migrate() error {
 		return fmt.Errorf("migrate images.updated_at: %w", err)
 	}
 
+	// Migration: add frames column to images if missing
+	_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN frames INTEGER NOT NULL DEFAULT 1`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("migrate images.frames: %w", err)
+	}
+
+	// Migration: add placeholder columns to images if missing (NULL = not computed yet)
+	for _, col := range []string{"lqip", "dominant_color"} {
+		_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN ` + col + ` TEXT`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migrate images.%s: %w", col, err)
+		}
+	}
+
+	// Migration: add content hashes to images if missing
+	for _, col := range []string{"phash INTEGER", "pixel_sha TEXT"} {
+		_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN ` + col)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migrate images.%s: %w", col, err)
+		}
+	}
+	if _, err := db.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_images_pixel_sha ON images(pixel_sha)`); err != nil {
+		return fmt.Errorf("create pixel_sha index: %w", err)
+	}
+	for band := 0; band < phashBands; band++ {
+		if _, err := db.conn.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_images_phash_b%d ON images(%s)`, band, phashBandExpr(band))); err != nil {
+			return fmt.Errorf("create phash band index: %w", err)
+		}
+	}
+
+	// Migration: add watermark_key column to images if missing
+	_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN watermark_key TEXT NOT NULL DEFAULT ''`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("migrate images.watermark_key: %w", err)
+	}
+
+	// Migration: add background processing state to images if missing
+	for _, col := range []string{"status TEXT NOT NULL DEFAULT 'ready'", "processing_error TEXT"} {
+		_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN ` + col)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migrate images.%s: %w", col, err)
+		}
+	}
+
+	// Migration: add focal point columns to images if missing (NULL = not set)
+	for _, col := range []string{"focal_x", "focal_y"} {
+		_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN ` + col + ` REAL`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migrate images.%s: %w", col, err)
+		}
+	}
+
+	// Migration: add integrity_error column to images if missing
+	_, err = db.conn.Exec(`ALTER TABLE images ADD COLUMN integrity_error TEXT`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("migrate images.integrity_error: %w", err)
+	}
+
+	// Migration: add trash columns to images and galleries if missing (NULL = not deleted)
+	for _, table := range []string{"images", "galleries"} {
+		for _, col := range []string{"deleted_at INTEGER", "deleted_by TEXT"} {
+			_, err = db.conn.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + col)
+			if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+				return fmt.Errorf("migrate %s.%s: %w", table, col, err)
+			}
+		}
+		if _, err := db.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_deleted ON ` + table + `(deleted_at)`); err != nil {
+			return fmt.Errorf("create %s trash index: %w", table, err)
+		}
+	}
+
 	return nil
 }
 
+// imageColumns is the column list scanned by scanImage.
+const imageColumns = `id, slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token, frames, lqip, dominant_color, phash, pixel_sha, watermark_key, status, processing_error, focal_x, focal_y, integrity_error`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImage(row rowScanner) (*Image, error) {
+	img := &Image{}
+	var editToken, lqip, dominantColor, pixelSHA, processingError, integrityError sql.NullString
+	var phash sql.NullInt64
+	var focalX, focalY sql.NullFloat64
+	err := row.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.MimeType, &img.FileSize, &img.Width, &img.Height,
+		&img.UserID, &img.CreatedAt, &img.UpdatedAt, &img.AccessedAt, &img.Downloads, &img.GalleryID, &img.Edited, &editToken, &img.Frames,
+		&lqip, &dominantColor, &phash, &pixelSHA, &img.WatermarkKey, &img.Status, &processingError, &focalX, &focalY, &integrityError)
+	if err != nil {
+		return nil, err
+	}
+	img.EditToken = editToken.String
+	img.LQIP = lqip.String
+	img.DominantColor = dominantColor.String
+	img.PHash = uint64(phash.Int64)
+	img.PixelSHA = pixelSHA.String
+	img.ProcessingError = processingError.String
+	img.IntegrityError = integrityError.String
+	if focalX.Valid && focalY.Valid {
+		img.Focal = &FocalPoint{X: focalX.Float64, Y: focalY.Float64}
+	}
+	return img, nil
+}
+
+func scanImages(rows *sql.Rows) ([]*Image, error) {
+	defer rows.Close()
+
+	var images []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
 func (db *DB) InsertImage(img *Image) (int64, error) {
+	frames := img.Frames
+	if frames < 1 {
+		frames = 1
+	}
+	status := img.Status
+	if status == "" {
+		status = ImageStatusReady
+	}
 	res, err := db.conn.Exec(`
-		INSERT INTO images (slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		img.Slug, img.OriginalName, img.MimeType, img.FileSize, img.Width, img.Height, img.UserID, img.CreatedAt, img.UpdatedAt, img.AccessedAt, img.Downloads, img.GalleryID, img.Edited, img.EditToken)
+		INSERT INTO images (slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token, frames, lqip, dominant_color, phash, pixel_sha, watermark_key, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		img.Slug, img.OriginalName, img.MimeType, img.FileSize, img.Width, img.Height, img.UserID, img.CreatedAt, img.UpdatedAt, img.AccessedAt, img.Downloads, img.GalleryID, img.Edited, img.EditToken, frames,
+		nullString(img.LQIP), nullString(img.DominantColor), nullHash(img.PHash, img.PixelSHA), nullString(img.PixelSHA), img.WatermarkKey, status)
 	if err != nil {
 		return 0, err
 	}
@@ -220,12 +438,7 @@ func (db *DB) InsertImage(img *Image) (int64, error) {
 }
 
 func (db *DB) GetImageBySlug(slug string) (*Image, error) {
-	img := &Image{}
-	err := db.conn.QueryRow(`
-		SELECT id, slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token
-		FROM images WHERE slug = ?`, slug).Scan(
-		&img.ID, &img.Slug, &img.OriginalName, &img.MimeType, &img.FileSize, &img.Width, &img.Height,
-		&img.UserID, &img.CreatedAt, &img.UpdatedAt, &img.AccessedAt, &img.Downloads, &img.GalleryID, &img.Edited, &img.EditToken)
+	img, err := scanImage(db.conn.QueryRow(`SELECT `+imageColumns+` FROM images WHERE slug = ? AND deleted_at IS NULL`, slug))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -257,7 +470,7 @@ func (db *DB) GetGalleryBySlug(slug string) (*Gallery, error) {
 	g := &Gallery{}
 	err := db.conn.QueryRow(`
 		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
-		FROM galleries WHERE slug = ?`, slug).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
+		FROM galleries WHERE slug = ? AND deleted_at IS NULL`, slug).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -268,7 +481,7 @@ func (db *DB) GetGalleryByID(id int64) (*Gallery, error) {
 	g := &Gallery{}
 	err := db.conn.QueryRow(`
 		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
-		FROM galleries WHERE id = ?`, id).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
+		FROM galleries WHERE id = ? AND deleted_at IS NULL`, id).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -279,7 +492,7 @@ func (db *DB) GetGalleryByExternalID(externalID string) (*Gallery, error) {
 	g := &Gallery{}
 	err := db.conn.QueryRow(`
 		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
-		FROM galleries WHERE external_id = ?`, externalID).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
+		FROM galleries WHERE external_id = ? AND deleted_at IS NULL`, externalID).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -292,7 +505,7 @@ func (db *DB) GetOrCreateBratGallery(userID int64, userSlug, entryID, title stri
 	g := &Gallery{}
 	err := db.conn.QueryRow(`
 		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
-		FROM galleries WHERE external_id = ? AND user_id = ?`, externalID, userID).Scan(
+		FROM galleries WHERE external_id = ? AND user_id = ? AND deleted_at IS NULL`, externalID, userID).Scan(
 		&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
 
 	if err == nil {
@@ -336,7 +549,7 @@ func generateSecureToken() string {
 func (db *DB) GetUserGalleries(userID int64) ([]*Gallery, error) {
 	rows, err := db.conn.Query(`
 		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
-		FROM galleries WHERE user_id = ? ORDER BY created_at DESC`, userID)
+		FROM galleries WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at DESC`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -509,86 +722,71 @@ func hashSessionToken(token string) string {
 }
 
 func (db *DB) GetGalleryImages(galleryID int64) ([]*Image, error) {
-	rows, err := db.conn.Query(`
-		SELECT id, slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token
-		FROM images WHERE gallery_id = ? ORDER BY created_at`, galleryID)
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE gallery_id = ? AND deleted_at IS NULL ORDER BY created_at`, galleryID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var images []*Image
-	for rows.Next() {
-		img := &Image{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.MimeType, &img.FileSize, &img.Width, &img.Height,
-			&img.UserID, &img.CreatedAt, &img.UpdatedAt, &img.AccessedAt, &img.Downloads, &img.GalleryID, &img.Edited, &img.EditToken); err != nil {
-			return nil, err
-		}
-		images = append(images, img)
-	}
-	return images, rows.Err()
+	return scanImages(rows)
 }
 
 func (db *DB) GetGalleryImagesPaginated(galleryID int64, limit, offset int) ([]*Image, int, error) {
 	var total int
-	err := db.conn.QueryRow(`SELECT COUNT(*) FROM images WHERE gallery_id = ?`, galleryID).Scan(&total)
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM images WHERE gallery_id = ? AND deleted_at IS NULL`, galleryID).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	rows, err := db.conn.Query(`
-		SELECT id, slug, original_name, mime_type, file_size, width, height, user_id, created_at, updated_at, accessed_at, downloads, gallery_id, edited, edit_token
-		FROM images WHERE gallery_id = ?
+		SELECT `+imageColumns+`
+		FROM images WHERE gallery_id = ? AND deleted_at IS NULL
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
 	`, galleryID, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
-	defer rows.Close()
-
-	var images []*Image
-	for rows.Next() {
-		img := &Image{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.MimeType, &img.FileSize, &img.Width, &img.Height,
-			&img.UserID, &img.CreatedAt, &img.UpdatedAt, &img.AccessedAt, &img.Downloads, &img.GalleryID, &img.Edited, &img.EditToken); err != nil {
-			return nil, 0, err
-		}
-		images = append(images, img)
-	}
 
-	return images, total, rows.Err()
+	images, err := scanImages(rows)
+	return images, total, err
 }
 
+// DeleteImageBySlug also drops the references to the blobs of the image;
+// blobs left unreferenced are removed by Filesystem.CollectBlobs.
 func (db *DB) DeleteImageBySlug(slug string) error {
-	_, err := db.conn.Exec("DELETE FROM images WHERE slug = ?", slug)
-	return err
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := unrefSlugBlobs(tx, slug); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM images WHERE slug = ?", slug); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// GetOldestImages returns the least recently accessed images, the ones in
+// the trash first.
 func (db *DB) GetOldestImages(limit int) ([]*Image, error) {
-	rows, err := db.conn.Query(`
-		SELECT id, slug, original_name, mime_type, file_size, width, height, user_id, created_at, accessed_at, downloads, gallery_id, edited, edit_token
-		FROM images ORDER BY accessed_at ASC LIMIT ?`, limit)
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images ORDER BY deleted_at IS NULL, accessed_at ASC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var images []*Image
-	for rows.Next() {
-		img := &Image{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.MimeType, &img.FileSize, &img.Width, &img.Height,
-			&img.UserID, &img.CreatedAt, &img.AccessedAt, &img.Downloads, &img.GalleryID, &img.Edited, &img.EditToken); err != nil {
-			return nil, err
-		}
-		images = append(images, img)
-	}
-	return images, rows.Err()
+	return scanImages(rows)
 }
 
+// totalSizeQuery counts every stored blob once, however many images share
+// it, plus file_size of images stored before content addressing.
+const totalSizeQuery = `
+	SELECT (SELECT COALESCE(SUM(size), 0) FROM blobs)
+	     + (SELECT COALESCE(SUM(file_size), 0) FROM images WHERE slug NOT IN (SELECT slug FROM blob_refs))`
+
+// GetTotalSize returns the bytes taken by stored images.
 func (db *DB) GetTotalSize() (int64, error) {
 	var total int64
-	err := db.conn.QueryRow("SELECT COALESCE(SUM(file_size), 0) FROM images").Scan(&total)
+	err := db.conn.QueryRow(totalSizeQuery).Scan(&total)
 	return total, err
 }
 
@@ -632,6 +830,11 @@ type ImageAdmin struct {
 	OwnerName    string
 	OwnerSlug    string
 	GallerySlug  string
+	// Status is one of the ImageStatus* values; ProcessingError explains a failure
+	Status          string
+	ProcessingError string
+	// IntegrityError is set when the storage scrubber flagged the files
+	IntegrityError string
 }
 
 type UserAdmin struct {
@@ -650,10 +853,10 @@ func (db *DB) GetUserAdmin(slug string) (*UserAdmin, error) {
 	u := &UserAdmin{}
 	err := db.conn.QueryRow(`
 		SELECT u.id, u.slug, u.display_name, u.created_at, COALESCE(u.updated_at, u.created_at),
-		       (SELECT COUNT(*) FROM galleries WHERE user_id = u.id) as gallery_count,
-		       (SELECT COUNT(*) FROM images WHERE user_id = u.id) as image_count,
-		       (SELECT COALESCE(SUM(file_size), 0) FROM images WHERE user_id = u.id) as total_size,
-		       (SELECT COALESCE(SUM(downloads), 0) FROM images WHERE user_id = u.id) as total_views
+		       (SELECT COUNT(*) FROM galleries WHERE user_id = u.id AND deleted_at IS NULL) as gallery_count,
+		       (SELECT COUNT(*) FROM images WHERE user_id = u.id AND deleted_at IS NULL) as image_count,
+		       (SELECT COALESCE(SUM(file_size), 0) FROM images WHERE user_id = u.id AND deleted_at IS NULL) as total_size,
+		       (SELECT COALESCE(SUM(downloads), 0) FROM images WHERE user_id = u.id AND deleted_at IS NULL) as total_views
 		FROM users u WHERE u.slug = ?`, slug).Scan(
 		&u.ID, &u.Slug, &u.DisplayName, &u.CreatedAt, &u.UpdatedAt,
 		&u.GalleryCount, &u.ImageCount, &u.TotalSize, &u.TotalViews)
@@ -670,9 +873,9 @@ func (db *DB) GetUserGalleriesAdmin(userID int64) ([]*GalleryAdmin, error) {
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug
 		FROM galleries g
-		LEFT JOIN images i ON i.gallery_id = g.id
+		LEFT JOIN images i ON i.gallery_id = g.id AND i.deleted_at IS NULL
 		LEFT JOIN users u ON u.id = g.user_id
-		WHERE g.user_id = ?
+		WHERE g.user_id = ? AND g.deleted_at IS NULL
 		GROUP BY g.id
 		ORDER BY g.created_at DESC
 	`, userID)
@@ -697,11 +900,12 @@ func (db *DB) GetUserImagesAdmin(userID int64, limit, offset int) ([]*ImageAdmin
 		SELECT i.id, i.slug, i.original_name, i.file_size, i.downloads, i.created_at, i.accessed_at, i.edited,
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug,
-		       COALESCE(g.slug, '') as gallery_slug
+		       COALESCE(g.slug, '') as gallery_slug,
+		       i.status, COALESCE(i.processing_error, ''), COALESCE(i.integrity_error, '')
 		FROM images i
 		LEFT JOIN users u ON u.id = i.user_id
 		LEFT JOIN galleries g ON g.id = i.gallery_id
-		WHERE i.user_id = ?
+		WHERE i.user_id = ? AND i.deleted_at IS NULL
 		ORDER BY i.created_at DESC
 		LIMIT ? OFFSET ?
 	`, userID, limit, offset)
@@ -713,7 +917,7 @@ func (db *DB) GetUserImagesAdmin(userID int64, limit, offset int) ([]*ImageAdmin
 	var images []*ImageAdmin
 	for rows.Next() {
 		img := &ImageAdmin{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug); err != nil {
+		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug, &img.Status, &img.ProcessingError, &img.IntegrityError); err != nil {
 			return nil, err
 		}
 		images = append(images, img)
@@ -744,12 +948,12 @@ func (db *DB) GetGalleryAdmin(slug string) (*GalleryDetailAdmin, error) {
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug,
 		       g.created_at, COALESCE(g.updated_at, g.created_at),
-		       (SELECT COUNT(*) FROM images WHERE gallery_id = g.id) as image_count,
-		       (SELECT COALESCE(SUM(file_size), 0) FROM images WHERE gallery_id = g.id) as total_size,
-		       (SELECT COALESCE(SUM(downloads), 0) FROM images WHERE gallery_id = g.id) as total_views
+		       (SELECT COUNT(*) FROM images WHERE gallery_id = g.id AND deleted_at IS NULL) as image_count,
+		       (SELECT COALESCE(SUM(file_size), 0) FROM images WHERE gallery_id = g.id AND deleted_at IS NULL) as total_size,
+		       (SELECT COALESCE(SUM(downloads), 0) FROM images WHERE gallery_id = g.id AND deleted_at IS NULL) as total_views
 		FROM galleries g
 		LEFT JOIN users u ON u.id = g.user_id
-		WHERE g.slug = ?`, slug).Scan(
+		WHERE g.slug = ? AND g.deleted_at IS NULL`, slug).Scan(
 		&g.ID, &g.Slug, &g.Title, &g.Description, &ownerID,
 		&g.OwnerName, &g.OwnerSlug, &g.CreatedAt, &g.UpdatedAt,
 		&g.ImageCount, &g.TotalSize, &g.TotalViews)
@@ -767,11 +971,12 @@ func (db *DB) GetGalleryImagesAdmin(galleryID int64) ([]*ImageAdmin, error) {
 		SELECT i.id, i.slug, i.original_name, i.file_size, i.downloads, i.created_at, i.accessed_at, i.edited,
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug,
-		       COALESCE(g.slug, '') as gallery_slug
+		       COALESCE(g.slug, '') as gallery_slug,
+		       i.status, COALESCE(i.processing_error, ''), COALESCE(i.integrity_error, '')
 		FROM images i
 		LEFT JOIN users u ON u.id = i.user_id
 		LEFT JOIN galleries g ON g.id = i.gallery_id
-		WHERE i.gallery_id = ?
+		WHERE i.gallery_id = ? AND i.deleted_at IS NULL
 		ORDER BY i.created_at DESC
 	`, galleryID)
 	if err != nil {
@@ -782,7 +987,7 @@ func (db *DB) GetGalleryImagesAdmin(galleryID int64) ([]*ImageAdmin, error) {
 	var images []*ImageAdmin
 	for rows.Next() {
 		img := &ImageAdmin{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug); err != nil {
+		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug, &img.Status, &img.ProcessingError, &img.IntegrityError); err != nil {
 			return nil, err
 		}
 		images = append(images, img)
@@ -793,16 +998,16 @@ func (db *DB) GetGalleryImagesAdmin(galleryID int64) ([]*ImageAdmin, error) {
 func (db *DB) GetStats() (*Stats, error) {
 	var stats Stats
 
-	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM images`).Scan(&stats.TotalImages); err != nil {
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM images WHERE deleted_at IS NULL`).Scan(&stats.TotalImages); err != nil {
 		return nil, err
 	}
-	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM galleries`).Scan(&stats.TotalGalleries); err != nil {
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM galleries WHERE deleted_at IS NULL`).Scan(&stats.TotalGalleries); err != nil {
 		return nil, err
 	}
 	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&stats.TotalUsers); err != nil {
 		return nil, err
 	}
-	if err := db.conn.QueryRow(`SELECT COALESCE(SUM(file_size), 0) FROM images`).Scan(&stats.DiskUsageBytes); err != nil {
+	if err := db.conn.QueryRow(totalSizeQuery).Scan(&stats.DiskUsageBytes); err != nil {
 		return nil, err
 	}
 
@@ -920,11 +1125,11 @@ func (db *DB) ListGalleriesAdminSortedFiltered(limit, offset int, sort, dir, que
 		orderDir = "ASC"
 	}
 
-	where := ""
+	where := "WHERE g.deleted_at IS NULL"
 	args := []any{}
 	if query != "" {
 		like := "%" + query + "%"
-		where = "WHERE (COALESCE(g.title, '') LIKE ? OR g.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ?)"
+		where += " AND (COALESCE(g.title, '') LIKE ? OR g.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ?)"
 		args = append(args, like, like, like, like)
 	}
 
@@ -934,7 +1139,7 @@ func (db *DB) ListGalleriesAdminSortedFiltered(limit, offset int, sort, dir, que
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug
 		FROM galleries g
-		LEFT JOIN images i ON i.gallery_id = g.id
+		LEFT JOIN images i ON i.gallery_id = g.id AND i.deleted_at IS NULL
 		LEFT JOIN users u ON u.id = g.user_id
 		`+where+`
 		GROUP BY g.id
@@ -958,11 +1163,11 @@ func (db *DB) ListGalleriesAdminSortedFiltered(limit, offset int, sort, dir, que
 }
 
 func (db *DB) CountGalleriesAdminFiltered(query string) (int, error) {
-	where := ""
+	where := "WHERE g.deleted_at IS NULL"
 	args := []any{}
 	if query != "" {
 		like := "%" + query + "%"
-		where = "WHERE (COALESCE(g.title, '') LIKE ? OR g.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ?)"
+		where += " AND (COALESCE(g.title, '') LIKE ? OR g.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ?)"
 		args = append(args, like, like, like, like)
 	}
 	var total int
@@ -1000,14 +1205,16 @@ func (db *DB) DeleteGalleryByID(id int64) error {
 }
 
 func (db *DB) ListImagesAdmin(limit, offset int) ([]*ImageAdmin, error) {
-	return db.ListImagesAdminSortedFiltered(limit, offset, "created", "desc", "")
+	return db.ListImagesAdminSortedFiltered(limit, offset, "created", "desc", "", "")
 }
 
 func (db *DB) ListImagesAdminSorted(limit, offset int, sort, dir string) ([]*ImageAdmin, error) {
-	return db.ListImagesAdminSortedFiltered(limit, offset, sort, dir, "")
+	return db.ListImagesAdminSortedFiltered(limit, offset, sort, dir, "", "")
 }
 
-func (db *DB) ListImagesAdminSortedFiltered(limit, offset int, sort, dir, query string) ([]*ImageAdmin, error) {
+// ListImagesAdminSortedFiltered lists images for the admin panel; an empty
+// status lists all of them.
+func (db *DB) ListImagesAdminSortedFiltered(limit, offset int, sort, dir, query, status string) ([]*ImageAdmin, error) {
 	orderBy := "i.created_at"
 	switch sort {
 	case "downloads":
@@ -1027,19 +1234,24 @@ func (db *DB) ListImagesAdminSortedFiltered(limit, offset int, sort, dir, query
 		orderDir = "ASC"
 	}
 
-	where := ""
+	where := "WHERE i.deleted_at IS NULL"
 	args := []any{}
 	if query != "" {
 		like := "%" + query + "%"
-		where = "WHERE (i.original_name LIKE ? OR i.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ? OR COALESCE(g.slug, '') LIKE ?)"
+		where += " AND (i.original_name LIKE ? OR i.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ? OR COALESCE(g.slug, '') LIKE ?)"
 		args = append(args, like, like, like, like, like)
 	}
+	if status != "" {
+		where += " AND i.status = ?"
+		args = append(args, status)
+	}
 
 	rows, err := db.conn.Query(`
 		SELECT i.id, i.slug, i.original_name, i.file_size, i.downloads, i.created_at, i.accessed_at, i.edited,
 		       COALESCE(u.display_name, '') as owner_name,
 		       COALESCE(u.slug, '') as owner_slug,
-		       COALESCE(g.slug, '') as gallery_slug
+		       COALESCE(g.slug, '') as gallery_slug,
+		       i.status, COALESCE(i.processing_error, ''), COALESCE(i.integrity_error, '')
 		FROM images i
 		LEFT JOIN users u ON u.id = i.user_id
 		LEFT JOIN galleries g ON g.id = i.gallery_id
@@ -1055,7 +1267,7 @@ func (db *DB) ListImagesAdminSortedFiltered(limit, offset int, sort, dir, query
 	var images []*ImageAdmin
 	for rows.Next() {
 		img := &ImageAdmin{}
-		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug); err != nil {
+		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.Downloads, &img.CreatedAt, &img.AccessedAt, &img.Edited, &img.OwnerName, &img.OwnerSlug, &img.GallerySlug, &img.Status, &img.ProcessingError, &img.IntegrityError); err != nil {
 			return nil, err
 		}
 		images = append(images, img)
@@ -1065,20 +1277,24 @@ func (db *DB) ListImagesAdminSortedFiltered(limit, offset int, sort, dir, query
 
 func (db *DB) CountImagesAdmin() (int, error) {
 	var total int
-	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM images`).Scan(&total); err != nil {
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM images WHERE deleted_at IS NULL`).Scan(&total); err != nil {
 		return 0, err
 	}
 	return total, nil
 }
 
-func (db *DB) CountImagesAdminFiltered(query string) (int, error) {
-	where := ""
+func (db *DB) CountImagesAdminFiltered(query, status string) (int, error) {
+	where := "WHERE i.deleted_at IS NULL"
 	args := []any{}
 	if query != "" {
 		like := "%" + query + "%"
-		where = "WHERE (i.original_name LIKE ? OR i.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ? OR COALESCE(g.slug, '') LIKE ?)"
+		where += " AND (i.original_name LIKE ? OR i.slug LIKE ? OR COALESCE(u.display_name, '') LIKE ? OR COALESCE(u.slug, '') LIKE ? OR COALESCE(g.slug, '') LIKE ?)"
 		args = append(args, like, like, like, like, like)
 	}
+	if status != "" {
+		where += " AND i.status = ?"
+		args = append(args, status)
+	}
 	var total int
 	if err := db.conn.QueryRow(`
 		SELECT COUNT(*)
@@ -1112,7 +1328,7 @@ func (db *DB) MarkImageEdited(slug string) error {
 }
 
 func (db *DB) UnmarkImageEdited(slug string) error {
-	_, err := db.conn.Exec("UPDATE images SET edited = 0 WHERE slug = ?", slug)
+	_, err := db.conn.Exec("UPDATE images SET edited = 0, updated_at = ? WHERE slug = ?", time.Now().Unix(), slug)
 	return err
 }
 
@@ -1123,6 +1339,24 @@ func (db *DB) UpdateImageMetadata(slug string, width, height int, fileSize int64
 	return err
 }
 
+// UpdateImagePlaceholder stores the LQIP and dominant colour. Empty strings
+// mark the image as processed without a placeholder, so backfill skips it.
+func (db *DB) UpdateImagePlaceholder(slug, lqip, dominantColor string) error {
+	_, err := db.conn.Exec(
+		"UPDATE images SET lqip = ?, dominant_color = ? WHERE slug = ?",
+		lqip, dominantColor, slug)
+	return err
+}
+
+// GetImagesWithoutPlaceholder returns images whose placeholder was never computed.
+func (db *DB) GetImagesWithoutPlaceholder(limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE lqip IS NULL AND status = 'ready' AND deleted_at IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
 func (db *DB) UpdateGalleryTitle(id int64, title string) error {
 	_, err := db.conn.Exec("UPDATE galleries SET title = ?, updated_at = ? WHERE id = ?",
 		title, time.Now().Unix(), id)
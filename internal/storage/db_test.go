@@ -110,6 +110,74 @@ func TestDB_GetImageBySlug(t *testing.T) {
 	}
 }
 
+func TestDB_GetImageBySlug_Frames(t *testing.T) {
+	db := testDB(t)
+
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "stat1", MimeType: "image/png", CreatedAt: now, AccessedAt: now})
+	db.InsertImage(&Image{Slug: "anim1", MimeType: "image/gif", Frames: 12, CreatedAt: now, AccessedAt: now})
+
+	static, err := db.GetImageBySlug("stat1")
+	if err != nil || static == nil {
+		t.Fatalf("GetImageBySlug(stat1) error = %v", err)
+	}
+	if static.Frames != 1 || static.IsAnimated() {
+		t.Errorf("static Frames = %d, IsAnimated = %v; want 1, false", static.Frames, static.IsAnimated())
+	}
+
+	anim, err := db.GetImageBySlug("anim1")
+	if err != nil || anim == nil {
+		t.Fatalf("GetImageBySlug(anim1) error = %v", err)
+	}
+	if anim.Frames != 12 || !anim.IsAnimated() {
+		t.Errorf("animated Frames = %d, IsAnimated = %v; want 12, true", anim.Frames, anim.IsAnimated())
+	}
+}
+
+func TestDB_ImagePlaceholder(t *testing.T) {
+	db := testDB(t)
+
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "withph", MimeType: "image/png", LQIP: "data:image/webp;base64,AAAA", DominantColor: "#112233", CreatedAt: now, AccessedAt: now})
+	db.InsertImage(&Image{Slug: "noph", MimeType: "image/png", CreatedAt: now, AccessedAt: now})
+	// trashed images are purged, not backfilled
+	db.InsertImage(&Image{Slug: "trashd", MimeType: "image/png", CreatedAt: now, AccessedAt: now})
+	db.TrashImage("trashd", "user")
+
+	img, err := db.GetImageBySlug("withph")
+	if err != nil || img == nil {
+		t.Fatalf("GetImageBySlug(withph) error = %v", err)
+	}
+	if img.LQIP != "data:image/webp;base64,AAAA" || img.DominantColor != "#112233" {
+		t.Errorf("placeholder = %q, %q", img.LQIP, img.DominantColor)
+	}
+
+	pending, err := db.GetImagesWithoutPlaceholder(10)
+	if err != nil {
+		t.Fatalf("GetImagesWithoutPlaceholder() error = %v", err)
+	}
+	if len(pending) != 1 || pending[0].Slug != "noph" {
+		t.Fatalf("GetImagesWithoutPlaceholder() = %v, want [noph]", pending)
+	}
+
+	// empty values mark the image as done
+	if err := db.UpdateImagePlaceholder("noph", "", ""); err != nil {
+		t.Fatalf("UpdateImagePlaceholder() error = %v", err)
+	}
+	pending, _ = db.GetImagesWithoutPlaceholder(10)
+	if len(pending) != 0 {
+		t.Errorf("GetImagesWithoutPlaceholder() after update = %d images, want 0", len(pending))
+	}
+
+	if err := db.UpdateImagePlaceholder("withph", "data:x", "#abcdef"); err != nil {
+		t.Fatalf("UpdateImagePlaceholder() error = %v", err)
+	}
+	img, _ = db.GetImageBySlug("withph")
+	if img.LQIP != "data:x" || img.DominantColor != "#abcdef" {
+		t.Errorf("updated placeholder = %q, %q", img.LQIP, img.DominantColor)
+	}
+}
+
 func TestDB_GetImageBySlug_NotFound(t *testing.T) {
 	db := testDB(t)
 
@@ -146,6 +214,30 @@ func TestDB_TouchImageBySlug(t *testing.T) {
 	}
 }
 
+func TestDB_MarkImageEdited_BumpsUpdatedAt(t *testing.T) {
+	db := testDB(t)
+
+	oldTime := time.Now().Add(-24 * time.Hour).Unix()
+	db.InsertImage(&Image{Slug: "edited", MimeType: "image/jpeg", CreatedAt: oldTime, UpdatedAt: oldTime, AccessedAt: oldTime})
+
+	if err := db.MarkImageEdited("edited"); err != nil {
+		t.Fatalf("MarkImageEdited() error = %v", err)
+	}
+	got, _ := db.GetImageBySlug("edited")
+	if !got.Edited || got.UpdatedAt <= oldTime {
+		t.Errorf("after edit: edited=%v updated_at=%d", got.Edited, got.UpdatedAt)
+	}
+
+	db.conn.Exec("UPDATE images SET updated_at = ? WHERE slug = ?", oldTime, "edited")
+	if err := db.UnmarkImageEdited("edited"); err != nil {
+		t.Fatalf("UnmarkImageEdited() error = %v", err)
+	}
+	got, _ = db.GetImageBySlug("edited")
+	if got.Edited || got.UpdatedAt <= oldTime {
+		t.Errorf("after restore: edited=%v updated_at=%d", got.Edited, got.UpdatedAt)
+	}
+}
+
 func TestDB_InsertGallery(t *testing.T) {
 	db := testDB(t)
 
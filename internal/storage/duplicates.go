@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// phashBands is how many 8-bit bands of the perceptual hash are indexed.
+// Hashes within fewer than phashBands bits of each other agree exactly on
+// at least one band, so near-duplicate lookups only visit images sharing
+// one.
+const phashBands = 8
+
+// phashBandExpr is band of images.phash as an SQL expression; the band
+// indexes are built on exactly this text, which queries must repeat.
+func phashBandExpr(band int) string {
+	return fmt.Sprintf("((phash >> %d) & 255)", band*8)
+}
+
+// nullHash stores the perceptual hash only alongside a pixel hash, so a zero
+// dHash of a computed fingerprint is not confused with "not computed".
+func nullHash(phash uint64, pixelSHA string) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(phash), Valid: pixelSHA != ""}
+}
+
+// UpdateImageFingerprint stores content hashes after an edit or backfill.
+// An empty pixelSHA marks the image as unhashable, so backfill skips it.
+func (db *DB) UpdateImageFingerprint(slug string, phash uint64, pixelSHA string) error {
+	_, err := db.conn.Exec(
+		"UPDATE images SET phash = ?, pixel_sha = ? WHERE slug = ?",
+		int64(phash), pixelSHA, slug)
+	return err
+}
+
+// GetImagesWithoutFingerprint returns images whose hashes were never
+// computed; trashed ones are left to the purge.
+func (db *DB) GetImagesWithoutFingerprint(limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE pixel_sha IS NULL AND status = 'ready' AND deleted_at IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// FindDuplicateImage returns an image with identical pixels or, failing that,
+// the closest one whose perceptual hash is within maxDistance bits.
+// A nil userID searches all images, otherwise only that user's.
+func (db *DB) FindDuplicateImage(phash uint64, pixelSHA string, maxDistance int, userID *int64) (*Image, error) {
+	scope, args := "", []any{pixelSHA}
+	if userID != nil {
+		scope, args = " AND user_id = ?", append(args, *userID)
+	}
+
+	img, err := scanImage(db.conn.QueryRow(
+		`SELECT `+imageColumns+` FROM images WHERE pixel_sha = ? AND status != '`+ImageStatusWriting+`' AND deleted_at IS NULL`+scope+` ORDER BY id LIMIT 1`, args...))
+	if err == nil {
+		return img, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	if maxDistance < 0 {
+		return nil, nil
+	}
+
+	// candidates share a band with phash; wider distances scan every hash.
+	// The unary + keeps SQLite off idx_images_deleted, which matches nearly
+	// every row, so it unions the band indexes instead.
+	candidates, bandArgs := "", []any(nil)
+	if maxDistance < phashBands {
+		terms := make([]string, phashBands)
+		for band := range terms {
+			terms[band] = phashBandExpr(band) + " = ?"
+			bandArgs = append(bandArgs, int64(phash>>(band*8)&255))
+		}
+		candidates = " AND (" + strings.Join(terms, " OR ") + ")"
+	}
+	rows, err := db.conn.Query(`SELECT id, phash FROM images WHERE pixel_sha != '' AND status != '`+ImageStatusWriting+`' AND +deleted_at IS NULL`+scope+candidates+` ORDER BY id`, append(args[1:], bandArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bestID, bestDist := int64(0), maxDistance+1
+	for rows.Next() {
+		var id, hash int64
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		if d := bits.OnesCount64(uint64(hash) ^ phash); d < bestDist {
+			bestID, bestDist = id, d
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if bestID == 0 {
+		return nil, nil
+	}
+	return scanImage(db.conn.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ?`, bestID))
+}
+
+// GetDuplicateClusters groups hashed images whose perceptual hashes are
+// within maxDistance bits of each other (transitively). Only groups with
+// at least two images are returned, largest first; images inside a group
+// are ordered by upload time.
+func (db *DB) GetDuplicateClusters(maxDistance int) ([][]*Image, error) {
+	rows, err := db.conn.Query(`SELECT id, phash, pixel_sha FROM images WHERE pixel_sha != '' AND deleted_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var hashes []uint64
+	var shas []string
+	for rows.Next() {
+		var id, hash int64
+		var sha string
+		if err := rows.Scan(&id, &hash, &sha); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		hashes = append(hashes, uint64(hash))
+		shas = append(shas, sha)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	parent := make([]int, len(ids))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) { parent[find(j)] = find(i) }
+
+	bySHA := make(map[string]int)
+	for i, sha := range shas {
+		if first, ok := bySHA[sha]; ok {
+			union(first, i)
+		} else {
+			bySHA[sha] = i
+		}
+	}
+
+	// Pigeonhole: hashes within maxDistance bits agree exactly on at least
+	// one of maxDistance+1 bands, so only images sharing a band are compared.
+	if maxDistance >= 0 {
+		bands := min(maxDistance+1, 64)
+		for band := 0; band < bands; band++ {
+			lo, hi := band*64/bands, (band+1)*64/bands
+			mask := (uint64(1)<<(hi-lo) - 1) << lo
+			if hi-lo == 64 {
+				mask = ^uint64(0)
+			}
+			buckets := make(map[uint64][]int)
+			for i, h := range hashes {
+				buckets[h&mask] = append(buckets[h&mask], i)
+			}
+			for _, members := range buckets {
+				for a := 0; a < len(members); a++ {
+					for b := a + 1; b < len(members); b++ {
+						i, j := members[a], members[b]
+						if find(i) != find(j) && bits.OnesCount64(hashes[i]^hashes[j]) <= maxDistance {
+							union(i, j)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]int64)
+	for i, id := range ids {
+		root := find(i)
+		groups[root] = append(groups[root], id)
+	}
+
+	var clusterIDs [][]int64
+	var all []any
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		clusterIDs = append(clusterIDs, g)
+		for _, id := range g {
+			all = append(all, id)
+		}
+	}
+	if len(clusterIDs) == 0 {
+		return nil, nil
+	}
+
+	byID := make(map[int64]*Image, len(all))
+	// stay under SQLite's bound parameter limit
+	for start := 0; start < len(all); start += 500 {
+		chunk := all[start:min(start+500, len(all))]
+		rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE id IN (?`+strings.Repeat(",?", len(chunk)-1)+`)`, chunk...)
+		if err != nil {
+			return nil, err
+		}
+		images, err := scanImages(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			byID[img.ID] = img
+		}
+	}
+
+	clusters := make([][]*Image, 0, len(clusterIDs))
+	for _, g := range clusterIDs {
+		var cluster []*Image
+		for _, id := range g {
+			if img := byID[id]; img != nil {
+				cluster = append(cluster, img)
+			}
+		}
+		sort.Slice(cluster, func(i, j int) bool { return cluster[i].CreatedAt < cluster[j].CreatedAt })
+		clusters = append(clusters, cluster)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0].CreatedAt > clusters[j][0].CreatedAt
+	})
+	return clusters, nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func insertHashed(t *testing.T, db *DB, slug string, userID *int64, phash uint64, sha string) {
+	t.Helper()
+	now := time.Now().Unix()
+	_, err := db.InsertImage(&Image{Slug: slug, MimeType: "image/png", UserID: userID,
+		PHash: phash, PixelSHA: sha, CreatedAt: now, AccessedAt: now})
+	if err != nil {
+		t.Fatalf("InsertImage(%s) error = %v", slug, err)
+	}
+}
+
+func TestDB_ImageFingerprint_RoundTrip(t *testing.T) {
+	db := testDB(t)
+	insertHashed(t, db, "hash1", nil, 0xF00DFACE00000001, "aaa")
+	insertHashed(t, db, "nohash", nil, 0, "")
+	insertHashed(t, db, "trashd", nil, 0, "")
+	db.TrashImage("trashd", "user")
+
+	img, _ := db.GetImageBySlug("hash1")
+	if img.PHash != 0xF00DFACE00000001 || img.PixelSHA != "aaa" {
+		t.Errorf("fingerprint = %x, %q", img.PHash, img.PixelSHA)
+	}
+
+	pending, err := db.GetImagesWithoutFingerprint(10)
+	if err != nil {
+		t.Fatalf("GetImagesWithoutFingerprint() error = %v", err)
+	}
+	if len(pending) != 1 || pending[0].Slug != "nohash" {
+		t.Fatalf("GetImagesWithoutFingerprint() = %v, want [nohash]", pending)
+	}
+
+	if err := db.UpdateImageFingerprint("nohash", 42, "bbb"); err != nil {
+		t.Fatalf("UpdateImageFingerprint() error = %v", err)
+	}
+	img, _ = db.GetImageBySlug("nohash")
+	if img.PHash != 42 || img.PixelSHA != "bbb" {
+		t.Errorf("updated fingerprint = %d, %q", img.PHash, img.PixelSHA)
+	}
+}
+
+func TestDB_FindDuplicateImage(t *testing.T) {
+	db := testDB(t)
+	ua, _ := db.GetOrCreateBratUser("alice")
+	ub, _ := db.GetOrCreateBratUser("bob")
+	alice, bob := ua.ID, ub.ID
+
+	insertHashed(t, db, "exact", &alice, 0x0F0F, "sha-exact")
+	insertHashed(t, db, "near", &alice, 0xFF00FF00, "sha-near")
+	insertHashed(t, db, "bobs", &bob, 0x12345678, "sha-bob")
+	insertHashed(t, db, "high", &bob, 0xF0E0D0C0B0A09080, "sha-high") // negative as int64
+
+	tests := []struct {
+		name   string
+		phash  uint64
+		sha    string
+		dist   int
+		userID *int64
+		want   string
+	}{
+		{"exact pixels", 0xFFFF, "sha-exact", 0, &alice, "exact"},
+		{"near hash", 0xFF00FF03, "sha-new", 4, &alice, "near"},
+		{"too far", 0xFF00FF3F, "sha-new", 4, &alice, ""},
+		{"other user scoped out", 0x12345678, "sha-bob", 4, &alice, ""},
+		{"global scope", 0x12345678, "sha-bob", 4, nil, "bobs"},
+		{"exact only", 0xFF00FF00, "sha-new", -1, nil, ""},
+		{"high bits", 0xF0E0D0C0B0A09081, "sha-new", 4, nil, "high"},
+		// one bit off in every band: no band matches, distance 8
+		{"beyond the bands", 0xF1E1D1C1B1A19181, "sha-new", 7, nil, ""},
+		{"wide distance scans all", 0xF1E1D1C1B1A19181, "sha-new", 8, nil, "high"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.FindDuplicateImage(tt.phash, tt.sha, tt.dist, tt.userID)
+			if err != nil {
+				t.Fatalf("FindDuplicateImage() error = %v", err)
+			}
+			var slug string
+			if got != nil {
+				slug = got.Slug
+			}
+			if slug != tt.want {
+				t.Errorf("FindDuplicateImage() = %q, want %q", slug, tt.want)
+			}
+		})
+	}
+}
+
+func TestDB_GetDuplicateClusters(t *testing.T) {
+	db := testDB(t)
+	insertHashed(t, db, "a1", nil, 0xAAAA000000000000, "s1")
+	insertHashed(t, db, "a2", nil, 0xAAAA000000000001, "s2")
+	insertHashed(t, db, "a3", nil, 0xAAAA000000000003, "s3") // chained via a2
+	insertHashed(t, db, "b1", nil, 0x1111111111111111, "same")
+	insertHashed(t, db, "b2", nil, 0x2222222222222222, "same") // exact pixels, different hash
+	insertHashed(t, db, "lone", nil, 0x5555555555555555, "s4")
+	insertHashed(t, db, "unhashed", nil, 0, "")
+
+	clusters, err := db.GetDuplicateClusters(1)
+	if err != nil {
+		t.Fatalf("GetDuplicateClusters() error = %v", err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("clusters = %d, want 2", len(clusters))
+	}
+	if len(clusters[0]) != 3 || len(clusters[1]) != 2 {
+		t.Errorf("cluster sizes = %d, %d; want 3, 2", len(clusters[0]), len(clusters[1]))
+	}
+	for _, img := range clusters[1] {
+		if img.PixelSHA != "same" {
+			t.Errorf("unexpected image %s in exact cluster", img.Slug)
+		}
+	}
+}
@@ -2,16 +2,33 @@ package storage
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Filesystem lays images out in a BlobStore. Every image has its own
+// namespace XX/slug/ of files: the WebP variants, the kept upload and the
+// edit history. Their bytes are stored once per content, as blobs
+// blobs/HH/<sha256>.<ext>, and the blob_refs table maps each file to its
+// blob; a blob is removed when the last file referencing it is. Files
+// written before that (and pending uploads) live at their own key.
 type Filesystem struct {
-	baseDir string
+	store      BlobStore
+	db         *DB
+	presignTTL time.Duration
+
+	// locks serialise storing and collecting the same blob, by hash
+	locks [64]sync.Mutex
+
+	claimMu sync.Mutex
+	claims  map[string]int // slugs of uploads whose row is not inserted yet
 }
 
 var mimeToExt = map[string]string{
@@ -20,16 +37,31 @@ var mimeToExt = map[string]string{
 	"image/gif":  ".gif",
 	"image/webp": ".webp",
 	"image/avif": ".avif",
+	"image/heic": ".heic",
+	"image/tiff": ".tiff",
+	"image/bmp":  ".bmp",
 }
 
-var originalExts = []string{".jpg", ".png", ".gif", ".webp", ".avif"}
+var originalExts = []string{".jpg", ".png", ".gif", ".webp", ".avif", ".heic", ".tiff", ".bmp"}
 
-func NewFilesystem(baseDir string) (*Filesystem, error) {
-	imagesDir := filepath.Join(baseDir, "images")
-	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+// NewFilesystem keeps images on local disk under baseDir/images, with the
+// blob references in db.
+func NewFilesystem(baseDir string, db *DB) (*Filesystem, error) {
+	store, err := NewLocalStore(filepath.Join(baseDir, "images"))
+	if err != nil {
 		return nil, fmt.Errorf("create images dir: %w", err)
 	}
-	return &Filesystem{baseDir: imagesDir}, nil
+	return NewBlobFilesystem(store, db, 0), nil
+}
+
+// NewBlobFilesystem keeps images in store. With presignTTL > 0 and a store
+// implementing Presigner, PresignedURL hands out direct links to blobs.
+func NewBlobFilesystem(store BlobStore, db *DB, presignTTL time.Duration) *Filesystem {
+	return &Filesystem{store: store, db: db, presignTTL: presignTTL}
+}
+
+func (fs *Filesystem) Store() BlobStore {
+	return fs.store
 }
 
 func GenerateSlug(length int) string {
@@ -40,37 +72,226 @@ func GenerateSlug(length int) string {
 	return hex.EncodeToString(b)[:length]
 }
 
-// Path returns path for image: XX/slug/size.webp
+// Key returns the key of a variant: XX/slug/size.webp
 // e.g., ab/ab1c2/original.webp (5-char slug)
-func (fs *Filesystem) Path(slug, sizeName string) string {
-	return filepath.Join(
-		fs.baseDir,
-		slug[0:2],
-		slug,
-		sizeName+".webp",
-	)
+func (fs *Filesystem) Key(slug, sizeName string) string {
+	return fs.dirKey(slug) + sizeName + ".webp"
 }
 
-func (fs *Filesystem) DirPath(slug string) string {
-	return filepath.Join(
-		fs.baseDir,
-		slug[0:2],
-		slug,
-	)
+// FileKey returns the key of any file of an image by its name, e.g.
+// "orig_original.jpg".
+func (fs *Filesystem) FileKey(slug, name string) string {
+	return fs.dirKey(slug) + name
 }
 
-func (fs *Filesystem) Save(slug, sizeName string, data []byte) error {
-	path := fs.Path(slug, sizeName)
+func (fs *Filesystem) dirKey(slug string) string {
+	return slug[0:2] + "/" + slug + "/"
+}
+
+// blobKey is where the blob with the SHA-256 hash is stored.
+func blobKey(hash, ext string) string {
+	return "blobs/" + hash[:2] + "/" + hash + ext
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return fmt.Errorf("create dir: %w", err)
+// splitKey parses a file key XX/slug/name.
+func splitKey(key string) (slug, name string, ok bool) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || len(parts[1]) < 2 || parts[0] != parts[1][:2] || parts[2] == "" {
+		return "", "", false
 	}
+	return parts[1], parts[2], true
+}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("write file: %w", err)
+// resolve maps a file key to the store key holding its bytes; ref is nil
+// for files stored at their own key.
+func (fs *Filesystem) resolve(key string) (string, *BlobRef, error) {
+	slug, name, ok := splitKey(key)
+	if !ok {
+		return key, nil, nil
+	}
+	ref, err := fs.db.GetBlobRef(slug, name)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve %s: %w", key, err)
 	}
+	if ref == nil {
+		return key, nil, nil
+	}
+	return blobKey(ref.Hash, ref.Ext), ref, nil
+}
 
-	return nil
+func (fs *Filesystem) Read(key string) ([]byte, error) {
+	storeKey, _, err := fs.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return fs.store.Get(storeKey)
+}
+
+// refBlob reports the modification time of the file rather than the one of
+// the blob, which may have been stored long before.
+type refBlob struct {
+	Blob
+	info BlobInfo
+}
+
+func (b *refBlob) Info() BlobInfo { return b.info }
+
+// Open returns the file; Info().Key of a blob-backed file is the blob key,
+// which changes whenever the content does.
+func (fs *Filesystem) Open(key string) (Blob, error) {
+	storeKey, ref, err := fs.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.store.Open(storeKey)
+	if err != nil || ref == nil {
+		return b, err
+	}
+	return &refBlob{Blob: b, info: refInfo(ref)}, nil
+}
+
+func refInfo(ref *BlobRef) BlobInfo {
+	return BlobInfo{Key: blobKey(ref.Hash, ref.Ext), Size: ref.Size, ModTime: time.Unix(0, ref.UpdatedAt), ETag: ref.Hash}
+}
+
+// Stat answers from the database for blob-backed files.
+func (fs *Filesystem) Stat(key string) (BlobInfo, error) {
+	storeKey, ref, err := fs.resolve(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if ref != nil {
+		return refInfo(ref), nil
+	}
+	return fs.store.Stat(storeKey)
+}
+
+func (fs *Filesystem) exists(key string) bool {
+	_, err := fs.Stat(key)
+	return err == nil
+}
+
+// PresignedURL returns a time-limited direct URL of key when the store
+// supports it and redirects are enabled.
+func (fs *Filesystem) PresignedURL(key string) (string, bool) {
+	presigner, ok := fs.store.(Presigner)
+	if !ok || fs.presignTTL <= 0 {
+		return "", false
+	}
+	storeKey, _, err := fs.resolve(key)
+	if err != nil {
+		return "", false
+	}
+	u, err := presigner.PresignGet(storeKey, fs.presignTTL)
+	if err != nil {
+		return "", false
+	}
+	return u, true
+}
+
+func (fs *Filesystem) lock(hash string) *sync.Mutex {
+	b, _ := hex.DecodeString(hash[:2])
+	return &fs.locks[int(b[0])%len(fs.locks)]
+}
+
+// put stores data as the file slug/name: the blob is written only when no
+// file has the same content yet.
+func (fs *Filesystem) put(slug, name string, data []byte) error {
+	return fs.putBlob(slug, name, data, false)
+}
+
+// putBlob is put; rewrite writes the blob even when it is known, to replace
+// a file that went missing or got damaged.
+func (fs *Filesystem) putBlob(slug, name string, data []byte, rewrite bool) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	ext := path.Ext(name)
+
+	mu := fs.lock(hash)
+	mu.Lock()
+	known, err := fs.db.BlobKnown(hash)
+	if err == nil && (!known || rewrite) {
+		err = fs.store.Put(blobKey(hash, ext), data)
+	}
+	if err != nil {
+		mu.Unlock()
+		return err
+	}
+	previous, err := fs.db.RefBlob(slug, name, hash, ext, int64(len(data)))
+	if err != nil && !known {
+		fs.store.Delete(blobKey(hash, ext))
+	}
+	mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("reference blob: %w", err)
+	}
+
+	if previous != "" {
+		if err := fs.releaseBlob(previous); err != nil {
+			return err
+		}
+	}
+	// a copy written before content addressing is superseded now
+	return fs.store.Delete(fs.dirKey(slug) + name)
+}
+
+// unref removes the file slug/name from the blob references.
+func (fs *Filesystem) unref(slug, name string) error {
+	hash, err := fs.db.UnrefBlob(slug, name)
+	if err != nil || hash == "" {
+		return err
+	}
+	return fs.releaseBlob(hash)
+}
+
+// releaseBlob removes the blob once no file references it.
+func (fs *Filesystem) releaseBlob(hash string) error {
+	mu := fs.lock(hash)
+	mu.Lock()
+	defer mu.Unlock()
+	ext, deleted, err := fs.db.DeleteUnusedBlob(hash)
+	if err != nil || !deleted {
+		return err
+	}
+	return fs.store.Delete(blobKey(hash, ext))
+}
+
+// CollectBlobs removes up to limit blobs left unreferenced by deleting the
+// image row first (DeleteImageBySlug, gallery cascades) and returns how
+// many were removed.
+func (fs *Filesystem) CollectBlobs(limit int) (int, error) {
+	hashes, err := fs.db.GetUnusedBlobs(limit)
+	if err != nil {
+		return 0, err
+	}
+	for i, hash := range hashes {
+		if err := fs.releaseBlob(hash); err != nil {
+			return i, err
+		}
+	}
+	return len(hashes), nil
+}
+
+func (fs *Filesystem) Save(slug, sizeName string, data []byte) error {
+	return fs.put(slug, sizeName+".webp", data)
+}
+
+// DeleteVariant removes one stored variant; a missing file is not an error.
+func (fs *Filesystem) DeleteVariant(slug, sizeName string) error {
+	if err := fs.unref(slug, sizeName+".webp"); err != nil {
+		return err
+	}
+	return fs.store.Delete(fs.Key(slug, sizeName))
+}
+
+// SourceKey returns the unwatermarked WebP original: clean.webp (see
+// image.CleanVariant) when the public variants carry a watermark,
+// original.webp otherwise.
+func (fs *Filesystem) SourceKey(slug string) string {
+	if clean := fs.Key(slug, "clean"); fs.exists(clean) {
+		return clean
+	}
+	return fs.Key(slug, "original")
 }
 
 func (fs *Filesystem) SaveOriginal(slug, name string, data []byte, mimeType string) (int64, error) {
@@ -79,28 +300,34 @@ func (fs *Filesystem) SaveOriginal(slug, name string, data []byte, mimeType stri
 		return 0, fmt.Errorf("unsupported mime type: %s", mimeType)
 	}
 
-	dir := fs.DirPath(slug)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return 0, fmt.Errorf("create dir: %w", err)
-	}
-
 	name = sanitizeOriginalName(name)
-	filename := "orig_" + name + ext
-	path := filepath.Join(dir, filename)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return 0, fmt.Errorf("write file: %w", err)
+	if err := fs.put(slug, "orig_"+name+ext, data); err != nil {
+		return 0, err
 	}
 	return int64(len(data)), nil
 }
 
-func (fs *Filesystem) GetOriginalPath(slug, name string) (string, error) {
-	dir := fs.DirPath(slug)
-	name = sanitizeOriginalName(name)
-
+// OriginalKey finds the upload kept by SaveOriginal, whatever its format.
+func (fs *Filesystem) OriginalKey(slug, name string) (string, error) {
+	name = "orig_" + sanitizeOriginalName(name)
+	refs, err := fs.db.GetBlobRefs(slug)
+	if err != nil {
+		return "", err
+	}
+	blobs, err := fs.store.List(fs.dirKey(slug) + name + ".")
+	if err != nil {
+		return "", err
+	}
 	for _, ext := range originalExts {
-		path := filepath.Join(dir, "orig_"+name+ext)
-		if _, err := os.Stat(path); err == nil {
-			return path, nil
+		for _, ref := range refs {
+			if ref.Name == name+ext {
+				return fs.dirKey(slug) + ref.Name, nil
+			}
+		}
+		for _, b := range blobs {
+			if b.Key == fs.dirKey(slug)+name+ext {
+				return b.Key, nil
+			}
 		}
 	}
 	return "", os.ErrNotExist
@@ -116,60 +343,170 @@ func sanitizeOriginalName(name string) string {
 	return name
 }
 
+// Delete removes everything stored for slug, in the trash area too; blobs
+// still referenced by other images stay.
 func (fs *Filesystem) Delete(slug string) error {
-	dir := fs.DirPath(slug)
-	return os.RemoveAll(dir)
+	if err := fs.deleteFiles(slug, func(string) bool { return true }); err != nil {
+		return err
+	}
+	trashed, err := fs.store.List(fs.trashKey(slug))
+	if err != nil {
+		return err
+	}
+	for _, b := range trashed {
+		if err := fs.store.Delete(b.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFiles removes the files of slug whose names match.
+func (fs *Filesystem) deleteFiles(slug string, match func(name string) bool) error {
+	refs, err := fs.db.GetBlobRefs(slug)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !match(ref.Name) {
+			continue
+		}
+		if err := fs.unref(slug, ref.Name); err != nil {
+			return err
+		}
+	}
+
+	blobs, err := fs.store.List(fs.dirKey(slug))
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if !match(strings.TrimPrefix(b.Key, fs.dirKey(slug))) {
+			continue
+		}
+		if err := fs.store.Delete(b.Key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (fs *Filesystem) Exists(slug string) bool {
-	dir := fs.DirPath(slug)
-	_, err := os.Stat(dir)
-	return err == nil
+	if refs, err := fs.db.GetBlobRefs(slug); err == nil && len(refs) > 0 {
+		return true
+	}
+	blobs, err := fs.store.List(fs.dirKey(slug))
+	return err == nil && len(blobs) > 0
 }
 
+// GetDiskUsage sums the bytes actually in the store, counting shared blobs
+// once.
 func (fs *Filesystem) GetDiskUsage() (int64, error) {
+	blobs, err := fs.store.List("")
+	if err != nil {
+		return 0, err
+	}
 	var total int64
-	err := filepath.Walk(fs.baseDir, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
+	for _, b := range blobs {
+		total += b.Size
+	}
+	return total, nil
+}
+
+func (fs *Filesystem) backupKey(slug string) string {
+	return fs.dirKey(slug) + "backup.webp"
+}
+
+// EditSourceKey is the untouched source edits are rendered from: the kept
+// upload (orig_*), else the WebP saved before the first edit, else the
+// current unmarked original.
+func (fs *Filesystem) EditSourceKey(slug string) string {
+	if key, err := fs.OriginalKey(slug, "original"); err == nil {
+		return key
+	}
+	if backup := fs.backupKey(slug); fs.exists(backup) {
+		return backup
+	}
+	return fs.SourceKey(slug)
+}
+
+// RevisionKey is where the result of an edit revision is kept.
+func (fs *Filesystem) RevisionKey(slug string, id int64) string {
+	return fs.dirKey(slug) + fmt.Sprintf("rev_%d.webp", id)
+}
+
+func (fs *Filesystem) SaveRevision(slug string, id int64, data []byte) error {
+	return fs.put(slug, fmt.Sprintf("rev_%d.webp", id), data)
+}
+
+// pendingSource and pendingParams keep an upload processed in the
+// background until its variants exist, so that a failed job can be retried.
+const (
+	pendingSource = "pending.src"
+	pendingParams = "pending.json"
+)
+
+// SavePending stores the upload and its transform parameters (JSON) for
+// background processing.
+func (fs *Filesystem) SavePending(slug string, data, params []byte) error {
+	dir := fs.dirKey(slug)
+	if err := fs.store.Put(dir+pendingParams, params); err != nil {
+		return fmt.Errorf("write params: %w", err)
+	}
+	if err := fs.store.Put(dir+pendingSource, data); err != nil {
+		return fmt.Errorf("write source: %w", err)
+	}
+	return nil
+}
+
+// ReadPending returns what SavePending stored.
+func (fs *Filesystem) ReadPending(slug string) (data, params []byte, err error) {
+	dir := fs.dirKey(slug)
+	if data, err = fs.store.Get(dir + pendingSource); err != nil {
+		return nil, nil, err
+	}
+	if params, err = fs.store.Get(dir + pendingParams); err != nil {
+		return nil, nil, err
+	}
+	return data, params, nil
+}
+
+// DeletePending removes the pending upload once the variants are saved.
+func (fs *Filesystem) DeletePending(slug string) error {
+	for _, name := range []string{pendingSource, pendingParams} {
+		if err := fs.store.Delete(fs.dirKey(slug) + name); err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			total += info.Size()
-		}
-		return nil
-	})
-	return total, err
+	}
+	return nil
 }
 
-func (fs *Filesystem) SaveBackup(slug string) error {
-	srcPath := fs.Path(slug, "original")
-	dstPath := filepath.Join(fs.DirPath(slug), "backup.webp")
+// DeleteVariants removes the stored WebP files of an image and keeps the
+// rest of its directory (kept upload, pending source).
+func (fs *Filesystem) DeleteVariants(slug string) error {
+	return fs.deleteFiles(slug, func(name string) bool { return strings.HasSuffix(name, ".webp") })
+}
 
-	data, err := os.ReadFile(srcPath)
+func (fs *Filesystem) SaveBackup(slug string) error {
+	data, err := fs.Read(fs.SourceKey(slug))
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dstPath, data, 0644)
+	return fs.put(slug, "backup.webp", data)
 }
 
 func (fs *Filesystem) RestoreFromBackup(slug string) error {
-	srcPath := filepath.Join(fs.DirPath(slug), "backup.webp")
-	dstPath := fs.Path(slug, "original")
-
-	data, err := os.ReadFile(srcPath)
+	data, err := fs.Read(fs.backupKey(slug))
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dstPath, data, 0644)
+	return fs.put(slug, "original.webp", data)
 }
 
 func (fs *Filesystem) HasBackup(slug string) bool {
-	path := filepath.Join(fs.DirPath(slug), "backup.webp")
-	_, err := os.Stat(path)
-	return err == nil
+	return fs.exists(fs.backupKey(slug))
 }
 
 func (fs *Filesystem) ReadBackup(slug string) ([]byte, error) {
-	path := filepath.Join(fs.DirPath(slug), "backup.webp")
-	return os.ReadFile(path)
+	return fs.Read(fs.backupKey(slug))
 }
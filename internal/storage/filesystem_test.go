@@ -5,6 +5,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"dajtu/internal/storage/s3test"
 )
 
 // Local test helpers to avoid import cycle with testutil
@@ -12,7 +15,7 @@ import (
 func localTestFilesystem(t *testing.T) (*Filesystem, string) {
 	t.Helper()
 	dir := t.TempDir()
-	fs, err := NewFilesystem(dir)
+	fs, err := NewFilesystem(dir, testDB(t))
 	if err != nil {
 		t.Fatalf("create test filesystem: %v", err)
 	}
@@ -66,7 +69,7 @@ func localSamplePNG() []byte {
 
 func TestNewFilesystem(t *testing.T) {
 	dir := t.TempDir()
-	fs, err := NewFilesystem(dir)
+	fs, err := NewFilesystem(dir, testDB(t))
 	if err != nil {
 		t.Fatalf("NewFilesystem() error = %v", err)
 	}
@@ -87,7 +90,7 @@ func TestNewFilesystem(t *testing.T) {
 
 func TestNewFilesystem_InvalidPath(t *testing.T) {
 	// Try to create in a read-only location
-	_, err := NewFilesystem("/proc/test-readonly")
+	_, err := NewFilesystem("/proc/test-readonly", nil)
 	if err == nil {
 		t.Error("expected error for invalid path")
 	}
@@ -131,44 +134,50 @@ func TestGenerateSlug_Unique(t *testing.T) {
 	}
 }
 
-func TestFilesystem_Path(t *testing.T) {
-	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+func TestFilesystem_Key(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
 
 	tests := []struct {
 		slug     string
 		sizeName string
 		want     string
 	}{
-		{"ab1c2", "original", filepath.Join(dir, "images", "ab", "ab1c2", "original.webp")},
-		{"xyz99", "thumb", filepath.Join(dir, "images", "xy", "xyz99", "thumb.webp")},
+		{"ab1c2", "original", "ab/ab1c2/original.webp"},
+		{"xyz99", "thumb", "xy/xyz99/thumb.webp"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.slug+"/"+tt.sizeName, func(t *testing.T) {
-			got := fs.Path(tt.slug, tt.sizeName)
+			got := fs.Key(tt.slug, tt.sizeName)
 			if got != tt.want {
-				t.Errorf("Path(%q, %q) = %q, want %q", tt.slug, tt.sizeName, got, tt.want)
+				t.Errorf("Key(%q, %q) = %q, want %q", tt.slug, tt.sizeName, got, tt.want)
 			}
 		})
 	}
 }
 
-func TestFilesystem_DirPath(t *testing.T) {
-	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+// sha256("data")
+const dataHash = "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
 
-	slug := "ab1c2"
-	want := filepath.Join(dir, "images", "ab", "ab1c2")
-	got := fs.DirPath(slug)
-	if got != want {
-		t.Errorf("DirPath(%q) = %q, want %q", slug, got, want)
+func TestFilesystem_LocalLayout(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+
+	fs.Save("ab1c2", "original", []byte("data"))
+	if _, err := os.Stat(filepath.Join(dir, "images", "blobs", "3a", dataHash+".webp")); err != nil {
+		t.Errorf("variant not stored under images/blobs/HH/<sha256>: %v", err)
+	}
+	if info, err := fs.Stat(fs.Key("ab1c2", "original")); err != nil || info.Key != "blobs/3a/"+dataHash+".webp" || info.Size != 4 || info.ETag != dataHash {
+		t.Errorf("Stat() = %+v, %v", info, err)
+	}
+	fs.Delete("ab1c2")
+	if _, err := os.Stat(filepath.Join(dir, "images", "blobs")); !os.IsNotExist(err) {
+		t.Errorf("empty directories left after Delete(): %v", err)
 	}
 }
 
 func TestFilesystem_Save(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	slug := "test1"
 	sizeName := "original"
@@ -180,8 +189,7 @@ func TestFilesystem_Save(t *testing.T) {
 	}
 
 	// Verify file exists
-	path := fs.Path(slug, sizeName)
-	content, err := os.ReadFile(path)
+	content, err := fs.Read(fs.Key(slug, sizeName))
 	if err != nil {
 		t.Fatalf("file not created: %v", err)
 	}
@@ -192,7 +200,7 @@ func TestFilesystem_Save(t *testing.T) {
 
 func TestFilesystem_Save_MultipleSizes(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	slug := "multi1"
 	sizes := []string{"original", "thumb"}
@@ -206,8 +214,7 @@ func TestFilesystem_Save_MultipleSizes(t *testing.T) {
 
 	// Verify all files exist
 	for _, size := range sizes {
-		path := fs.Path(slug, size)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := fs.Stat(fs.Key(slug, size)); os.IsNotExist(err) {
 			t.Errorf("file not created for size %q", size)
 		}
 	}
@@ -224,9 +231,13 @@ func TestSaveOriginal_JPEG(t *testing.T) {
 		t.Fatalf("SaveOriginal failed: %v", err)
 	}
 
-	path := filepath.Join(dir, "images", slug[:2], slug, "orig_original.jpg")
+	ref, _ := fs.db.GetBlobRef(slug, "orig_original.jpg")
+	if ref == nil {
+		t.Fatal("orig_original.jpg not referenced")
+	}
+	path := filepath.Join(dir, "images", "blobs", ref.Hash[:2], ref.Hash+".jpg")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		t.Errorf("orig_original.jpg not created at %s", path)
+		t.Errorf("blob not created at %s", path)
 	}
 }
 
@@ -241,13 +252,17 @@ func TestSaveOriginal_PNG(t *testing.T) {
 		t.Fatalf("SaveOriginal failed: %v", err)
 	}
 
-	path := filepath.Join(dir, "images", slug[:2], slug, "orig_original.png")
+	ref, _ := fs.db.GetBlobRef(slug, "orig_original.png")
+	if ref == nil {
+		t.Fatal("orig_original.png not referenced")
+	}
+	path := filepath.Join(dir, "images", "blobs", ref.Hash[:2], ref.Hash+".png")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		t.Errorf("orig_original.png not created at %s", path)
+		t.Errorf("blob not created at %s", path)
 	}
 }
 
-func TestGetOriginalPath(t *testing.T) {
+func TestOriginalKey(t *testing.T) {
 	fs, _ := localTestFilesystem(t)
 
 	slug := "testslug"
@@ -257,18 +272,37 @@ func TestGetOriginalPath(t *testing.T) {
 		t.Fatalf("SaveOriginal failed: %v", err)
 	}
 
-	path, err := fs.GetOriginalPath(slug, "original")
+	key, err := fs.OriginalKey(slug, "original")
 	if err != nil {
-		t.Fatalf("GetOriginalPath failed: %v", err)
+		t.Fatalf("OriginalKey failed: %v", err)
 	}
-	if !strings.HasSuffix(path, "orig_original.png") {
-		t.Errorf("GetOriginalPath = %q, want suffix %q", path, "orig_original.png")
+	if key != slug[:2]+"/"+slug+"/orig_original.png" {
+		t.Errorf("OriginalKey = %q, want orig_original.png", key)
+	}
+}
+
+func TestOriginalKey_HEIC(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+
+	slug := "heic1"
+	data := []byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'c'}
+
+	if _, err := fs.SaveOriginal(slug, "original", data, "image/heic"); err != nil {
+		t.Fatalf("SaveOriginal failed: %v", err)
+	}
+
+	key, err := fs.OriginalKey(slug, "original")
+	if err != nil {
+		t.Fatalf("OriginalKey failed: %v", err)
+	}
+	if key != slug[:2]+"/"+slug+"/orig_original.heic" {
+		t.Errorf("OriginalKey = %q, want orig_original.heic", key)
 	}
 }
 
 func TestFilesystem_Delete(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	slug := "del01"
 	fs.Save(slug, "original", []byte("data"))
@@ -287,7 +321,7 @@ func TestFilesystem_Delete(t *testing.T) {
 
 func TestFilesystem_Delete_NonExistent(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	// Should not error on non-existent
 	err := fs.Delete("nonexistent")
@@ -298,7 +332,7 @@ func TestFilesystem_Delete_NonExistent(t *testing.T) {
 
 func TestFilesystem_Exists(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	slug := "exist"
 
@@ -321,7 +355,7 @@ func TestFilesystem_Exists(t *testing.T) {
 
 func TestFilesystem_GetDiskUsage(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	// Initially empty
 	usage, err := fs.GetDiskUsage()
@@ -347,7 +381,7 @@ func TestFilesystem_GetDiskUsage(t *testing.T) {
 
 func TestFilesystem_GetDiskUsage_AfterDelete(t *testing.T) {
 	dir := t.TempDir()
-	fs, _ := NewFilesystem(dir)
+	fs, _ := NewFilesystem(dir, testDB(t))
 
 	fs.Save("test1", "original", []byte(strings.Repeat("x", 1000)))
 
@@ -358,3 +392,254 @@ func TestFilesystem_GetDiskUsage_AfterDelete(t *testing.T) {
 		t.Errorf("GetDiskUsage() after delete = %d, want 0", usage)
 	}
 }
+
+func TestFilesystem_SourceKey_Clean(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	slug := "abc12"
+
+	fs.Save(slug, "original", []byte("marked"))
+	if got := fs.SourceKey(slug); got != fs.Key(slug, "original") {
+		t.Errorf("SourceKey() without clean = %q", got)
+	}
+
+	fs.Save(slug, "clean", []byte("clean"))
+	if got := fs.SourceKey(slug); got != fs.Key(slug, "clean") {
+		t.Errorf("SourceKey() with clean = %q", got)
+	}
+
+	// backups must never contain the watermark
+	if err := fs.SaveBackup(slug); err != nil {
+		t.Fatalf("SaveBackup() error = %v", err)
+	}
+	if data, _ := fs.ReadBackup(slug); string(data) != "clean" {
+		t.Errorf("backup = %q, want clean copy", data)
+	}
+
+	if err := fs.DeleteVariant(slug, "clean"); err != nil {
+		t.Fatalf("DeleteVariant() error = %v", err)
+	}
+	if err := fs.DeleteVariant(slug, "clean"); err != nil {
+		t.Errorf("DeleteVariant() of missing file error = %v", err)
+	}
+	if got := fs.SourceKey(slug); got != fs.Key(slug, "original") {
+		t.Errorf("SourceKey() after delete = %q", got)
+	}
+}
+
+func TestFilesystem_EditSourceKey(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	slug := "abc12"
+
+	fs.Save(slug, "original", []byte("first"))
+	if got := fs.EditSourceKey(slug); got != fs.Key(slug, "original") {
+		t.Errorf("EditSourceKey() before edits = %q", got)
+	}
+
+	fs.SaveBackup(slug)
+	fs.Save(slug, "original", []byte("edited"))
+	if data, _ := fs.Read(fs.EditSourceKey(slug)); string(data) != "first" {
+		t.Errorf("EditSourceKey() after edit reads %q, want the backup", data)
+	}
+
+	fs.SaveOriginal(slug, "original", []byte("jpeg"), "image/jpeg")
+	if data, _ := fs.Read(fs.EditSourceKey(slug)); string(data) != "jpeg" {
+		t.Errorf("EditSourceKey() with kept upload reads %q", data)
+	}
+}
+
+func TestFilesystem_SaveRevision(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	fs.Save("abc12", "original", []byte("x"))
+
+	if err := fs.SaveRevision("abc12", 7, []byte("rev")); err != nil {
+		t.Fatalf("SaveRevision() error = %v", err)
+	}
+	if fs.RevisionKey("abc12", 7) != "ab/abc12/rev_7.webp" {
+		t.Errorf("RevisionKey() = %q", fs.RevisionKey("abc12", 7))
+	}
+	if data, _ := fs.Read(fs.RevisionKey("abc12", 7)); string(data) != "rev" {
+		t.Errorf("revision file = %q", data)
+	}
+}
+
+func TestFilesystem_Pending(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	slug := "abc12"
+
+	if err := fs.SavePending(slug, []byte("upload"), []byte(`{"rotation":90}`)); err != nil {
+		t.Fatalf("SavePending() error = %v", err)
+	}
+	data, params, err := fs.ReadPending(slug)
+	if err != nil || string(data) != "upload" || string(params) != `{"rotation":90}` {
+		t.Fatalf("ReadPending() = %q, %q, %v", data, params, err)
+	}
+
+	fs.Save(slug, "original", []byte("x"))
+	fs.Save(slug, "thumb", []byte("x"))
+	if err := fs.DeleteVariants(slug); err != nil {
+		t.Fatalf("DeleteVariants() error = %v", err)
+	}
+	if fs.exists(fs.Key(slug, "original")) || fs.exists(fs.Key(slug, "thumb")) {
+		t.Error("variants left after DeleteVariants")
+	}
+	if _, _, err := fs.ReadPending(slug); err != nil {
+		t.Errorf("DeleteVariants removed the pending upload: %v", err)
+	}
+
+	if err := fs.DeletePending(slug); err != nil {
+		t.Fatalf("DeletePending() error = %v", err)
+	}
+	if _, _, err := fs.ReadPending(slug); !os.IsNotExist(err) {
+		t.Errorf("ReadPending() after delete error = %v", err)
+	}
+	if err := fs.DeletePending(slug); err != nil {
+		t.Errorf("DeletePending() twice error = %v", err)
+	}
+}
+
+func TestFilesystem_S3(t *testing.T) {
+	srv := s3test.NewServer(t)
+	fs := NewBlobFilesystem(testS3Store(t, srv, "images"), testDB(t), time.Minute)
+	slug := "abc12"
+
+	fs.Save(slug, "original", []byte("webp"))
+	fs.Save(slug, "thumb", []byte("t"))
+	fs.SaveOriginal(slug, "original", []byte("jpeg"), "image/jpeg")
+	if keys := srv.Keys(); len(keys) != 3 || !strings.HasPrefix(keys[0], "images/blobs/") {
+		t.Errorf("bucket keys = %q", keys)
+	}
+	if key := fs.EditSourceKey(slug); key != "ab/abc12/orig_original.jpg" {
+		t.Errorf("EditSourceKey() = %q", key)
+	}
+	if usage, _ := fs.GetDiskUsage(); usage != 9 {
+		t.Errorf("GetDiskUsage() = %d, want 9", usage)
+	}
+	if u, ok := fs.PresignedURL(fs.Key(slug, "original")); !ok || !strings.Contains(u, "X-Amz-Signature=") {
+		t.Errorf("PresignedURL() = %q, %v", u, ok)
+	}
+
+	if err := fs.DeleteVariants(slug); err != nil {
+		t.Fatalf("DeleteVariants() error = %v", err)
+	}
+	if !fs.Exists(slug) || fs.exists(fs.Key(slug, "thumb")) {
+		t.Error("DeleteVariants() should keep only the upload")
+	}
+	if err := fs.Delete(slug); err != nil || fs.Exists(slug) || len(srv.Keys()) != 0 {
+		t.Errorf("Delete() = %v, left %q", err, srv.Keys())
+	}
+}
+
+func TestFilesystem_PresignedURL_Local(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	fs.Save("abc12", "original", []byte("x"))
+	if _, ok := fs.PresignedURL(fs.Key("abc12", "original")); ok {
+		t.Error("local store should never redirect")
+	}
+}
+
+func TestFilesystem_Dedup(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+	data := []byte("same bytes")
+
+	fs.Save("aaa01", "original", data)
+	fs.Save("bbb02", "original", data)
+	fs.Save("bbb02", "thumb", data)
+	if blobs, _ := fs.store.List("blobs/"); len(blobs) != 1 {
+		t.Fatalf("stored %d blobs for one content, want 1", len(blobs))
+	}
+	if usage, _ := fs.GetDiskUsage(); usage != int64(len(data)) {
+		t.Errorf("GetDiskUsage() = %d, want %d", usage, len(data))
+	}
+
+	if err := fs.Delete("aaa01"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if got, err := fs.Read(fs.Key("bbb02", "original")); err != nil || string(got) != "same bytes" {
+		t.Fatalf("shared blob gone after deleting one image: %q, %v", got, err)
+	}
+	fs.DeleteVariant("bbb02", "thumb")
+	if _, err := fs.Read(fs.Key("bbb02", "original")); err != nil {
+		t.Fatalf("blob still referenced by original removed: %v", err)
+	}
+
+	fs.Delete("bbb02")
+	if entries, _ := os.ReadDir(filepath.Join(dir, "images")); len(entries) != 0 {
+		t.Errorf("blob left after the last reference went: %v", entries)
+	}
+}
+
+func TestFilesystem_Overwrite(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+
+	fs.Save("abc12", "original", []byte("first"))
+	fs.SaveBackup("abc12")
+	fs.Save("abc12", "original", []byte("edited"))
+	if data, _ := fs.Read(fs.Key("abc12", "original")); string(data) != "edited" {
+		t.Errorf("original = %q", data)
+	}
+	if blobs, _ := fs.store.List("blobs/"); len(blobs) != 2 {
+		t.Errorf("stored %d blobs, want the backup and the edit", len(blobs))
+	}
+
+	// restoring points the original back at the backup blob; the edit goes
+	fs.RestoreFromBackup("abc12")
+	if blobs, _ := fs.store.List("blobs/"); len(blobs) != 1 {
+		t.Errorf("stored %d blobs after restore, want 1", len(blobs))
+	}
+	if data, _ := fs.Read(fs.Key("abc12", "original")); string(data) != "first" {
+		t.Errorf("restored original = %q", data)
+	}
+}
+
+func TestFilesystem_CollectBlobs(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	data := []byte("shared")
+	for _, slug := range []string{"aaa01", "bbb02"} {
+		fs.db.InsertImage(&Image{Slug: slug, OriginalName: "x.jpg", MimeType: "image/webp", FileSize: 999, Width: 1, Height: 1})
+		fs.Save(slug, "original", data)
+	}
+	if total, _ := fs.db.GetTotalSize(); total != int64(len(data)) {
+		t.Errorf("GetTotalSize() = %d, want the bytes of the one blob", total)
+	}
+
+	fs.db.DeleteImageBySlug("aaa01")
+	if n, _ := fs.CollectBlobs(10); n != 0 {
+		t.Errorf("CollectBlobs() removed %d blobs still in use", n)
+	}
+	fs.db.DeleteImageBySlug("bbb02")
+	if n, err := fs.CollectBlobs(10); n != 1 || err != nil {
+		t.Errorf("CollectBlobs() = %d, %v, want 1", n, err)
+	}
+	if usage, _ := fs.GetDiskUsage(); usage != 0 {
+		t.Errorf("GetDiskUsage() = %d after collecting", usage)
+	}
+	if total, _ := fs.db.GetTotalSize(); total != 0 {
+		t.Errorf("GetTotalSize() = %d after collecting", total)
+	}
+}
+
+func TestFilesystem_LegacyFiles(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	fs.db.InsertImage(&Image{Slug: "old01", OriginalName: "x.jpg", MimeType: "image/webp", FileSize: 123, Width: 1, Height: 1})
+	// written before content addressing
+	fs.store.Put("ol/old01/original.webp", []byte("legacy"))
+	fs.store.Put("ol/old01/thumb.webp", []byte("t"))
+
+	if data, err := fs.Read(fs.Key("old01", "original")); err != nil || string(data) != "legacy" {
+		t.Errorf("Read(legacy) = %q, %v", data, err)
+	}
+	if total, _ := fs.db.GetTotalSize(); total != 123 {
+		t.Errorf("GetTotalSize() = %d, want file_size of the legacy image", total)
+	}
+
+	fs.Save("old01", "original", []byte("new"))
+	if _, err := fs.store.Stat("ol/old01/original.webp"); !os.IsNotExist(err) {
+		t.Errorf("legacy copy left after Save(): %v", err)
+	}
+	if data, _ := fs.Read(fs.Key("old01", "thumb")); string(data) != "t" {
+		t.Errorf("Read(legacy thumb) = %q", data)
+	}
+	if err := fs.Delete("old01"); err != nil || fs.Exists("old01") {
+		t.Errorf("Delete() = %v, left %v", err, fs.Exists("old01"))
+	}
+}
@@ -0,0 +1,22 @@
+package storage
+
+import "time"
+
+// FocalPoint is the subject of an image, as fractions (0-1) of the width
+// and height of its original variant.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// SetImageFocalPoint stores the focal point of an image; nil clears it.
+// It bumps updated_at, the cover variants are rendered anew.
+func (db *DB) SetImageFocalPoint(slug string, focal *FocalPoint) error {
+	var x, y any
+	if focal != nil {
+		x, y = focal.X, focal.Y
+	}
+	_, err := db.conn.Exec(`UPDATE images SET focal_x = ?, focal_y = ?, updated_at = ? WHERE slug = ?`,
+		x, y, time.Now().Unix(), slug)
+	return err
+}
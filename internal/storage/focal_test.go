@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDB_SetImageFocalPoint(t *testing.T) {
+	db := testDB(t)
+	old := time.Now().Add(-time.Hour).Unix()
+	db.InsertImage(&Image{Slug: "face1", MimeType: "image/jpeg", CreatedAt: old, UpdatedAt: old, AccessedAt: old})
+
+	if img, _ := db.GetImageBySlug("face1"); img.Focal != nil {
+		t.Fatalf("new image focal = %+v, want nil", img.Focal)
+	}
+
+	if err := db.SetImageFocalPoint("face1", &FocalPoint{X: 0.25, Y: 0.1}); err != nil {
+		t.Fatalf("SetImageFocalPoint() error = %v", err)
+	}
+	img, _ := db.GetImageBySlug("face1")
+	if img.Focal == nil || *img.Focal != (FocalPoint{X: 0.25, Y: 0.1}) {
+		t.Errorf("focal = %+v, want {0.25 0.1}", img.Focal)
+	}
+	if img.UpdatedAt <= old {
+		t.Error("setting the focal point should bump updated_at")
+	}
+
+	if err := db.SetImageFocalPoint("face1", nil); err != nil {
+		t.Fatalf("SetImageFocalPoint(nil) error = %v", err)
+	}
+	if img, _ := db.GetImageBySlug("face1"); img.Focal != nil {
+		t.Errorf("cleared focal = %+v, want nil", img.Focal)
+	}
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrChecksumMismatch means the bytes of a blob no longer hash to the
+// SHA-256 it is named after.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ReadVerified is Read that also checks a content-addressed file against
+// the hash of its blob. Files stored at their own key have no checksum.
+func (fs *Filesystem) ReadVerified(key string) ([]byte, error) {
+	storeKey, ref, err := fs.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.store.Get(storeKey)
+	if err != nil || ref == nil {
+		return data, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, fmt.Errorf("%s: %w", storeKey, ErrChecksumMismatch)
+	}
+	return data, nil
+}
+
+// SaveRepaired is Save that writes the blob even when its row exists, so
+// that re-rendering a variant replaces a blob file that went missing or got
+// damaged even when the new bytes hash the same.
+func (fs *Filesystem) SaveRepaired(slug, sizeName string, data []byte) error {
+	return fs.putBlob(slug, sizeName+".webp", data, true)
+}
+
+// Claim marks slug as taken by an upload that stores files before it
+// inserts the image row. Until release is called DeleteOrphan leaves the
+// files alone, however long processing takes.
+func (fs *Filesystem) Claim(slug string) (release func()) {
+	fs.claimMu.Lock()
+	defer fs.claimMu.Unlock()
+	if fs.claims == nil {
+		fs.claims = make(map[string]int)
+	}
+	fs.claims[slug]++
+	return sync.OnceFunc(func() {
+		fs.claimMu.Lock()
+		defer fs.claimMu.Unlock()
+		if fs.claims[slug]--; fs.claims[slug] <= 0 {
+			delete(fs.claims, slug)
+		}
+	})
+}
+
+// DeleteOrphan deletes everything stored for slug unless an image row has
+// it (trashed rows count) or an upload holds a Claim on it, and reports
+// whether it did. The checks and the delete happen under the claim lock,
+// so an upload claiming the slug meanwhile waits and then writes afresh.
+func (fs *Filesystem) DeleteOrphan(slug string) (bool, error) {
+	fs.claimMu.Lock()
+	defer fs.claimMu.Unlock()
+	if fs.claims[slug] > 0 {
+		return false, nil
+	}
+	exists, err := fs.db.SlugExists("images", slug)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := fs.Delete(slug); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StoreOrphans is what FindOrphans found out of step between the store
+// and the database.
+type StoreOrphans struct {
+	Slugs        []string // slugs with stored files but no image row
+	Blobs        []string // store keys of blob files without a blob row
+	MissingBlobs []string // hashes of blob rows whose file is gone
+}
+
+// FindOrphans compares the whole store with the database. Files written
+// less than grace ago are skipped, they may belong to an upload whose row
+// is not inserted yet; uploads running longer are protected by Claim, which
+// DeleteOrphan checks.
+func (fs *Filesystem) FindOrphans(grace time.Duration) (*StoreOrphans, error) {
+	cutoff := time.Now().Add(-grace)
+	orphans := &StoreOrphans{}
+
+	// rows first: a blob stored after this has its file listed below too
+	known, err := fs.db.getBlobExts()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := fs.store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("list store: %w", err)
+	}
+
+	listed := make(map[string]bool)
+	slugFiles := make(map[string]time.Time) // newest file of each slug
+	for _, b := range blobs {
+		if rest, ok := strings.CutPrefix(b.Key, "blobs/"); ok {
+			hash := strings.TrimSuffix(path.Base(rest), path.Ext(rest))
+			listed[hash] = true
+			if _, ok := known[hash]; !ok && b.ModTime.Before(cutoff) {
+				orphans.Blobs = append(orphans.Blobs, b.Key)
+			}
+			continue
+		}
+		if slug, _, ok := splitKey(b.Key); ok && b.ModTime.After(slugFiles[slug]) {
+			slugFiles[slug] = b.ModTime
+		}
+	}
+
+	for hash, ext := range known {
+		if listed[hash] {
+			continue
+		}
+		// collected since the rows were read?
+		if ok, err := fs.db.BlobKnown(hash); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if _, err := fs.store.Stat(blobKey(hash, ext)); errors.Is(err, os.ErrNotExist) {
+			orphans.MissingBlobs = append(orphans.MissingBlobs, hash)
+		}
+	}
+
+	slugs, err := fs.db.imageSlugs()
+	if err != nil {
+		return nil, err
+	}
+	for slug, newest := range slugFiles {
+		if !slugs[slug] && newest.Before(cutoff) {
+			orphans.Slugs = append(orphans.Slugs, slug)
+		}
+	}
+	refSlugs, err := fs.db.GetOrphanBlobSlugs()
+	if err != nil {
+		return nil, err
+	}
+	for _, slug := range refSlugs {
+		if _, ok := slugFiles[slug]; ok {
+			continue // reported above
+		}
+		refs, err := fs.db.GetBlobRefs(slug)
+		if err != nil {
+			return nil, err
+		}
+		var newest int64
+		for _, ref := range refs {
+			newest = max(newest, ref.UpdatedAt)
+		}
+		if time.Unix(0, newest).Before(cutoff) {
+			orphans.Slugs = append(orphans.Slugs, slug)
+		}
+	}
+	sort.Strings(orphans.Slugs)
+	sort.Strings(orphans.MissingBlobs)
+	return orphans, nil
+}
+
+// DeleteOrphanBlob removes a blob file FindOrphans reported. It reports
+// false when the blob got a row since, stored again by an upload.
+func (fs *Filesystem) DeleteOrphanBlob(key string) (bool, error) {
+	rest, ok := strings.CutPrefix(key, "blobs/")
+	if !ok {
+		return false, fmt.Errorf("%s is not a blob", key)
+	}
+	hash := strings.TrimSuffix(path.Base(rest), path.Ext(rest))
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return true, fs.store.Delete(key) // not named by put at all
+	}
+
+	mu := fs.lock(hash)
+	mu.Lock()
+	defer mu.Unlock()
+	if known, err := fs.db.BlobKnown(hash); err != nil || known {
+		return false, err
+	}
+	return true, fs.store.Delete(key)
+}
+
+// getBlobExts returns the extension of every blob, by hash.
+func (db *DB) getBlobExts() (map[string]string, error) {
+	rows, err := db.conn.Query(`SELECT hash, ext FROM blobs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exts := make(map[string]string)
+	for rows.Next() {
+		var hash, ext string
+		if err := rows.Scan(&hash, &ext); err != nil {
+			return nil, err
+		}
+		exts[hash] = ext
+	}
+	return exts, rows.Err()
+}
+
+func (db *DB) imageSlugs() (map[string]bool, error) {
+	rows, err := db.conn.Query(`SELECT slug FROM images`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slugs := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		slugs[slug] = true
+	}
+	return slugs, rows.Err()
+}
+
+// GetReadyImagesAfter pages through the ready images by id, leaving out
+// the trashed ones: some of their files are in the trash.
+func (db *DB) GetReadyImagesAfter(afterID int64, limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE id > ? AND status = ? AND deleted_at IS NULL ORDER BY id LIMIT ?`,
+		afterID, ImageStatusReady, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// SetImageIntegrityError flags an image with what is wrong with its files;
+// an empty reason clears the flag.
+func (db *DB) SetImageIntegrityError(slug, reason string) error {
+	_, err := db.conn.Exec(`UPDATE images SET integrity_error = ? WHERE slug = ?`, nullString(reason), slug)
+	return err
+}
+
+// GetFlaggedImages returns the images SetImageIntegrityError flagged.
+func (db *DB) GetFlaggedImages(limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE integrity_error IS NOT NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
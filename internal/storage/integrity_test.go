@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesystem_ReadVerified(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+	fs.Save("abc12", "original", []byte("data"))
+	fs.store.Put(fs.Key("old12", "original"), []byte("legacy"))
+
+	if data, err := fs.ReadVerified(fs.Key("abc12", "original")); err != nil || string(data) != "data" {
+		t.Errorf("ReadVerified() = %q, %v", data, err)
+	}
+	if data, err := fs.ReadVerified(fs.Key("old12", "original")); err != nil || string(data) != "legacy" {
+		t.Errorf("ReadVerified(legacy) = %q, %v", data, err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "images", blobKey(dataHash, ".webp")), []byte("rot!"), 0644)
+	if _, err := fs.ReadVerified(fs.Key("abc12", "original")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("ReadVerified(damaged) error = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := fs.ReadVerified(fs.Key("nope1", "original")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadVerified(missing) error = %v, want ErrNotExist", err)
+	}
+}
+
+func TestFilesystem_SaveRepaired(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+	fs.Save("abc12", "original", []byte("data"))
+	fs.Save("def34", "original", []byte("data"))
+	os.Remove(filepath.Join(dir, "images", blobKey(dataHash, ".webp")))
+
+	// the blob is known, a plain Save would not write it again
+	if err := fs.SaveRepaired("abc12", "original", []byte("data")); err != nil {
+		t.Fatalf("SaveRepaired() error = %v", err)
+	}
+	for _, slug := range []string{"abc12", "def34"} {
+		if data, err := fs.ReadVerified(fs.Key(slug, "original")); err != nil || string(data) != "data" {
+			t.Errorf("%s after repair = %q, %v", slug, data, err)
+		}
+	}
+	if n := blobRefcount(t, fs.db, dataHash); n != 2 {
+		t.Errorf("refcount = %d, want 2", n)
+	}
+}
+
+func TestFilesystem_FindOrphans(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+	now := time.Now().Unix()
+
+	fs.db.InsertImage(&Image{Slug: "good1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("good1", "original", []byte("good"))
+	fs.db.InsertImage(&Image{Slug: "lost1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("lost1", "original", []byte("lost"))
+	os.Remove(filepath.Join(dir, "images", blobKey(sha256Hex([]byte("lost")), ".webp")))
+	// files of a failed gallery upload, row never inserted
+	fs.Save("orph1", "original", []byte("orphan"))
+	fs.store.Put(fs.Key("orph2", "thumb"), []byte("legacy orphan"))
+	// a blob written without its row
+	stray := blobKey(sha256Hex([]byte("stray")), ".webp")
+	fs.store.Put(stray, []byte("stray"))
+
+	if orphans, err := fs.FindOrphans(time.Hour); err != nil || len(orphans.Slugs)+len(orphans.Blobs) != 0 {
+		t.Errorf("FindOrphans(grace) = %+v, %v, want fresh files skipped", orphans, err)
+	}
+
+	orphans, err := fs.FindOrphans(0)
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if strings.Join(orphans.Slugs, ",") != "orph1,orph2" {
+		t.Errorf("Slugs = %q", orphans.Slugs)
+	}
+	if strings.Join(orphans.Blobs, ",") != stray {
+		t.Errorf("Blobs = %q, want %s", orphans.Blobs, stray)
+	}
+	if strings.Join(orphans.MissingBlobs, ",") != sha256Hex([]byte("lost")) {
+		t.Errorf("MissingBlobs = %q", orphans.MissingBlobs)
+	}
+
+	if deleted, err := fs.DeleteOrphanBlob(stray); err != nil || !deleted {
+		t.Errorf("DeleteOrphanBlob() = %v, %v", deleted, err)
+	}
+	fs.Save("good1", "thumb", []byte("good thumb"))
+	if deleted, _ := fs.DeleteOrphanBlob(blobKey(sha256Hex([]byte("good thumb")), ".webp")); deleted {
+		t.Error("DeleteOrphanBlob() removed a blob with a row")
+	}
+	if _, err := fs.store.Stat(stray); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stray blob left: %v", err)
+	}
+}
+
+func TestFilesystem_DeleteOrphan(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	now := time.Now().Unix()
+	fs.db.InsertImage(&Image{Slug: "good1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("good1", "original", []byte("good"))
+	// an upload still processing, its row not inserted yet
+	release := fs.Claim("slow1")
+	fs.Save("slow1", "original", []byte("slow"))
+
+	if deleted, err := fs.DeleteOrphan("good1"); err != nil || deleted || !fs.Exists("good1") {
+		t.Errorf("DeleteOrphan(with row) = %v, %v", deleted, err)
+	}
+	if deleted, err := fs.DeleteOrphan("slow1"); err != nil || deleted || !fs.Exists("slow1") {
+		t.Errorf("DeleteOrphan(claimed) = %v, %v", deleted, err)
+	}
+
+	release()
+	release() // a second call is a no-op
+	if deleted, err := fs.DeleteOrphan("slow1"); err != nil || !deleted || fs.Exists("slow1") {
+		t.Errorf("DeleteOrphan(released) = %v, %v", deleted, err)
+	}
+}
+
+func TestDB_IntegrityError(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "abc12", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	db.InsertImage(&Image{Slug: "def34", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+
+	if err := db.SetImageIntegrityError("abc12", "original.webp: missing"); err != nil {
+		t.Fatalf("SetImageIntegrityError() error = %v", err)
+	}
+	flagged, err := db.GetFlaggedImages(10)
+	if err != nil || len(flagged) != 1 || flagged[0].IntegrityError != "original.webp: missing" {
+		t.Errorf("GetFlaggedImages() = %v, %v", flagged, err)
+	}
+	if admin, _ := db.ListImagesAdminSortedFiltered(10, 0, "", "", "abc12", ""); len(admin) != 1 || admin[0].IntegrityError == "" {
+		t.Errorf("admin list does not show the flag: %+v", admin)
+	}
+
+	db.SetImageIntegrityError("abc12", "")
+	if flagged, _ := db.GetFlaggedImages(10); len(flagged) != 0 {
+		t.Errorf("GetFlaggedImages() after clearing = %d images", len(flagged))
+	}
+
+	page, _ := db.GetReadyImagesAfter(0, 1)
+	if len(page) != 1 || page[0].Slug != "abc12" {
+		t.Fatalf("GetReadyImagesAfter(0) = %v", page)
+	}
+	if page, _ := db.GetReadyImagesAfter(page[0].ID, 10); len(page) != 1 || page[0].Slug != "def34" {
+		t.Errorf("GetReadyImagesAfter(next) = %v", page)
+	}
+}
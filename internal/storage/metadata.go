@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// ImageMetadata holds the EXIF/XMP fields kept for an image. GPS is only
+// stored when the uploader opted in.
+type ImageMetadata struct {
+	ImageID      int64    `json:"-"`
+	CameraMake   string   `json:"camera_make,omitempty"`
+	CameraModel  string   `json:"camera_model,omitempty"`
+	LensModel    string   `json:"lens_model,omitempty"`
+	TakenAt      string   `json:"taken_at,omitempty"`
+	ExposureTime string   `json:"exposure_time,omitempty"`
+	FNumber      float64  `json:"f_number,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focal_length,omitempty"`
+	GPSLat       *float64 `json:"gps_lat,omitempty"`
+	GPSLon       *float64 `json:"gps_lon,omitempty"`
+}
+
+// Camera returns make and model, without repeating the make when the model
+// already starts with it ("Canon Canon EOS R5").
+func (m *ImageMetadata) Camera() string {
+	if m.CameraMake == "" || strings.HasPrefix(strings.ToLower(m.CameraModel), strings.ToLower(m.CameraMake)) {
+		return m.CameraModel
+	}
+	if m.CameraModel == "" {
+		return m.CameraMake
+	}
+	return m.CameraMake + " " + m.CameraModel
+}
+
+func (m *ImageMetadata) HasGPS() bool {
+	return m.GPSLat != nil && m.GPSLon != nil
+}
+
+func (db *DB) InsertImageMetadata(m *ImageMetadata) error {
+	_, err := db.conn.Exec(`
+		INSERT OR REPLACE INTO image_metadata (image_id, camera_make, camera_model, lens_model, taken_at, exposure_time, f_number, iso, focal_length, gps_lat, gps_lon)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.ImageID, nullString(m.CameraMake), nullString(m.CameraModel), nullString(m.LensModel), nullString(m.TakenAt),
+		nullString(m.ExposureTime), nullFloat(m.FNumber), nullInt(m.ISO), nullFloat(m.FocalLength), m.GPSLat, m.GPSLon)
+	return err
+}
+
+// GetImageMetadata returns nil when the image has no stored metadata.
+func (db *DB) GetImageMetadata(imageID int64) (*ImageMetadata, error) {
+	m := &ImageMetadata{ImageID: imageID}
+	var make_, model, lens, takenAt, exposure sql.NullString
+	var fNumber, focal sql.NullFloat64
+	var iso sql.NullInt64
+	err := db.conn.QueryRow(`
+		SELECT camera_make, camera_model, lens_model, taken_at, exposure_time, f_number, iso, focal_length, gps_lat, gps_lon
+		FROM image_metadata WHERE image_id = ?`, imageID).
+		Scan(&make_, &model, &lens, &takenAt, &exposure, &fNumber, &iso, &focal, &m.GPSLat, &m.GPSLon)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.CameraMake = make_.String
+	m.CameraModel = model.String
+	m.LensModel = lens.String
+	m.TakenAt = takenAt.String
+	m.ExposureTime = exposure.String
+	m.FNumber = fNumber.Float64
+	m.ISO = int(iso.Int64)
+	m.FocalLength = focal.Float64
+	return m, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullFloat(f float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: f, Valid: f != 0}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
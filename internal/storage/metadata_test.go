@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDB_ImageMetadata_RoundTrip(t *testing.T) {
+	db := testDB(t)
+
+	now := time.Now().Unix()
+	id, err := db.InsertImage(&Image{Slug: "exif1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	if err != nil {
+		t.Fatalf("InsertImage() error = %v", err)
+	}
+
+	lat, lon := 52.2297, 21.0122
+	want := &ImageMetadata{
+		ImageID:      id,
+		CameraMake:   "Canon",
+		CameraModel:  "Canon EOS R5",
+		LensModel:    "RF50mm F1.8 STM",
+		TakenAt:      "2024-04-30 18:42:07",
+		ExposureTime: "1/250",
+		FNumber:      2.8,
+		ISO:          400,
+		FocalLength:  50,
+		GPSLat:       &lat,
+		GPSLon:       &lon,
+	}
+	if err := db.InsertImageMetadata(want); err != nil {
+		t.Fatalf("InsertImageMetadata() error = %v", err)
+	}
+
+	got, err := db.GetImageMetadata(id)
+	if err != nil {
+		t.Fatalf("GetImageMetadata() error = %v", err)
+	}
+	if got == nil {
+		t.Fatal("GetImageMetadata() = nil")
+	}
+	if got.Camera() != "Canon EOS R5" || got.LensModel != want.LensModel || got.TakenAt != want.TakenAt {
+		t.Errorf("got %+v", got)
+	}
+	if got.ExposureTime != "1/250" || got.FNumber != 2.8 || got.ISO != 400 || got.FocalLength != 50 {
+		t.Errorf("exposure fields = %+v", got)
+	}
+	if !got.HasGPS() || *got.GPSLat != lat || *got.GPSLon != lon {
+		t.Errorf("GPS = %v, %v", got.GPSLat, got.GPSLon)
+	}
+}
+
+func TestDB_ImageMetadata_NotFound(t *testing.T) {
+	db := testDB(t)
+
+	got, err := db.GetImageMetadata(12345)
+	if err != nil {
+		t.Fatalf("GetImageMetadata() error = %v", err)
+	}
+	if got != nil {
+		t.Errorf("GetImageMetadata() = %+v, want nil", got)
+	}
+}
+
+func TestDB_ImageMetadata_DeletedWithImage(t *testing.T) {
+	db := testDB(t)
+
+	now := time.Now().Unix()
+	id, _ := db.InsertImage(&Image{Slug: "exif2", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	if err := db.InsertImageMetadata(&ImageMetadata{ImageID: id, CameraModel: "X-T4"}); err != nil {
+		t.Fatalf("InsertImageMetadata() error = %v", err)
+	}
+
+	if err := db.DeleteImageBySlug("exif2"); err != nil {
+		t.Fatalf("DeleteImageBySlug() error = %v", err)
+	}
+
+	got, err := db.GetImageMetadata(id)
+	if err != nil {
+		t.Fatalf("GetImageMetadata() error = %v", err)
+	}
+	if got != nil {
+		t.Errorf("metadata should be deleted with image, got %+v", got)
+	}
+}
+
+func TestImageMetadata_Camera(t *testing.T) {
+	tests := []struct {
+		make, model, want string
+	}{
+		{"Canon", "Canon EOS R5", "Canon EOS R5"},
+		{"FUJIFILM", "X-T4", "FUJIFILM X-T4"},
+		{"", "X-T4", "X-T4"},
+		{"Apple", "", "Apple"},
+	}
+	for _, tt := range tests {
+		m := &ImageMetadata{CameraMake: tt.make, CameraModel: tt.model}
+		if got := m.Camera(); got != tt.want {
+			t.Errorf("Camera(%q, %q) = %q, want %q", tt.make, tt.model, got, tt.want)
+		}
+	}
+}
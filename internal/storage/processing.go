@@ -0,0 +1,99 @@
+package storage
+
+import "time"
+
+// Image processing states, see Image.Status.
+const (
+	ImageStatusPending = "pending"
+	ImageStatusReady   = "ready"
+	ImageStatusFailed  = "failed"
+	// ImageStatusWriting is the first phase of storing an upload: the row
+	// exists, the variants are not all durable yet. A row left in it by a
+	// crash is removed at startup, see Filesystem.RecoverInterruptedWrites.
+	ImageStatusWriting = "writing"
+)
+
+// MarkImageReady ends the writing phase once the variants are stored. It
+// reports false when the row is gone or not being written.
+func (db *DB) MarkImageReady(slug string) (bool, error) {
+	res, err := db.conn.Exec(`UPDATE images SET status = ? WHERE slug = ? AND status = ?`,
+		ImageStatusReady, slug, ImageStatusWriting)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CompleteImageProcessing stores what background processing computed and
+// marks the image ready. It reports false when the row is gone, the image
+// was deleted while it was being processed.
+func (db *DB) CompleteImageProcessing(img *Image) (bool, error) {
+	frames := max(img.Frames, 1)
+	res, err := db.conn.Exec(`
+		UPDATE images SET file_size = ?, width = ?, height = ?, frames = ?, lqip = ?, dominant_color = ?,
+			phash = ?, pixel_sha = ?, watermark_key = ?, status = ?, processing_error = NULL, updated_at = ?
+		WHERE slug = ?`,
+		img.FileSize, img.Width, img.Height, frames, nullString(img.LQIP), nullString(img.DominantColor),
+		nullHash(img.PHash, img.PixelSHA), nullString(img.PixelSHA), img.WatermarkKey, ImageStatusReady, time.Now().Unix(),
+		img.Slug)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// FailImageProcessing marks the image failed with a reason for the admin
+// panel. Like CompleteImageProcessing it reports false for a deleted row.
+func (db *DB) FailImageProcessing(slug, reason string) (bool, error) {
+	res, err := db.conn.Exec(`UPDATE images SET status = ?, processing_error = ? WHERE slug = ?`,
+		ImageStatusFailed, reason, slug)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RetryImageProcessing moves a failed image back to pending. It reports
+// false when the image is not failed, so that two retries do not queue it
+// twice.
+func (db *DB) RetryImageProcessing(slug string) (bool, error) {
+	res, err := db.conn.Exec(`UPDATE images SET status = ?, processing_error = NULL WHERE slug = ? AND status = ?`,
+		ImageStatusPending, slug, ImageStatusFailed)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetImagesByStatus returns images in the given state, oldest first.
+func (db *DB) GetImagesByStatus(status string, limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE status = ? ORDER BY id LIMIT ?`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// CountImagesByStatus counts images per state; ready ones are included.
+func (db *DB) CountImagesByStatus() (map[string]int, error) {
+	rows, err := db.conn.Query(`SELECT status, COUNT(*) FROM images GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDB_ImageProcessingStatus(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "ready", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	db.InsertImage(&Image{Slug: "big01", MimeType: "image/jpeg", Status: ImageStatusPending, CreatedAt: now, AccessedAt: now})
+
+	if img, _ := db.GetImageBySlug("ready"); img.Status != ImageStatusReady {
+		t.Errorf("default status = %q, want ready", img.Status)
+	}
+	pending, err := db.GetImagesByStatus(ImageStatusPending, 10)
+	if err != nil || len(pending) != 1 || pending[0].Slug != "big01" {
+		t.Fatalf("GetImagesByStatus(pending) = %v, %v", pending, err)
+	}
+
+	// backfills leave unprocessed images alone
+	if imgs, _ := db.GetImagesWithoutPlaceholder(10); len(imgs) != 1 || imgs[0].Slug != "ready" {
+		t.Errorf("GetImagesWithoutPlaceholder() = %d images, want only the ready one", len(imgs))
+	}
+
+	if ok, err := db.FailImageProcessing("big01", "vips: out of memory"); !ok || err != nil {
+		t.Fatalf("FailImageProcessing() = %v, %v", ok, err)
+	}
+	img, _ := db.GetImageBySlug("big01")
+	if img.Status != ImageStatusFailed || img.ProcessingError != "vips: out of memory" {
+		t.Errorf("after failure status=%q error=%q", img.Status, img.ProcessingError)
+	}
+
+	if ok, _ := db.RetryImageProcessing("big01"); !ok {
+		t.Fatal("RetryImageProcessing() of a failed image = false")
+	}
+	if ok, _ := db.RetryImageProcessing("big01"); ok {
+		t.Error("RetryImageProcessing() of a pending image = true")
+	}
+
+	done := &Image{Slug: "big01", FileSize: 4096, Width: 8000, Height: 6000, Frames: 1, LQIP: "data:x", DominantColor: "#102030", PHash: 42, PixelSHA: "abc"}
+	if ok, err := db.CompleteImageProcessing(done); !ok || err != nil {
+		t.Fatalf("CompleteImageProcessing() = %v, %v", ok, err)
+	}
+	img, _ = db.GetImageBySlug("big01")
+	if img.Status != ImageStatusReady || img.ProcessingError != "" || img.Width != 8000 || img.PixelSHA != "abc" || img.UpdatedAt == 0 {
+		t.Errorf("after completion = %+v", img)
+	}
+
+	counts, err := db.CountImagesByStatus()
+	if err != nil || counts[ImageStatusReady] != 2 || counts[ImageStatusPending] != 0 {
+		t.Errorf("CountImagesByStatus() = %v, %v", counts, err)
+	}
+
+	// the image was deleted while it was processed
+	db.DeleteImageBySlug("big01")
+	if ok, err := db.CompleteImageProcessing(done); ok || err != nil {
+		t.Errorf("CompleteImageProcessing() of a deleted image = %v, %v", ok, err)
+	}
+	if ok, err := db.FailImageProcessing("big01", "x"); ok || err != nil {
+		t.Errorf("FailImageProcessing() of a deleted image = %v, %v", ok, err)
+	}
+}
+
+func TestDB_MarkImageReady(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "new01", MimeType: "image/jpeg", Status: ImageStatusWriting, PixelSHA: "abc", CreatedAt: now, AccessedAt: now})
+
+	// a half-written image is nobody's duplicate
+	if dup, _ := db.FindDuplicateImage(0, "abc", -1, nil); dup != nil {
+		t.Errorf("FindDuplicateImage() = %s while it is written", dup.Slug)
+	}
+	if ok, err := db.MarkImageReady("new01"); !ok || err != nil {
+		t.Fatalf("MarkImageReady() = %v, %v", ok, err)
+	}
+	if img, _ := db.GetImageBySlug("new01"); img.Status != ImageStatusReady {
+		t.Errorf("status = %q", img.Status)
+	}
+	if ok, _ := db.MarkImageReady("new01"); ok {
+		t.Error("MarkImageReady() of a ready image = true")
+	}
+	if dup, _ := db.FindDuplicateImage(0, "abc", -1, nil); dup == nil {
+		t.Error("FindDuplicateImage() misses the ready image")
+	}
+}
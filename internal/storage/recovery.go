@@ -0,0 +1,73 @@
+package storage
+
+import "fmt"
+
+// RecoveryReport counts what RecoverInterruptedWrites cleaned up.
+type RecoveryReport struct {
+	TempFiles  int // temporary files of interrupted writes
+	Unfinished int // images left in ImageStatusWriting
+	Orphans    int // slugs with stored files but no image row
+	Blobs      int // blobs no file references
+}
+
+func (r RecoveryReport) Empty() bool {
+	return r == RecoveryReport{}
+}
+
+// tempCleaner is implemented by stores whose writes can leave temporary
+// files behind.
+type tempCleaner interface {
+	RemoveTempFiles() (int, error)
+}
+
+// RecoverInterruptedWrites removes what a crash in the middle of storing an
+// upload left behind. Writes of single files are atomic, so only whole
+// slugs can be half-written: images still in ImageStatusWriting and files
+// stored before their row was inserted. It must run at startup, before
+// anything is uploaded.
+func (fs *Filesystem) RecoverInterruptedWrites() (RecoveryReport, error) {
+	var report RecoveryReport
+	if cleaner, ok := fs.store.(tempCleaner); ok {
+		n, err := cleaner.RemoveTempFiles()
+		if err != nil {
+			return report, fmt.Errorf("remove temp files: %w", err)
+		}
+		report.TempFiles = n
+	}
+
+	unfinished, err := fs.db.GetImagesByStatus(ImageStatusWriting, 10000)
+	if err != nil {
+		return report, err
+	}
+	for _, img := range unfinished {
+		if err := fs.Delete(img.Slug); err != nil {
+			return report, fmt.Errorf("delete files of %s: %w", img.Slug, err)
+		}
+		if err := fs.db.DeleteImageBySlug(img.Slug); err != nil {
+			return report, fmt.Errorf("delete %s: %w", img.Slug, err)
+		}
+		report.Unfinished++
+	}
+
+	orphans, err := fs.db.GetOrphanBlobSlugs()
+	if err != nil {
+		return report, err
+	}
+	for _, slug := range orphans {
+		if err := fs.Delete(slug); err != nil {
+			return report, fmt.Errorf("delete files of %s: %w", slug, err)
+		}
+		report.Orphans++
+	}
+
+	for {
+		n, err := fs.CollectBlobs(500)
+		report.Blobs += n
+		if err != nil {
+			return report, err
+		}
+		if n < 500 {
+			return report, nil
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecoverInterruptedWrites(t *testing.T) {
+	fs, dir := localTestFilesystem(t)
+	now := time.Now().Unix()
+
+	// stored completely
+	fs.db.InsertImage(&Image{Slug: "done1", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	fs.Save("done1", "original", []byte("done"))
+	// crashed while the variants were written
+	fs.db.InsertImage(&Image{Slug: "half1", MimeType: "image/jpeg", Status: ImageStatusWriting, CreatedAt: now, AccessedAt: now})
+	fs.Save("half1", "original", []byte("half"))
+	// crashed after the kept upload, before the row
+	fs.SaveOriginal("orph1", "original", []byte("jpeg"), "image/jpeg")
+	// crashed in the middle of a file
+	os.WriteFile(filepath.Join(dir, "images", "blobs", tempPrefix+"x.webp-1"), []byte("tr"), 0644)
+
+	report, err := fs.RecoverInterruptedWrites()
+	if err != nil {
+		t.Fatalf("RecoverInterruptedWrites() error = %v", err)
+	}
+	want := RecoveryReport{TempFiles: 1, Unfinished: 1, Orphans: 1}
+	if report != want {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+
+	if img, _ := fs.db.GetImageBySlug("half1"); img != nil || fs.Exists("half1") {
+		t.Error("half-written image left")
+	}
+	if fs.Exists("orph1") {
+		t.Error("files without an image row left")
+	}
+	if data, err := fs.Read(fs.Key("done1", "original")); err != nil || string(data) != "done" {
+		t.Errorf("complete image damaged: %q, %v", data, err)
+	}
+	if usage, _ := fs.GetDiskUsage(); usage != 4 {
+		t.Errorf("GetDiskUsage() = %d, want only the complete image", usage)
+	}
+
+	if report, _ := fs.RecoverInterruptedWrites(); !report.Empty() {
+		t.Errorf("second pass = %+v, want nothing to do", report)
+	}
+}
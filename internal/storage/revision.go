@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ImageRevision records one edit of an image: the transform parameters as
+// JSON and the size of the result, which is kept as rev_{id}.webp.
+type ImageRevision struct {
+	ID           int64
+	ImageID      int64
+	Params       string // JSON of image.TransformParams
+	FromSource   bool   // rendered from the untouched source, can be re-rendered from Params
+	RevertedFrom *int64 // set when the revision restores an earlier one
+	Width        int
+	Height       int
+	FileSize     int64
+	CreatedAt    int64
+}
+
+const revisionColumns = `id, image_id, params, from_source, reverted_from, width, height, file_size, created_at`
+
+func scanRevision(row rowScanner) (*ImageRevision, error) {
+	rev := &ImageRevision{}
+	err := row.Scan(&rev.ID, &rev.ImageID, &rev.Params, &rev.FromSource, &rev.RevertedFrom, &rev.Width, &rev.Height, &rev.FileSize, &rev.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rev, err
+}
+
+// InsertImageRevision stores rev and sets its ID and CreatedAt.
+func (db *DB) InsertImageRevision(rev *ImageRevision) error {
+	rev.CreatedAt = time.Now().Unix()
+	if rev.Params == "" {
+		rev.Params = "{}"
+	}
+	res, err := db.conn.Exec(`
+		INSERT INTO image_revisions (image_id, params, from_source, reverted_from, width, height, file_size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rev.ImageID, rev.Params, rev.FromSource, rev.RevertedFrom, rev.Width, rev.Height, rev.FileSize, rev.CreatedAt)
+	if err != nil {
+		return err
+	}
+	rev.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetImageRevisions returns the revisions of an image, newest first.
+func (db *DB) GetImageRevisions(imageID int64) ([]*ImageRevision, error) {
+	rows, err := db.conn.Query(`SELECT `+revisionColumns+` FROM image_revisions WHERE image_id = ? ORDER BY id DESC`, imageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*ImageRevision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// GetImageRevision returns nil when the revision does not belong to the image.
+func (db *DB) GetImageRevision(imageID, id int64) (*ImageRevision, error) {
+	return scanRevision(db.conn.QueryRow(`SELECT `+revisionColumns+` FROM image_revisions WHERE image_id = ? AND id = ?`, imageID, id))
+}
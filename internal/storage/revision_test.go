@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDB_ImageRevisions(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	imageID, _ := db.InsertImage(&Image{Slug: "img01", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	otherID, _ := db.InsertImage(&Image{Slug: "img02", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+
+	first := &ImageRevision{ImageID: imageID, Params: `{"rotation":90}`, FromSource: true, Width: 300, Height: 400, FileSize: 1234}
+	if err := db.InsertImageRevision(first); err != nil {
+		t.Fatalf("InsertImageRevision() error = %v", err)
+	}
+	if first.ID == 0 || first.CreatedAt == 0 {
+		t.Errorf("ID/CreatedAt not set: %+v", first)
+	}
+	second := &ImageRevision{ImageID: imageID, RevertedFrom: &first.ID}
+	db.InsertImageRevision(second)
+	db.InsertImageRevision(&ImageRevision{ImageID: otherID})
+
+	revs, err := db.GetImageRevisions(imageID)
+	if err != nil {
+		t.Fatalf("GetImageRevisions() error = %v", err)
+	}
+	if len(revs) != 2 || revs[0].ID != second.ID || revs[1].ID != first.ID {
+		t.Fatalf("GetImageRevisions() = %+v, want newest first", revs)
+	}
+	if revs[0].Params != "{}" || revs[0].RevertedFrom == nil || *revs[0].RevertedFrom != first.ID {
+		t.Errorf("second revision = %+v", revs[0])
+	}
+	if !revs[1].FromSource || revs[1].Width != 300 || revs[1].Params != `{"rotation":90}` {
+		t.Errorf("first revision = %+v", revs[1])
+	}
+
+	if rev, _ := db.GetImageRevision(otherID, first.ID); rev != nil {
+		t.Error("GetImageRevision() returned a revision of another image")
+	}
+	if rev, _ := db.GetImageRevision(imageID, first.ID); rev == nil || rev.FileSize != 1234 {
+		t.Errorf("GetImageRevision() = %+v", rev)
+	}
+
+	db.DeleteImageBySlug("img01")
+	if revs, _ := db.GetImageRevisions(imageID); len(revs) != 0 {
+		t.Errorf("revisions after image delete = %d", len(revs))
+	}
+}
@@ -0,0 +1,280 @@
+// Package s3test runs an in-memory stand-in for an S3-compatible server
+// (path-style, like MinIO) for tests of storage.S3Store and its users. It
+// implements only what the store uses: PUT, GET and HEAD with Range,
+// DELETE and ListObjectsV2, and it checks SigV4 signatures, both in the
+// Authorization header and presigned in the query.
+package s3test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	Bucket    = "dajtu"
+	Region    = "eu-test-1"
+	AccessKey = "TESTACCESSKEY"
+	SecretKey = "test/secret+key"
+)
+
+type object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+type Server struct {
+	*httptest.Server
+	// MaxKeys is the page size of ListObjectsV2.
+	MaxKeys int
+
+	mu       sync.Mutex
+	objects  map[string]object
+	requests map[string]int // by method
+}
+
+// NewServer starts a server with an empty bucket Bucket; it is closed with
+// the test.
+func NewServer(t testing.TB) *Server {
+	s := &Server{MaxKeys: 1000, objects: make(map[string]object), requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Object returns a stored object by its full key.
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	return obj.data, ok
+}
+
+// Requests returns how many signed requests with method the server got.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+// Keys returns all stored keys, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if code := verify(r, body); code != "" {
+		s3Error(w, http.StatusForbidden, code)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			s3Error(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		s.list(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[r.Method]++
+	obj, ok := s.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[key] = object{data: body, contentType: r.Header.Get("Content-Type"), modTime: time.Now().UTC().Truncate(time.Second)}
+	case http.MethodDelete:
+		delete(s.objects, key)
+	}
+	s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if obj.contentType != "" {
+			w.Header().Set("Content-Type", obj.contentType)
+		}
+		sum := md5.Sum(obj.data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		http.ServeContent(w, r, "", obj.modTime, bytes.NewReader(obj.data))
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int    `xml:"Size"`
+}
+
+type listResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContents `xml:"Contents"`
+}
+
+// list answers ListObjectsV2; the continuation token is the last key sent.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, after := q.Get("prefix"), q.Get("continuation-token")
+	result := listResult{Name: Bucket, Prefix: prefix}
+	s.mu.Lock()
+	for _, key := range s.keysLocked() {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if len(result.Contents) == s.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, listContents{Key: key, LastModified: obj.modTime.Format("2006-01-02T15:04:05.000Z"), Size: len(obj.data)})
+	}
+	s.mu.Unlock()
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) keysLocked() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// verify checks the SigV4 signature of r and returns an S3 error code, or
+// "" when the request is signed correctly.
+func verify(r *http.Request, body []byte) string {
+	q := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := q.Get("X-Amz-Signature") != ""
+	if presigned {
+		credential, signedHeaders, signature = q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature")
+		amzDate, payloadHash = q.Get("X-Amz-Date"), "UNSIGNED-PAYLOAD"
+		date, err := time.Parse("20060102T150405Z", amzDate)
+		expires, _ := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(date.Add(time.Duration(expires)*time.Second)) {
+			return "AccessDenied"
+		}
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+		if !ok {
+			return "AccessDenied"
+		}
+		for _, field := range strings.Split(auth, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate, payloadHash = r.Header.Get("X-Amz-Date"), r.Header.Get("X-Amz-Content-Sha256")
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return "XAmzContentSHA256Mismatch"
+		}
+	}
+
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || scope[0] != AccessKey || len(amzDate) < 8 || scope[1] != amzDate[:8]+"/"+Region+"/s3/aws4_request" {
+		return "InvalidAccessKeyId"
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	uri, _, _ := strings.Cut(r.RequestURI, "?")
+	query := make(map[string]string)
+	for name := range q {
+		if name != "X-Amz-Signature" {
+			query[name] = q.Get(name)
+		}
+	}
+	canonical := strings.Join([]string{r.Method, uri, encodeQuery(query), headers.String(), signedHeaders, payloadHash}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope[1] + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + SecretKey)
+	for _, part := range []string{amzDate[:8], Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(signature)) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func encodeQuery(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		// QueryEscape encodes a space as + and leaves ~ alone; SigV4 wants %20
+		parts[i] = strings.ReplaceAll(url.QueryEscape(name), "+", "%20") + "=" + strings.ReplaceAll(url.QueryEscape(params[name]), "+", "%20")
+	}
+	return strings.Join(parts, "&")
+}
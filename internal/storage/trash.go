@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Deleted images and galleries go to the trash first: their rows get
+// deleted_at and deleted_by and drop out of every lookup and listing, the
+// files stored at their own key move to trash/XX/slug/, and blobs keep
+// their references. Until the trash is purged the admin panel can restore
+// them.
+
+// DeletedByOwner is deleted_by of content deleted with an edit token or by
+// its owner; admins are recorded as "admin:<nick>".
+const DeletedByOwner = "owner"
+
+// ErrNotInTrash is returned when restoring something that is not trashed,
+// or an image whose gallery is.
+var ErrNotInTrash = errors.New("not in trash")
+
+// TrashedImage is an image in the trash, as listed in the admin panel.
+type TrashedImage struct {
+	ID           int64
+	Slug         string
+	OriginalName string
+	FileSize     int64
+	OwnerName    string
+	GallerySlug  string
+	DeletedAt    int64
+	DeletedBy    string
+}
+
+// TrashedGallery is a gallery in the trash; ImageCount counts the images
+// trashed along with it.
+type TrashedGallery struct {
+	ID         int64
+	Slug       string
+	Title      string
+	OwnerName  string
+	ImageCount int
+	TotalSize  int64
+	DeletedAt  int64
+	DeletedBy  string
+}
+
+// TrashImage moves an image to the trash; trashing it again keeps the
+// first deletion.
+func (db *DB) TrashImage(slug, by string) error {
+	_, err := db.conn.Exec(`UPDATE images SET deleted_at = ?, deleted_by = ? WHERE slug = ? AND deleted_at IS NULL`,
+		time.Now().Unix(), by, slug)
+	return err
+}
+
+// TrashGallery moves a gallery and the images still in it to the trash,
+// all with the same deleted_at so that RestoreGallery brings back exactly
+// these images.
+func (db *DB) TrashGallery(id int64, by string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`UPDATE galleries SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL`, now, by, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE images SET deleted_at = ?, deleted_by = ? WHERE gallery_id = ? AND deleted_at IS NULL`, now, by, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestoreImage takes an image out of the trash. An image of a trashed
+// gallery comes back with its gallery only.
+func (db *DB) RestoreImage(slug string) error {
+	res, err := db.conn.Exec(`
+		UPDATE images SET deleted_at = NULL, deleted_by = NULL
+		WHERE slug = ? AND deleted_at IS NOT NULL
+		  AND (gallery_id IS NULL OR gallery_id NOT IN (SELECT id FROM galleries WHERE deleted_at IS NOT NULL))`, slug)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotInTrash
+	}
+	return nil
+}
+
+// RestoreGallery takes a gallery out of the trash together with the images
+// trashed along with it; the ones deleted earlier on their own stay there.
+// It returns the slugs of the restored images.
+func (db *DB) RestoreGallery(id int64) ([]string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var deletedAt sql.NullInt64
+	err = tx.QueryRow(`SELECT deleted_at FROM galleries WHERE id = ?`, id).Scan(&deletedAt)
+	if err == sql.ErrNoRows || (err == nil && !deletedAt.Valid) {
+		return nil, ErrNotInTrash
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT slug FROM images WHERE gallery_id = ? AND deleted_at = ?`, id, deletedAt.Int64)
+	if err != nil {
+		return nil, err
+	}
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE images SET deleted_at = NULL, deleted_by = NULL WHERE gallery_id = ? AND deleted_at = ?`, id, deletedAt.Int64); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE galleries SET deleted_at = NULL, deleted_by = NULL WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return slugs, tx.Commit()
+}
+
+// ImageTrashed reports whether the image is in the trash.
+func (db *DB) ImageTrashed(slug string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM images WHERE slug = ? AND deleted_at IS NOT NULL`, slug).Scan(&n)
+	return n > 0, err
+}
+
+// GalleryTrashed reports whether the gallery is in the trash.
+func (db *DB) GalleryTrashed(slug string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM galleries WHERE slug = ? AND deleted_at IS NOT NULL`, slug).Scan(&n)
+	return n > 0, err
+}
+
+// GetTrashedGallery returns a trashed gallery, nil when it is not trashed.
+func (db *DB) GetTrashedGallery(id int64) (*Gallery, error) {
+	g := &Gallery{}
+	err := db.conn.QueryRow(`
+		SELECT id, slug, edit_token, title, description, user_id, external_id, created_at, updated_at
+		FROM galleries WHERE id = ? AND deleted_at IS NOT NULL`, id).Scan(&g.ID, &g.Slug, &g.EditToken, &g.Title, &g.Description, &g.UserID, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+// ListTrashedImages lists the trashed images that can be restored on their
+// own, the most recently deleted first; those of trashed galleries are
+// counted with their gallery.
+func (db *DB) ListTrashedImages(limit int) ([]*TrashedImage, error) {
+	rows, err := db.conn.Query(`
+		SELECT i.id, i.slug, COALESCE(i.original_name, ''), i.file_size,
+		       COALESCE(u.display_name, ''), COALESCE(g.slug, ''),
+		       i.deleted_at, COALESCE(i.deleted_by, '')
+		FROM images i
+		LEFT JOIN users u ON u.id = i.user_id
+		LEFT JOIN galleries g ON g.id = i.gallery_id
+		WHERE i.deleted_at IS NOT NULL AND g.deleted_at IS NULL
+		ORDER BY i.deleted_at DESC, i.id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []*TrashedImage
+	for rows.Next() {
+		img := &TrashedImage{}
+		if err := rows.Scan(&img.ID, &img.Slug, &img.OriginalName, &img.FileSize, &img.OwnerName, &img.GallerySlug, &img.DeletedAt, &img.DeletedBy); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// ListTrashedGalleries lists the trashed galleries, the most recently
+// deleted first.
+func (db *DB) ListTrashedGalleries(limit int) ([]*TrashedGallery, error) {
+	rows, err := db.conn.Query(`
+		SELECT g.id, g.slug, COALESCE(g.title, ''), COALESCE(u.display_name, ''),
+		       COUNT(i.id), COALESCE(SUM(i.file_size), 0),
+		       g.deleted_at, COALESCE(g.deleted_by, '')
+		FROM galleries g
+		LEFT JOIN users u ON u.id = g.user_id
+		LEFT JOIN images i ON i.gallery_id = g.id AND i.deleted_at = g.deleted_at
+		WHERE g.deleted_at IS NOT NULL
+		GROUP BY g.id
+		ORDER BY g.deleted_at DESC, g.id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var galleries []*TrashedGallery
+	for rows.Next() {
+		g := &TrashedGallery{}
+		if err := rows.Scan(&g.ID, &g.Slug, &g.Title, &g.OwnerName, &g.ImageCount, &g.TotalSize, &g.DeletedAt, &g.DeletedBy); err != nil {
+			return nil, err
+		}
+		galleries = append(galleries, g)
+	}
+	return galleries, rows.Err()
+}
+
+// GetExpiredTrash returns the slugs of images and the ids of galleries
+// trashed before the unix time before, at most limit of each.
+func (db *DB) GetExpiredTrash(before int64, limit int) (slugs []string, galleryIDs []int64, err error) {
+	rows, err := db.conn.Query(`SELECT slug FROM images WHERE deleted_at < ? ORDER BY deleted_at LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.conn.Query(`SELECT id FROM galleries WHERE deleted_at < ? ORDER BY deleted_at LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	return slugs, galleryIDs, rows.Err()
+}
+
+// trashKey is where Trash moves the files of slug stored at their own key.
+func (fs *Filesystem) trashKey(slug string) string {
+	return "trash/" + fs.dirKey(slug)
+}
+
+// Trash moves the files of slug stored at their own key to the trash area.
+// Files stored as blobs keep their references, so the blobs outlive
+// CollectBlobs until the image is purged.
+func (fs *Filesystem) Trash(slug string) error {
+	return fs.moveFiles(fs.dirKey(slug), fs.trashKey(slug))
+}
+
+// Untrash moves back what Trash moved.
+func (fs *Filesystem) Untrash(slug string) error {
+	return fs.moveFiles(fs.trashKey(slug), fs.dirKey(slug))
+}
+
+func (fs *Filesystem) moveFiles(from, to string) error {
+	blobs, err := fs.store.List(from)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		data, err := fs.store.Get(b.Key)
+		if err != nil {
+			return err
+		}
+		if err := fs.store.Put(to+strings.TrimPrefix(b.Key, from), data); err != nil {
+			return err
+		}
+		if err := fs.store.Delete(b.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeImage deletes an image for good, trashed or not: its files, those
+// in the trash area and its row.
+func (fs *Filesystem) PurgeImage(slug string) error {
+	if err := fs.Delete(slug); err != nil {
+		return fmt.Errorf("delete files of %s: %w", slug, err)
+	}
+	return fs.db.DeleteImageBySlug(slug)
+}
+
+// PurgeGallery deletes a gallery for good with every image in it.
+func (fs *Filesystem) PurgeGallery(id int64) error {
+	images, err := fs.db.GetImagesByGallery(id)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if err := fs.PurgeImage(img.Slug); err != nil {
+			return err
+		}
+	}
+	return fs.db.DeleteGalleryByID(id)
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_TrashImage(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	db.InsertImage(&Image{Slug: "abc12", OriginalName: "cat.jpg", MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+
+	if err := db.TrashImage("abc12", DeletedByOwner); err != nil {
+		t.Fatalf("TrashImage() error = %v", err)
+	}
+	if img, err := db.GetImageBySlug("abc12"); err != nil || img != nil {
+		t.Errorf("GetImageBySlug(trashed) = %v, %v, want nil", img, err)
+	}
+	if trashed, err := db.ImageTrashed("abc12"); err != nil || !trashed {
+		t.Errorf("ImageTrashed() = %v, %v", trashed, err)
+	}
+	if exists, _ := db.SlugExists("images", "abc12"); !exists {
+		t.Error("slug of a trashed image is free again")
+	}
+	if n, _ := db.CountImagesAdminFiltered("", ""); n != 0 {
+		t.Errorf("admin count = %d, want trashed image left out", n)
+	}
+
+	trash, err := db.ListTrashedImages(10)
+	if err != nil || len(trash) != 1 {
+		t.Fatalf("ListTrashedImages() = %v, %v", trash, err)
+	}
+	if trash[0].Slug != "abc12" || trash[0].DeletedBy != DeletedByOwner || trash[0].DeletedAt < now {
+		t.Errorf("trashed image = %+v", trash[0])
+	}
+
+	// trashing again keeps who deleted it first
+	db.TrashImage("abc12", "admin:root")
+	if trash, _ := db.ListTrashedImages(10); trash[0].DeletedBy != DeletedByOwner {
+		t.Errorf("DeletedBy = %q after a second delete", trash[0].DeletedBy)
+	}
+
+	if err := db.RestoreImage("abc12"); err != nil {
+		t.Fatalf("RestoreImage() error = %v", err)
+	}
+	if img, _ := db.GetImageBySlug("abc12"); img == nil {
+		t.Error("restored image not found")
+	}
+	if err := db.RestoreImage("abc12"); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("RestoreImage(not trashed) error = %v, want ErrNotInTrash", err)
+	}
+}
+
+func TestDB_TrashGallery(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&Gallery{Slug: "gal1", EditToken: "tok", Title: "Trip", CreatedAt: now, UpdatedAt: now})
+	db.InsertImage(&Image{Slug: "img01", MimeType: "image/jpeg", FileSize: 10, GalleryID: &galleryID, CreatedAt: now, AccessedAt: now})
+	db.InsertImage(&Image{Slug: "img02", MimeType: "image/jpeg", FileSize: 20, GalleryID: &galleryID, CreatedAt: now, AccessedAt: now})
+	// removed from the gallery before the gallery was deleted
+	db.TrashImage("img02", DeletedByOwner)
+	db.conn.Exec(`UPDATE images SET deleted_at = ? WHERE slug = 'img02'`, now-60)
+
+	if err := db.TrashGallery(galleryID, "admin:root"); err != nil {
+		t.Fatalf("TrashGallery() error = %v", err)
+	}
+	if g, _ := db.GetGalleryBySlug("gal1"); g != nil {
+		t.Error("trashed gallery still found")
+	}
+	if trashed, _ := db.GalleryTrashed("gal1"); !trashed {
+		t.Error("GalleryTrashed() = false")
+	}
+	if g, _ := db.GetTrashedGallery(galleryID); g == nil || g.Slug != "gal1" {
+		t.Errorf("GetTrashedGallery() = %v", g)
+	}
+	if trashed, _ := db.ImageTrashed("img01"); !trashed {
+		t.Error("image of the gallery not trashed with it")
+	}
+
+	galleries, err := db.ListTrashedGalleries(10)
+	if err != nil || len(galleries) != 1 {
+		t.Fatalf("ListTrashedGalleries() = %v, %v", galleries, err)
+	}
+	if g := galleries[0]; g.ImageCount != 1 || g.TotalSize != 10 || g.DeletedBy != "admin:root" {
+		t.Errorf("trashed gallery = %+v", g)
+	}
+	if images, _ := db.ListTrashedImages(10); len(images) != 0 {
+		t.Errorf("images of a trashed gallery listed on their own: %d", len(images))
+	}
+	if err := db.RestoreImage("img02"); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("RestoreImage(in trashed gallery) error = %v, want ErrNotInTrash", err)
+	}
+
+	slugs, err := db.RestoreGallery(galleryID)
+	if err != nil || strings.Join(slugs, ",") != "img01" {
+		t.Fatalf("RestoreGallery() = %v, %v", slugs, err)
+	}
+	if g, _ := db.GetGalleryBySlug("gal1"); g == nil {
+		t.Error("restored gallery not found")
+	}
+	if images, _ := db.GetGalleryImages(galleryID); len(images) != 1 || images[0].Slug != "img01" {
+		t.Errorf("gallery images after restore = %v", images)
+	}
+	if images, _ := db.ListTrashedImages(10); len(images) != 1 || images[0].Slug != "img02" {
+		t.Errorf("trash after restoring the gallery = %v", images)
+	}
+	if _, err := db.RestoreGallery(galleryID); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("RestoreGallery(not trashed) error = %v, want ErrNotInTrash", err)
+	}
+}
+
+func TestDB_GetExpiredTrash(t *testing.T) {
+	db := testDB(t)
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&Gallery{Slug: "gal1", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+	for _, slug := range []string{"old01", "new01", "live1"} {
+		db.InsertImage(&Image{Slug: slug, MimeType: "image/jpeg", CreatedAt: now, AccessedAt: now})
+	}
+	db.TrashImage("old01", DeletedByOwner)
+	db.TrashImage("new01", DeletedByOwner)
+	db.TrashGallery(galleryID, DeletedByOwner)
+	db.conn.Exec(`UPDATE images SET deleted_at = ? WHERE slug = 'old01'`, now-7200)
+	db.conn.Exec(`UPDATE galleries SET deleted_at = ?`, now-7200)
+
+	slugs, ids, err := db.GetExpiredTrash(now-3600, 10)
+	if err != nil {
+		t.Fatalf("GetExpiredTrash() error = %v", err)
+	}
+	if strings.Join(slugs, ",") != "old01" || len(ids) != 1 || ids[0] != galleryID {
+		t.Errorf("GetExpiredTrash() = %v, %v", slugs, ids)
+	}
+}
+
+func TestFilesystem_Trash(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	fs.Save("abc12", "original", []byte("data"))
+	legacy := fs.Key("abc12", "thumb")
+	fs.store.Put(legacy, []byte("legacy"))
+
+	if err := fs.Trash("abc12"); err != nil {
+		t.Fatalf("Trash() error = %v", err)
+	}
+	if _, err := fs.store.Stat(legacy); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("legacy file left in place: %v", err)
+	}
+	if data, err := fs.store.Get("trash/" + legacy); err != nil || string(data) != "legacy" {
+		t.Errorf("trashed legacy file = %q, %v", data, err)
+	}
+	// the blob stays referenced
+	if n, _ := fs.CollectBlobs(10); n != 0 {
+		t.Errorf("CollectBlobs() removed %d blobs of a trashed image", n)
+	}
+
+	if err := fs.Untrash("abc12"); err != nil {
+		t.Fatalf("Untrash() error = %v", err)
+	}
+	if data, err := fs.Read(legacy); err != nil || string(data) != "legacy" {
+		t.Errorf("restored legacy file = %q, %v", data, err)
+	}
+	if data, err := fs.Read(fs.Key("abc12", "original")); err != nil || string(data) != "data" {
+		t.Errorf("blob file after restore = %q, %v", data, err)
+	}
+
+	fs.Trash("abc12")
+	if err := fs.Delete("abc12"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if blobs, _ := fs.store.List("trash/"); len(blobs) != 0 {
+		t.Errorf("Delete() left %d files in the trash", len(blobs))
+	}
+	if fs.Exists("abc12") {
+		t.Error("files left after Delete()")
+	}
+}
+
+func TestFilesystem_PurgeGallery(t *testing.T) {
+	fs, _ := localTestFilesystem(t)
+	now := time.Now().Unix()
+	galleryID, _ := fs.db.InsertGallery(&Gallery{Slug: "gal1", EditToken: "tok", CreatedAt: now, UpdatedAt: now})
+	fs.db.InsertImage(&Image{Slug: "img01", MimeType: "image/jpeg", GalleryID: &galleryID, CreatedAt: now, AccessedAt: now})
+	fs.Save("img01", "original", []byte("data"))
+	fs.db.TrashGallery(galleryID, DeletedByOwner)
+	fs.Trash("img01")
+
+	if err := fs.PurgeGallery(galleryID); err != nil {
+		t.Fatalf("PurgeGallery() error = %v", err)
+	}
+	if exists, _ := fs.db.SlugExists("galleries", "gal1"); exists {
+		t.Error("gallery row left")
+	}
+	if exists, _ := fs.db.SlugExists("images", "img01"); exists {
+		t.Error("image row left")
+	}
+	if fs.Exists("img01") {
+		t.Error("image files left")
+	}
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"time"
+)
+
+// Watermark holds the overlay settings of a user or a gallery. A gallery
+// watermark takes precedence over the uploader's one.
+type Watermark struct {
+	ID        int64
+	UserID    *int64
+	GalleryID *int64
+	Text      string
+	Image     []byte // PNG, used when Text is empty
+	Position  string
+	Opacity   float64
+	Scale     float64
+	Key       string // changes with any setting, compared with images.watermark_key
+	UpdatedAt int64
+}
+
+// watermarkKey hashes everything that affects the rendered overlay.
+func watermarkKey(wm *Watermark) string {
+	h := sha256.New()
+	var buf [8]byte
+	for _, v := range []float64{wm.Opacity, wm.Scale} {
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+		h.Write(buf[:])
+	}
+	h.Write([]byte(wm.Position + "\x00" + wm.Text + "\x00"))
+	h.Write(wm.Image)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+const watermarkColumns = `id, user_id, gallery_id, text, image, position, opacity, scale, key, updated_at`
+
+func scanWatermark(row rowScanner) (*Watermark, error) {
+	wm := &Watermark{}
+	err := row.Scan(&wm.ID, &wm.UserID, &wm.GalleryID, &wm.Text, &wm.Image, &wm.Position, &wm.Opacity, &wm.Scale, &wm.Key, &wm.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return wm, err
+}
+
+func (db *DB) setWatermark(column string, ownerID int64, wm *Watermark) error {
+	wm.Key = watermarkKey(wm)
+	wm.UpdatedAt = time.Now().Unix()
+	_, err := db.conn.Exec(`
+		INSERT INTO watermarks (`+column+`, text, image, position, opacity, scale, key, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(`+column+`) DO UPDATE SET
+			text = excluded.text, image = excluded.image, position = excluded.position,
+			opacity = excluded.opacity, scale = excluded.scale, key = excluded.key, updated_at = excluded.updated_at`,
+		ownerID, wm.Text, wm.Image, wm.Position, wm.Opacity, wm.Scale, wm.Key, wm.UpdatedAt)
+	return err
+}
+
+// SetUserWatermark creates or replaces the watermark of a user.
+func (db *DB) SetUserWatermark(userID int64, wm *Watermark) error {
+	return db.setWatermark("user_id", userID, wm)
+}
+
+// SetGalleryWatermark creates or replaces the watermark of a gallery.
+func (db *DB) SetGalleryWatermark(galleryID int64, wm *Watermark) error {
+	return db.setWatermark("gallery_id", galleryID, wm)
+}
+
+// GetUserWatermark returns nil when the user has none.
+func (db *DB) GetUserWatermark(userID int64) (*Watermark, error) {
+	return scanWatermark(db.conn.QueryRow(`SELECT `+watermarkColumns+` FROM watermarks WHERE user_id = ?`, userID))
+}
+
+// GetGalleryWatermark returns nil when the gallery has none.
+func (db *DB) GetGalleryWatermark(galleryID int64) (*Watermark, error) {
+	return scanWatermark(db.conn.QueryRow(`SELECT `+watermarkColumns+` FROM watermarks WHERE gallery_id = ?`, galleryID))
+}
+
+func (db *DB) DeleteUserWatermark(userID int64) error {
+	_, err := db.conn.Exec(`DELETE FROM watermarks WHERE user_id = ?`, userID)
+	return err
+}
+
+func (db *DB) DeleteGalleryWatermark(galleryID int64) error {
+	_, err := db.conn.Exec(`DELETE FROM watermarks WHERE gallery_id = ?`, galleryID)
+	return err
+}
+
+// GetEffectiveWatermark returns the watermark for an image in the given
+// gallery uploaded by the given user: the gallery's one, else the user's,
+// else nil. Images added through a gallery form carry no user_id; the
+// gallery owner's watermark applies to them.
+func (db *DB) GetEffectiveWatermark(galleryID, userID *int64) (*Watermark, error) {
+	if galleryID != nil {
+		wm, err := db.GetGalleryWatermark(*galleryID)
+		if wm != nil || err != nil {
+			return wm, err
+		}
+		if userID == nil {
+			err := db.conn.QueryRow(`SELECT user_id FROM galleries WHERE id = ?`, *galleryID).Scan(&userID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+	}
+	if userID != nil {
+		return db.GetUserWatermark(*userID)
+	}
+	return nil, nil
+}
+
+// GetImagesWithStaleWatermark returns images whose variants carry a
+// different watermark than GetEffectiveWatermark currently resolves for them.
+func (db *DB) GetImagesWithStaleWatermark(limit int) ([]*Image, error) {
+	rows, err := db.conn.Query(`SELECT `+imageColumns+` FROM images WHERE id IN (
+		SELECT i.id FROM images i
+		LEFT JOIN galleries g ON g.id = i.gallery_id
+		LEFT JOIN watermarks gw ON gw.gallery_id = i.gallery_id
+		LEFT JOIN watermarks uw ON uw.user_id = COALESCE(i.user_id, g.user_id)
+		WHERE i.status = 'ready' AND i.deleted_at IS NULL AND i.watermark_key != COALESCE(gw.key, uw.key, '')
+		ORDER BY i.id LIMIT ?
+	) ORDER BY id`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// SetImageWatermarkKey records the watermark burned into the variants and
+// bumps updated_at, the pixels changed.
+func (db *DB) SetImageWatermarkKey(slug, key string) error {
+	_, err := db.conn.Exec("UPDATE images SET watermark_key = ?, updated_at = ? WHERE slug = ?", key, time.Now().Unix(), slug)
+	return err
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDB_Watermark_SetGetDelete(t *testing.T) {
+	db := testDB(t)
+	user, _ := db.GetOrCreateBratUser("artist")
+
+	if wm, err := db.GetUserWatermark(user.ID); err != nil || wm != nil {
+		t.Fatalf("GetUserWatermark() = %v, %v; want nil", wm, err)
+	}
+
+	wm := &Watermark{Text: "dajtu.com/u/abcd", Position: "bottom-right", Opacity: 0.5, Scale: 0.2}
+	if err := db.SetUserWatermark(user.ID, wm); err != nil {
+		t.Fatalf("SetUserWatermark() error = %v", err)
+	}
+	firstKey := wm.Key
+
+	got, err := db.GetUserWatermark(user.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetUserWatermark() = %v, %v", got, err)
+	}
+	if got.Text != wm.Text || got.Position != "bottom-right" || got.Opacity != 0.5 || got.Key != firstKey {
+		t.Errorf("GetUserWatermark() = %+v", got)
+	}
+
+	// upsert replaces and changes the key
+	wm.Opacity = 0.8
+	if err := db.SetUserWatermark(user.ID, wm); err != nil {
+		t.Fatalf("SetUserWatermark() update error = %v", err)
+	}
+	got, _ = db.GetUserWatermark(user.ID)
+	if got.Opacity != 0.8 || got.Key == firstKey {
+		t.Errorf("after update opacity=%v key=%s (old %s)", got.Opacity, got.Key, firstKey)
+	}
+
+	if err := db.DeleteUserWatermark(user.ID); err != nil {
+		t.Fatalf("DeleteUserWatermark() error = %v", err)
+	}
+	if got, _ := db.GetUserWatermark(user.ID); got != nil {
+		t.Error("watermark still present after delete")
+	}
+}
+
+func TestDB_GetEffectiveWatermark(t *testing.T) {
+	db := testDB(t)
+	user, _ := db.GetOrCreateBratUser("artist")
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&Gallery{Slug: "gal1", EditToken: "t", CreatedAt: now, UpdatedAt: now})
+	plainID, _ := db.InsertGallery(&Gallery{Slug: "gal2", EditToken: "t", CreatedAt: now, UpdatedAt: now})
+	ownedID, _ := db.InsertGallery(&Gallery{Slug: "gal3", EditToken: "t", UserID: &user.ID, CreatedAt: now, UpdatedAt: now})
+
+	db.SetUserWatermark(user.ID, &Watermark{Text: "user", Position: "center", Opacity: 1, Scale: 0.1})
+	db.SetGalleryWatermark(galleryID, &Watermark{Text: "gallery", Position: "center", Opacity: 1, Scale: 0.1})
+
+	tests := []struct {
+		name      string
+		galleryID *int64
+		userID    *int64
+		want      string
+	}{
+		{"gallery wins", &galleryID, &user.ID, "gallery"},
+		{"gallery without mark falls back to user", &plainID, &user.ID, "user"},
+		{"user only", nil, &user.ID, "user"},
+		{"gallery owner when image has no user", &ownedID, nil, "user"},
+		{"anonymous gallery", &plainID, nil, ""},
+		{"anonymous", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		wm, err := db.GetEffectiveWatermark(tt.galleryID, tt.userID)
+		if err != nil {
+			t.Fatalf("%s: error = %v", tt.name, err)
+		}
+		var got string
+		if wm != nil {
+			got = wm.Text
+		}
+		if got != tt.want {
+			t.Errorf("%s: watermark = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDB_GetImagesWithStaleWatermark(t *testing.T) {
+	db := testDB(t)
+	user, _ := db.GetOrCreateBratUser("artist")
+	now := time.Now().Unix()
+	galleryID, _ := db.InsertGallery(&Gallery{Slug: "gal1", EditToken: "t", CreatedAt: now, UpdatedAt: now})
+
+	userMark := &Watermark{Text: "user", Position: "center", Opacity: 1, Scale: 0.1}
+	db.SetUserWatermark(user.ID, userMark)
+
+	insert := func(slug string, gallery *int64, owner *int64, key string) {
+		db.InsertImage(&Image{Slug: slug, MimeType: "image/webp", UserID: owner, GalleryID: gallery,
+			WatermarkKey: key, CreatedAt: now, AccessedAt: now})
+	}
+	insert("fresh", nil, &user.ID, userMark.Key)
+	insert("stale", nil, &user.ID, "")
+	insert("anon", nil, nil, "")
+	insert("leftover", nil, nil, "oldkey") // watermark removed since
+	insert("ingal", &galleryID, &user.ID, userMark.Key)
+	ownedID, _ := db.InsertGallery(&Gallery{Slug: "gal2", EditToken: "t", UserID: &user.ID, CreatedAt: now, UpdatedAt: now})
+	insert("viaform", &ownedID, nil, "") // gallery form uploads have no user_id
+
+	stale, err := db.GetImagesWithStaleWatermark(10)
+	if err != nil {
+		t.Fatalf("GetImagesWithStaleWatermark() error = %v", err)
+	}
+	got := map[string]bool{}
+	for _, img := range stale {
+		got[img.Slug] = true
+	}
+	if len(got) != 3 || !got["stale"] || !got["leftover"] || !got["viaform"] {
+		t.Errorf("stale = %v, want stale, leftover and viaform", got)
+	}
+
+	// a gallery mark overrides the user's for images in it
+	db.SetGalleryWatermark(galleryID, &Watermark{Text: "gallery", Position: "center", Opacity: 1, Scale: 0.1})
+	stale, _ = db.GetImagesWithStaleWatermark(10)
+	if len(stale) != 4 {
+		t.Errorf("stale after gallery mark = %d images, want 4", len(stale))
+	}
+
+	before, _ := db.GetImageBySlug("stale")
+	db.conn.Exec("UPDATE images SET updated_at = 1 WHERE slug = 'stale'")
+	if err := db.SetImageWatermarkKey("stale", userMark.Key); err != nil {
+		t.Fatalf("SetImageWatermarkKey() error = %v", err)
+	}
+	after, _ := db.GetImageBySlug("stale")
+	if after.WatermarkKey != userMark.Key || after.UpdatedAt <= 1 || before.WatermarkKey != "" {
+		t.Errorf("after SetImageWatermarkKey: key=%q updated_at=%d", after.WatermarkKey, after.UpdatedAt)
+	}
+}
@@ -32,11 +32,12 @@ func TestDB(t *testing.T) (*storage.DB, string) {
 	return db, dir
 }
 
-// TestFilesystem creates a test filesystem in temp directory
-func TestFilesystem(t *testing.T) (*storage.Filesystem, string) {
+// TestFilesystem creates a test filesystem in temp directory, keeping its
+// blob references in db
+func TestFilesystem(t *testing.T, db *storage.DB) (*storage.Filesystem, string) {
 	t.Helper()
 	dir := TempDir(t)
-	fs, err := storage.NewFilesystem(dir)
+	fs, err := storage.NewFilesystem(dir, db)
 	if err != nil {
 		t.Fatalf("create test filesystem: %v", err)
 	}
@@ -117,6 +118,24 @@ func SampleGIF() []byte {
 	}
 }
 
+// AnimatedGIF returns a GIF with a width x height canvas and n 1x1 frames
+func AnimatedGIF(width, height, n int) []byte {
+	data := []byte("GIF89a")
+	data = append(data, byte(width), byte(width>>8), byte(height), byte(height>>8))
+	data = append(data, 0x80, 0, 0) // global colour table of 2
+	data = append(data, 0, 0, 0, 255, 255, 255)
+	// NETSCAPE2.0 loop extension
+	data = append(data, 0x21, 0xFF, 11)
+	data = append(data, []byte("NETSCAPE2.0")...)
+	data = append(data, 3, 1, 0, 0, 0)
+	for i := 0; i < n; i++ {
+		data = append(data, 0x21, 0xF9, 4, 0, 10, 0, 0, 0) // graphic control
+		data = append(data, 0x2C, 0, 0, 0, 0, 1, 0, 1, 0, 0)
+		data = append(data, 2, 2, 0x44, 0x01, 0)
+	}
+	return append(data, 0x3B)
+}
+
 // SampleWebP returns minimal valid WebP bytes (1x1 pixel WebP)
 func SampleWebP() []byte {
 	return []byte{
@@ -43,7 +43,7 @@ func buildImageMux(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 		t.Fatalf("NewDB() error = %v", err)
 	}
 	t.Cleanup(func() { _ = db.Close() })
-	fs, err := storage.NewFilesystem(dir)
+	fs, err := storage.NewFilesystem(dir, db)
 	if err != nil {
 		t.Fatalf("NewFilesystem() error = %v", err)
 	}
@@ -62,7 +62,7 @@ func buildImageMux(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 			http.NotFound(w, r)
 			return
 		}
-		if len(parts) > 2 {
+		if len(parts) > 2 && parts[1] != "revisions" {
 			http.NotFound(w, r)
 			return
 		}
@@ -73,6 +73,11 @@ func buildImageMux(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 			return
 		}
 
+		if len(parts) >= 2 && parts[1] == "revisions" {
+			imageEditHandler.Revisions(w, r, slug, parts[2:])
+			return
+		}
+
 		if r.Method == http.MethodDelete && len(parts) == 1 {
 			uploadHandler.DeleteImage(w, r, slug)
 			return
@@ -83,6 +88,16 @@ func buildImageMux(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 			return
 		}
 
+		if len(parts) == 2 && parts[1] == "focal" {
+			imageEditHandler.FocalPoint(w, r, slug)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "status" {
+			uploadHandler.Status(w, r, slug)
+			return
+		}
+
 		if len(parts) == 2 && parts[1] == "restore" {
 			if r.Method != http.MethodPost {
 				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -121,11 +136,12 @@ func buildImageMux(t *testing.T) (*config.Config, *storage.DB, *storage.Filesyst
 			}
 		}
 
-		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-		w.Header().Set("Content-Type", "image/webp")
-
-		filePath := cfg.DataDir + "/images/" + prefix + "/" + slug + "/" + size
-		http.ServeFile(w, r, filePath)
+		img, err := db.GetImageBySlug(slug)
+		if err != nil || img == nil {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeImageBlob(w, r, fs, img, prefix+"/"+slug+"/"+size, "image/webp")
 	})
 
 	return cfg, db, fs, middleware.NewSessionMiddleware(db).Middleware(mux)